@@ -1,6 +1,7 @@
 package blobs
 
 import (
+	"bufio"
 	"context"
 	"io"
 
@@ -13,6 +14,7 @@ import (
 type concat struct {
 	unprocessed []*entry
 	processing  *entry
+	reader      *bufio.Reader
 	processed   []*entry
 
 	stagedRange *manifest.Range
@@ -35,10 +37,12 @@ func (c *concat) advance() {
 		c.capRange()
 		c.processed = append(c.processed, c.processing)
 		c.processing = nil
+		c.reader = nil
 	}
 	if len(c.unprocessed) > 0 {
 		c.processing = c.unprocessed[0]
 		c.processing.stream = &manifest.Stream{}
+		c.reader = bufio.NewReader(c.processing.source)
 		c.unprocessed = c.unprocessed[1:]
 		c.resetRange()
 	}
@@ -49,8 +53,15 @@ func (c *concat) Read(p []byte) (n int, err error) {
 		return 0, io.EOF
 	}
 	for {
-		n, err = c.processing.source.Read(p)
+		n, err = c.reader.Read(p)
 		c.offset += int64(n)
+		if err == nil && n > 0 {
+			// an entry is done as soon as its last byte is read, so that it is
+			// processed in (and indexed by) the blob its data ends in.
+			if _, peekErr := c.reader.Peek(1); peekErr == io.EOF {
+				err = io.EOF
+			}
+		}
 		if err != nil {
 			if err != io.EOF {
 				return n, errs.Wrap(err)
@@ -94,13 +105,37 @@ func (c *concat) cut() {
 }
 
 func (c *concat) Cut(ctx context.Context) error {
+	return callbacks(ctx, c.cutEntries())
+}
+
+// index returns the combined index of the entries that ended in the
+// current blob so far.
+func (c *concat) index() *manifest.BlobIndex {
+	var index manifest.BlobIndex
+	for _, entry := range c.processed {
+		entry.index(&index)
+	}
+	return &index
+}
+
+// cutEntries ends the current blob and returns the entries that ended in it,
+// without calling their callbacks.
+func (c *concat) cutEntries() []*entry {
 	c.cut()
-	for i, entry := range c.processed {
-		err := entry.cb(ctx, entry.stream, i == len(c.processed)-1)
+	processed := c.processed
+	c.processed = nil
+	return processed
+}
+
+func callbacks(ctx context.Context, entries []*entry) error {
+	for i, entry := range entries {
+		// the indexer is always called before the callback, even if the entry
+		// didn't end up in any blob's index.
+		entry.index(&manifest.BlobIndex{})
+		err := entry.cb(ctx, entry.stream, i == len(entries)-1)
 		if err != nil {
 			return err
 		}
 	}
-	c.processed = nil
 	return nil
 }
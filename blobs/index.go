@@ -0,0 +1,169 @@
+package blobs
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/zeebo/errs"
+
+	"github.com/jtolio/jam/backends"
+	"github.com/jtolio/jam/manifest"
+)
+
+// Every blob ends with a trailer: the blob's index (a marshaled
+// manifest.BlobIndex), the length of the index as a big-endian uint64, and
+// indexMagic. Ranges never refer to the trailer.
+const (
+	indexMagic  = "jamblbix"
+	footerSize  = 8 + len(indexMagic)
+	maxIndexLen = 1 << 30
+
+	// tailSize is how much of the end of a blob ReadIndex keeps while looking
+	// for the end, which is enough for the trailer of all but the largest
+	// indexes.
+	tailSize = 1 << 20
+)
+
+// ErrNoIndex is returned by ReadIndex for blobs written before blobs had an
+// index.
+var ErrNoIndex = errs.Class("blob has no index")
+
+// Indexer is given to Put, and is called with the stream of the data once its
+// location is known, before the blob the data ends in is stored. It may
+// annotate the stream, which is the same stream later given to the callback.
+// It adds whatever should be recorded about the data to index.
+type Indexer func(stream *manifest.Stream, index *manifest.BlobIndex)
+
+func (e *entry) index(index *manifest.BlobIndex) {
+	if e.indexer == nil || e.indexed {
+		return
+	}
+	e.indexed = true
+	e.indexer(e.stream, index)
+}
+
+// trailerReader reads the trailer of the blob currently being read from c.
+// The trailer is only generated once the blob's data has all been read.
+type trailerReader struct {
+	c       *concat
+	trailer *bytes.Reader
+}
+
+func (t *trailerReader) Read(p []byte) (n int, err error) {
+	if t.trailer == nil {
+		data, err := AppendIndex(nil, t.c.index())
+		if err != nil {
+			return 0, err
+		}
+		t.trailer = bytes.NewReader(data)
+	}
+	return t.trailer.Read(p)
+}
+
+// AppendIndex appends a trailer with index to data, for blobs that are
+// written without a Store.
+func AppendIndex(data []byte, index *manifest.BlobIndex) ([]byte, error) {
+	raw, err := proto.Marshal(index)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	var footer [8]byte
+	binary.BigEndian.PutUint64(footer[:], uint64(len(raw)))
+	return append(append(append(data, raw...), footer[:]...), indexMagic...), nil
+}
+
+// ReadIndex reads the index at the end of a blob. Since backends can't say
+// how long an object is, and encryption may pad it with zeros, the whole blob
+// is read to find the last non-zero byte, which ends the trailer. The trailer
+// is parsed from the end of what was read, and only read again if the index
+// is too large to have been kept.
+func ReadIndex(ctx context.Context, backend backends.Backend, blobPath string) (
+	*manifest.BlobIndex, error) {
+	r, err := backend.Get(ctx, blobPath, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	size, tail, err := dataEnd(r, tailSize)
+	err = errs.Combine(err, r.Close())
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	if size < int64(footerSize) {
+		return nil, ErrNoIndex.New("%s", blobPath)
+	}
+
+	footer := tail[len(tail)-footerSize:]
+	if string(footer[8:]) != indexMagic {
+		return nil, ErrNoIndex.New("%s", blobPath)
+	}
+	length := binary.BigEndian.Uint64(footer[:8])
+	if length > maxIndexLen || int64(length) > size-int64(footerSize) {
+		return nil, errs.New("invalid index length for blob %s", blobPath)
+	}
+	if length == 0 {
+		return &manifest.BlobIndex{}, nil
+	}
+
+	var data []byte
+	if int64(length) <= int64(len(tail)-footerSize) {
+		data = tail[len(tail)-footerSize-int(length) : len(tail)-footerSize]
+	} else {
+		data, err = readAt(ctx, backend, blobPath, size-int64(footerSize)-int64(length), int64(length))
+		if err != nil {
+			return nil, err
+		}
+	}
+	var index manifest.BlobIndex
+	err = proto.Unmarshal(data, &index)
+	if err != nil {
+		return nil, errs.New("invalid index for blob %s: %v", blobPath, err)
+	}
+	return &index, nil
+}
+
+// dataEnd returns the offset just past the last non-zero byte of r, along
+// with the up to keep bytes that come right before that offset.
+func dataEnd(r io.Reader, keep int) (end int64, tail []byte, err error) {
+	buf := make([]byte, 32*1024)
+	var offset int64
+	for {
+		n, err := r.Read(buf)
+		for i := n - 1; i >= 0; i-- {
+			if buf[i] != 0 {
+				// the zeros between the old end and this read are data too.
+				gap := offset - end
+				if gap >= int64(keep) {
+					tail, gap = tail[:0], int64(keep)
+				}
+				tail = append(tail, make([]byte, gap)...)
+				tail = append(tail, buf[:i+1]...)
+				if len(tail) > keep {
+					tail = append(tail[:0], tail[len(tail)-keep:]...)
+				}
+				end = offset + int64(i) + 1
+				break
+			}
+		}
+		offset += int64(n)
+		if err != nil {
+			if err == io.EOF {
+				return end, tail, nil
+			}
+			return 0, nil, err
+		}
+	}
+}
+
+func readAt(ctx context.Context, backend backends.Backend, path string, offset, length int64) (
+	[]byte, error) {
+	r, err := backend.Get(ctx, path, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, length)
+	_, err = io.ReadFull(r, data)
+	return data, errs.Combine(errs.Wrap(err), r.Close())
+}
@@ -0,0 +1,118 @@
+package blobs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"testing"
+	"testing/iotest"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jtolio/jam/backends"
+	"github.com/jtolio/jam/backends/fs"
+	"github.com/jtolio/jam/manifest"
+)
+
+func TestDataEnd(t *testing.T) {
+	zeros := func(n int) string { return string(make([]byte, n)) }
+	for _, tc := range []struct {
+		data string
+		keep int
+		end  int64
+		tail string
+	}{
+		{"", 4, 0, ""},
+		{zeros(10), 4, 0, ""},
+		{"abc", 4, 3, "abc"},
+		{"abcdef", 4, 6, "cdef"},
+		{"abcdef" + zeros(10), 4, 6, "cdef"},
+		{"ab" + zeros(2) + "c" + zeros(3), 4, 5, "b" + zeros(2) + "c"},
+		{"ab" + zeros(10) + "c", 4, 13, zeros(3) + "c"},
+		{"ab" + zeros(3) + "c", 4, 6, zeros(3) + "c"},
+		{"ab" + zeros(100000) + "cd" + zeros(5), 4, 100004, zeros(2) + "cd"},
+	} {
+		for _, oneByte := range []bool{false, true} {
+			var r io.Reader = bytes.NewReader([]byte(tc.data))
+			if oneByte {
+				r = iotest.OneByteReader(r)
+			}
+			end, tail, err := dataEnd(r, tc.keep)
+			require.NoError(t, err)
+			require.Equal(t, tc.end, end, "%q", tc.data)
+			require.Equal(t, tc.tail, string(tail), "%q", tc.data)
+		}
+	}
+}
+
+// countingGets counts the Gets of a backend.
+type countingGets struct {
+	backends.Backend
+	gets int
+}
+
+func (c *countingGets) Get(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error) {
+	c.gets++
+	return c.Backend.Get(ctx, path, offset, length)
+}
+
+func TestReadIndex(t *testing.T) {
+	td, err := os.MkdirTemp("", "blobstest")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(td))
+	}()
+
+	fsBackend, err := fs.New(ctx, &url.URL{Path: td})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, fsBackend.Close())
+	}()
+	b := &countingGets{Backend: fsBackend}
+
+	indexWith := func(hashes int) *manifest.BlobIndex {
+		var index manifest.BlobIndex
+		for i := 0; i < hashes; i++ {
+			index.Hashes = append(index.Hashes, &manifest.HashedData{
+				Hash: []byte(fmt.Sprintf("hash-%032d", i)),
+				Data: &manifest.Stream{Ranges: []*manifest.Range{{BlobBytes: []byte("blob"), Length: int64(i)}}},
+			})
+		}
+		return &index
+	}
+
+	for _, tc := range []struct {
+		name    string
+		data    []byte
+		index   *manifest.BlobIndex
+		padding int
+		gets    int
+	}{
+		{"empty index", []byte("data"), &manifest.BlobIndex{}, 0, 1},
+		{"small index", []byte("data"), indexWith(10), 0, 1},
+		{"padded", bytes.Repeat([]byte("data"), 100000), indexWith(10), 10000, 1},
+		{"no data", nil, indexWith(10), 100, 1},
+		{"large index", []byte("data"), indexWith(30000), 100, 2},
+	} {
+		blob, err := AppendIndex(tc.data, tc.index)
+		require.NoError(t, err)
+		blob = append(blob, make([]byte, tc.padding)...)
+		require.NoError(t, b.Put(ctx, tc.name, bytes.NewReader(blob)))
+
+		b.gets = 0
+		index, err := ReadIndex(ctx, b, tc.name)
+		require.NoError(t, err, tc.name)
+		require.True(t, proto.Equal(tc.index, index), tc.name)
+		require.Equal(t, tc.gets, b.gets, tc.name)
+	}
+
+	for _, blob := range [][]byte{nil, []byte("data"), []byte("data" + indexMagic), make([]byte, 100)} {
+		require.NoError(t, b.Put(ctx, "old", bytes.NewReader(blob)))
+		_, err := ReadIndex(ctx, b, "old")
+		require.True(t, ErrNoIndex.Has(err), "%q", blob)
+	}
+}
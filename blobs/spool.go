@@ -0,0 +1,59 @@
+package blobs
+
+import (
+	"io"
+	"os"
+
+	"github.com/zeebo/errs"
+)
+
+// spool is a local file that entries are copied into when they are put, so
+// that their sources don't have to stay open until the next flush.
+type spool struct {
+	dir  string
+	fh   *os.File
+	size int64
+}
+
+// add copies data to the end of the spool and closes it, returning a reader
+// of the copy.
+func (s *spool) add(data io.ReadCloser) (io.ReadCloser, error) {
+	if s.fh == nil {
+		fh, err := os.CreateTemp(s.dir, "spool-*")
+		if err != nil {
+			return nil, errs.Combine(errs.Wrap(err), data.Close())
+		}
+		s.fh = fh
+	}
+	offset := s.size
+	_, err := s.fh.Seek(offset, io.SeekStart)
+	if err != nil {
+		return nil, errs.Combine(errs.Wrap(err), data.Close())
+	}
+	n, err := io.Copy(s.fh, data)
+	err = errs.Combine(err, data.Close())
+	if err != nil {
+		// drop whatever part was copied
+		return nil, errs.Combine(errs.Wrap(err), errs.Wrap(s.fh.Truncate(offset)))
+	}
+	s.size += n
+	return io.NopCloser(io.NewSectionReader(s.fh, offset, n)), nil
+}
+
+// reset discards everything in the spool.
+func (s *spool) reset() error {
+	s.size = 0
+	if s.fh == nil {
+		return nil
+	}
+	return errs.Wrap(s.fh.Truncate(0))
+}
+
+func (s *spool) Close() error {
+	if s.fh == nil {
+		return nil
+	}
+	fh := s.fh
+	s.fh = nil
+	return errs.Combine(errs.Wrap(fh.Close()), errs.Wrap(os.Remove(fh.Name())))
+}
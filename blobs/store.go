@@ -2,8 +2,10 @@ package blobs
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"io"
+	"os"
 	"sort"
 
 	"github.com/zeebo/errs"
@@ -15,6 +17,8 @@ import (
 
 type entry struct {
 	source  io.ReadCloser
+	indexer Indexer
+	indexed bool
 	cb      func(ctx context.Context, stream *manifest.Stream, lastOfBlob bool) error
 	size    int64
 	sortKey SortKey
@@ -25,14 +29,29 @@ type Store struct {
 	backend      backends.Backend
 	blobSize     int64
 	maxUnflushed int
+	uploads      int
+	staging      string
+	spool        spool
 	unflushed    []*entry
 }
 
-func NewStore(backend backends.Backend, blobSize int64, maxUnflushed int) *Store {
+// NewStore returns a Store. uploads is how many blobs may be uploaded at
+// once. When more than one, each blob in flight is buffered in memory.
+//
+// If staging is not empty, it is a local directory that data is copied into
+// as it is put, so that the data's source is closed right away instead of at
+// the next flush. Blobs in flight are buffered there instead of in memory.
+func NewStore(backend backends.Backend, blobSize int64, maxUnflushed, uploads int, staging string) *Store {
+	if uploads < 1 {
+		uploads = 1
+	}
 	return &Store{
 		backend:      backend,
 		blobSize:     blobSize,
 		maxUnflushed: maxUnflushed,
+		uploads:      uploads,
+		staging:      staging,
+		spool:        spool{dir: staging},
 	}
 }
 
@@ -40,9 +59,20 @@ type SortKey interface {
 	Less(b SortKey) bool
 }
 
-func (s *Store) Put(ctx context.Context, data io.ReadCloser, size int64, sortKey SortKey, cb func(ctx context.Context, stream *manifest.Stream, lastOfBlob bool) error) error {
+// Put queues data to be stored in a blob. indexer, if not nil, is called with
+// the data's stream before the blob the data ends in is stored, and cb once
+// that blob and every blob before it have been stored.
+func (s *Store) Put(ctx context.Context, data io.ReadCloser, size int64, sortKey SortKey, indexer Indexer, cb func(ctx context.Context, stream *manifest.Stream, lastOfBlob bool) error) error {
+	if s.staging != "" {
+		staged, err := s.spool.add(data)
+		if err != nil {
+			return err
+		}
+		data = staged
+	}
 	s.unflushed = append(s.unflushed, &entry{
 		source:  data,
+		indexer: indexer,
 		cb:      cb,
 		size:    size,
 		sortKey: sortKey,
@@ -57,21 +87,41 @@ func (s *Store) Flush(ctx context.Context) (err error) {
 	unflushed := s.unflushed
 	s.unflushed = nil
 	defer func() {
-		err = errs.Combine(err, closeEntries(unflushed))
+		err = errs.Combine(err, closeEntries(unflushed), s.spool.reset())
 	}()
 
 	sort.Sort(entriesBySortKey(unflushed))
 
 	c := newConcat(unflushed...)
 
+	if s.uploads <= 1 {
+		return s.flushSerial(ctx, c)
+	}
+	return s.flushParallel(ctx, c)
+}
+
+// nextBlob returns a reader of the next blob's data followed by its trailer,
+// or false if there is no more data.
+func (s *Store) nextBlob(c *concat) (io.Reader, bool, error) {
+	data := bufio.NewReader(io.LimitReader(c, s.blobSize))
+	_, err := data.Peek(1)
+	if err != nil {
+		if err == io.EOF {
+			return nil, false, nil
+		}
+		return nil, false, errs.Wrap(err)
+	}
+	return io.MultiReader(data, &trailerReader{c: c}), true, nil
+}
+
+func (s *Store) flushSerial(ctx context.Context, c *concat) (err error) {
 	for !c.EOF() {
-		blob := bufio.NewReader(io.LimitReader(c, s.blobSize))
-		_, err = blob.Peek(1)
+		blob, ok, err := s.nextBlob(c)
 		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return errs.Wrap(err)
+			return err
+		}
+		if !ok {
+			break
 		}
 		err = s.backend.Put(ctx, streams.BlobPath(c.Blob()), blob)
 		if err != nil {
@@ -83,13 +133,112 @@ func (s *Store) Flush(ctx context.Context) (err error) {
 		}
 	}
 
-	return nil
+	// empty entries after the last of the data still need their callbacks.
+	return errs.Wrap(c.Cut(ctx))
+}
+
+type upload struct {
+	cuts []*entry
+	done chan error
+}
+
+// flushParallel reads the next blob while earlier ones upload. The entries
+// that end in a blob are only told about their streams once that blob and
+// every blob before it has been uploaded, so that nothing refers to a blob
+// that might not exist.
+func (s *Store) flushParallel(ctx context.Context, c *concat) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var inflight []*upload
+	finish := func() error {
+		u := inflight[0]
+		inflight = inflight[1:]
+		err := <-u.done
+		if err != nil {
+			return err
+		}
+		return callbacks(ctx, u.cuts)
+	}
+	defer func() {
+		if err != nil {
+			cancel()
+			for _, u := range inflight {
+				<-u.done
+			}
+		}
+	}()
+
+	for !c.EOF() {
+		if len(inflight) >= s.uploads {
+			err = finish()
+			if err != nil {
+				return errs.Wrap(err)
+			}
+		}
+
+		data, ok, err := s.nextBlob(c)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		blob, release, err := s.bufferBlob(data)
+		if err != nil {
+			return err
+		}
+		path := streams.BlobPath(c.Blob())
+		u := &upload{cuts: c.cutEntries(), done: make(chan error, 1)}
+		inflight = append(inflight, u)
+		go func() {
+			err := s.backend.Put(ctx, path, blob)
+			u.done <- errs.Combine(err, release())
+		}()
+	}
+
+	for len(inflight) > 0 {
+		err = finish()
+		if err != nil {
+			return errs.Wrap(err)
+		}
+	}
+	return errs.Wrap(c.Cut(ctx))
+}
+
+// bufferBlob reads all of data into memory, or into a file in the staging
+// directory if there is one. release frees the buffer.
+func (s *Store) bufferBlob(data io.Reader) (blob io.Reader, release func() error, err error) {
+	if s.staging == "" {
+		var buf bytes.Buffer
+		_, err = io.Copy(&buf, data)
+		if err != nil {
+			return nil, nil, errs.Wrap(err)
+		}
+		return &buf, func() error { return nil }, nil
+	}
+
+	fh, err := os.CreateTemp(s.staging, "blob-*")
+	if err != nil {
+		return nil, nil, errs.Wrap(err)
+	}
+	release = func() error {
+		return errs.Combine(errs.Wrap(fh.Close()), errs.Wrap(os.Remove(fh.Name())))
+	}
+	_, err = io.Copy(fh, data)
+	if err == nil {
+		_, err = fh.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return nil, nil, errs.Combine(errs.Wrap(err), release())
+	}
+	return fh, release, nil
 }
 
 func (s *Store) Close() error {
 	unflushed := s.unflushed
 	s.unflushed = nil
-	return closeEntries(unflushed)
+	return errs.Combine(closeEntries(unflushed), s.spool.Close())
 }
 
 func closeEntries(entries []*entry) error {
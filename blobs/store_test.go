@@ -0,0 +1,160 @@
+package blobs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jtolio/jam/backends/fs"
+	"github.com/jtolio/jam/manifest"
+	"github.com/jtolio/jam/streams"
+)
+
+type orderKey int
+
+func (a orderKey) Less(b SortKey) bool { return a < b.(orderKey) }
+
+func TestStoreFlush(t *testing.T) {
+	for _, staged := range []bool{false, true} {
+		for _, uploads := range []int{1, 3} {
+			for _, blobSize := range []int64{5, 8, 1000} {
+				t.Run(fmt.Sprintf("staged=%v,uploads=%d,size=%d", staged, uploads, blobSize), func(t *testing.T) {
+					testStoreFlush(t, staged, uploads, blobSize)
+				})
+			}
+		}
+	}
+}
+
+func testStoreFlush(t *testing.T, staged bool, uploads int, blobSize int64) {
+	td, err := os.MkdirTemp("", "blobstest")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(td))
+	}()
+
+	b, err := fs.New(ctx, &url.URL{Path: filepath.Join(td, "backend")})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, b.Close())
+	}()
+
+	var staging string
+	if staged {
+		staging = filepath.Join(td, "staging")
+		require.NoError(t, os.Mkdir(staging, 0700))
+	}
+
+	store := NewStore(b, blobSize, 100, uploads, staging)
+	defer func() {
+		require.NoError(t, store.Close())
+		if staged {
+			// nothing is left behind in the staging directory
+			left, err := os.ReadDir(staging)
+			require.NoError(t, err)
+			require.Empty(t, left)
+		}
+	}()
+
+	// the last entry ends exactly on a blob boundary for some blob sizes.
+	data := []string{"hello", "", "there", "a longer entry than a blo", "12345"}
+	results := make([]*manifest.Stream, len(data))
+	for i, d := range data {
+		i, d := i, d // range variable/closure fix
+		require.NoError(t, store.Put(ctx, io.NopCloser(bytes.NewReader([]byte(d))), int64(len(d)), orderKey(i),
+			func(stream *manifest.Stream, index *manifest.BlobIndex) {
+				index.Hashes = append(index.Hashes, &manifest.HashedData{Hash: []byte(d), Data: stream})
+			},
+			func(ctx context.Context, stream *manifest.Stream, lastOfBlob bool) error {
+				require.Nil(t, results[i])
+				// every blob a stream refers to must already be stored.
+				for _, r := range stream.Ranges {
+					rc, err := b.Get(ctx, streams.BlobPath(r.Blob()), r.Offset, r.Length)
+					require.NoError(t, err)
+					require.NoError(t, rc.Close())
+				}
+				results[i] = stream
+				return nil
+			}))
+	}
+	require.NoError(t, store.Flush(ctx))
+
+	for i, d := range data {
+		require.NotNil(t, results[i], "entry %d", i)
+		s, err := streams.Open(ctx, b, results[i])
+		require.NoError(t, err)
+		actual, err := io.ReadAll(s)
+		require.NoError(t, err)
+		require.Equal(t, d, string(actual))
+
+		if len(d) == 0 {
+			continue
+		}
+		// the blob with the end of the data has the data's stream in its index
+		last := results[i].Ranges[len(results[i].Ranges)-1]
+		index, err := ReadIndex(ctx, b, streams.BlobPath(last.Blob()))
+		require.NoError(t, err)
+		var found bool
+		for _, hashed := range index.Hashes {
+			if string(hashed.Hash) == d {
+				require.True(t, proto.Equal(results[i], hashed.Data))
+				found = true
+			}
+		}
+		require.True(t, found, "entry %d", i)
+	}
+}
+
+type failingReader struct{ io.Reader }
+
+func (f failingReader) Read(p []byte) (int, error) {
+	n, err := f.Reader.Read(p)
+	if err == io.EOF {
+		return n, fmt.Errorf("read failed")
+	}
+	return n, err
+}
+
+func (failingReader) Close() error { return nil }
+
+func TestStagedPutError(t *testing.T) {
+	td, err := os.MkdirTemp("", "blobstest")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(td))
+	}()
+
+	b, err := fs.New(ctx, &url.URL{Path: filepath.Join(td, "backend")})
+	require.NoError(t, err)
+	store := NewStore(b, 1000, 100, 1, td)
+	defer func() {
+		require.NoError(t, store.Close())
+	}()
+
+	var result *manifest.Stream
+	cb := func(ctx context.Context, stream *manifest.Stream, lastOfBlob bool) error {
+		result = stream
+		return nil
+	}
+	// a failed put leaves nothing behind in the spool
+	require.Error(t, store.Put(ctx, failingReader{bytes.NewReader([]byte("partial"))}, 7, orderKey(0), nil, cb))
+	require.NoError(t, store.Put(ctx, io.NopCloser(bytes.NewReader([]byte("whole"))), 5, orderKey(1), nil, cb))
+	require.NoError(t, store.Flush(ctx))
+
+	require.NotNil(t, result)
+	require.Len(t, result.Ranges, 1)
+	require.Equal(t, int64(0), result.Ranges[0].Offset)
+	s, err := streams.Open(ctx, b, result)
+	require.NoError(t, err)
+	actual, err := io.ReadAll(s)
+	require.NoError(t, err)
+	require.Equal(t, "whole", string(actual))
+}
@@ -77,7 +77,10 @@ func (c *Cache) Close() error {
 
 func (c *Cache) shouldCache(path string) bool {
 	if strings.HasPrefix(path, hashdb.HashPrefix) {
-		return true
+		// runs are only ever read a block at a time, so caching one would mean
+		// downloading all of it to read a block. their indexes are small and
+		// read whole, so those are what gets cached.
+		return !strings.HasSuffix(path, hashdb.RunSuffix)
 	}
 	if strings.HasPrefix(path, session.ManifestPrefix) {
 		return true
@@ -0,0 +1,124 @@
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/jtolio/jam/backends"
+	"github.com/jtolio/jam/backends/fs"
+	"github.com/jtolio/jam/hashdb"
+	"github.com/jtolio/jam/manifest"
+)
+
+var ctx = context.Background()
+
+// countingBackend counts the bytes read from it.
+type countingBackend struct {
+	backends.Backend
+	read int64
+}
+
+func (c *countingBackend) Get(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error) {
+	rc, err := c.Backend.Get(ctx, path, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	return &countingReader{ReadCloser: rc, read: &c.read}, nil
+}
+
+type countingReader struct {
+	io.ReadCloser
+	read *int64
+}
+
+func (r *countingReader) Read(p []byte) (n int, err error) {
+	n, err = r.ReadCloser.Read(p)
+	*r.read += int64(n)
+	return n, err
+}
+
+func tempBackend(t *testing.T) backends.Backend {
+	td, err := os.MkdirTemp("", "cachetest")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, os.RemoveAll(td))
+	})
+	b, err := fs.New(ctx, &url.URL{Path: td})
+	require.NoError(t, err)
+	return b
+}
+
+func TestCacheHashLookup(t *testing.T) {
+	persistent := &countingBackend{Backend: tempBackend(t)}
+	cacheStore := tempBackend(t)
+
+	db := hashdb.New(persistent)
+	var hashes []string
+	for i := 0; i < 20000; i++ {
+		hash := sha256.Sum256([]byte(fmt.Sprint(i)))
+		hashes = append(hashes, string(hash[:]))
+		require.NoError(t, db.Put(ctx, string(hash[:]), &manifest.Stream{Ranges: []*manifest.Range{
+			{BlobBytes: hash[:8], Offset: int64(i), Length: 1},
+		}}))
+	}
+	require.NoError(t, db.Flush(ctx))
+	require.NoError(t, db.Close())
+
+	var runSize int64
+	require.NoError(t, persistent.List(ctx, hashdb.HashPrefix, func(ctx context.Context, path string) error {
+		if !strings.HasSuffix(path, hashdb.RunSuffix) {
+			return nil
+		}
+		rc, err := persistent.Get(ctx, path, 0, -1)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		n, err := io.Copy(io.Discard, rc)
+		runSize += n
+		return err
+	}))
+	require.NotZero(t, runSize)
+
+	c, err := New(ctx, persistent, cacheStore, false)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, c.Close())
+	}()
+
+	// looking up one hash reads the run's index and one block of the run,
+	// not all of it.
+	lookup := func() int64 {
+		persistent.read = 0
+		db, err := hashdb.Open(ctx, c)
+		require.NoError(t, err)
+		defer func() {
+			require.NoError(t, db.Close())
+		}()
+		stream, err := db.Lookup(ctx, hashes[1234])
+		require.NoError(t, err)
+		require.NotNil(t, stream)
+		require.Equal(t, int64(1234), stream.Ranges[0].Offset)
+		return persistent.read
+	}
+	uncached := lookup()
+	require.Less(t, uncached, runSize/4)
+
+	// the index is cached then, but the run isn't, so only a block is read
+	// the next time.
+	require.NoError(t, cacheStore.List(ctx, hashdb.HashPrefix, func(ctx context.Context, path string) error {
+		require.False(t, strings.HasSuffix(path, hashdb.RunSuffix), path)
+		return nil
+	}))
+	cached := lookup()
+	require.NotZero(t, cached)
+	require.Less(t, cached, uncached)
+}
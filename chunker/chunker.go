@@ -0,0 +1,153 @@
+// Package chunker splits data into content-defined chunks, such that an
+// insertion or deletion only changes the chunks around it.
+//
+// The boundaries are found with FastCDC's normalized chunking: a gear hash is
+// rolled over the data, and a boundary is cut where the hash has enough zero
+// bits. Below the average size more zero bits are required than above it,
+// which pulls chunk sizes towards the average.
+package chunker
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+const (
+	DefaultMinSize = 512 * 1024
+	DefaultAvgSize = 2 * 1024 * 1024
+	DefaultMaxSize = 8 * 1024 * 1024
+)
+
+// Chunker reads from an io.Reader and returns it chunk by chunk.
+type Chunker struct {
+	r          io.Reader
+	buf        []byte
+	start, end int
+	eof        bool
+
+	minSize, avgSize int
+	maskS, maskL     uint64
+}
+
+// New returns a Chunker with the given size bounds. avgSize must be a power
+// of two, and minSize <= avgSize <= maxSize.
+func New(r io.Reader, minSize, avgSize, maxSize int) (*Chunker, error) {
+	if minSize <= 0 || avgSize < minSize || maxSize < avgSize {
+		return nil, fmt.Errorf("invalid chunk sizes: min %d, avg %d, max %d",
+			minSize, avgSize, maxSize)
+	}
+	if avgSize&(avgSize-1) != 0 {
+		return nil, fmt.Errorf("average chunk size must be a power of two: %d", avgSize)
+	}
+	avgBits := bits.TrailingZeros(uint(avgSize))
+	return &Chunker{
+		r:       r,
+		buf:     make([]byte, maxSize),
+		minSize: minSize,
+		avgSize: avgSize,
+		maskS:   topBits(avgBits + 1),
+		maskL:   topBits(avgBits - 1),
+	}, nil
+}
+
+// NewDefault returns a Chunker using the default size bounds.
+func NewDefault(r io.Reader) *Chunker {
+	c, err := New(r, DefaultMinSize, DefaultAvgSize, DefaultMaxSize)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// the gear hash shifts left, so the high bits depend on the most recent bytes.
+func topBits(n int) uint64 {
+	if n <= 0 {
+		return 0
+	}
+	if n > 64 {
+		n = 64
+	}
+	return ^uint64(0) << uint(64-n)
+}
+
+// Next returns the next chunk. The returned slice is only valid until the
+// next call to Next. io.EOF is returned once there is no more data.
+func (c *Chunker) Next() ([]byte, error) {
+	err := c.fill()
+	if err != nil {
+		return nil, err
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+	n := c.cut(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
+
+// fill makes sure there's at least a max size chunk buffered, unless the
+// reader has run out.
+func (c *Chunker) fill() error {
+	if c.eof || c.end-c.start == len(c.buf) {
+		return nil
+	}
+	c.end = copy(c.buf, c.buf[c.start:c.end])
+	c.start = 0
+	for c.end < len(c.buf) {
+		n, err := c.r.Read(c.buf[c.end:])
+		c.end += n
+		if err != nil {
+			if err == io.EOF {
+				c.eof = true
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// cut returns the length of the chunk at the start of data. data is only
+// shorter than the max chunk size at the end of the stream.
+func (c *Chunker) cut(data []byte) int {
+	if len(data) <= c.minSize {
+		return len(data)
+	}
+	normal := c.avgSize
+	if normal > len(data) {
+		normal = len(data)
+	}
+
+	var fp uint64
+	i := c.minSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < len(data); i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return len(data)
+}
+
+// gear is a table of random values, one per byte value. It must never change,
+// or previously stored data will no longer deduplicate against new data.
+var gear = func() (table [256]uint64) {
+	// splitmix64 with a fixed seed
+	state := uint64(0x6a616d6368756e6b)
+	for i := range table {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
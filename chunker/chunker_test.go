@@ -0,0 +1,85 @@
+package chunker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func randData(t *testing.T, seed int64, amount int) []byte {
+	data := make([]byte, amount)
+	_, err := rand.New(rand.NewSource(seed)).Read(data)
+	require.NoError(t, err)
+	return data
+}
+
+func chunks(t *testing.T, r io.Reader) [][]byte {
+	c, err := New(r, 1024, 4096, 16384)
+	require.NoError(t, err)
+	var rv [][]byte
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return rv
+		}
+		require.NoError(t, err)
+		rv = append(rv, append([]byte(nil), chunk...))
+	}
+}
+
+func TestChunkerBounds(t *testing.T) {
+	data := randData(t, 0, 1024*1024+7)
+	for _, wrapper := range []func(io.Reader) io.Reader{
+		func(r io.Reader) io.Reader { return r },
+		iotest.HalfReader,
+		iotest.OneByteReader,
+		iotest.DataErrReader,
+	} {
+		result := chunks(t, wrapper(bytes.NewReader(data)))
+		require.True(t, len(result) > 1024*1024/16384)
+		for i, chunk := range result {
+			require.True(t, len(chunk) <= 16384)
+			if i < len(result)-1 {
+				require.True(t, len(chunk) > 1024)
+			}
+		}
+		require.Equal(t, data, bytes.Join(result, nil))
+	}
+}
+
+func TestChunkerEmpty(t *testing.T) {
+	require.Equal(t, 0, len(chunks(t, bytes.NewReader(nil))))
+	require.Equal(t, [][]byte{{1, 2, 3}}, chunks(t, bytes.NewReader([]byte{1, 2, 3})))
+}
+
+func TestChunkerResync(t *testing.T) {
+	data := randData(t, 1, 512*1024)
+	edited := append(append(append([]byte(nil), data[:100000]...), "an insertion"...), data[100000:]...)
+
+	hashes := map[[sha256.Size]byte]bool{}
+	original := chunks(t, bytes.NewReader(data))
+	for _, chunk := range original {
+		hashes[sha256.Sum256(chunk)] = true
+	}
+	var changed int
+	for _, chunk := range chunks(t, bytes.NewReader(edited)) {
+		if !hashes[sha256.Sum256(chunk)] {
+			changed++
+		}
+	}
+	require.True(t, changed <= 3, "%d of %d chunks changed", changed, len(original))
+}
+
+func TestChunkerInvalid(t *testing.T) {
+	_, err := New(nil, 0, 4096, 16384)
+	require.Error(t, err)
+	_, err = New(nil, 1024, 4000, 16384)
+	require.Error(t, err)
+	_, err = New(nil, 1024, 4096, 2048)
+	require.Error(t, err)
+}
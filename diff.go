@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+
+	"github.com/jtolio/jam/locks"
+	"github.com/jtolio/jam/manifest"
+	"github.com/jtolio/jam/utils"
+)
+
+var (
+	diffFlags         = flag.NewFlagSet("", flag.ExitOnError)
+	diffFlagLocal     = diffFlags.String("local", "", "if set, compare -snap against this local directory instead of another snapshot")
+	diffFlagSnapshot  = diffFlags.String("snap", "latest", "which snapshot to compare the local directory against")
+	diffFlagNoRenames = diffFlags.Bool("no-renames", false, "if true, show renames as a removal and an addition")
+	// with -local, the options store would be run with.
+	diffFlagStoreOpts = bindStoreOptions(diffFlags)
+
+	cmdDiff = &ffcli.Command{
+		Name:      "diff",
+		ShortHelp: "diff lists paths added, removed, modified or renamed between snapshots",
+		ShortUsage: fmt.Sprintf("%s [opts] diff [opts] <snap-a> <snap-b> [<prefix>]\n  "+
+			"%s [opts] diff [opts] -local <source-dir> [<target-prefix>]", os.Args[0], os.Args[0]),
+		FlagSet: diffFlags,
+		Exec:    Diff,
+	}
+)
+
+func Diff(ctx context.Context, args []string) error {
+	if *diffFlagLocal != "" {
+		if len(args) > 1 {
+			return flag.ErrHelp
+		}
+	} else if len(args) != 2 && len(args) != 3 {
+		return flag.ErrHelp
+	}
+
+	mgr, _, _, mgrClose, err := getManager(ctx, locks.Shared)
+	if err != nil {
+		return err
+	}
+	defer mgrClose()
+
+	var changes diffCollector
+	if *diffFlagLocal != "" {
+		var prefix string
+		if len(args) == 1 {
+			prefix = args[0]
+		}
+		snap, ts, err := getReadSnapshot(ctx, mgr, *diffFlagSnapshot)
+		if err != nil {
+			return err
+		}
+		defer snap.Close()
+
+		// the local directory is stored into a session that stores nothing,
+		// so that the diff is exactly what store would change.
+		sess, err := mgr.NewDryRunSessionAt(ctx, ts)
+		if err != nil {
+			return err
+		}
+		defer sess.Close()
+		_, err = storeInto(ctx, mgr, sess, *diffFlagLocal, prefix, diffFlagStoreOpts)
+		if err != nil {
+			return err
+		}
+
+		err = sess.Diff(ctx, snap, changes.add)
+		if err != nil {
+			return err
+		}
+	} else {
+		var prefix string
+		if len(args) == 3 {
+			prefix = args[2]
+		}
+		snapA, _, err := getReadSnapshot(ctx, mgr, args[0])
+		if err != nil {
+			return err
+		}
+		defer snapA.Close()
+		snapB, _, err := getReadSnapshot(ctx, mgr, args[1])
+		if err != nil {
+			return err
+		}
+		defer snapB.Close()
+
+		err = snapA.Diff(ctx, snapB, prefix, changes.add)
+		if err != nil {
+			return err
+		}
+	}
+
+	changes.print(ctx, !*diffFlagNoRenames)
+	return nil
+}
+
+type diffChange struct {
+	path       string
+	oldContent *manifest.Content
+	newContent *manifest.Content
+}
+
+type diffCollector struct {
+	changes []diffChange
+}
+
+func (d *diffCollector) add(ctx context.Context, path string, oldContent, newContent *manifest.Content) error {
+	d.changes = append(d.changes, diffChange{path: path, oldContent: oldContent, newContent: newContent})
+	return nil
+}
+
+var emptyHash = sha256.Sum256(nil)
+
+func (d *diffCollector) print(ctx context.Context, detectRenames bool) {
+	type line struct {
+		path string
+		text string
+	}
+	var lines []line
+	var added, removed, modified, renamed int
+
+	// a removed file and an added file with the same content are a rename.
+	// empty files all share a hash, so they are never considered renamed.
+	renamedFrom := map[string]string{}
+	renamedTo := map[string]bool{}
+	if detectRenames {
+		removedByHash := map[string][]string{}
+		for _, change := range d.changes {
+			if change.newContent == nil && renameCandidate(change.oldContent) {
+				hash := string(change.oldContent.Hash)
+				removedByHash[hash] = append(removedByHash[hash], change.path)
+			}
+		}
+		for _, change := range d.changes {
+			if change.oldContent != nil || !renameCandidate(change.newContent) {
+				continue
+			}
+			hash := string(change.newContent.Hash)
+			if candidates := removedByHash[hash]; len(candidates) > 0 {
+				renamedFrom[change.path] = candidates[0]
+				renamedTo[candidates[0]] = true
+				removedByHash[hash] = candidates[1:]
+			}
+		}
+	}
+
+	for _, change := range d.changes {
+		switch {
+		case change.oldContent == nil:
+			if from, exists := renamedFrom[change.path]; exists {
+				renamed++
+				lines = append(lines, line{path: from, text: fmt.Sprintf("R %s -> %s", from, change.path)})
+				continue
+			}
+			added++
+			lines = append(lines, line{path: change.path, text: "A " + change.path})
+		case change.newContent == nil:
+			if renamedTo[change.path] {
+				continue
+			}
+			removed++
+			lines = append(lines, line{path: change.path, text: "D " + change.path})
+		default:
+			modified++
+			lines = append(lines, line{path: change.path, text: fmt.Sprintf("M %s (%s)",
+				change.path, describeChange(change.oldContent, change.newContent))})
+		}
+	}
+
+	sort.SliceStable(lines, func(i, j int) bool { return lines[i].path < lines[j].path })
+	for _, l := range lines {
+		fmt.Println(l.text)
+	}
+
+	utils.L(ctx).Normalf("%d added, %d removed, %d modified, %d renamed",
+		added, removed, modified, renamed)
+}
+
+func renameCandidate(content *manifest.Content) bool {
+	return content.Metadata.Type == manifest.Metadata_FILE &&
+		len(content.Hash) > 0 && !bytes.Equal(content.Hash, emptyHash[:])
+}
+
+func describeChange(oldContent, newContent *manifest.Content) string {
+	switch {
+	case oldContent.Metadata.Type != newContent.Metadata.Type:
+		return "type changed"
+	case !bytes.Equal(oldContent.Hash, newContent.Hash):
+		return "content changed"
+	case !bytes.Equal(oldContent.Metadata.LinkTarget, newContent.Metadata.LinkTarget):
+		return "link target changed"
+	default:
+		return "metadata changed"
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jtolio/jam/ignore"
+	"github.com/jtolio/jam/utils"
+)
+
+const (
+	ignoreFileName = ".jamignore"
+
+	// see https://bford.info/cachedir/
+	cacheDirTagName      = "CACHEDIR.TAG"
+	cacheDirTagSignature = "Signature: 8a477f597d28d172789f06886806bc55"
+)
+
+// storeFilter decides which paths under a store source directory are left
+// out. Directories are checked before their contents, so that an excluded
+// directory can be skipped entirely.
+type storeFilter struct {
+	source        string
+	prefixes      []string
+	excludes      ignore.Rules
+	includes      ignore.Rules
+	excludeCaches bool
+	device        uint64
+	oneFileSystem bool
+}
+
+func newStoreFilter(source string, prefixes []string, excludeFile string, includes []string,
+	excludeCaches, oneFileSystem bool) (*storeFilter, error) {
+	f := &storeFilter{
+		source:        source,
+		prefixes:      prefixes,
+		excludeCaches: excludeCaches,
+		oneFileSystem: oneFileSystem,
+	}
+	if excludeFile != "" {
+		fh, err := os.Open(excludeFile)
+		if err != nil {
+			return nil, err
+		}
+		err = f.excludes.AddFrom("", fh)
+		fh.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", excludeFile, err)
+		}
+	}
+	for _, include := range includes {
+		// includes are negated exclusions that take precedence over
+		// everything else.
+		err := f.includes.Add("", "!"+include)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if oneFileSystem {
+		info, err := os.Stat(source)
+		if err != nil {
+			return nil, err
+		}
+		device, ok := deviceID(info)
+		if !ok {
+			return nil, fmt.Errorf("staying on one filesystem is not supported on this platform")
+		}
+		f.device = device
+	}
+	return f, nil
+}
+
+// skip returns true if path should not be stored. When path is a directory
+// that isn't skipped, its ignore file is loaded for the paths inside it.
+func (f *storeFilter) skip(ctx context.Context, path string, info os.FileInfo) (bool, error) {
+	for _, prefix := range f.prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true, nil
+		}
+	}
+
+	rel, err := filepath.Rel(f.source, path)
+	if err != nil {
+		return false, err
+	}
+	rel = filepath.ToSlash(rel)
+	isDir := info.IsDir()
+
+	if rel != "." {
+		matched, excluded := f.includes.Match(rel, isDir)
+		if !matched {
+			excluded = f.excludes.Excluded(rel, isDir)
+		}
+		if excluded {
+			utils.L(ctx).Debugf("excluding %q", path)
+			return true, nil
+		}
+	}
+
+	if !isDir {
+		return false, nil
+	}
+
+	if f.oneFileSystem {
+		if device, ok := deviceID(info); ok && device != f.device {
+			utils.L(ctx).Normalf("skipping %q, on a different filesystem", path)
+			return true, nil
+		}
+	}
+
+	if f.excludeCaches && isCacheDir(path) {
+		utils.L(ctx).Normalf("skipping %q, tagged as a cache", path)
+		return true, nil
+	}
+
+	fh, err := os.Open(filepath.Join(path, ignoreFileName))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			utils.L(ctx).Urgentf("unable to read ignore file in %q: %v", path, err)
+		}
+		return false, nil
+	}
+	defer fh.Close()
+	base := rel
+	if base == "." {
+		base = ""
+	}
+	err = f.excludes.AddFrom(base, fh)
+	if err != nil {
+		return false, fmt.Errorf("%q: %w", filepath.Join(path, ignoreFileName), err)
+	}
+	return false, nil
+}
+
+func isCacheDir(path string) bool {
+	fh, err := os.Open(filepath.Join(path, cacheDirTagName))
+	if err != nil {
+		return false
+	}
+	defer fh.Close()
+	signature := make([]byte, len(cacheDirTagSignature))
+	_, err = io.ReadFull(fh, signature)
+	return err == nil && bytes.Equal(signature, []byte(cacheDirTagSignature))
+}
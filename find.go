@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/peterbourgon/ff/v3/ffcli"
+
+	"github.com/jtolio/jam/locks"
+	"github.com/jtolio/jam/manifest"
+	"github.com/jtolio/jam/session"
+)
+
+var (
+	findFlags        = flag.NewFlagSet("", flag.ExitOnError)
+	findFlagSnapshot = findFlags.String("snap", "latest", "which snapshot to search")
+	findFlagAllSnaps = findFlags.Bool("all-snaps", false, "if true, search every snapshot, newest first")
+	findFlagName     = findFlags.String("name", "", "if set, a glob the last element of paths must match")
+	findFlagSize     = findFlags.String("size", "", "if set, only files of this size, such as 10M, or\n\tmore (+1G) or less (-4K) than it")
+	findFlagNewer    = findFlags.String("newer", "", "if set, only paths modified after this date, such as\n\t2006-01-02 or \"2006-01-02 15:04\", or this long ago, such as 2w")
+	cmdFind          = &ffcli.Command{
+		Name:       "find",
+		ShortHelp:  "find lists paths in snapshots that match the given conditions",
+		ShortUsage: fmt.Sprintf("%s [opts] find [opts] [<prefix>]", os.Args[0]),
+		FlagSet:    findFlags,
+		Exec:       Find,
+	}
+)
+
+// findFilter holds the conditions paths have to match. Unset conditions
+// always match.
+type findFilter struct {
+	name  string
+	size  func(size int64) bool
+	newer *time.Time
+}
+
+func newFindFilter(name, size, newer string, now time.Time) (*findFilter, error) {
+	filter := &findFilter{name: name}
+	if name != "" {
+		_, err := path.Match(name, "")
+		if err != nil {
+			return nil, fmt.Errorf("invalid name pattern %q: %w", name, err)
+		}
+	}
+	if size != "" {
+		var err error
+		filter.size, err = parseSizeCondition(size)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if newer != "" {
+		after, err := parseDate(newer, now)
+		if err != nil {
+			return nil, err
+		}
+		filter.newer = &after
+	}
+	return filter, nil
+}
+
+// parseSizeCondition parses a size with an optional K, M, G or T suffix,
+// which is matched exactly, or by anything larger or smaller if it starts
+// with + or -.
+func parseSizeCondition(val string) (func(size int64) bool, error) {
+	sign, number := byte(0), val
+	if len(number) > 0 && (number[0] == '+' || number[0] == '-') {
+		sign, number = number[0], number[1:]
+	}
+	number = strings.TrimSuffix(strings.ToUpper(number), "B")
+	multiplier := int64(1)
+	if len(number) > 0 {
+		if i := strings.IndexByte("KMGT", number[len(number)-1]); i >= 0 {
+			multiplier = int64(1) << (10 * uint(i+1))
+			number = number[:len(number)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid size: %q", val)
+	}
+	limit := int64(n * float64(multiplier))
+	switch sign {
+	case '+':
+		return func(size int64) bool { return size > limit }, nil
+	case '-':
+		return func(size int64) bool { return size < limit }, nil
+	}
+	return func(size int64) bool { return size == limit }, nil
+}
+
+// parseDate parses a local date and optional time, or a duration before now
+// understood by parseRetentionDuration.
+func parseDate(val string, now time.Time) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02", "2006-01-02 15:04", "2006-01-02 15:04:05", time.RFC3339} {
+		date, err := time.ParseInLocation(layout, val, time.Local)
+		if err == nil {
+			return date, nil
+		}
+	}
+	ago, err := parseRetentionDuration(val)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date: %q", val)
+	}
+	return now.Add(-ago), nil
+}
+
+func (f *findFilter) matches(p string, content *manifest.Content) bool {
+	meta := content.GetMetadata()
+	if f.name != "" {
+		if ok, _ := path.Match(f.name, path.Base(strings.TrimSuffix(p, "/"))); !ok {
+			return false
+		}
+	}
+	if f.size != nil && (meta.GetType() != manifest.Metadata_FILE || !f.size(meta.GetSize())) {
+		return false
+	}
+	if f.newer != nil {
+		modified, err := ptypes.Timestamp(meta.GetModified())
+		if err != nil || !modified.After(*f.newer) {
+			return false
+		}
+	}
+	return true
+}
+
+func Find(ctx context.Context, args []string) error {
+	if len(args) > 1 {
+		return flag.ErrHelp
+	}
+	prefix := ""
+	if len(args) == 1 {
+		prefix = args[0]
+	}
+	filter, err := newFindFilter(*findFlagName, *findFlagSize, *findFlagNewer, time.Now())
+	if err != nil {
+		return err
+	}
+
+	mgr, _, _, mgrClose, err := getManager(ctx, locks.Shared)
+	if err != nil {
+		return err
+	}
+	defer mgrClose()
+
+	if !*findFlagAllSnaps {
+		snap, _, err := getReadSnapshot(ctx, mgr, *findFlagSnapshot)
+		if err != nil {
+			return err
+		}
+		defer snap.Close()
+		return findIn(ctx, snap, prefix, filter, func(path string, content *manifest.Content) {
+			fmt.Println(path)
+		})
+	}
+
+	// a path is only listed again in an older snapshot if it was different
+	// there.
+	listed := map[string]*manifest.Content{}
+	return mgr.ListSnapshots(ctx, func(ctx context.Context, timestamp time.Time) error {
+		snap, err := mgr.OpenSnapshot(ctx, timestamp)
+		if err != nil {
+			return err
+		}
+		defer snap.Close()
+		return findIn(ctx, snap, prefix, filter, func(path string, content *manifest.Content) {
+			if last, ok := listed[path]; ok && proto.Equal(last, content) {
+				return
+			}
+			listed[path] = content
+			fmt.Printf("%d %s\n", timestamp.UnixNano(), path)
+		})
+	})
+}
+
+func findIn(ctx context.Context, snap *session.Snapshot, prefix string, filter *findFilter,
+	cb func(path string, content *manifest.Content)) error {
+	return snap.Contents(ctx, prefix, func(ctx context.Context, path string, content *manifest.Content) error {
+		if filter.matches(path, content) {
+			cb(path, content)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSizeCondition(t *testing.T) {
+	const (
+		k = int64(1) << 10
+		m = int64(1) << 20
+		g = int64(1) << 30
+	)
+	for _, tc := range []struct {
+		val        string
+		matches    []int64
+		nonMatches []int64
+	}{
+		{"+1G", []int64{g + 1, 10 * g}, []int64{g, g - 1, 0}},
+		{"-4K", []int64{0, 4*k - 1}, []int64{4 * k, 4*k + 1}},
+		{"10M", []int64{10 * m}, []int64{10*m - 1, 10*m + 1}},
+		{"1.5M", []int64{m + m/2}, []int64{m, 2 * m}},
+		{"10MB", []int64{10 * m}, []int64{10 * k}},
+		{"10mb", []int64{10 * m}, []int64{10 * k}},
+		{"512", []int64{512}, []int64{511, 513}},
+		{"+0", []int64{1}, []int64{0}},
+	} {
+		match, err := parseSizeCondition(tc.val)
+		require.NoError(t, err, tc.val)
+		for _, size := range tc.matches {
+			require.True(t, match(size), "%q should match %d", tc.val, size)
+		}
+		for _, size := range tc.nonMatches {
+			require.False(t, match(size), "%q shouldn't match %d", tc.val, size)
+		}
+	}
+
+	for _, val := range []string{"", "+", "G", "10X", "1GG", "--1", "-1-", "ten"} {
+		_, err := parseSizeCondition(val)
+		require.Error(t, err, val)
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	now := time.Date(2024, 3, 15, 12, 0, 0, 0, time.Local)
+	for _, tc := range []struct {
+		val  string
+		date time.Time
+	}{
+		{"2006-01-02", time.Date(2006, 1, 2, 0, 0, 0, 0, time.Local)},
+		{"2006-01-02 15:04", time.Date(2006, 1, 2, 15, 4, 0, 0, time.Local)},
+		{"2006-01-02 15:04:05", time.Date(2006, 1, 2, 15, 4, 5, 0, time.Local)},
+		{"2006-01-02T15:04:05Z", time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)},
+		{"2w", now.Add(-14 * 24 * time.Hour)},
+		{"1d12h", now.Add(-36 * time.Hour)},
+	} {
+		date, err := parseDate(tc.val, now)
+		require.NoError(t, err, tc.val)
+		require.True(t, tc.date.Equal(date), "%q parsed as %v, not %v", tc.val, date, tc.date)
+	}
+
+	for _, val := range []string{"", "yesterday", "2006-13-01", "2006-01-02 25:00", "2x", "-2w"} {
+		_, err := parseDate(val, now)
+		require.Error(t, err, val)
+	}
+}
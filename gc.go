@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+
+	"github.com/jtolio/jam/locks"
+	"github.com/jtolio/jam/manifest"
+	"github.com/jtolio/jam/session"
+	"github.com/jtolio/jam/streams"
+	"github.com/jtolio/jam/utils"
+)
+
+var (
+	gcFlags       = flag.NewFlagSet("", flag.ExitOnError)
+	gcFlagDryRun  = gcFlags.Bool("dry-run", false, "if true, only report what would be deleted")
+	gcFlagVerbose = gcFlags.Bool("v", false, "if true, list every blob that is or would be deleted")
+
+	cmdGC = &ffcli.Command{
+		Name:       "gc",
+		ShortHelp:  "gc deletes hashes and blobs no longer referenced by any snapshot",
+		ShortUsage: fmt.Sprintf("%s [opts] gc [opts]", os.Args[0]),
+		FlagSet:    gcFlags,
+		Exec:       GC,
+	}
+)
+
+func GC(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return flag.ErrHelp
+	}
+
+	mgr, backend, hashes, mgrClose, err := getManager(ctx, locks.Exclusive)
+	if err != nil {
+		return err
+	}
+	defer mgrClose()
+
+	live, pages, err := liveHashes(ctx, mgr)
+	if err != nil {
+		return err
+	}
+
+	utils.L(ctx).Debugf("collecting blobs referenced by live hashes")
+
+	liveBlobs := map[string]bool{}
+	for blobPath := range pages {
+		liveBlobs[blobPath] = true
+	}
+	blobEnds := map[string]int64{}
+	err = hashes.Iterate(ctx, func(ctx context.Context, hash, hashset string, stream *manifest.Stream) error {
+		for _, r := range stream.Ranges {
+			if r.Hole {
+				continue
+			}
+			blobPath := streams.BlobPath(r.Blob())
+			if live[hash] {
+				liveBlobs[blobPath] = true
+			}
+			if end := r.Offset + r.Length; end > blobEnds[blobPath] {
+				blobEnds[blobPath] = end
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// unreferenced hashes are only removed if their data is going away. the
+	// rest are left for repack to account for and still allow deduplication.
+	deadHashes := map[string]bool{}
+	err = hashes.Iterate(ctx, func(ctx context.Context, hash, hashset string, stream *manifest.Stream) error {
+		if live[hash] {
+			return nil
+		}
+		for _, r := range stream.Ranges {
+			if !r.Hole && !liveBlobs[streams.BlobPath(r.Blob())] {
+				deadHashes[hash] = true
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var deadBlobs []string
+	err = backend.List(ctx, streams.BlobPrefix,
+		func(ctx context.Context, path string) error {
+			if !liveBlobs[path] {
+				deadBlobs = append(deadBlobs, path)
+			}
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+	sort.Strings(deadBlobs)
+
+	// blobs that no hash refers to at all have an unknown size, so this is a
+	// lower bound.
+	var reclaimable int64
+	for _, path := range deadBlobs {
+		reclaimable += blobEnds[path]
+	}
+
+	if *gcFlagDryRun {
+		if *gcFlagVerbose {
+			for _, path := range deadBlobs {
+				fmt.Printf("would delete blob: %s\n", path)
+			}
+		}
+		fmt.Printf("would remove %d unreferenced hashes and %d unreferenced blobs, reclaiming at least %s\n",
+			len(deadHashes), len(deadBlobs), byteFmt(reclaimable))
+		return nil
+	}
+
+	// the hashsets must no longer refer to a blob before the blob is deleted,
+	// otherwise a crash would leave hashes that point at missing data.
+	if len(deadHashes) > 0 {
+		_, err = hashes.Prune(ctx, func(hash string) bool { return !deadHashes[hash] })
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, path := range deadBlobs {
+		if *gcFlagVerbose {
+			fmt.Printf("deleting blob: %s\n", path)
+		}
+		err = backend.Delete(ctx, path)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the hashsets that Prune superseded can refer to the deleted blobs.
+	_, err = hashes.Cleanup(ctx)
+	if err != nil {
+		return err
+	}
+
+	utils.L(ctx).Normalf("removed %d unreferenced hashes and %d unreferenced blobs, reclaiming at least %s",
+		len(deadHashes), len(deadBlobs), byteFmt(reclaimable))
+	return nil
+}
+
+// liveHashes returns the set of hashes referenced by any snapshot, and the
+// set of blobs that hold the snapshots' manifest pages.
+func liveHashes(ctx context.Context, mgr *session.Manager) (live, pages map[string]bool, err error) {
+	utils.L(ctx).Debugf("collecting hashes referenced by snapshots")
+
+	live = map[string]bool{}
+	pages = map[string]bool{}
+	seen := map[string]bool{}
+	err = mgr.ListSnapshots(ctx, func(ctx context.Context, timestamp time.Time) error {
+		utils.L(ctx).Debugf("checking snapshot %v", timestamp.UnixNano())
+		snap, err := mgr.OpenSnapshot(ctx, timestamp)
+		if err != nil {
+			return err
+		}
+		defer snap.Close()
+		return snap.References(ctx, seen,
+			func(ctx context.Context, hash string) error {
+				live[hash] = true
+				return nil
+			},
+			func(ctx context.Context, data *manifest.Stream) error {
+				for _, r := range data.Ranges {
+					pages[streams.BlobPath(r.Blob())] = true
+				}
+				return nil
+			})
+	})
+	return live, pages, err
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/jtolio/jam/locks"
+)
+
+// useTestStore points the store flags at a new local store for the rest of
+// the test.
+func useTestStore(t *testing.T) {
+	td, err := os.MkdirTemp("", "jamtest")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, os.RemoveAll(td))
+	})
+	for flag, val := range map[*string]string{
+		sysFlagStore:  (&url.URL{Scheme: "file", Path: td}).String(),
+		sysFlagEncKey: strings.Repeat("ab", keySize),
+	} {
+		old := *flag
+		*flag = val
+		t.Cleanup(func() { *flag = old })
+	}
+	oldCache := *sysFlagCacheEnabled
+	*sysFlagCacheEnabled = false
+	t.Cleanup(func() { *sysFlagCacheEnabled = oldCache })
+}
+
+func TestGCKeepsHashesInLiveBlobs(t *testing.T) {
+	ctx := context.Background()
+	useTestStore(t)
+	source, err := os.MkdirTemp("", "jamtest")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(source))
+	}()
+	// incompressible data, with more of it unreferenced than not once
+	// "removed" is gone, so that repack picks the blob.
+	rng := rand.New(rand.NewSource(0))
+	for name, size := range map[string]int{"kept": 1000, "removed": 3000} {
+		data := make([]byte, size)
+		_, err := rng.Read(data)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(source, name), data, 0644))
+	}
+
+	// both files are stored in one blob, and then the only snapshot with
+	// "removed" is deleted.
+	mgr, _, hashes, mgrClose, err := getManager(ctx, locks.Exclusive)
+	require.NoError(t, err)
+	flags := shellFlags("store")
+	opts := bindStoreOptions(flags)
+	sess, err := mgr.NewSession(ctx)
+	require.NoError(t, err)
+	_, err = storeInto(ctx, mgr, sess, source, "", opts)
+	require.NoError(t, err)
+	require.NoError(t, sess.Commit(ctx))
+	require.NoError(t, sess.Close())
+	snap, first, err := mgr.LatestSnapshot(ctx)
+	require.NoError(t, err)
+	removed, err := snap.Lookup(ctx, "removed")
+	require.NoError(t, err)
+	require.NoError(t, snap.Close())
+	sess, err = mgr.NewSession(ctx)
+	require.NoError(t, err)
+	_, err = sess.Delete(ctx, "removed")
+	require.NoError(t, err)
+	require.NoError(t, sess.Commit(ctx))
+	require.NoError(t, sess.Close())
+	require.NoError(t, mgr.DeleteSnapshot(ctx, first))
+	exists, err := hashes.Has(ctx, string(removed.Hash))
+	require.NoError(t, err)
+	require.True(t, exists)
+	require.NoError(t, mgrClose())
+
+	hasRemoved := func() bool {
+		_, _, hashes, mgrClose, err := getManager(ctx, locks.Shared)
+		require.NoError(t, err)
+		defer func() {
+			require.NoError(t, mgrClose())
+		}()
+		exists, err := hashes.Has(ctx, string(removed.Hash))
+		require.NoError(t, err)
+		return exists
+	}
+
+	// gc leaves the unreferenced hash, since its blob is still live, so that
+	// repack can tell how much of the blob is unreferenced.
+	require.NoError(t, GC(ctx, nil))
+	require.True(t, hasRemoved())
+
+	// repack copies "kept" out of the blob, and drops the hash along with it.
+	require.NoError(t, Repack(ctx, nil))
+	require.False(t, hasRemoved())
+	mgr, _, _, mgrClose, err = getManager(ctx, locks.Shared)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, mgrClose())
+	}()
+	expected, err := os.ReadFile(filepath.Join(source, "kept"))
+	require.NoError(t, err)
+	require.Equal(t, string(expected), readLatest(t, mgr, "kept"))
+}
@@ -57,6 +57,14 @@ func (a *asyncHashDB) init(ctx context.Context) (DB, error) {
 	return a.hashDB, nil
 }
 
+func (a *asyncHashDB) Cleanup(ctx context.Context) (removed int, err error) {
+	hashDB, err := a.init(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return hashDB.Cleanup(ctx)
+}
+
 func (a *asyncHashDB) Coalesce(ctx context.Context) error {
 	hashDB, err := a.init(ctx)
 	if err != nil {
@@ -98,6 +106,14 @@ func (a *asyncHashDB) Lookup(ctx context.Context, hash string) (*manifest.Stream
 	return hashDB.Lookup(ctx, hash)
 }
 
+func (a *asyncHashDB) Prune(ctx context.Context, keep func(hash string) bool) (removed int, err error) {
+	hashDB, err := a.init(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return hashDB.Prune(ctx, keep)
+}
+
 func (a *asyncHashDB) Put(ctx context.Context, hash string, data *manifest.Stream) error {
 	hashDB, err := a.init(ctx)
 	if err != nil {
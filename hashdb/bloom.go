@@ -0,0 +1,119 @@
+package hashdb
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+
+	"github.com/jtolio/jam/manifest"
+)
+
+func newBloom(expected int64) []byte {
+	bytes := (expected*bloomBitsPerHash + 7) / 8
+	if bytes < 8 {
+		bytes = 8
+	}
+	return make([]byte, bytes)
+}
+
+// bloomBits calls cb with every bit of the filter that hash sets, using
+// double hashing. Hashes are usually sha256 sums already, but aren't
+// assumed to be.
+func bloomBits(bloom []byte, k uint32, hash string, cb func(byteIdx int, mask byte) bool) bool {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(hash))
+	h1 := h.Sum64()
+	h = fnv.New64()
+	_, _ = h.Write([]byte(hash))
+	h2 := h.Sum64() | 1
+	bits := uint64(len(bloom)) * 8
+	for i := uint64(0); i < uint64(k); i++ {
+		bit := (h1 + i*h2) % bits
+		if !cb(int(bit/8), 1<<(bit%8)) {
+			return false
+		}
+	}
+	return true
+}
+
+func bloomAdd(bloom []byte, k uint32, hash string) {
+	bloomBits(bloom, k, hash, func(byteIdx int, mask byte) bool {
+		bloom[byteIdx] |= mask
+		return true
+	})
+}
+
+// bloomHas returns false only if hash was never added.
+func bloomHas(bloom []byte, k uint32, hash string) bool {
+	if len(bloom) == 0 {
+		return true
+	}
+	return bloomBits(bloom, k, hash, func(byteIdx int, mask byte) bool {
+		return bloom[byteIdx]&mask != 0
+	})
+}
+
+// blockCache keeps the most recently read run blocks.
+type blockCache struct {
+	mtx     sync.Mutex
+	size    int
+	order   *list.List
+	entries map[blockKey]*list.Element
+}
+
+type blockKey struct {
+	path  string
+	block int
+}
+
+type cachedBlock struct {
+	key blockKey
+	set *manifest.HashSet
+}
+
+func newBlockCache(size int) *blockCache {
+	return &blockCache{
+		size:    size,
+		order:   list.New(),
+		entries: map[blockKey]*list.Element{},
+	}
+}
+
+func (c *blockCache) get(path string, block int) *manifest.HashSet {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	elem, ok := c.entries[blockKey{path: path, block: block}]
+	if !ok {
+		return nil
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*cachedBlock).set
+}
+
+func (c *blockCache) put(path string, block int, set *manifest.HashSet) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	key := blockKey{path: path, block: block}
+	if elem, ok := c.entries[key]; ok {
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cachedBlock{key: key, set: set})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedBlock).key)
+	}
+}
+
+// forget drops every block of the run at path.
+func (c *blockCache) forget(path string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for key, elem := range c.entries {
+		if key.path == path {
+			c.order.Remove(elem)
+			delete(c.entries, key)
+		}
+	}
+}
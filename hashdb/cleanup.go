@@ -2,98 +2,191 @@ package hashdb
 
 import (
 	"context"
+	"sort"
+	"strings"
+
+	"github.com/zeebo/errs"
 
 	"github.com/jtolio/jam/manifest"
 	"github.com/jtolio/jam/utils"
 )
 
+// Coalesce writes a full run with every hash. The old runs and hashsets are
+// superseded by it, but are left for Cleanup.
 func (d *dbImpl) Coalesce(ctx context.Context) error {
-	// TODO: seems silly to write out a small hashset only to delete it
-	err := d.Flush(ctx)
+	_, err := d.rewriteAll(ctx, nil, 0)
+	return err
+}
+
+// Split is like Coalesce, but splits the full set of hashes into runs of at
+// most maxRunHashes hashes, so that later merges don't have to rewrite
+// everything.
+func (d *dbImpl) Split(ctx context.Context) error {
+	_, err := d.rewriteAll(ctx, nil, maxRunHashes)
+	return err
+}
+
+// Prune writes a full set of runs like Split, leaving out every hash that
+// keep returns false for. Once it returns, the hashes it left out are no
+// longer read from the old runs and hashsets, which are left for Cleanup.
+func (d *dbImpl) Prune(ctx context.Context, keep func(hash string) bool) (removed int, err error) {
+	removed, err = d.rewriteAll(ctx, keep, maxRunHashes)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	newpath, err := d.flush(ctx, d.existing)
+	utils.L(ctx).Normalf("pruned %d hashes", removed)
+	return removed, nil
+}
+
+func (d *dbImpl) rewriteAll(ctx context.Context, keep func(hash string) bool, limit int64) (
+	removed int, err error) {
+	err = d.Flush(ctx)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	utils.L(ctx).Normalf("wrote new hashset with %d hashes. deleting old hashsets...", len(d.existing))
-	deleted := map[string]bool{}
-	for _, oldpath := range d.paths {
-		if deleted[oldpath] {
-			continue
-		}
-		err = d.backend.Delete(ctx, oldpath)
-		if err != nil {
-			return err
-		}
-		deleted[oldpath] = true
+	old := len(d.runs) + len(d.legacyPaths)
+	written, removed, err := d.rewrite(ctx, d.runs, true, keep, limit, manifest.HashRunIndex_FULL)
+	if err != nil {
+		return 0, err
 	}
-	d.paths = []string{newpath}
-	for hash := range d.source {
-		d.source[hash] = newpath
+	d.runs = written
+	var count int64
+	for _, r := range written {
+		count += r.index.Count
 	}
-	utils.L(ctx).Normalf("deleted %d old hashsets.", len(deleted))
-	return nil
+	utils.L(ctx).Normalf("wrote %d new hashsets with %d hashes, superseding %d old hashsets",
+		len(written), count, old)
+	return removed, nil
 }
 
-func (d *dbImpl) Split(ctx context.Context) error {
-	// TODO: seems silly to write out a small hashset only to delete it
-	err := d.Flush(ctx)
-	if err != nil {
-		return err
+// rewrite merges runs, which must be the newest runs, and the legacy
+// hashsets if legacy is true, into new runs of at most limit hashes each, or
+// one run if limit is zero. It leaves out the hashes keep returns false for.
+// The last of the new runs supersedes the old runs and hashsets, which
+// aren't deleted, since something else may still be reading them.
+func (d *dbImpl) rewrite(ctx context.Context, runs []*run, legacy bool,
+	keep func(hash string) bool, limit int64, typ manifest.HashRunIndex_Type) (
+	written []*run, removed int, err error) {
+	var expected int64
+	for _, r := range runs {
+		expected += r.index.Count
 	}
-
-	utils.L(ctx).Normalf("categorizing hashes by last blob")
-
-	hashesByBlob := map[string]map[string]*manifest.Stream{}
-
-	for hash, stream := range d.existing {
-		blob := ""
-		if len(stream.Ranges) > 0 {
-			blob = stream.Ranges[len(stream.Ranges)-1].Blob()
-		}
-		if _, exists := hashesByBlob[blob]; !exists {
-			hashesByBlob[blob] = map[string]*manifest.Stream{}
-		}
-		hashesByBlob[blob][hash] = stream
+	if legacy {
+		expected += int64(len(d.legacy))
 	}
-
-	utils.L(ctx).Normalf("found %d in-use last blobs, writing new hash sets",
-		len(hashesByBlob))
-	if len(hashesByBlob[""]) > 0 {
-		utils.L(ctx).Normalf("found %d zero-length hashes", len(hashesByBlob[""]))
+	if keep == nil {
+		keep = func(hash string) bool { return true }
 	}
+	supersedes := d.supersedes(runs, legacy)
 
-	newPaths := make([]string, 0, len(hashesByBlob))
-	newSources := map[string]string{}
-	for _, hashset := range hashesByBlob {
-		path, err := d.flush(ctx, hashset)
+	it := &filterIterator{iterator: d.iterator(runs, legacy), keep: keep}
+	err = func() (err error) {
+		defer func() { err = errs.Combine(err, it.close()) }()
+		first, err := it.next(ctx)
 		if err != nil {
 			return err
 		}
-		utils.L(ctx).Normalf("wrote new hashset with %d hashes", len(hashset))
-		newPaths = append(newPaths, path)
-		for hash := range hashset {
-			newSources[hash] = path
+		for {
+			// if everything is left out, this still writes an empty run to
+			// supersede the old ones.
+			r, next, err := d.writeRun(ctx, it, first, expected, limit, typ, supersedes)
+			if err != nil {
+				return err
+			}
+			utils.L(ctx).Debugf("wrote hashset %q with %d hashes", r.path, r.index.Count)
+			written = append(written, r)
+			// this never underestimates what's left, which would make the
+			// bloom filters useless.
+			expected -= r.index.Count
+			if next == nil {
+				return nil
+			}
+			first = next
 		}
+	}()
+	if err != nil {
+		return nil, 0, err
 	}
 
-	utils.L(ctx).Normalf("deleting %d old hashsets...", len(d.paths))
-	deleted := map[string]bool{}
-	for _, oldpath := range d.paths {
-		if deleted[oldpath] {
-			continue
+	if legacy {
+		d.legacy = map[string]*manifest.Stream{}
+		d.legacySource = map[string]string{}
+		d.legacyPaths = nil
+	}
+	return written, it.removed, nil
+}
+
+// supersedes returns what a run with the hashes of runs (and the legacy
+// hashsets if legacy is true) supersedes: those runs and hashsets and
+// everything they supersede that still exists, so that loading never has to
+// read a superseded run's index to know what else is superseded.
+func (d *dbImpl) supersedes(runs []*run, legacy bool) []string {
+	set := map[string]bool{}
+	for _, r := range runs {
+		set[r.path] = true
+		for _, path := range r.index.Supersedes {
+			if d.listed[path] {
+				set[path] = true
+			}
 		}
-		err = d.backend.Delete(ctx, oldpath)
-		if err != nil {
-			return err
+	}
+	if legacy {
+		for _, path := range d.legacyPaths {
+			set[path] = true
 		}
-		deleted[oldpath] = true
 	}
+	rv := make([]string, 0, len(set))
+	for path := range set {
+		rv = append(rv, path)
+	}
+	sort.Strings(rv)
+	return rv
+}
 
-	d.paths = newPaths
-	d.source = newSources
+// Cleanup deletes the runs and hashsets that newer runs supersede. Nothing
+// else may be using the hash database while it runs.
+func (d *dbImpl) Cleanup(ctx context.Context) (removed int, err error) {
+	scanned, err := d.scan(ctx)
+	if err != nil {
+		return 0, err
+	}
+	inUse := map[string]bool{}
+	for _, r := range d.runs {
+		inUse[r.path] = true
+	}
 
-	return nil
+	var paths []string
+	for path := range scanned.superseded {
+		if !inUse[path] {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		objects := []string{path}
+		if strings.HasSuffix(path, RunSuffix) {
+			// the index goes first, so that no one finds a run with missing
+			// data.
+			objects = []string{runIndexPath(path), path}
+		}
+		var deleted bool
+		for _, object := range objects {
+			if !scanned.listed[object] {
+				continue
+			}
+			utils.L(ctx).Debugf("deleting superseded hashset %q", object)
+			err = d.backend.Delete(ctx, object)
+			if err != nil {
+				return removed, err
+			}
+			delete(d.listed, object)
+			deleted = true
+		}
+		d.blocks.forget(path)
+		if deleted {
+			removed++
+		}
+	}
+	utils.L(ctx).Normalf("deleted %d superseded hashsets", removed)
+	return removed, nil
 }
@@ -1,17 +1,16 @@
 package hashdb
 
 import (
-	"bytes"
 	"compress/zlib"
 	"context"
 	"crypto/sha256"
 	"io"
+	"strings"
 
 	"github.com/zeebo/errs"
 
 	"github.com/jtolio/jam/backends"
 	"github.com/jtolio/jam/manifest"
-	"github.com/jtolio/jam/streams"
 	"github.com/jtolio/jam/utils"
 )
 
@@ -20,7 +19,16 @@ const HashPrefix = "hash/"
 const SmallHashsetSuffix = ".hs"
 const SmallHashsetThreshold = 64 * 1024
 
+const (
+	// automatic compaction doesn't grow runs past this many hashes, so that a
+	// flush never has to rewrite a large run. Split also uses it.
+	maxRunHashes = 1 << 20
+
+	blockCacheSize = 256
+)
+
 type DB interface {
+	Cleanup(ctx context.Context) (removed int, err error)
 	Close() error
 	Coalesce(context.Context) error
 	Flush(context.Context) error
@@ -28,18 +36,32 @@ type DB interface {
 	Iterate(context.Context,
 		func(ctx context.Context, hash, hashset string, data *manifest.Stream) error) error
 	Lookup(ctx context.Context, hash string) (*manifest.Stream, error)
+	Prune(ctx context.Context, keep func(hash string) bool) (removed int, err error)
 	Put(ctx context.Context, hash string, data *manifest.Stream) error
 	Split(context.Context) error
 }
 
+// dbImpl is a log-structured merge tree of runs (see run.go). New hashes are
+// kept in memory until Flush writes them as a new run, and runs of similar
+// size are merged as they accumulate.
 type dbImpl struct {
 	backend backends.Backend
 
-	// TODO: do an LSM tree instead of putting all of this in RAM
-	existing map[string]*manifest.Stream
-	new      map[string]*manifest.Stream
-	source   map[string]string
-	paths    []string
+	// legacy has the hashes of hashsets in the format from before runs,
+	// which is read entirely into memory. Coalesce, Split and Prune rewrite
+	// them as runs.
+	legacy       map[string]*manifest.Stream
+	legacySource map[string]string
+	legacyPaths  []string
+
+	// runs are ordered from oldest to newest. listed has the paths of every
+	// run and hashset known to exist.
+	runs      []*run
+	listed    map[string]bool
+	lastStamp int64
+	blocks    *blockCache
+
+	new map[string]*manifest.Stream
 }
 
 func Open(ctx context.Context, backend backends.Backend) (DB, error) {
@@ -49,10 +71,12 @@ func Open(ctx context.Context, backend backends.Backend) (DB, error) {
 
 func newDB(backend backends.Backend) *dbImpl {
 	return &dbImpl{
-		backend:  backend,
-		existing: map[string]*manifest.Stream{},
-		new:      map[string]*manifest.Stream{},
-		source:   map[string]string{},
+		backend:      backend,
+		legacy:       map[string]*manifest.Stream{},
+		legacySource: map[string]string{},
+		listed:       map[string]bool{},
+		blocks:       newBlockCache(blockCacheSize),
+		new:          map[string]*manifest.Stream{},
 	}
 }
 
@@ -61,23 +85,92 @@ func New(backend backends.Backend) DB {
 }
 
 func (d *dbImpl) load(ctx context.Context) error {
-	var paths []string
-	err := utils.SortedList(ctx, d.backend, HashPrefix,
-		func(ctx context.Context, path string) error {
+	scanned, err := d.scan(ctx)
+	if err != nil {
+		return err
+	}
+	d.runs = scanned.runs
+	d.listed = scanned.listed
+	for _, path := range scanned.legacy {
+		err = func() error {
 			r, err := d.backend.Get(ctx, path, 0, -1)
 			if err != nil {
 				return err
 			}
 			defer r.Close()
-
-			paths = append(paths, path)
 			return d.loadStream(ctx, r, path)
+		}()
+		if err != nil {
+			return err
+		}
+		d.legacyPaths = append(d.legacyPaths, path)
+	}
+	return nil
+}
+
+type scanResult struct {
+	// runs that aren't superseded, from oldest to newest
+	runs []*run
+	// legacy hashsets that aren't superseded
+	legacy     []string
+	superseded map[string]bool
+	listed     map[string]bool
+}
+
+// scan lists the runs and hashsets, opening the runs that aren't superseded
+// from newest to oldest. Runs are always newer than what they supersede, so
+// a superseded run never needs to be opened.
+func (d *dbImpl) scan(ctx context.Context) (*scanResult, error) {
+	rv := &scanResult{superseded: map[string]bool{}, listed: map[string]bool{}}
+	var indexes, legacy []string
+	err := utils.SortedList(ctx, d.backend, HashPrefix,
+		func(ctx context.Context, path string) error {
+			rv.listed[path] = true
+			switch {
+			case strings.HasSuffix(path, RunSuffix):
+				// runs are found by their index
+			case strings.HasSuffix(path, RunIndexSuffix):
+				indexes = append(indexes, path)
+			default:
+				legacy = append(legacy, path)
+			}
+			return nil
 		})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	d.paths = paths
-	return nil
+
+	for i := len(indexes) - 1; i >= 0; i-- {
+		path := runPath(indexes[i])
+		stamp, err := runStamp(path)
+		if err != nil {
+			return nil, err
+		}
+		if stamp > d.lastStamp {
+			d.lastStamp = stamp
+		}
+		if rv.superseded[path] {
+			continue
+		}
+		r, err := d.openRun(ctx, indexes[i])
+		if err != nil {
+			return nil, err
+		}
+		for _, superseded := range r.index.Supersedes {
+			rv.superseded[superseded] = true
+		}
+		rv.runs = append(rv.runs, r)
+	}
+	for i, j := 0, len(rv.runs)-1; i < j; i, j = i+1, j-1 {
+		rv.runs[i], rv.runs[j] = rv.runs[j], rv.runs[i]
+	}
+
+	for _, path := range legacy {
+		if !rv.superseded[path] {
+			rv.legacy = append(rv.legacy, path)
+		}
+	}
+	return rv, nil
 }
 
 func (d *dbImpl) loadStream(ctx context.Context, stream io.Reader, path string) error {
@@ -123,8 +216,8 @@ func (d *dbImpl) loadStream(ctx context.Context, stream io.Reader, path string)
 
 			hash := string(hashBytes)
 			// TODO: log on overwrites?
-			d.existing[hash] = entry.Data
-			d.source[hash] = path
+			d.legacy[hash] = entry.Data
+			d.legacySource[hash] = path
 		}
 	}
 
@@ -137,11 +230,16 @@ func (d *dbImpl) Has(ctx context.Context, hash string) (exists bool, err error)
 }
 
 func (d *dbImpl) Lookup(ctx context.Context, hash string) (*manifest.Stream, error) {
-	rv := d.existing[hash]
-	if rv != nil {
+	if rv := d.new[hash]; rv != nil {
 		return rv, nil
 	}
-	return d.new[hash], nil
+	for i := len(d.runs) - 1; i >= 0; i-- {
+		rv, err := d.lookupRun(ctx, d.runs[i], hash)
+		if err != nil || rv != nil {
+			return rv, err
+		}
+	}
+	return d.legacy[hash], nil
 }
 
 func (d *dbImpl) Put(ctx context.Context, hash string, data *manifest.Stream) error {
@@ -149,63 +247,38 @@ func (d *dbImpl) Put(ctx context.Context, hash string, data *manifest.Stream) er
 	return nil
 }
 
-func (d *dbImpl) flush(ctx context.Context, hashes map[string]*manifest.Stream) (string, error) {
-	if len(hashes) == 0 {
-		return "", nil
-	}
-
-	// TODO: LSM tree instead of this
-	var set manifest.HashSet
-	for hash, data := range hashes {
-		set.Hashes = append(set.Hashes, &manifest.HashedData{
-			Hash: []byte(hash),
-			Data: data,
-		})
-	}
-
-	// TODO: reduce code duplication with pathdb.Serialize
-	data, err := utils.MarshalSized(&set)
-	if err != nil {
-		return "", err
-	}
-
-	var out bytes.Buffer
-	compressor := zlib.NewWriter(&out)
-	_, err = compressor.Write(data)
-	if err != nil {
-		return "", err
+// Flush writes the hashes put since the last Flush as a new incremental run,
+// and then merges the newest runs while the newest is at least half the size
+// of the one before it, so that there are only logarithmically many runs.
+func (d *dbImpl) Flush(ctx context.Context) error {
+	if len(d.new) == 0 {
+		return nil
 	}
-	err = compressor.Close()
+	it := newMapIterator(d.new, nil, "")
+	first, err := it.next(ctx)
 	if err != nil {
-		return "", err
-	}
-
-	path := HashPrefix + streams.IdPathComponent(utils.IdGen())
-	if out.Len() <= SmallHashsetThreshold {
-		path += SmallHashsetSuffix
+		return err
 	}
-
-	err = d.backend.Put(ctx, path, io.MultiReader(
-		bytes.NewReader([]byte(versionHeader)),
-		utils.NewFramingReader(&out)))
-	if err != nil {
-		return "", err
-	}
-
-	return path, nil
-}
-
-func (d *dbImpl) Flush(ctx context.Context) error {
-	path, err := d.flush(ctx, d.new)
+	r, _, err := d.writeRun(ctx, it, first, int64(len(d.new)), 0, manifest.HashRunIndex_INCREMENTAL, nil)
 	if err != nil {
 		return err
 	}
-	for hash, data := range d.new {
-		d.existing[hash] = data
-		d.source[hash] = path
-	}
+	d.runs = append(d.runs, r)
 	d.new = map[string]*manifest.Stream{}
 
+	for len(d.runs) >= 2 {
+		older, newer := d.runs[len(d.runs)-2], d.runs[len(d.runs)-1]
+		if newer.index.Count*2 < older.index.Count ||
+			older.index.Count+newer.index.Count > maxRunHashes {
+			break
+		}
+		merged, _, err := d.rewrite(ctx, d.runs[len(d.runs)-2:], false, nil, 0,
+			manifest.HashRunIndex_INCREMENTAL)
+		if err != nil {
+			return err
+		}
+		d.runs = append(d.runs[:len(d.runs)-2], merged...)
+	}
 	return nil
 }
 
@@ -213,18 +286,31 @@ func (d *dbImpl) Close() error {
 	return nil
 }
 
-func (d *dbImpl) Iterate(ctx context.Context, cb func(ctx context.Context, hash, hashset string, data *manifest.Stream) error) error {
-	for hash, data := range d.existing {
-		err := cb(ctx, hash, d.source[hash], data)
-		if err != nil {
+func (d *dbImpl) iterator(runs []*run, legacy bool) iterator {
+	its := make([]iterator, 0, len(runs)+1)
+	if legacy {
+		its = append(its, newMapIterator(d.legacy, d.legacySource, ""))
+	}
+	for _, r := range runs {
+		its = append(its, &runIterator{d: d, r: r})
+	}
+	return newMergeIterator(its...)
+}
+
+// Iterate calls cb once per hash with its current data, in hash order.
+// hashset is the run or hashset the data is from, or "" if it hasn't been
+// flushed.
+func (d *dbImpl) Iterate(ctx context.Context, cb func(ctx context.Context, hash, hashset string, data *manifest.Stream) error) (err error) {
+	it := newMergeIterator(d.iterator(d.runs, true), newMapIterator(d.new, nil, ""))
+	defer func() { err = errs.Combine(err, it.close()) }()
+	for {
+		e, err := it.next(ctx)
+		if err != nil || e == nil {
 			return err
 		}
-	}
-	for hash, data := range d.new {
-		err := cb(ctx, hash, "", data)
+		err = cb(ctx, e.hash, e.source, e.data)
 		if err != nil {
 			return err
 		}
 	}
-	return nil
 }
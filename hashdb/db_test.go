@@ -1,8 +1,12 @@
 package hashdb
 
 import (
+	"bytes"
+	"compress/zlib"
 	"context"
 	"crypto/sha256"
+	"fmt"
+	"io"
 	"net/url"
 	"os"
 	"strings"
@@ -10,6 +14,7 @@ import (
 
 	"github.com/stretchr/testify/require"
 
+	"github.com/jtolio/jam/backends"
 	"github.com/jtolio/jam/backends/fs"
 	"github.com/jtolio/jam/manifest"
 	"github.com/jtolio/jam/utils"
@@ -95,3 +100,270 @@ func TestHashDB(t *testing.T) {
 
 	require.NoError(t, db.Close())
 }
+
+func TestHashDBPrune(t *testing.T) {
+	td, err := os.MkdirTemp("", "hashdbtest")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(td))
+	}()
+
+	b, err := fs.New(ctx, &url.URL{Path: td})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, b.Close())
+	}()
+
+	db, err := Open(ctx, b)
+	require.NoError(t, err)
+
+	for _, hash := range []string{"a", "b", "c"} {
+		require.NoError(t, db.Put(ctx, extendHash(hash),
+			&manifest.Stream{Ranges: []*manifest.Range{
+				{BlobBytes: []byte(hash), Offset: 0, Length: 1},
+			}}))
+		require.NoError(t, db.Flush(ctx))
+	}
+
+	removed, err := db.Prune(ctx, func(hash string) bool { return hash != extendHash("b") })
+	require.NoError(t, err)
+	require.Equal(t, 1, removed)
+
+	removed, err = db.Prune(ctx, func(hash string) bool { return true })
+	require.NoError(t, err)
+	require.Equal(t, 0, removed)
+
+	require.NoError(t, db.Close())
+
+	db, err = Open(ctx, b)
+	require.NoError(t, err)
+
+	for hash, expected := range map[string]bool{"a": true, "b": false, "c": true} {
+		exists, err := db.Has(ctx, extendHash(hash))
+		require.NoError(t, err)
+		require.Equal(t, expected, exists)
+	}
+
+	// an empty run still supersedes everything before it.
+	removed, err = db.Prune(ctx, func(hash string) bool { return false })
+	require.NoError(t, err)
+	require.Equal(t, 2, removed)
+	require.NoError(t, db.Close())
+
+	db, err = Open(ctx, b)
+	require.NoError(t, err)
+	require.NoError(t, db.Iterate(ctx, func(ctx context.Context, hash, hashset string, data *manifest.Stream) error {
+		return fmt.Errorf("unexpected hash %x", hash)
+	}))
+	require.NoError(t, db.Close())
+}
+
+// Prune rewrites every hash even if it removes none, which repack relies on to
+// replace hashes' old ranges.
+func TestHashDBPruneRewrites(t *testing.T) {
+	td, err := os.MkdirTemp("", "hashdbtest")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(td))
+	}()
+
+	b, err := fs.New(ctx, &url.URL{Path: td})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, b.Close())
+	}()
+
+	db, err := Open(ctx, b)
+	require.NoError(t, err)
+	require.NoError(t, db.Put(ctx, extendHash("a"), testStream("a", 0)))
+	require.NoError(t, db.Flush(ctx))
+	require.NoError(t, db.Put(ctx, extendHash("a"), testStream("b", 1)))
+
+	removed, err := db.Prune(ctx, func(hash string) bool { return true })
+	require.NoError(t, err)
+	require.Equal(t, 0, removed)
+	require.NoError(t, db.Close())
+
+	db, err = Open(ctx, b)
+	require.NoError(t, err)
+	requireHashes(t, db, map[string]int64{extendHash("a"): 1})
+	require.NoError(t, db.Iterate(ctx, func(ctx context.Context, hash, hashset string, data *manifest.Stream) error {
+		require.Equal(t, utils.PathSafeIdEncode([]byte("b")), data.Ranges[0].Blob())
+		return nil
+	}))
+	require.NoError(t, db.Close())
+}
+
+func testStream(blob string, offset int64) *manifest.Stream {
+	return &manifest.Stream{Ranges: []*manifest.Range{
+		{BlobBytes: []byte(blob), Offset: offset, Length: 1},
+	}}
+}
+
+func requireHashes(t *testing.T, db DB, expected map[string]int64) {
+	for hash, offset := range expected {
+		stream, err := db.Lookup(ctx, hash)
+		require.NoError(t, err)
+		require.NotNil(t, stream, "hash %x", hash)
+		require.Equal(t, offset, stream.Ranges[0].Offset, "hash %x", hash)
+	}
+	exists, err := db.Has(ctx, extendHash("missing"))
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	seen := map[string]bool{}
+	require.NoError(t, db.Iterate(ctx, func(ctx context.Context, hash, hashset string, data *manifest.Stream) error {
+		require.False(t, seen[hash])
+		seen[hash] = true
+		require.Equal(t, expected[hash], data.Ranges[0].Offset)
+		return nil
+	}))
+	require.Equal(t, len(expected), len(seen))
+}
+
+func countObjects(t *testing.T, b backends.Backend, suffix string) (count int) {
+	require.NoError(t, b.List(ctx, HashPrefix, func(ctx context.Context, path string) error {
+		if strings.HasSuffix(path, suffix) {
+			count++
+		}
+		return nil
+	}))
+	return count
+}
+
+func TestHashDBRuns(t *testing.T) {
+	td, err := os.MkdirTemp("", "hashdbtest")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(td))
+	}()
+
+	b, err := fs.New(ctx, &url.URL{Path: td})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, b.Close())
+	}()
+
+	db, err := Open(ctx, b)
+	require.NoError(t, err)
+
+	// enough hashes for more than one block per run
+	expected := map[string]int64{}
+	for i := 0; i < 3000; i++ {
+		hash := extendHash(fmt.Sprint(i))
+		require.NoError(t, db.Put(ctx, hash, testStream("a", 0)))
+		expected[hash] = 0
+	}
+	require.NoError(t, db.Flush(ctx))
+
+	// later flushes take precedence, and small runs get merged.
+	for i := 0; i < 64; i++ {
+		hash := extendHash(fmt.Sprint(i * 7))
+		require.NoError(t, db.Put(ctx, hash, testStream("b", int64(i+1))))
+		expected[hash] = int64(i + 1)
+		require.NoError(t, db.Flush(ctx))
+	}
+	requireHashes(t, db, expected)
+	require.NoError(t, db.Close())
+	require.Equal(t, countObjects(t, b, RunSuffix), countObjects(t, b, RunIndexSuffix))
+
+	// merged runs are only superseded, not deleted.
+	db, err = Open(ctx, b)
+	require.NoError(t, err)
+	requireHashes(t, db, expected)
+	loaded := len(db.(*dbImpl).runs)
+	require.Less(t, loaded, 10)
+	require.Greater(t, countObjects(t, b, RunIndexSuffix), loaded)
+
+	removed, err := db.Cleanup(ctx)
+	require.NoError(t, err)
+	require.Equal(t, loaded, countObjects(t, b, RunIndexSuffix))
+	require.Equal(t, loaded, countObjects(t, b, RunSuffix))
+	require.Greater(t, removed, 0)
+	requireHashes(t, db, expected)
+
+	// coalescing writes a full run and leaves the old ones for cleanup.
+	require.NoError(t, db.Coalesce(ctx))
+	requireHashes(t, db, expected)
+	require.NoError(t, db.Close())
+	require.Equal(t, loaded+1, countObjects(t, b, RunIndexSuffix))
+
+	db, err = Open(ctx, b)
+	require.NoError(t, err)
+	require.Len(t, db.(*dbImpl).runs, 1)
+	require.Equal(t, manifest.HashRunIndex_FULL, db.(*dbImpl).runs[0].index.Type)
+	requireHashes(t, db, expected)
+
+	removed, err = db.Cleanup(ctx)
+	require.NoError(t, err)
+	require.Equal(t, loaded, removed)
+	require.Equal(t, 1, countObjects(t, b, RunIndexSuffix))
+	require.Equal(t, 1, countObjects(t, b, RunSuffix))
+	require.NoError(t, db.Close())
+
+	db, err = Open(ctx, b)
+	require.NoError(t, err)
+	requireHashes(t, db, expected)
+	require.NoError(t, db.Close())
+}
+
+func TestHashDBLegacy(t *testing.T) {
+	td, err := os.MkdirTemp("", "hashdbtest")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(td))
+	}()
+
+	b, err := fs.New(ctx, &url.URL{Path: td})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, b.Close())
+	}()
+
+	// a hashset as written before runs
+	set := &manifest.HashSet{Hashes: []*manifest.HashedData{
+		{Hash: []byte(extendHash("a")), Data: testStream("1", 1)},
+		{Hash: []byte(extendHash("b")), Data: testStream("1", 2)},
+	}}
+	data, err := utils.MarshalSized(set)
+	require.NoError(t, err)
+	var out bytes.Buffer
+	compressor := zlib.NewWriter(&out)
+	_, err = compressor.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, compressor.Close())
+	require.NoError(t, b.Put(ctx, HashPrefix+"ab/cdef"+SmallHashsetSuffix, io.MultiReader(
+		bytes.NewReader([]byte(versionHeader)), utils.NewFramingReader(&out))))
+
+	db, err := Open(ctx, b)
+	require.NoError(t, err)
+	require.NoError(t, db.Put(ctx, extendHash("b"), testStream("2", 3)))
+	require.NoError(t, db.Put(ctx, extendHash("c"), testStream("2", 4)))
+	require.NoError(t, db.Flush(ctx))
+
+	expected := map[string]int64{extendHash("a"): 1, extendHash("b"): 3, extendHash("c"): 4}
+	requireHashes(t, db, expected)
+	require.NoError(t, db.Close())
+
+	db, err = Open(ctx, b)
+	require.NoError(t, err)
+	requireHashes(t, db, expected)
+	require.NoError(t, db.Coalesce(ctx))
+	require.NoError(t, db.Close())
+
+	// the legacy hashset is superseded, and not even read anymore.
+	db, err = Open(ctx, b)
+	require.NoError(t, err)
+	require.Empty(t, db.(*dbImpl).legacyPaths)
+	requireHashes(t, db, expected)
+	require.Equal(t, 1, countObjects(t, b, SmallHashsetSuffix))
+	_, err = db.Cleanup(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 0, countObjects(t, b, SmallHashsetSuffix))
+	require.NoError(t, db.Close())
+
+	db, err = Open(ctx, b)
+	require.NoError(t, err)
+	requireHashes(t, db, expected)
+	require.NoError(t, db.Close())
+}
@@ -0,0 +1,130 @@
+package hashdb
+
+import (
+	"context"
+	"sort"
+
+	"github.com/zeebo/errs"
+
+	"github.com/jtolio/jam/manifest"
+)
+
+type entry struct {
+	hash   string
+	data   *manifest.Stream
+	source string
+}
+
+// iterator yields hashes in increasing order, and then nil.
+type iterator interface {
+	next(ctx context.Context) (*entry, error)
+	close() error
+}
+
+type mapIterator struct {
+	hashes  map[string]*manifest.Stream
+	sources map[string]string
+	source  string
+	sorted  []string
+}
+
+// newMapIterator iterates over hashes. The source of a hash is its value in
+// sources if it has one, and source otherwise.
+func newMapIterator(hashes map[string]*manifest.Stream, sources map[string]string, source string) *mapIterator {
+	sorted := make([]string, 0, len(hashes))
+	for hash := range hashes {
+		sorted = append(sorted, hash)
+	}
+	sort.Strings(sorted)
+	return &mapIterator{hashes: hashes, sources: sources, source: source, sorted: sorted}
+}
+
+func (it *mapIterator) next(ctx context.Context) (*entry, error) {
+	if len(it.sorted) == 0 {
+		return nil, nil
+	}
+	hash := it.sorted[0]
+	it.sorted = it.sorted[1:]
+	source, ok := it.sources[hash]
+	if !ok {
+		source = it.source
+	}
+	return &entry{hash: hash, data: it.hashes[hash], source: source}, nil
+}
+
+func (it *mapIterator) close() error { return nil }
+
+// mergeIterator merges iterators, which are given from oldest to newest.
+// When more than one has a hash, the newest one's entry is used.
+type mergeIterator struct {
+	its   []iterator
+	heads []*entry
+	init  bool
+}
+
+func newMergeIterator(its ...iterator) *mergeIterator {
+	return &mergeIterator{its: its, heads: make([]*entry, len(its))}
+}
+
+func (m *mergeIterator) next(ctx context.Context) (*entry, error) {
+	if !m.init {
+		for i, it := range m.its {
+			head, err := it.next(ctx)
+			if err != nil {
+				return nil, err
+			}
+			m.heads[i] = head
+		}
+		m.init = true
+	}
+
+	// there are few enough iterators that a heap isn't worth it.
+	var rv *entry
+	for _, head := range m.heads {
+		if head != nil && (rv == nil || head.hash <= rv.hash) {
+			rv = head
+		}
+	}
+	if rv == nil {
+		return nil, nil
+	}
+	for i, head := range m.heads {
+		if head == nil || head.hash != rv.hash {
+			continue
+		}
+		next, err := m.its[i].next(ctx)
+		if err != nil {
+			return nil, err
+		}
+		m.heads[i] = next
+	}
+	return rv, nil
+}
+
+func (m *mergeIterator) close() error {
+	var group errs.Group
+	for _, it := range m.its {
+		group.Add(it.close())
+	}
+	return group.Err()
+}
+
+// filterIterator skips hashes that keep returns false for, counting them.
+type filterIterator struct {
+	iterator
+	keep    func(hash string) bool
+	removed int
+}
+
+func (f *filterIterator) next(ctx context.Context) (*entry, error) {
+	for {
+		e, err := f.iterator.next(ctx)
+		if err != nil || e == nil {
+			return e, err
+		}
+		if f.keep(e.hash) {
+			return e, nil
+		}
+		f.removed++
+	}
+}
@@ -0,0 +1,368 @@
+package hashdb
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/zeebo/errs"
+
+	"github.com/jtolio/jam/manifest"
+	"github.com/jtolio/jam/utils"
+)
+
+// A run is a sorted, immutable set of hashes stored as two objects: the run
+// itself, which is a sequence of compressed blocks of hashes, and a small
+// index of where each block starts and a bloom filter of every hash. Only
+// the index is loaded up front. Blocks are read with range reads as needed.
+//
+// Runs are named by the time they were written, so that listing them in
+// order lists them from oldest to newest. When more than one run has a
+// hash, the newest one wins.
+const (
+	RunSuffix        = ".run"
+	RunIndexSuffix   = ".idx"
+	runVersionHeader = "jam-run-v0\n"
+
+	// blocks are cut after about this many bytes of uncompressed hashes
+	runBlockSize = 32 * 1024
+
+	bloomBitsPerHash = 10
+	bloomHashes      = 7
+)
+
+type run struct {
+	path  string
+	stamp int64
+	index *manifest.HashRunIndex
+}
+
+func runIndexPath(path string) string {
+	return strings.TrimSuffix(path, RunSuffix) + RunIndexSuffix
+}
+
+func runPath(indexPath string) string {
+	return strings.TrimSuffix(indexPath, RunIndexSuffix) + RunSuffix
+}
+
+func runStamp(path string) (int64, error) {
+	name := strings.TrimPrefix(path, HashPrefix)
+	dash := strings.IndexByte(name, '-')
+	if dash < 0 {
+		return 0, errs.New("invalid run name %q", path)
+	}
+	stamp, err := strconv.ParseInt(name[:dash], 10, 64)
+	if err != nil {
+		return 0, errs.New("invalid run name %q", path)
+	}
+	return stamp, nil
+}
+
+// nextRunPath returns a name for a new run that sorts after every run the
+// database knows about, even if the clock says otherwise.
+func (d *dbImpl) nextRunPath() string {
+	stamp := time.Now().UnixNano()
+	if stamp <= d.lastStamp {
+		stamp = d.lastStamp + 1
+	}
+	d.lastStamp = stamp
+	return fmt.Sprintf("%s%020d-%s%s", HashPrefix, stamp, utils.IdGen(), RunSuffix)
+}
+
+func (d *dbImpl) openRun(ctx context.Context, indexPath string) (*run, error) {
+	path := runPath(indexPath)
+	stamp, err := runStamp(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := d.backend.Get(ctx, indexPath, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	v := make([]byte, len(runVersionHeader))
+	_, err = io.ReadFull(rc, v)
+	if err != nil {
+		if err == io.EOF {
+			err = errs.New("unexpected EOF for run index %q", indexPath)
+		}
+		return nil, err
+	}
+	if runVersionHeader != string(v) {
+		return nil, errs.New("invalid run version for run index %q", indexPath)
+	}
+
+	r, err := zlib.NewReader(utils.NewUnframingReader(rc))
+	if err != nil {
+		return nil, errs.New("error for run index %q: %+v", indexPath, err)
+	}
+	defer r.Close()
+
+	var index manifest.HashRunIndex
+	err = utils.UnmarshalSized(r, &index)
+	if err != nil {
+		return nil, errs.New("error for run index %q: %+v", indexPath, err)
+	}
+
+	return &run{path: path, stamp: stamp, index: &index}, nil
+}
+
+func decodeBlock(data []byte, path string) (*manifest.HashSet, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, errs.New("error for run %q: %+v", path, err)
+	}
+	defer r.Close()
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, errs.New("error for run %q: %+v", path, err)
+	}
+	var set manifest.HashSet
+	err = proto.Unmarshal(raw, &set)
+	if err != nil {
+		return nil, errs.New("error for run %q: %+v", path, err)
+	}
+	return &set, nil
+}
+
+func (d *dbImpl) readBlock(ctx context.Context, r *run, i int) (*manifest.HashSet, error) {
+	if set := d.blocks.get(r.path, i); set != nil {
+		return set, nil
+	}
+	block := r.index.Blocks[i]
+	rc, err := d.backend.Get(ctx, r.path, block.Offset, block.Length)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data := make([]byte, block.Length)
+	_, err = io.ReadFull(rc, data)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	set, err := decodeBlock(data, r.path)
+	if err != nil {
+		return nil, err
+	}
+	d.blocks.put(r.path, i, set)
+	return set, nil
+}
+
+// lookupRun returns nil if the run doesn't have hash.
+func (d *dbImpl) lookupRun(ctx context.Context, r *run, hash string) (*manifest.Stream, error) {
+	if !bloomHas(r.index.Bloom, r.index.BloomHashes, hash) {
+		return nil, nil
+	}
+	blocks := r.index.Blocks
+	i := sort.Search(len(blocks), func(i int) bool { return string(blocks[i].First) > hash }) - 1
+	if i < 0 {
+		return nil, nil
+	}
+	set, err := d.readBlock(ctx, r, i)
+	if err != nil {
+		return nil, err
+	}
+	j := sort.Search(len(set.Hashes), func(j int) bool { return string(set.Hashes[j].Hash) >= hash })
+	if j < len(set.Hashes) && string(set.Hashes[j].Hash) == hash {
+		return set.Hashes[j].Data, nil
+	}
+	return nil, nil
+}
+
+// writeRun writes first and the hashes after it from it, which must be in
+// increasing order, as a new run of type typ, stopping after limit hashes if
+// limit is positive. expected is about how many hashes there will be and
+// sizes the bloom filter. next is the first hash that didn't fit, if any. If
+// there is none, the run is the last and supersedes what supersedes lists.
+func (d *dbImpl) writeRun(ctx context.Context, it iterator, first *entry, expected, limit int64,
+	typ manifest.HashRunIndex_Type, supersedes []string) (r *run, next *entry, err error) {
+	if limit > 0 && expected > limit {
+		expected = limit
+	}
+
+	path := d.nextRunPath()
+	index := &manifest.HashRunIndex{
+		Bloom:       newBloom(expected),
+		BloomHashes: bloomHashes,
+		Type:        typ,
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		next, err = writeBlocks(ctx, pw, it, first, index, limit)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	err = d.backend.Put(ctx, path, pr)
+	pr.CloseWithError(errs.New("run upload stopped"))
+	err = errs.Combine(err, <-done)
+	if err != nil {
+		return nil, nil, err
+	}
+	if next == nil {
+		index.Supersedes = supersedes
+	}
+
+	data, err := utils.MarshalSized(index)
+	if err != nil {
+		return nil, nil, err
+	}
+	var out bytes.Buffer
+	compressor := zlib.NewWriter(&out)
+	_, err = compressor.Write(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = compressor.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	// the index is written last, so that a run without an index is never
+	// used.
+	err = d.backend.Put(ctx, runIndexPath(path), io.MultiReader(
+		bytes.NewReader([]byte(runVersionHeader)),
+		utils.NewFramingReader(&out)))
+	if err != nil {
+		return nil, nil, err
+	}
+	d.listed[path] = true
+	d.listed[runIndexPath(path)] = true
+
+	stamp, err := runStamp(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &run{path: path, stamp: stamp, index: index}, next, nil
+}
+
+// writeBlocks writes e and what follows it from it until it runs out or
+// limit is reached, returning the next hash in the latter case. e may be
+// nil for an empty run.
+func writeBlocks(ctx context.Context, w io.Writer, it iterator, e *entry,
+	index *manifest.HashRunIndex, limit int64) (next *entry, err error) {
+	_, err = w.Write([]byte(runVersionHeader))
+	if err != nil {
+		return nil, err
+	}
+	offset := int64(len(runVersionHeader))
+
+	var set manifest.HashSet
+	var size int
+	writeBlock := func() error {
+		raw, err := proto.Marshal(&set)
+		if err != nil {
+			return err
+		}
+		var out bytes.Buffer
+		compressor := zlib.NewWriter(&out)
+		_, err = compressor.Write(raw)
+		if err != nil {
+			return err
+		}
+		err = compressor.Close()
+		if err != nil {
+			return err
+		}
+		index.Blocks = append(index.Blocks, &manifest.HashRunBlock{
+			First:  set.Hashes[0].Hash,
+			Offset: offset,
+			Length: int64(out.Len()),
+		})
+		offset += int64(out.Len())
+		_, err = w.Write(out.Bytes())
+		set.Hashes, size = nil, 0
+		return err
+	}
+
+	for e != nil {
+		if limit > 0 && index.Count >= limit {
+			next = e
+			break
+		}
+		hashed := &manifest.HashedData{Hash: []byte(e.hash), Data: e.data}
+		set.Hashes = append(set.Hashes, hashed)
+		size += proto.Size(hashed)
+		bloomAdd(index.Bloom, index.BloomHashes, e.hash)
+		index.Count++
+
+		if size >= runBlockSize {
+			err = writeBlock()
+			if err != nil {
+				return nil, err
+			}
+		}
+		e, err = it.next(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(set.Hashes) > 0 {
+		return next, writeBlock()
+	}
+	return next, nil
+}
+
+// runIterator reads a whole run in order with one request.
+type runIterator struct {
+	d   *dbImpl
+	r   *run
+	rc  io.ReadCloser
+	pos int64
+	blk int
+	set []*manifest.HashedData
+}
+
+func (it *runIterator) next(ctx context.Context) (*entry, error) {
+	for len(it.set) == 0 {
+		blocks := it.r.index.Blocks
+		if it.blk >= len(blocks) {
+			return nil, it.close()
+		}
+		block := blocks[it.blk]
+		it.blk++
+		if it.rc == nil {
+			rc, err := it.d.backend.Get(ctx, it.r.path, block.Offset, -1)
+			if err != nil {
+				return nil, err
+			}
+			it.rc, it.pos = rc, block.Offset
+		}
+		if block.Offset != it.pos {
+			return nil, errs.New("run %q has overlapping blocks", it.r.path)
+		}
+		data := make([]byte, block.Length)
+		_, err := io.ReadFull(it.rc, data)
+		if err != nil {
+			return nil, errs.Wrap(err)
+		}
+		it.pos += block.Length
+		set, err := decodeBlock(data, it.r.path)
+		if err != nil {
+			return nil, err
+		}
+		it.set = set.Hashes
+	}
+	hashed := it.set[0]
+	it.set = it.set[1:]
+	return &entry{hash: string(hashed.Hash), data: hashed.Data, source: it.r.path}, nil
+}
+
+func (it *runIterator) close() error {
+	if it.rc == nil {
+		return nil
+	}
+	rc := it.rc
+	it.rc = nil
+	return rc.Close()
+}
@@ -9,6 +9,7 @@ import (
 	"os"
 	"os/user"
 	"path/filepath"
+	"runtime/debug"
 	"strconv"
 	"strings"
 	"time"
@@ -20,6 +21,9 @@ import (
 	"github.com/jtolio/jam/cache"
 	"github.com/jtolio/jam/enc"
 	"github.com/jtolio/jam/hashdb"
+	"github.com/jtolio/jam/locks"
+	"github.com/jtolio/jam/manifest"
+	"github.com/jtolio/jam/pathdb"
 	"github.com/jtolio/jam/session"
 )
 
@@ -44,14 +48,31 @@ var (
 	sysFlagBlobSize = sysFlags.Int64("blobs.size", 60*1024*1024,
 		"target blob size")
 	sysFlagMaxUnflushed = sysFlags.Int("blobs.max-unflushed", 1000,
-		"max number of objects to stage\n\tbefore flushing (must fit file\n\tdescriptor limit)")
+		"max number of objects to stage\n\tbefore flushing (must fit file\n\tdescriptor limit unless staging)")
+	sysFlagCompression = sysFlags.String("compression", "zlib",
+		"how to compress new file data,\n\teither zlib or none")
+	sysFlagCompressionSkip = sysFlags.String("compression.skip", "default",
+		"comma-separated extensions of\n\tfiles to store uncompressed.\n\t"+
+			"default means common already\n\tcompressed formats")
+	sysFlagBlobUploads = sysFlags.Int("blobs.uploads", 2,
+		"how many blobs to upload at once.\n\tmore than one buffers each in\n\tmemory unless staging")
+	sysFlagBlobStaging = sysFlags.String("blobs.staging", "",
+		"if set, a local directory to copy\n\tfile data and blobs into before\n\tuploading")
 	sysFlagCache = sysFlags.String("cache",
 		(&url.URL{Scheme: "file", Path: filepath.Join(homeDir(), ".jam", "cache")}).String(),
 		"where to cache things that are\n\tfrequently read")
 	sysFlagCacheEnabled      = sysFlags.Bool("cache.enabled", true, "if false, disable caching")
 	sysFlagCacheBlobsEnabled = sysFlags.Bool("cache.blobs", false, "if true and caching is enabled, cache blobs")
+	sysFlagLockWait          = sysFlags.Duration("lock.wait", 0,
+		"how long to wait for conflicting\n\tlocks held by other processes")
+	sysFlagMergeConflicts = sysFlags.String("merge.conflicts", "fail",
+		"how to resolve paths changed both\n\tby a command and by a snapshot\n\tcommitted while it ran. fail,\n\t"+
+			"newer (keep the most recently\n\tmodified) or both (keep the\n\tother under a new name)")
 )
 
+// noLock is for getManager callers that don't need a lock.
+const noLock locks.Kind = ""
+
 func homeDir() string {
 	u, err := user.Current()
 	if err != nil {
@@ -65,9 +86,91 @@ func homeDir() string {
 
 func help(ctx context.Context, args []string) error { return flag.ErrHelp }
 
-func getManager(ctx context.Context) (mgr *session.Manager, backend backends.Backend, hashes hashdb.DB, close func() error, err error) {
+// version is recorded with every snapshot. It can be set with
+// -ldflags "-X main.version=...", and otherwise comes from the module
+// version jam was built from.
+var version = ""
+
+func jamVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		return info.Main.Version
+	}
+	return "unknown"
+}
+
+// snapshotHeader returns a header for a snapshot made on this system by the
+// current user.
+func snapshotHeader() *manifest.SnapshotHeader {
+	header := &manifest.SnapshotHeader{Version: jamVersion()}
+	if hostname, err := os.Hostname(); err == nil {
+		header.Hostname = hostname
+	}
+	if u, err := user.Current(); err == nil {
+		header.User = u.Username
+	}
+	return header
+}
+
+// mergePolicy returns how commits resolve paths changed concurrently.
+func mergePolicy() (pathdb.MergePolicy, error) {
+	return pathdb.ParseMergePolicy(*sysFlagMergeConflicts)
+}
+
+// lockInfo says who is acquiring a lock.
+func lockInfo() *manifest.LockInfo {
+	info := &manifest.LockInfo{Pid: int64(os.Getpid()), Command: commandName}
+	if hostname, err := os.Hostname(); err == nil {
+		info.Hostname = hostname
+	}
+	if u, err := user.Current(); err == nil {
+		info.User = u.Username
+	}
+	return info
+}
+
+// getManager opens the configured store, holding a lock of the given kind
+// on it until close is called.
+func getManager(ctx context.Context, lockKind locks.Kind) (mgr *session.Manager, backend backends.Backend, hashes hashdb.DB, close func() error, err error) {
+	compression, err := compressionPolicy()
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	if *sysFlagBlobStaging != "" {
+		err = os.MkdirAll(*sysFlagBlobStaging, 0700)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+	}
+
+	store, storeClose, err := getBackend(ctx, lockKind)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	hashes = hashdb.AsyncHashDB(ctx, func(ctx context.Context) (hashdb.DB, error) {
+		return hashdb.Open(ctx, store)
+	})
+	blobs := getBlobStore(store)
+	return session.NewManager(store, blobs, hashes, compression), store, hashes,
+		func() error {
+			return errs.Combine(blobs.Close(), hashes.Close(), storeClose())
+		}, nil
+}
+
+func getBlobStore(store backends.Backend) *blobs.Store {
+	return blobs.NewStore(store, *sysFlagBlobSize, *sysFlagMaxUnflushed, *sysFlagBlobUploads,
+		*sysFlagBlobStaging)
+}
+
+// getBackend opens the configured, encrypted backend and acquires a lock of
+// lockKind on it, without loading anything stored in it.
+func getBackend(ctx context.Context, lockKind locks.Kind) (backend backends.Backend, close func() error, err error) {
 	if *sysFlagEncKey == "" {
-		return nil, nil, nil, nil, fmt.Errorf("invalid configuration, no root encryption key specified")
+		return nil, nil, fmt.Errorf("invalid configuration, no root encryption key specified")
 	}
 
 	input := bufio.NewReader(os.Stdin)
@@ -83,11 +186,11 @@ func getManager(ctx context.Context) (mgr *session.Manager, backend backends.Bac
 	for _, storeurl := range strings.Split(*sysFlagStore, ",") {
 		u, err := url.Parse(storeurl)
 		if err != nil {
-			return nil, nil, nil, nil, err
+			return nil, nil, err
 		}
 		store, err := backends.Create(ctx, u)
 		if err != nil {
-			return nil, nil, nil, nil, err
+			return nil, nil, err
 		}
 		stores = append(stores, store)
 	}
@@ -110,17 +213,17 @@ func getManager(ctx context.Context) (mgr *session.Manager, backend backends.Bac
 	if *sysFlagCacheEnabled {
 		cacheURL, err := url.Parse(*sysFlagCache)
 		if err != nil {
-			return nil, nil, nil, nil, err
+			return nil, nil, err
 		}
 		cacheStore, err := backends.Create(ctx, cacheURL)
 		if err != nil {
-			return nil, nil, nil, nil, err
+			return nil, nil, err
 		}
 
 		wrappedStore, err := cache.New(ctx, store, cacheStore, *sysFlagCacheBlobsEnabled)
 		if err != nil {
 			cacheStore.Close()
-			return nil, nil, nil, nil, err
+			return nil, nil, err
 		}
 		// only set store (cleaned up by defer) if err == nil
 		store = wrappedStore
@@ -128,21 +231,43 @@ func getManager(ctx context.Context) (mgr *session.Manager, backend backends.Bac
 
 	encKey, err := parseKey(os.Stdout, input, *sysFlagEncKey)
 	if err != nil {
-		return nil, nil, nil, nil, err
+		return nil, nil, err
 	}
 
 	codecMap := enc.NewCodecMap(enc.NewSecretboxCodec(*sysFlagBlockSizeDefault))
 	codecMap.Register(hashdb.SmallHashsetSuffix,
 		enc.NewSecretboxCodec(*sysFlagBlockSizeSmall))
 	store = enc.NewEncWrapper(codecMap, enc.NewHMACKeyGenerator(encKey), store)
-	hashes = hashdb.AsyncHashDB(ctx, func(ctx context.Context) (hashdb.DB, error) {
-		return hashdb.Open(ctx, store)
-	})
-	blobs := blobs.NewStore(store, *sysFlagBlobSize, *sysFlagMaxUnflushed)
-	return session.NewManager(store, blobs, hashes), store, hashes,
-		func() error {
-			return errs.Combine(blobs.Close(), hashes.Close(), store.Close())
-		}, nil
+
+	if lockKind == noLock {
+		return store, store.Close, nil
+	}
+	lock, err := locks.Acquire(ctx, store, lockKind, lockInfo(), *sysFlagLockWait)
+	if err != nil {
+		return nil, nil, err
+	}
+	// operations fail if the lock is lost, since maintenance may then run.
+	return lock.Guard(store), func() error {
+		return errs.Combine(lock.Release(), store.Close())
+	}, nil
+}
+
+func compressionPolicy() (session.CompressionPolicy, error) {
+	compression, ok := manifest.Range_Compression_value[strings.ToUpper(*sysFlagCompression)]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression: %q", *sysFlagCompression)
+	}
+	var skip []string
+	for _, ext := range strings.Split(*sysFlagCompressionSkip, ",") {
+		switch ext = strings.TrimSpace(ext); ext {
+		case "":
+		case "default":
+			skip = append(skip, session.DefaultIncompressible...)
+		default:
+			skip = append(skip, ext)
+		}
+	}
+	return session.ExtensionPolicy(manifest.Range_Compression(compression), skip), nil
 }
 
 func getReadSnapshot(ctx context.Context, mgr *session.Manager, snapshotFlag string) (*session.Snapshot, time.Time, error) {
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"github.com/zeebo/errs"
+
+	"github.com/jtolio/jam/locks"
+	"github.com/jtolio/jam/manifest"
+	"github.com/jtolio/jam/session"
+)
+
+var (
+	historyFlags = flag.NewFlagSet("", flag.ExitOnError)
+	cmdHistory   = &ffcli.Command{
+		Name:       "history",
+		ShortHelp:  "history lists every snapshot where a path changed",
+		ShortUsage: fmt.Sprintf("%s [opts] history <path>", os.Args[0]),
+		FlagSet:    historyFlags,
+		Exec:       History,
+	}
+)
+
+type historyEntry struct {
+	timestamp time.Time
+	status    string
+	content   *manifest.Content
+}
+
+func History(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return flag.ErrHelp
+	}
+	path := args[0]
+
+	mgr, _, _, mgrClose, err := getManager(ctx, locks.Shared)
+	if err != nil {
+		return err
+	}
+	defer mgrClose()
+
+	var timestamps []time.Time
+	err = mgr.ListSnapshots(ctx, func(ctx context.Context, timestamp time.Time) error {
+		timestamps = append(timestamps, timestamp)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// walk from oldest to newest so each snapshot is compared to the one
+	// before it.
+	var entries []historyEntry
+	var last *manifest.Content
+	for i := len(timestamps) - 1; i >= 0; i-- {
+		content, err := lookupIn(ctx, mgr, timestamps[i], path)
+		if err != nil {
+			return err
+		}
+		status := historyStatus(last, content)
+		last = content
+		if status != "" {
+			entries = append(entries, historyEntry{timestamp: timestamps[i], status: status, content: content})
+		}
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("%q is not in any snapshot", path)
+	}
+
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		fmt.Printf("%v: %v %s", entry.timestamp.UnixNano(),
+			entry.timestamp.Local().Format("2006-01-02 03:04:05 pm"), entry.status)
+		if entry.content != nil {
+			meta := entry.content.GetMetadata()
+			fmt.Printf(", %s", byteFmt(meta.GetSize()))
+			if modified, err := ptypes.Timestamp(meta.GetModified()); err == nil {
+				fmt.Printf(", modified %v", modified.Local().Format("2006-01-02 03:04:05 pm"))
+			}
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+func lookupIn(ctx context.Context, mgr *session.Manager, timestamp time.Time, path string) (
+	content *manifest.Content, err error) {
+	snap, err := mgr.OpenSnapshot(ctx, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = errs.Combine(err, snap.Close())
+	}()
+	return snap.Lookup(ctx, path)
+}
+
+// historyStatus describes how a path went from before to after, or returns
+// "" if it did not change.
+func historyStatus(before, after *manifest.Content) string {
+	switch {
+	case before == nil && after == nil:
+		return ""
+	case before == nil:
+		return "added"
+	case after == nil:
+		return "removed"
+	case !bytes.Equal(before.GetHash(), after.GetHash()):
+		return "changed"
+	case !proto.Equal(before.GetMetadata(), after.GetMetadata()):
+		return "metadata changed"
+	}
+	return ""
+}
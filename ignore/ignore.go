@@ -0,0 +1,142 @@
+// Package ignore implements gitignore-style path patterns.
+package ignore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+type rule struct {
+	base     string
+	segments []string
+	negate   bool
+	dirOnly  bool
+}
+
+// Rules is an ordered list of gitignore-style patterns. When more than one
+// pattern matches a path, the last one added wins.
+//
+// Paths are slash-separated and relative to some root. Like with git, a path
+// inside of an excluded directory can't be included again, so callers should
+// check directories before descending into them.
+type Rules struct {
+	rules []rule
+}
+
+// Add adds a pattern. base is the directory the pattern is relative to, with
+// "" meaning the root. Blank patterns and comments (starting with '#') are
+// ignored.
+//
+// Patterns are matched against path segments with path.Match. A leading '!'
+// negates the pattern, and a trailing '/' only matches directories. A pattern
+// without a '/' other than a trailing one matches at any depth below base,
+// otherwise it is anchored to base. A "**" segment matches any number of
+// directories.
+func (r *Rules) Add(base, pattern string) error {
+	pattern = strings.TrimRight(pattern, " \t\r")
+	if pattern == "" || strings.HasPrefix(pattern, "#") {
+		return nil
+	}
+	original := pattern
+	var ru rule
+	ru.base = strings.Trim(base, "/")
+	if strings.HasPrefix(pattern, "!") {
+		ru.negate = true
+		pattern = pattern[1:]
+	} else if strings.HasPrefix(pattern, `\!`) || strings.HasPrefix(pattern, `\#`) {
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		ru.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+	if pattern == "" {
+		return fmt.Errorf("invalid pattern: %q", original)
+	}
+	ru.segments = strings.Split(pattern, "/")
+	if !anchored {
+		ru.segments = append([]string{"**"}, ru.segments...)
+	}
+	for _, segment := range ru.segments {
+		if _, err := path.Match(segment, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", original, err)
+		}
+	}
+	r.rules = append(r.rules, ru)
+	return nil
+}
+
+// AddFrom adds a pattern per line of data, such as the contents of a
+// .gitignore file.
+func (r *Rules) AddFrom(base string, data io.Reader) error {
+	scanner := bufio.NewScanner(data)
+	for scanner.Scan() {
+		err := r.Add(base, scanner.Text())
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Match checks p against the rules. matched is false if no rule matched,
+// otherwise excluded says whether the last matching rule excludes p.
+func (r *Rules) Match(p string, isDir bool) (matched, excluded bool) {
+	p = strings.Trim(p, "/")
+	for i := len(r.rules) - 1; i >= 0; i-- {
+		ru := &r.rules[i]
+		if ru.dirOnly && !isDir {
+			continue
+		}
+		rel := p
+		if ru.base != "" {
+			if !strings.HasPrefix(p, ru.base+"/") {
+				continue
+			}
+			rel = p[len(ru.base)+1:]
+		}
+		if matchSegments(ru.segments, strings.Split(rel, "/")) {
+			return true, !ru.negate
+		}
+	}
+	return false, false
+}
+
+// Excluded is a convenience wrapper around Match.
+func (r *Rules) Excluded(p string, isDir bool) bool {
+	_, excluded := r.Match(p, isDir)
+	return excluded
+}
+
+func matchSegments(pattern, parts []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			rest := pattern[1:]
+			if len(rest) == 0 {
+				// a trailing "**" matches everything inside, but not the
+				// directory itself.
+				return len(parts) > 0
+			}
+			for i := 0; i <= len(parts); i++ {
+				if matchSegments(rest, parts[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(parts) == 0 {
+			return false
+		}
+		ok, err := path.Match(pattern[0], parts[0])
+		if err != nil || !ok {
+			return false
+		}
+		pattern, parts = pattern[1:], parts[1:]
+	}
+	return len(parts) == 0
+}
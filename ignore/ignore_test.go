@@ -0,0 +1,77 @@
+package ignore
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRules(t *testing.T) {
+	var r Rules
+	require.NoError(t, r.AddFrom("", strings.NewReader(`
+# comment
+*.tmp
+!keep.tmp
+**/node_modules
+build/
+/top
+docs/**/*.pdf
+logs/**
+`)))
+
+	for _, tc := range []struct {
+		path     string
+		isDir    bool
+		excluded bool
+	}{
+		{"a.tmp", false, true},
+		{"x/y/a.tmp", false, true},
+		{"keep.tmp", false, false},
+		{"x/keep.tmp", false, false},
+		{"node_modules", true, true},
+		{"a/b/node_modules", true, true},
+		{"build", true, true},
+		{"x/build", true, true},
+		{"build", false, false},
+		{"top", false, true},
+		{"x/top", false, false},
+		{"docs/a.pdf", false, true},
+		{"docs/a/b/c.pdf", false, true},
+		{"x/docs/a.pdf", false, false},
+		{"logs", true, false},
+		{"logs/a/b", false, true},
+		{"a.txt", false, false},
+		{"# comment", false, false},
+	} {
+		require.Equal(t, tc.excluded, r.Excluded(tc.path, tc.isDir), tc.path)
+	}
+}
+
+func TestRulesBase(t *testing.T) {
+	var r Rules
+	require.NoError(t, r.Add("", "*.log"))
+	require.NoError(t, r.Add("sub", "!important.log"))
+	require.NoError(t, r.Add("sub", "/cache"))
+
+	require.True(t, r.Excluded("important.log", false))
+	require.False(t, r.Excluded("sub/important.log", false))
+	require.False(t, r.Excluded("sub/x/important.log", false))
+	require.True(t, r.Excluded("sub/other.log", false))
+	require.True(t, r.Excluded("sub/cache", true))
+	require.False(t, r.Excluded("sub/x/cache", true))
+	require.False(t, r.Excluded("cache", true))
+
+	matched, _ := r.Match("readme", false)
+	require.False(t, matched)
+}
+
+func TestRulesInvalid(t *testing.T) {
+	var r Rules
+	require.Error(t, r.Add("", "[a-"))
+	require.Error(t, r.Add("", "/"))
+	require.NoError(t, r.Add("", `\#hash`))
+	require.NoError(t, r.Add("", `\!bang`))
+	require.True(t, r.Excluded("#hash", false))
+	require.True(t, r.Excluded("!bang", false))
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/peterbourgon/ff/v3/ffcli"
 
+	"github.com/jtolio/jam/locks"
 	"github.com/jtolio/jam/manifest"
 	"github.com/jtolio/jam/session"
 	"github.com/jtolio/jam/streams"
@@ -38,7 +39,7 @@ func Integrity(ctx context.Context, args []string) error {
 
 	utils.L(ctx).Debugf("loading backend and hash db")
 
-	mgr, backend, hashes, mgrClose, err := getManager(ctx)
+	mgr, backend, hashes, mgrClose, err := getManager(ctx, locks.Shared)
 	if err != nil {
 		return err
 	}
@@ -48,6 +49,7 @@ func Integrity(ctx context.Context, args []string) error {
 	blobLastRange := map[string]*manifest.Range{}
 	missing := map[string]bool{}
 	bad := map[string]bool{}
+	pages := map[string]bool{}
 
 	utils.L(ctx).Debugf("confirming that a blob exists for every hash")
 
@@ -61,6 +63,9 @@ func Integrity(ctx context.Context, args []string) error {
 	}
 	err = hashes.Iterate(ctx, func(ctx context.Context, hash, hashset string, stream *manifest.Stream) error {
 		for _, r := range stream.Ranges {
+			if r.Hole {
+				continue
+			}
 			blobPath := streams.BlobPath(r.Blob())
 			if lastRange, exists := blobLastRange[blobPath]; r.Length > 0 && (!exists || lastRange.Offset < r.Offset) {
 				blobLastRange[blobPath] = r
@@ -84,14 +89,6 @@ func Integrity(ctx context.Context, args []string) error {
 
 	utils.L(ctx).Debugf("no dangling hashes")
 
-	if *integrityFlagShowUnneeded {
-		for path := range blobs {
-			if _, exists := blobLastRange[path]; !exists {
-				fmt.Printf("blob unnecessary: %s\n", path)
-			}
-		}
-	}
-
 	if !*integrityFlagSkipSnaps {
 		utils.L(ctx).Debugf("making sure a hash for every listed path in every snapshot exists")
 
@@ -106,7 +103,7 @@ func Integrity(ctx context.Context, args []string) error {
 				return err
 			}
 			defer snap.Close()
-			return snap.List(ctx, "", true, func(ctx context.Context, entry *session.ListEntry) error {
+			err = snap.List(ctx, "", true, func(ctx context.Context, entry *session.ListEntry) error {
 				if entry.Meta.Type != manifest.Metadata_FILE {
 					return nil
 				}
@@ -116,6 +113,17 @@ func Integrity(ctx context.Context, args []string) error {
 				}
 				return stream.Close()
 			})
+			if err != nil {
+				return err
+			}
+			return snap.References(ctx, nil,
+				func(ctx context.Context, hash string) error { return nil },
+				func(ctx context.Context, data *manifest.Stream) error {
+					for _, r := range data.Ranges {
+						pages[streams.BlobPath(r.Blob())] = true
+					}
+					return nil
+				})
 		})
 		if err != nil {
 			return err
@@ -124,6 +132,16 @@ func Integrity(ctx context.Context, args []string) error {
 		utils.L(ctx).Debugf("no dangling paths")
 	}
 
+	// blobs with manifest pages are only known about if the snapshots were
+	// checked.
+	if *integrityFlagShowUnneeded {
+		for path := range blobs {
+			if _, exists := blobLastRange[path]; !exists && !pages[path] {
+				fmt.Printf("blob unnecessary: %s\n", path)
+			}
+		}
+	}
+
 	// check to make sure none of the blobs are truncated
 	if !*integrityFlagSkipBlobEnd {
 		utils.L(ctx).Debugf("checking to make sure the last byte of each blob is readable")
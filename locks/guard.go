@@ -0,0 +1,94 @@
+package locks
+
+import (
+	"context"
+	"io"
+
+	"github.com/jtolio/jam/backends"
+)
+
+// Guard returns a backend that fails every operation once the lock is lost,
+// canceling the writes, deletes and lists already running. Without the
+// lock, other processes may be changing the backend in ways that conflict.
+func (l *Lock) Guard(backend backends.Backend) backends.Backend {
+	return &guarded{lock: l, backend: backend}
+}
+
+type guarded struct {
+	lock    *Lock
+	backend backends.Backend
+}
+
+// bind returns a context that is also canceled when the lock is lost.
+func (g *guarded) bind(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-g.lock.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// check returns the lock's error in place of err, if the lock was lost.
+func (g *guarded) check(err error) error {
+	if lost := g.lock.Err(); lost != nil {
+		return lost
+	}
+	return err
+}
+
+func (g *guarded) Get(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error) {
+	// the returned reader may need ctx after Get returns, so Get is only
+	// refused once the lock is lost.
+	if err := g.check(nil); err != nil {
+		return nil, err
+	}
+	return g.backend.Get(ctx, path, offset, length)
+}
+
+func (g *guarded) Put(ctx context.Context, path string, data io.Reader) error {
+	if err := g.check(nil); err != nil {
+		return err
+	}
+	ctx, cancel := g.bind(ctx)
+	defer cancel()
+	err := g.backend.Put(ctx, path, data)
+	if err != nil {
+		return g.check(err)
+	}
+	return nil
+}
+
+func (g *guarded) Delete(ctx context.Context, path string) error {
+	if err := g.check(nil); err != nil {
+		return err
+	}
+	ctx, cancel := g.bind(ctx)
+	defer cancel()
+	err := g.backend.Delete(ctx, path)
+	if err != nil {
+		return g.check(err)
+	}
+	return nil
+}
+
+func (g *guarded) List(ctx context.Context, prefix string,
+	cb func(ctx context.Context, path string) error) error {
+	if err := g.check(nil); err != nil {
+		return err
+	}
+	ctx, cancel := g.bind(ctx)
+	defer cancel()
+	err := g.backend.List(ctx, prefix, cb)
+	if err != nil {
+		return g.check(err)
+	}
+	return nil
+}
+
+func (g *guarded) Close() error {
+	return g.backend.Close()
+}
@@ -0,0 +1,351 @@
+// Package locks keeps writers and maintenance operations from getting in
+// each other's way, using nothing but the objects a backend stores.
+//
+// A lock is an object named by its kind, when it was last refreshed and a
+// random id. Acquiring a lock puts its object first and then lists every
+// lock, backing off if a conflicting lock is held. Since every process puts
+// before it lists, of two processes acquiring conflicting locks at the same
+// time at least one sees the other. Objects can't be changed, so a held
+// lock is refreshed by putting a new object with the same id and deleting
+// the old one. A lock that hasn't been refreshed for StaleAfter is assumed
+// to belong to a process that died, and is ignored, so a process that can't
+// refresh its lock for LostAfter gives it up and stops using the backend.
+package locks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/zeebo/errs"
+
+	"github.com/jtolio/jam/backends"
+	"github.com/jtolio/jam/manifest"
+	"github.com/jtolio/jam/utils"
+)
+
+const (
+	Prefix = "locks/"
+
+	// StaleAfter is how long a lock is considered held without being
+	// refreshed. The clocks of systems sharing a backend have to agree to
+	// well within it.
+	StaleAfter = 30 * time.Minute
+	// RefreshInterval is how often held locks are refreshed.
+	RefreshInterval = 5 * time.Minute
+	// LostAfter is how long a held lock can go without being refreshed
+	// before it is considered lost, leaving a margin before others consider
+	// it stale.
+	LostAfter = StaleAfter - 2*RefreshInterval
+	// RetryInterval is about how long to wait before trying to acquire a
+	// lock again.
+	RetryInterval = 5 * time.Second
+)
+
+// Kind is the kind of a lock. Any number of shared locks can be held at
+// once, but an exclusive lock is only held alone.
+type Kind string
+
+const (
+	Shared    Kind = "shared"
+	Exclusive Kind = "exclusive"
+)
+
+var (
+	// ErrLocked is returned when a conflicting lock is held.
+	ErrLocked = errs.Class("locked")
+	// ErrLost is returned when a held lock couldn't be refreshed in time.
+	ErrLost = errs.Class("lock lost")
+)
+
+// these are variables so that tests can shorten them.
+var (
+	refreshInterval      = RefreshInterval
+	refreshRetryInterval = RetryInterval
+	lostAfter            = LostAfter
+)
+
+// Held describes a lock object.
+type Held struct {
+	Path      string
+	Kind      Kind
+	ID        string
+	Refreshed time.Time
+	Stale     bool
+}
+
+func lockPath(kind Kind, refreshed time.Time, id string) string {
+	return fmt.Sprintf("%s%s-%020d-%s", Prefix, kind, refreshed.UnixNano(), id)
+}
+
+func parsePath(path string, now time.Time) (*Held, error) {
+	parts := strings.SplitN(strings.TrimPrefix(path, Prefix), "-", 3)
+	if len(parts) != 3 || (Kind(parts[0]) != Shared && Kind(parts[0]) != Exclusive) {
+		return nil, errs.New("invalid lock name %q", path)
+	}
+	nanos, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, errs.New("invalid lock name %q", path)
+	}
+	refreshed := time.Unix(0, nanos)
+	return &Held{
+		Path:      path,
+		Kind:      Kind(parts[0]),
+		ID:        parts[2],
+		Refreshed: refreshed,
+		Stale:     now.Sub(refreshed) > StaleAfter,
+	}, nil
+}
+
+// List returns every lock object, oldest first.
+func List(ctx context.Context, backend backends.Backend) (locks []*Held, err error) {
+	now := time.Now()
+	err = backend.List(ctx, Prefix, func(ctx context.Context, path string) error {
+		held, err := parsePath(path, now)
+		if err != nil {
+			utils.L(ctx).Urgentf("skipping %v", err)
+			return nil
+		}
+		locks = append(locks, held)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(locks, func(i, j int) bool { return locks[i].Refreshed.Before(locks[j].Refreshed) })
+	return locks, nil
+}
+
+// Info reads who holds a lock.
+func Info(ctx context.Context, backend backends.Backend, held *Held) (*manifest.LockInfo, error) {
+	rc, err := backend.Get(ctx, held.Path, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	var info manifest.LockInfo
+	err = utils.UnmarshalSized(rc, &info)
+	if err != nil {
+		return nil, errs.New("invalid lock %q: %v", held.Path, err)
+	}
+	return &info, nil
+}
+
+// Lock is a held lock, which is refreshed until it is released.
+type Lock struct {
+	backend backends.Backend
+	kind    Kind
+	id      string
+	data    []byte
+	ctx     context.Context
+	cancel  func()
+
+	mtx       sync.Mutex
+	path      string
+	refreshed time.Time
+	leftover  []string
+	lost      error
+	stop      chan struct{}
+	stopped   chan struct{}
+	released  bool
+}
+
+// Acquire acquires a lock of the given kind, waiting up to wait for
+// conflicting locks to go away. info says who is acquiring it.
+func Acquire(ctx context.Context, backend backends.Backend, kind Kind, info *manifest.LockInfo,
+	wait time.Duration) (*Lock, error) {
+	info = proto.Clone(info).(*manifest.LockInfo)
+	info.Acquired = time.Now().UnixNano()
+	data, err := utils.MarshalSized(info)
+	if err != nil {
+		return nil, err
+	}
+	l := &Lock{
+		backend: backend,
+		kind:    kind,
+		id:      utils.IdGen(),
+		data:    data,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		conflicts, err := l.try(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(conflicts) == 0 {
+			break
+		}
+		if !time.Now().Before(deadline) {
+			return nil, l.lockedError(ctx, conflicts)
+		}
+		utils.L(ctx).Normalf("waiting for %d conflicting locks", len(conflicts))
+		// the jitter keeps two processes that keep seeing each other's locks
+		// from retrying in step forever.
+		delay := RetryInterval/2 + time.Duration(rand.Int63n(int64(RetryInterval)))
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+
+	l.ctx, l.cancel = context.WithCancel(ctx)
+	go l.refresh(l.ctx)
+	return l, nil
+}
+
+// Context returns a context that is canceled once the lock is lost or
+// released.
+func (l *Lock) Context() context.Context { return l.ctx }
+
+// Err returns an ErrLost error once the lock is lost, and nil before.
+func (l *Lock) Err() error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.lost
+}
+
+// try puts the lock's object and returns the locks that conflict with it.
+// If there are any, the object is deleted again.
+func (l *Lock) try(ctx context.Context) (conflicts []*Held, err error) {
+	now := time.Now()
+	path := lockPath(l.kind, now, l.id)
+	err = l.backend.Put(ctx, path, bytes.NewReader(l.data))
+	if err != nil {
+		return nil, err
+	}
+	locks, err := List(ctx, l.backend)
+	if err != nil {
+		return nil, errs.Combine(err, l.backend.Delete(ctx, path))
+	}
+	for _, held := range locks {
+		if held.ID == l.id || held.Stale {
+			continue
+		}
+		if l.kind == Exclusive || held.Kind == Exclusive {
+			conflicts = append(conflicts, held)
+		}
+	}
+	if len(conflicts) > 0 {
+		return conflicts, l.backend.Delete(ctx, path)
+	}
+	l.path = path
+	l.refreshed = now
+	return nil, nil
+}
+
+func (l *Lock) lockedError(ctx context.Context, conflicts []*Held) error {
+	var holders []string
+	for _, held := range conflicts {
+		holder := fmt.Sprintf("%s lock %s", held.Kind, held.ID)
+		if info, err := Info(ctx, l.backend, held); err == nil {
+			holder += fmt.Sprintf(" held by %q (pid %d on %s, as %s) since %v",
+				info.Command, info.Pid, info.Hostname, info.User,
+				time.Unix(0, info.Acquired).Local().Format("2006-01-02 15:04:05"))
+		}
+		holders = append(holders, holder)
+	}
+	return ErrLocked.New("can't acquire %s lock while others are held: %s. "+
+		"if they belong to processes that are gone, see jam utils unlock",
+		l.kind, strings.Join(holders, "; "))
+}
+
+// refresh refreshes the lock every refreshInterval, retrying failures more
+// often, until it is released. If the lock goes lostAfter without being
+// refreshed, others may soon take it to be stale, so it is given up.
+func (l *Lock) refresh(ctx context.Context) {
+	defer close(l.stopped)
+	wait := refreshInterval
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		l.mtx.Lock()
+		err := l.refreshLocked(ctx)
+		if err != nil && time.Since(l.refreshed) >= lostAfter {
+			l.lost = ErrLost.New("%s lock not refreshed since %v: %v", l.kind,
+				l.refreshed.Local().Format("2006-01-02 15:04:05"), err)
+			err = l.lost
+		}
+		lost := l.lost
+		l.mtx.Unlock()
+
+		if lost != nil {
+			utils.L(ctx).Urgentf("%v", lost)
+			l.cancel()
+			return
+		}
+		if err != nil {
+			utils.L(ctx).Urgentf("failed refreshing %s lock, retrying: %v", l.kind, err)
+			wait = refreshRetryInterval
+			continue
+		}
+		wait = refreshInterval
+	}
+}
+
+// refreshLocked puts a new lock object and deletes the old one. It expects
+// l.mtx to be held.
+func (l *Lock) refreshLocked(ctx context.Context) error {
+	now := time.Now()
+	if now.Sub(l.refreshed) >= lostAfter {
+		// e.g. the system was asleep. others may have ignored the lock
+		// already, so it can't be refreshed anymore.
+		return errs.New("too late to refresh")
+	}
+	newPath := lockPath(l.kind, now, l.id)
+	err := l.backend.Put(ctx, newPath, bytes.NewReader(l.data))
+	if err != nil {
+		return err
+	}
+	oldPath := l.path
+	l.path, l.refreshed = newPath, now
+	err = l.backend.Delete(ctx, oldPath)
+	if err != nil {
+		utils.L(ctx).Urgentf("failed deleting old %s lock object, will retry on release: %v", l.kind, err)
+		l.leftover = append(l.leftover, oldPath)
+	}
+	return nil
+}
+
+// Release stops refreshing the lock and deletes it. It returns the ErrLost
+// error if the lock was lost while held.
+func (l *Lock) Release() error {
+	l.mtx.Lock()
+	if l.released {
+		l.mtx.Unlock()
+		return nil
+	}
+	l.released = true
+	l.mtx.Unlock()
+
+	close(l.stop)
+	<-l.stopped
+	l.cancel()
+
+	// the context Acquire was called with may be canceled by now, but the
+	// lock object should still go away.
+	ctx := context.Background()
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	err := l.lost
+	for _, path := range append(l.leftover, l.path) {
+		err = errs.Combine(err, l.backend.Delete(ctx, path))
+	}
+	return err
+}
@@ -0,0 +1,177 @@
+package locks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/jtolio/jam/backends"
+	"github.com/jtolio/jam/backends/fs"
+	"github.com/jtolio/jam/manifest"
+)
+
+var ctx = context.Background()
+
+func TestLocks(t *testing.T) {
+	td, err := os.MkdirTemp("", "lockstest")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(td))
+	}()
+
+	backend, err := fs.New(ctx, &url.URL{Path: td})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, backend.Close())
+	}()
+
+	info := &manifest.LockInfo{Hostname: "host", Pid: 1, Command: "test"}
+
+	// shared locks don't conflict with each other, but do with exclusive
+	// ones.
+	shared1, err := Acquire(ctx, backend, Shared, info, 0)
+	require.NoError(t, err)
+	shared2, err := Acquire(ctx, backend, Shared, info, 0)
+	require.NoError(t, err)
+	_, err = Acquire(ctx, backend, Exclusive, info, 0)
+	require.True(t, ErrLocked.Has(err))
+	require.Contains(t, err.Error(), "pid 1 on host")
+
+	require.NoError(t, shared1.Release())
+	require.NoError(t, shared2.Release())
+	require.NoError(t, shared2.Release())
+	locks, err := List(ctx, backend)
+	require.NoError(t, err)
+	require.Empty(t, locks)
+
+	exclusive, err := Acquire(ctx, backend, Exclusive, info, 0)
+	require.NoError(t, err)
+	_, err = Acquire(ctx, backend, Shared, info, 0)
+	require.True(t, ErrLocked.Has(err))
+	_, err = Acquire(ctx, backend, Exclusive, info, 0)
+	require.True(t, ErrLocked.Has(err))
+	locks, err = List(ctx, backend)
+	require.NoError(t, err)
+	require.Len(t, locks, 1)
+	require.Equal(t, Exclusive, locks[0].Kind)
+	require.False(t, locks[0].Stale)
+	got, err := Info(ctx, backend, locks[0])
+	require.NoError(t, err)
+	require.Equal(t, "test", got.Command)
+	require.NotZero(t, got.Acquired)
+	require.NoError(t, exclusive.Release())
+
+	// stale locks are ignored.
+	stalePath := lockPath(Exclusive, time.Now().Add(-2*StaleAfter), "stale")
+	require.NoError(t, backend.Put(ctx, stalePath, bytes.NewReader(nil)))
+	exclusive, err = Acquire(ctx, backend, Exclusive, info, 0)
+	require.NoError(t, err)
+	locks, err = List(ctx, backend)
+	require.NoError(t, err)
+	require.Len(t, locks, 2)
+	require.Equal(t, stalePath, locks[0].Path)
+	require.True(t, locks[0].Stale)
+	require.False(t, locks[1].Stale)
+	require.NoError(t, exclusive.Release())
+}
+
+// failingPuts fails every Put while failing is set.
+type failingPuts struct {
+	backends.Backend
+	failing int32
+}
+
+func (f *failingPuts) Put(ctx context.Context, path string, data io.Reader) error {
+	if atomic.LoadInt32(&f.failing) != 0 {
+		return errors.New("put failed")
+	}
+	return f.Backend.Put(ctx, path, data)
+}
+
+func TestLost(t *testing.T) {
+	defer func(refresh, retry, lost time.Duration) {
+		refreshInterval, refreshRetryInterval, lostAfter = refresh, retry, lost
+	}(refreshInterval, refreshRetryInterval, lostAfter)
+	refreshInterval, refreshRetryInterval, lostAfter =
+		20*time.Millisecond, 5*time.Millisecond, 200*time.Millisecond
+
+	td, err := os.MkdirTemp("", "lockstest")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(td))
+	}()
+	fsBackend, err := fs.New(ctx, &url.URL{Path: td})
+	require.NoError(t, err)
+	backend := &failingPuts{Backend: fsBackend}
+	defer func() {
+		require.NoError(t, backend.Close())
+	}()
+
+	info := &manifest.LockInfo{Hostname: "host", Pid: 1, Command: "test"}
+
+	// failures shorter than lostAfter are retried.
+	lock, err := Acquire(ctx, backend, Shared, info, 0)
+	require.NoError(t, err)
+	atomic.StoreInt32(&backend.failing, 1)
+	time.Sleep(lostAfter / 4)
+	atomic.StoreInt32(&backend.failing, 0)
+	time.Sleep(lostAfter)
+	require.NoError(t, lock.Err())
+	require.NoError(t, lock.Context().Err())
+	require.NoError(t, lock.Release())
+	locks, err := List(ctx, backend)
+	require.NoError(t, err)
+	require.Empty(t, locks)
+
+	// longer ones lose the lock, which fails the holder's operations.
+	lock, err = Acquire(ctx, backend, Exclusive, info, 0)
+	require.NoError(t, err)
+	guarded := lock.Guard(backend)
+	require.NoError(t, guarded.Put(ctx, "data/a", bytes.NewReader(nil)))
+	atomic.StoreInt32(&backend.failing, 1)
+	select {
+	case <-lock.Context().Done():
+	case <-time.After(10 * lostAfter):
+		t.Fatal("lock wasn't lost")
+	}
+	atomic.StoreInt32(&backend.failing, 0)
+	require.True(t, ErrLost.Has(lock.Err()))
+	require.True(t, ErrLost.Has(guarded.Put(ctx, "data/b", bytes.NewReader(nil))))
+	require.True(t, ErrLost.Has(guarded.Delete(ctx, "data/a")))
+	_, err = guarded.Get(ctx, "data/a", 0, -1)
+	require.True(t, ErrLost.Has(err))
+	require.True(t, ErrLost.Has(lock.Release()))
+	locks, err = List(ctx, backend)
+	require.NoError(t, err)
+	require.Empty(t, locks)
+}
+
+func TestReleaseCanceled(t *testing.T) {
+	td, err := os.MkdirTemp("", "lockstest")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(td))
+	}()
+	backend, err := fs.New(ctx, &url.URL{Path: td})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, backend.Close())
+	}()
+
+	lockCtx, cancel := context.WithCancel(ctx)
+	lock, err := Acquire(lockCtx, backend, Shared, &manifest.LockInfo{}, 0)
+	require.NoError(t, err)
+	cancel()
+	require.NoError(t, lock.Release())
+	locks, err := List(ctx, backend)
+	require.NoError(t, err)
+	require.Empty(t, locks)
+}
@@ -31,13 +31,23 @@ var (
 		ShortHelp:  "jam preserves your data",
 		ShortUsage: fmt.Sprintf("%s [opts] <subcommand> [opts]", os.Args[0]),
 		Subcommands: []*ffcli.Command{
+			cmdBatch,
+			cmdCat,
+			cmdDiff,
+			cmdFind,
+			cmdGC,
+			cmdHistory,
 			cmdIntegrity,
 			cmdKeys,
 			cmdLs,
+			cmdMerge,
 			cmdMount,
+			cmdPrune,
 			cmdRename,
+			cmdRestore,
 			cmdRevertTo,
 			cmdRm,
+			cmdShell,
 			cmdSnaps,
 			cmdStore,
 			cmdUnsnap,
@@ -52,14 +62,33 @@ var (
 		},
 		Exec: help,
 	}
+
+	// commandName is the subcommand being run, such as "utils repack".
+	commandName string
 )
 
+// findCommandName returns the names of the subcommands of cmd named in args.
+func findCommandName(cmd *ffcli.Command, args []string) string {
+	for i, arg := range args {
+		for _, sub := range cmd.Subcommands {
+			if sub.Name == arg {
+				if rest := findCommandName(sub, args[i+1:]); rest != "" {
+					return sub.Name + " " + rest
+				}
+				return sub.Name
+			}
+		}
+	}
+	return ""
+}
+
 func main() {
 	err := func() error {
 		err := cmdRoot.Parse(os.Args[1:])
 		if err != nil {
 			return err
 		}
+		commandName = findCommandName(cmdRoot, os.Args[1:])
 		logLevel, err := utils.ParseLogLevel(*sysFlagLogLevel)
 		if err != nil {
 			return err
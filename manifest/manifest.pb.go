@@ -22,24 +22,63 @@ var _ = math.Inf
 // proto package needs to be updated.
 const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
 
+type Range_Compression int32
+
+const (
+	Range_NONE Range_Compression = 0
+	Range_ZLIB Range_Compression = 1
+)
+
+var Range_Compression_name = map[int32]string{
+	0: "NONE",
+	1: "ZLIB",
+}
+
+var Range_Compression_value = map[string]int32{
+	"NONE": 0,
+	"ZLIB": 1,
+}
+
+func (x Range_Compression) String() string {
+	return proto.EnumName(Range_Compression_name, int32(x))
+}
+
+func (Range_Compression) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_0bb23f43f7afb4c1, []int{0, 0}
+}
+
 type Metadata_Type int32
 
 const (
 	Metadata_UNKNOWN Metadata_Type = 0
 	Metadata_FILE    Metadata_Type = 1
 	Metadata_SYMLINK Metadata_Type = 2
+	// a directory's path ends with a '/'
+	Metadata_DIRECTORY Metadata_Type = 3
+	Metadata_FIFO      Metadata_Type = 4
+	// a block or character device, depending on mode
+	Metadata_DEVICE Metadata_Type = 5
+	Metadata_SOCKET Metadata_Type = 6
 )
 
 var Metadata_Type_name = map[int32]string{
 	0: "UNKNOWN",
 	1: "FILE",
 	2: "SYMLINK",
+	3: "DIRECTORY",
+	4: "FIFO",
+	5: "DEVICE",
+	6: "SOCKET",
 }
 
 var Metadata_Type_value = map[string]int32{
-	"UNKNOWN": 0,
-	"FILE":    1,
-	"SYMLINK": 2,
+	"UNKNOWN":   0,
+	"FILE":      1,
+	"SYMLINK":   2,
+	"DIRECTORY": 3,
+	"FIFO":      4,
+	"DEVICE":    5,
+	"SOCKET":    6,
 }
 
 func (x Metadata_Type) String() string {
@@ -50,10 +89,43 @@ func (Metadata_Type) EnumDescriptor() ([]byte, []int) {
 	return fileDescriptor_0bb23f43f7afb4c1, []int{2, 0}
 }
 
+type HashRunIndex_Type int32
+
+const (
+	HashRunIndex_INCREMENTAL HashRunIndex_Type = 0
+	HashRunIndex_FULL        HashRunIndex_Type = 1
+)
+
+var HashRunIndex_Type_name = map[int32]string{
+	0: "INCREMENTAL",
+	1: "FULL",
+}
+
+var HashRunIndex_Type_value = map[string]int32{
+	"INCREMENTAL": 0,
+	"FULL":        1,
+}
+
+func (x HashRunIndex_Type) String() string {
+	return proto.EnumName(HashRunIndex_Type_name, int32(x))
+}
+
+func (HashRunIndex_Type) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_0bb23f43f7afb4c1, []int{12, 0}
+}
+
 type Range struct {
-	Offset               int64    `protobuf:"varint,2,opt,name=offset,proto3" json:"offset,omitempty"`
-	Length               int64    `protobuf:"varint,3,opt,name=length,proto3" json:"length,omitempty"`
-	BlobBytes            []byte   `protobuf:"bytes,4,opt,name=blob_bytes,json=blobBytes,proto3" json:"blob_bytes,omitempty"`
+	Offset    int64  `protobuf:"varint,2,opt,name=offset,proto3" json:"offset,omitempty"`
+	Length    int64  `protobuf:"varint,3,opt,name=length,proto3" json:"length,omitempty"`
+	BlobBytes []byte `protobuf:"bytes,4,opt,name=blob_bytes,json=blobBytes,proto3" json:"blob_bytes,omitempty"`
+	// a compressed frame may be split across more than one range. the first
+	// range of a frame has the frame's uncompressed length, and every following
+	// range of the same frame has an uncompressed length of zero.
+	Compression        Range_Compression `protobuf:"varint,5,opt,name=compression,proto3,enum=manifest.Range_Compression" json:"compression,omitempty"`
+	UncompressedLength int64             `protobuf:"varint,6,opt,name=uncompressed_length,json=uncompressedLength,proto3" json:"uncompressed_length,omitempty"`
+	// a hole is a run of length zeros that was never written, and refers to no
+	// blob.
+	Hole                 bool     `protobuf:"varint,7,opt,name=hole,proto3" json:"hole,omitempty"`
 	DeprecatedBlobString string   `protobuf:"bytes,1,opt,name=deprecated_blob_string,json=deprecatedBlobString,proto3" json:"deprecated_blob_string,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
@@ -106,6 +178,27 @@ func (m *Range) GetBlobBytes() []byte {
 	return nil
 }
 
+func (m *Range) GetCompression() Range_Compression {
+	if m != nil {
+		return m.Compression
+	}
+	return Range_NONE
+}
+
+func (m *Range) GetUncompressedLength() int64 {
+	if m != nil {
+		return m.UncompressedLength
+	}
+	return 0
+}
+
+func (m *Range) GetHole() bool {
+	if m != nil {
+		return m.Hole
+	}
+	return false
+}
+
 func (m *Range) GetDeprecatedBlobString() string {
 	if m != nil {
 		return m.DeprecatedBlobString
@@ -153,14 +246,26 @@ func (m *Stream) GetRanges() []*Range {
 }
 
 type Metadata struct {
-	Type                 Metadata_Type        `protobuf:"varint,1,opt,name=type,proto3,enum=manifest.Metadata_Type" json:"type,omitempty"`
-	Creation             *timestamp.Timestamp `protobuf:"bytes,2,opt,name=creation,proto3" json:"creation,omitempty"`
-	Modified             *timestamp.Timestamp `protobuf:"bytes,3,opt,name=modified,proto3" json:"modified,omitempty"`
-	Mode                 uint32               `protobuf:"varint,4,opt,name=mode,proto3" json:"mode,omitempty"`
-	LinkTarget           []byte               `protobuf:"bytes,5,opt,name=link_target,json=linkTarget,proto3" json:"link_target,omitempty"`
-	XXX_NoUnkeyedLiteral struct{}             `json:"-"`
-	XXX_unrecognized     []byte               `json:"-"`
-	XXX_sizecache        int32                `json:"-"`
+	Type       Metadata_Type        `protobuf:"varint,1,opt,name=type,proto3,enum=manifest.Metadata_Type" json:"type,omitempty"`
+	Creation   *timestamp.Timestamp `protobuf:"bytes,2,opt,name=creation,proto3" json:"creation,omitempty"`
+	Modified   *timestamp.Timestamp `protobuf:"bytes,3,opt,name=modified,proto3" json:"modified,omitempty"`
+	Mode       uint32               `protobuf:"varint,4,opt,name=mode,proto3" json:"mode,omitempty"`
+	LinkTarget []byte               `protobuf:"bytes,5,opt,name=link_target,json=linkTarget,proto3" json:"link_target,omitempty"`
+	Size       int64                `protobuf:"varint,6,opt,name=size,proto3" json:"size,omitempty"`
+	Inode      uint64               `protobuf:"varint,7,opt,name=inode,proto3" json:"inode,omitempty"`
+	Changed    *timestamp.Timestamp `protobuf:"bytes,8,opt,name=changed,proto3" json:"changed,omitempty"`
+	// who owned the path when it was stored, if known
+	Owner *Metadata_Owner `protobuf:"bytes,9,opt,name=owner,proto3" json:"owner,omitempty"`
+	// extended attributes (which include ACLs on some systems), sorted by name
+	Xattrs []*Metadata_Xattr `protobuf:"bytes,10,rep,name=xattrs,proto3" json:"xattrs,omitempty"`
+	// set for files that had more than one hard link when stored. files with
+	// the same link group and hash were links to the same file.
+	LinkGroup string `protobuf:"bytes,11,opt,name=link_group,json=linkGroup,proto3" json:"link_group,omitempty"`
+	// the device number of a device, as encoded by the system that stored it
+	Device               uint64   `protobuf:"varint,12,opt,name=device,proto3" json:"device,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
 }
 
 func (m *Metadata) Reset()         { *m = Metadata{} }
@@ -223,6 +328,167 @@ func (m *Metadata) GetLinkTarget() []byte {
 	return nil
 }
 
+func (m *Metadata) GetSize() int64 {
+	if m != nil {
+		return m.Size
+	}
+	return 0
+}
+
+func (m *Metadata) GetInode() uint64 {
+	if m != nil {
+		return m.Inode
+	}
+	return 0
+}
+
+func (m *Metadata) GetChanged() *timestamp.Timestamp {
+	if m != nil {
+		return m.Changed
+	}
+	return nil
+}
+
+func (m *Metadata) GetOwner() *Metadata_Owner {
+	if m != nil {
+		return m.Owner
+	}
+	return nil
+}
+
+func (m *Metadata) GetXattrs() []*Metadata_Xattr {
+	if m != nil {
+		return m.Xattrs
+	}
+	return nil
+}
+
+func (m *Metadata) GetLinkGroup() string {
+	if m != nil {
+		return m.LinkGroup
+	}
+	return ""
+}
+
+func (m *Metadata) GetDevice() uint64 {
+	if m != nil {
+		return m.Device
+	}
+	return 0
+}
+
+type Metadata_Owner struct {
+	Uid uint32 `protobuf:"varint,1,opt,name=uid,proto3" json:"uid,omitempty"`
+	Gid uint32 `protobuf:"varint,2,opt,name=gid,proto3" json:"gid,omitempty"`
+	// the user and group names, if known, which are preferred over the ids
+	// when restoring on another system.
+	User                 string   `protobuf:"bytes,3,opt,name=user,proto3" json:"user,omitempty"`
+	Group                string   `protobuf:"bytes,4,opt,name=group,proto3" json:"group,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Metadata_Owner) Reset()         { *m = Metadata_Owner{} }
+func (m *Metadata_Owner) String() string { return proto.CompactTextString(m) }
+func (*Metadata_Owner) ProtoMessage()    {}
+func (*Metadata_Owner) Descriptor() ([]byte, []int) {
+	return fileDescriptor_0bb23f43f7afb4c1, []int{2, 0}
+}
+
+func (m *Metadata_Owner) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Metadata_Owner.Unmarshal(m, b)
+}
+func (m *Metadata_Owner) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Metadata_Owner.Marshal(b, m, deterministic)
+}
+func (m *Metadata_Owner) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Metadata_Owner.Merge(m, src)
+}
+func (m *Metadata_Owner) XXX_Size() int {
+	return xxx_messageInfo_Metadata_Owner.Size(m)
+}
+func (m *Metadata_Owner) XXX_DiscardUnknown() {
+	xxx_messageInfo_Metadata_Owner.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Metadata_Owner proto.InternalMessageInfo
+
+func (m *Metadata_Owner) GetUid() uint32 {
+	if m != nil {
+		return m.Uid
+	}
+	return 0
+}
+
+func (m *Metadata_Owner) GetGid() uint32 {
+	if m != nil {
+		return m.Gid
+	}
+	return 0
+}
+
+func (m *Metadata_Owner) GetUser() string {
+	if m != nil {
+		return m.User
+	}
+	return ""
+}
+
+func (m *Metadata_Owner) GetGroup() string {
+	if m != nil {
+		return m.Group
+	}
+	return ""
+}
+
+type Metadata_Xattr struct {
+	Name                 string   `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Value                []byte   `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Metadata_Xattr) Reset()         { *m = Metadata_Xattr{} }
+func (m *Metadata_Xattr) String() string { return proto.CompactTextString(m) }
+func (*Metadata_Xattr) ProtoMessage()    {}
+func (*Metadata_Xattr) Descriptor() ([]byte, []int) {
+	return fileDescriptor_0bb23f43f7afb4c1, []int{2, 1}
+}
+
+func (m *Metadata_Xattr) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Metadata_Xattr.Unmarshal(m, b)
+}
+func (m *Metadata_Xattr) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Metadata_Xattr.Marshal(b, m, deterministic)
+}
+func (m *Metadata_Xattr) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Metadata_Xattr.Merge(m, src)
+}
+func (m *Metadata_Xattr) XXX_Size() int {
+	return xxx_messageInfo_Metadata_Xattr.Size(m)
+}
+func (m *Metadata_Xattr) XXX_DiscardUnknown() {
+	xxx_messageInfo_Metadata_Xattr.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Metadata_Xattr proto.InternalMessageInfo
+
+func (m *Metadata_Xattr) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *Metadata_Xattr) GetValue() []byte {
+	if m != nil {
+		return m.Value
+	}
+	return nil
+}
+
 type Content struct {
 	Metadata             *Metadata `protobuf:"bytes,1,opt,name=metadata,proto3" json:"metadata,omitempty"`
 	Hash                 []byte    `protobuf:"bytes,3,opt,name=hash,proto3" json:"hash,omitempty"`
@@ -361,10 +627,16 @@ type Page struct {
 	// Types that are valid to be assigned to Descendents:
 	//	*Page_Branch
 	//	*Page_Entries
-	Descendents          isPage_Descendents `protobuf_oneof:"descendents"`
-	XXX_NoUnkeyedLiteral struct{}           `json:"-"`
-	XXX_unrecognized     []byte             `json:"-"`
-	XXX_sizecache        int32              `json:"-"`
+	//	*Page_BranchHash
+	Descendents isPage_Descendents `protobuf_oneof:"descendents"`
+	// how many paths a branch has
+	Count int64 `protobuf:"varint,5,opt,name=count,proto3" json:"count,omitempty"`
+	// set only on the first page of a snapshot's manifest, which has nothing
+	// else.
+	Header               *SnapshotHeader `protobuf:"bytes,6,opt,name=header,proto3" json:"header,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}        `json:"-"`
+	XXX_unrecognized     []byte          `json:"-"`
+	XXX_sizecache        int32           `json:"-"`
 }
 
 func (m *Page) Reset()         { *m = Page{} }
@@ -411,10 +683,16 @@ type Page_Entries struct {
 	Entries *EntrySet `protobuf:"bytes,3,opt,name=entries,proto3,oneof"`
 }
 
+type Page_BranchHash struct {
+	BranchHash []byte `protobuf:"bytes,4,opt,name=branch_hash,json=branchHash,proto3,oneof"`
+}
+
 func (*Page_Branch) isPage_Descendents() {}
 
 func (*Page_Entries) isPage_Descendents() {}
 
+func (*Page_BranchHash) isPage_Descendents() {}
+
 func (m *Page) GetDescendents() isPage_Descendents {
 	if m != nil {
 		return m.Descendents
@@ -436,11 +714,33 @@ func (m *Page) GetEntries() *EntrySet {
 	return nil
 }
 
+func (m *Page) GetBranchHash() []byte {
+	if x, ok := m.GetDescendents().(*Page_BranchHash); ok {
+		return x.BranchHash
+	}
+	return nil
+}
+
+func (m *Page) GetCount() int64 {
+	if m != nil {
+		return m.Count
+	}
+	return 0
+}
+
+func (m *Page) GetHeader() *SnapshotHeader {
+	if m != nil {
+		return m.Header
+	}
+	return nil
+}
+
 // XXX_OneofWrappers is for the internal use of the proto package.
 func (*Page) XXX_OneofWrappers() []interface{} {
 	return []interface{}{
 		(*Page_Branch)(nil),
 		(*Page_Entries)(nil),
+		(*Page_BranchHash)(nil),
 	}
 }
 
@@ -530,17 +830,474 @@ func (m *HashSet) GetHashes() []*HashedData {
 	return nil
 }
 
+type ChunkedData struct {
+	Hash   []byte   `protobuf:"bytes,1,opt,name=hash,proto3" json:"hash,omitempty"`
+	Chunks [][]byte `protobuf:"bytes,2,rep,name=chunks,proto3" json:"chunks,omitempty"`
+	// for sparse files, the length of the hole before each chunk, followed by
+	// the length of the hole after the last one.
+	Holes                []int64  `protobuf:"varint,3,rep,packed,name=holes,proto3" json:"holes,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ChunkedData) Reset()         { *m = ChunkedData{} }
+func (m *ChunkedData) String() string { return proto.CompactTextString(m) }
+func (*ChunkedData) ProtoMessage()    {}
+func (*ChunkedData) Descriptor() ([]byte, []int) {
+	return fileDescriptor_0bb23f43f7afb4c1, []int{9}
+}
+
+func (m *ChunkedData) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ChunkedData.Unmarshal(m, b)
+}
+func (m *ChunkedData) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ChunkedData.Marshal(b, m, deterministic)
+}
+func (m *ChunkedData) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ChunkedData.Merge(m, src)
+}
+func (m *ChunkedData) XXX_Size() int {
+	return xxx_messageInfo_ChunkedData.Size(m)
+}
+func (m *ChunkedData) XXX_DiscardUnknown() {
+	xxx_messageInfo_ChunkedData.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ChunkedData proto.InternalMessageInfo
+
+func (m *ChunkedData) GetHash() []byte {
+	if m != nil {
+		return m.Hash
+	}
+	return nil
+}
+
+func (m *ChunkedData) GetChunks() [][]byte {
+	if m != nil {
+		return m.Chunks
+	}
+	return nil
+}
+
+func (m *ChunkedData) GetHoles() []int64 {
+	if m != nil {
+		return m.Holes
+	}
+	return nil
+}
+
+type BlobIndex struct {
+	Hashes               []*HashedData  `protobuf:"bytes,1,rep,name=hashes,proto3" json:"hashes,omitempty"`
+	Chunked              []*ChunkedData `protobuf:"bytes,2,rep,name=chunked,proto3" json:"chunked,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}       `json:"-"`
+	XXX_unrecognized     []byte         `json:"-"`
+	XXX_sizecache        int32          `json:"-"`
+}
+
+func (m *BlobIndex) Reset()         { *m = BlobIndex{} }
+func (m *BlobIndex) String() string { return proto.CompactTextString(m) }
+func (*BlobIndex) ProtoMessage()    {}
+func (*BlobIndex) Descriptor() ([]byte, []int) {
+	return fileDescriptor_0bb23f43f7afb4c1, []int{10}
+}
+
+func (m *BlobIndex) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_BlobIndex.Unmarshal(m, b)
+}
+func (m *BlobIndex) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_BlobIndex.Marshal(b, m, deterministic)
+}
+func (m *BlobIndex) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_BlobIndex.Merge(m, src)
+}
+func (m *BlobIndex) XXX_Size() int {
+	return xxx_messageInfo_BlobIndex.Size(m)
+}
+func (m *BlobIndex) XXX_DiscardUnknown() {
+	xxx_messageInfo_BlobIndex.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_BlobIndex proto.InternalMessageInfo
+
+func (m *BlobIndex) GetHashes() []*HashedData {
+	if m != nil {
+		return m.Hashes
+	}
+	return nil
+}
+
+func (m *BlobIndex) GetChunked() []*ChunkedData {
+	if m != nil {
+		return m.Chunked
+	}
+	return nil
+}
+
+// HashRunBlock locates a compressed HashSet within a hash run.
+type HashRunBlock struct {
+	// the smallest hash in the block
+	First                []byte   `protobuf:"bytes,1,opt,name=first,proto3" json:"first,omitempty"`
+	Offset               int64    `protobuf:"varint,2,opt,name=offset,proto3" json:"offset,omitempty"`
+	Length               int64    `protobuf:"varint,3,opt,name=length,proto3" json:"length,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *HashRunBlock) Reset()         { *m = HashRunBlock{} }
+func (m *HashRunBlock) String() string { return proto.CompactTextString(m) }
+func (*HashRunBlock) ProtoMessage()    {}
+func (*HashRunBlock) Descriptor() ([]byte, []int) {
+	return fileDescriptor_0bb23f43f7afb4c1, []int{11}
+}
+
+func (m *HashRunBlock) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_HashRunBlock.Unmarshal(m, b)
+}
+func (m *HashRunBlock) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_HashRunBlock.Marshal(b, m, deterministic)
+}
+func (m *HashRunBlock) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_HashRunBlock.Merge(m, src)
+}
+func (m *HashRunBlock) XXX_Size() int {
+	return xxx_messageInfo_HashRunBlock.Size(m)
+}
+func (m *HashRunBlock) XXX_DiscardUnknown() {
+	xxx_messageInfo_HashRunBlock.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_HashRunBlock proto.InternalMessageInfo
+
+func (m *HashRunBlock) GetFirst() []byte {
+	if m != nil {
+		return m.First
+	}
+	return nil
+}
+
+func (m *HashRunBlock) GetOffset() int64 {
+	if m != nil {
+		return m.Offset
+	}
+	return 0
+}
+
+func (m *HashRunBlock) GetLength() int64 {
+	if m != nil {
+		return m.Length
+	}
+	return 0
+}
+
+// HashRunIndex describes a hash run, a sorted and immutable set of hashes
+// split into blocks, so that the run can be searched with range reads.
+type HashRunIndex struct {
+	Count  int64           `protobuf:"varint,1,opt,name=count,proto3" json:"count,omitempty"`
+	Blocks []*HashRunBlock `protobuf:"bytes,2,rep,name=blocks,proto3" json:"blocks,omitempty"`
+	// a bloom filter of every hash in the run
+	Bloom       []byte            `protobuf:"bytes,3,opt,name=bloom,proto3" json:"bloom,omitempty"`
+	BloomHashes uint32            `protobuf:"varint,4,opt,name=bloom_hashes,json=bloomHashes,proto3" json:"bloom_hashes,omitempty"`
+	Type        HashRunIndex_Type `protobuf:"varint,5,opt,name=type,proto3,enum=manifest.HashRunIndex_Type" json:"type,omitempty"`
+	// the paths of runs and hashsets whose hashes this run (or the runs
+	// written along with it) has, so that they no longer need to be read.
+	Supersedes           []string `protobuf:"bytes,6,rep,name=supersedes,proto3" json:"supersedes,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *HashRunIndex) Reset()         { *m = HashRunIndex{} }
+func (m *HashRunIndex) String() string { return proto.CompactTextString(m) }
+func (*HashRunIndex) ProtoMessage()    {}
+func (*HashRunIndex) Descriptor() ([]byte, []int) {
+	return fileDescriptor_0bb23f43f7afb4c1, []int{12}
+}
+
+func (m *HashRunIndex) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_HashRunIndex.Unmarshal(m, b)
+}
+func (m *HashRunIndex) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_HashRunIndex.Marshal(b, m, deterministic)
+}
+func (m *HashRunIndex) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_HashRunIndex.Merge(m, src)
+}
+func (m *HashRunIndex) XXX_Size() int {
+	return xxx_messageInfo_HashRunIndex.Size(m)
+}
+func (m *HashRunIndex) XXX_DiscardUnknown() {
+	xxx_messageInfo_HashRunIndex.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_HashRunIndex proto.InternalMessageInfo
+
+func (m *HashRunIndex) GetCount() int64 {
+	if m != nil {
+		return m.Count
+	}
+	return 0
+}
+
+func (m *HashRunIndex) GetBlocks() []*HashRunBlock {
+	if m != nil {
+		return m.Blocks
+	}
+	return nil
+}
+
+func (m *HashRunIndex) GetBloom() []byte {
+	if m != nil {
+		return m.Bloom
+	}
+	return nil
+}
+
+func (m *HashRunIndex) GetBloomHashes() uint32 {
+	if m != nil {
+		return m.BloomHashes
+	}
+	return 0
+}
+
+func (m *HashRunIndex) GetType() HashRunIndex_Type {
+	if m != nil {
+		return m.Type
+	}
+	return HashRunIndex_INCREMENTAL
+}
+
+func (m *HashRunIndex) GetSupersedes() []string {
+	if m != nil {
+		return m.Supersedes
+	}
+	return nil
+}
+
+// SnapshotHeader describes a snapshot, so that snapshots can be listed
+// without reading everything in them.
+type SnapshotHeader struct {
+	Hostname string `protobuf:"bytes,1,opt,name=hostname,proto3" json:"hostname,omitempty"`
+	User     string `protobuf:"bytes,2,opt,name=user,proto3" json:"user,omitempty"`
+	// the local directory stored and the prefix it was stored under, if the
+	// snapshot was made by storing one.
+	Source      string   `protobuf:"bytes,3,opt,name=source,proto3" json:"source,omitempty"`
+	Prefix      string   `protobuf:"bytes,4,opt,name=prefix,proto3" json:"prefix,omitempty"`
+	Tags        []string `protobuf:"bytes,5,rep,name=tags,proto3" json:"tags,omitempty"`
+	Description string   `protobuf:"bytes,6,opt,name=description,proto3" json:"description,omitempty"`
+	// the version of jam that made the snapshot
+	Version string `protobuf:"bytes,7,opt,name=version,proto3" json:"version,omitempty"`
+	// totals over the whole snapshot. files counts every path but
+	// directories, and bytes adds up the sizes files had when stored.
+	Paths int64 `protobuf:"varint,8,opt,name=paths,proto3" json:"paths,omitempty"`
+	Files int64 `protobuf:"varint,9,opt,name=files,proto3" json:"files,omitempty"`
+	Bytes int64 `protobuf:"varint,10,opt,name=bytes,proto3" json:"bytes,omitempty"`
+	// the snapshots this one was made from, in unix nanoseconds. usually the
+	// latest snapshot when it was started, but a merge has two or more.
+	Parents              []int64  `protobuf:"varint,11,rep,packed,name=parents,proto3" json:"parents,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *SnapshotHeader) Reset()         { *m = SnapshotHeader{} }
+func (m *SnapshotHeader) String() string { return proto.CompactTextString(m) }
+func (*SnapshotHeader) ProtoMessage()    {}
+func (*SnapshotHeader) Descriptor() ([]byte, []int) {
+	return fileDescriptor_0bb23f43f7afb4c1, []int{13}
+}
+
+func (m *SnapshotHeader) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_SnapshotHeader.Unmarshal(m, b)
+}
+func (m *SnapshotHeader) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_SnapshotHeader.Marshal(b, m, deterministic)
+}
+func (m *SnapshotHeader) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_SnapshotHeader.Merge(m, src)
+}
+func (m *SnapshotHeader) XXX_Size() int {
+	return xxx_messageInfo_SnapshotHeader.Size(m)
+}
+func (m *SnapshotHeader) XXX_DiscardUnknown() {
+	xxx_messageInfo_SnapshotHeader.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_SnapshotHeader proto.InternalMessageInfo
+
+func (m *SnapshotHeader) GetHostname() string {
+	if m != nil {
+		return m.Hostname
+	}
+	return ""
+}
+
+func (m *SnapshotHeader) GetUser() string {
+	if m != nil {
+		return m.User
+	}
+	return ""
+}
+
+func (m *SnapshotHeader) GetSource() string {
+	if m != nil {
+		return m.Source
+	}
+	return ""
+}
+
+func (m *SnapshotHeader) GetPrefix() string {
+	if m != nil {
+		return m.Prefix
+	}
+	return ""
+}
+
+func (m *SnapshotHeader) GetTags() []string {
+	if m != nil {
+		return m.Tags
+	}
+	return nil
+}
+
+func (m *SnapshotHeader) GetDescription() string {
+	if m != nil {
+		return m.Description
+	}
+	return ""
+}
+
+func (m *SnapshotHeader) GetVersion() string {
+	if m != nil {
+		return m.Version
+	}
+	return ""
+}
+
+func (m *SnapshotHeader) GetPaths() int64 {
+	if m != nil {
+		return m.Paths
+	}
+	return 0
+}
+
+func (m *SnapshotHeader) GetFiles() int64 {
+	if m != nil {
+		return m.Files
+	}
+	return 0
+}
+
+func (m *SnapshotHeader) GetBytes() int64 {
+	if m != nil {
+		return m.Bytes
+	}
+	return 0
+}
+
+func (m *SnapshotHeader) GetParents() []int64 {
+	if m != nil {
+		return m.Parents
+	}
+	return nil
+}
+
+// LockInfo is stored in every lock object, to say who holds the lock.
+type LockInfo struct {
+	Hostname string `protobuf:"bytes,1,opt,name=hostname,proto3" json:"hostname,omitempty"`
+	User     string `protobuf:"bytes,2,opt,name=user,proto3" json:"user,omitempty"`
+	Pid      int64  `protobuf:"varint,3,opt,name=pid,proto3" json:"pid,omitempty"`
+	Command  string `protobuf:"bytes,4,opt,name=command,proto3" json:"command,omitempty"`
+	// when the lock was first acquired, in unix nanoseconds. lock objects are
+	// replaced as they are refreshed, and are named by when that happened.
+	Acquired             int64    `protobuf:"varint,5,opt,name=acquired,proto3" json:"acquired,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *LockInfo) Reset()         { *m = LockInfo{} }
+func (m *LockInfo) String() string { return proto.CompactTextString(m) }
+func (*LockInfo) ProtoMessage()    {}
+func (*LockInfo) Descriptor() ([]byte, []int) {
+	return fileDescriptor_0bb23f43f7afb4c1, []int{14}
+}
+
+func (m *LockInfo) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_LockInfo.Unmarshal(m, b)
+}
+func (m *LockInfo) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_LockInfo.Marshal(b, m, deterministic)
+}
+func (m *LockInfo) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_LockInfo.Merge(m, src)
+}
+func (m *LockInfo) XXX_Size() int {
+	return xxx_messageInfo_LockInfo.Size(m)
+}
+func (m *LockInfo) XXX_DiscardUnknown() {
+	xxx_messageInfo_LockInfo.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_LockInfo proto.InternalMessageInfo
+
+func (m *LockInfo) GetHostname() string {
+	if m != nil {
+		return m.Hostname
+	}
+	return ""
+}
+
+func (m *LockInfo) GetUser() string {
+	if m != nil {
+		return m.User
+	}
+	return ""
+}
+
+func (m *LockInfo) GetPid() int64 {
+	if m != nil {
+		return m.Pid
+	}
+	return 0
+}
+
+func (m *LockInfo) GetCommand() string {
+	if m != nil {
+		return m.Command
+	}
+	return ""
+}
+
+func (m *LockInfo) GetAcquired() int64 {
+	if m != nil {
+		return m.Acquired
+	}
+	return 0
+}
+
 func init() {
+	proto.RegisterEnum("manifest.Range_Compression", Range_Compression_name, Range_Compression_value)
 	proto.RegisterEnum("manifest.Metadata_Type", Metadata_Type_name, Metadata_Type_value)
+	proto.RegisterEnum("manifest.HashRunIndex_Type", HashRunIndex_Type_name, HashRunIndex_Type_value)
 	proto.RegisterType((*Range)(nil), "manifest.Range")
 	proto.RegisterType((*Stream)(nil), "manifest.Stream")
 	proto.RegisterType((*Metadata)(nil), "manifest.Metadata")
+	proto.RegisterType((*Metadata_Owner)(nil), "manifest.Metadata.Owner")
+	proto.RegisterType((*Metadata_Xattr)(nil), "manifest.Metadata.Xattr")
 	proto.RegisterType((*Content)(nil), "manifest.Content")
 	proto.RegisterType((*Entry)(nil), "manifest.Entry")
 	proto.RegisterType((*EntrySet)(nil), "manifest.EntrySet")
 	proto.RegisterType((*Page)(nil), "manifest.Page")
 	proto.RegisterType((*HashedData)(nil), "manifest.HashedData")
 	proto.RegisterType((*HashSet)(nil), "manifest.HashSet")
+	proto.RegisterType((*ChunkedData)(nil), "manifest.ChunkedData")
+	proto.RegisterType((*BlobIndex)(nil), "manifest.BlobIndex")
+	proto.RegisterType((*HashRunBlock)(nil), "manifest.HashRunBlock")
+	proto.RegisterType((*HashRunIndex)(nil), "manifest.HashRunIndex")
+	proto.RegisterType((*SnapshotHeader)(nil), "manifest.SnapshotHeader")
+	proto.RegisterType((*LockInfo)(nil), "manifest.LockInfo")
 }
 
 func init() {
@@ -548,41 +1305,83 @@ func init() {
 }
 
 var fileDescriptor_0bb23f43f7afb4c1 = []byte{
-	// 563 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x84, 0x93, 0x5b, 0x6f, 0xd3, 0x4e,
-	0x10, 0xc5, 0xeb, 0xc4, 0x4d, 0xdc, 0x71, 0xdb, 0x7f, 0xfe, 0xab, 0xaa, 0x58, 0x95, 0x50, 0x23,
-	0x0b, 0x89, 0xd0, 0x22, 0x57, 0x84, 0xdb, 0x7b, 0xa0, 0x55, 0x4a, 0xdb, 0x80, 0x36, 0x45, 0xa8,
-	0xbc, 0x44, 0xeb, 0x78, 0xec, 0x58, 0xc4, 0x6b, 0xcb, 0x1e, 0x24, 0xf2, 0x0d, 0x40, 0xe2, 0x43,
-	0xa3, 0x5d, 0xdf, 0x10, 0x17, 0xf1, 0xb6, 0x7b, 0xe6, 0xcc, 0xce, 0xd9, 0x9f, 0xd7, 0xb0, 0x9f,
-	0x08, 0x19, 0x87, 0x58, 0x90, 0x97, 0xe5, 0x29, 0xa5, 0xcc, 0xaa, 0xf7, 0x47, 0xc7, 0x51, 0x9a,
-	0x46, 0x6b, 0x3c, 0xd3, 0xba, 0xff, 0x39, 0x3c, 0xa3, 0x38, 0xc1, 0x82, 0x44, 0x92, 0x95, 0x56,
-	0xf7, 0xbb, 0x01, 0xdb, 0x5c, 0xc8, 0x08, 0xd9, 0x21, 0xf4, 0xd2, 0x30, 0x2c, 0x90, 0x9c, 0xce,
-	0xd0, 0x18, 0x75, 0x79, 0xb5, 0x53, 0xfa, 0x1a, 0x65, 0x44, 0x2b, 0xa7, 0x5b, 0xea, 0xe5, 0x8e,
-	0xdd, 0x07, 0xf0, 0xd7, 0xa9, 0xbf, 0xf0, 0x37, 0x84, 0x85, 0x63, 0x0e, 0x8d, 0xd1, 0x2e, 0xdf,
-	0x51, 0xca, 0x44, 0x09, 0xec, 0x19, 0x1c, 0x06, 0x98, 0xe5, 0xb8, 0x14, 0x84, 0xc1, 0x42, 0x3b,
-	0x0b, 0xca, 0x63, 0x19, 0x39, 0xc6, 0xd0, 0x18, 0xed, 0xf0, 0x83, 0xb6, 0x3a, 0x59, 0xa7, 0xfe,
-	0x5c, 0xd7, 0xdc, 0x27, 0xd0, 0x9b, 0x53, 0x8e, 0x22, 0x61, 0x0f, 0xa1, 0x97, 0xab, 0x5c, 0x85,
-	0x63, 0x0c, 0xbb, 0x23, 0x7b, 0xfc, 0x9f, 0xd7, 0x5c, 0x52, 0xe7, 0xe5, 0x55, 0xd9, 0xfd, 0xda,
-	0x01, 0xeb, 0x06, 0x49, 0x04, 0x82, 0x04, 0x3b, 0x05, 0x93, 0x36, 0x19, 0xea, 0x19, 0xfb, 0xe3,
-	0x7b, 0x6d, 0x4f, 0xed, 0xf0, 0x6e, 0x37, 0x19, 0x72, 0x6d, 0x62, 0x2f, 0xc0, 0x5a, 0xe6, 0x28,
-	0x28, 0x4e, 0xa5, 0xbe, 0xb3, 0x3d, 0x3e, 0xf2, 0x4a, 0x5e, 0x5e, 0xcd, 0xcb, 0xbb, 0xad, 0x79,
-	0xf1, 0xc6, 0xab, 0xfa, 0x92, 0x34, 0x88, 0xc3, 0x18, 0x03, 0xcd, 0xe4, 0x1f, 0x7d, 0xb5, 0x97,
-	0x31, 0x30, 0x93, 0x34, 0x40, 0xcd, 0x6a, 0x8f, 0xeb, 0x35, 0x3b, 0x06, 0x7b, 0x1d, 0xcb, 0x4f,
-	0x0b, 0x12, 0x79, 0x84, 0xe4, 0x6c, 0x6b, 0x8c, 0xa0, 0xa4, 0x5b, 0xad, 0xb8, 0x27, 0x60, 0xaa,
-	0xc8, 0xcc, 0x86, 0xfe, 0xfb, 0xd9, 0xd5, 0xec, 0xed, 0x87, 0xd9, 0x60, 0x8b, 0x59, 0x60, 0x5e,
-	0x5c, 0x5e, 0x9f, 0x0f, 0x0c, 0x25, 0xcf, 0xef, 0x6e, 0xae, 0x2f, 0x67, 0x57, 0x83, 0x8e, 0x7b,
-	0x07, 0xfd, 0x57, 0xa9, 0x24, 0x94, 0xc4, 0x3c, 0xb0, 0x92, 0xea, 0xca, 0x1a, 0x86, 0x3d, 0x66,
-	0xbf, 0xc3, 0xe0, 0x8d, 0x47, 0x65, 0x5b, 0x89, 0xa2, 0xfc, 0xc6, 0xbb, 0x5c, 0xaf, 0xdf, 0x98,
-	0x56, 0x67, 0xd0, 0xe5, 0xa6, 0xaa, 0xbb, 0x53, 0xd8, 0x3e, 0x97, 0x94, 0x6f, 0x94, 0x31, 0x13,
-	0xb4, 0xd2, 0x87, 0xee, 0x72, 0xbd, 0x66, 0xa7, 0xd0, 0x5f, 0x96, 0x73, 0x2b, 0x8e, 0xff, 0xb7,
-	0xb3, 0xaa, 0x40, 0xbc, 0x76, 0xb8, 0xcf, 0xc1, 0xd2, 0x27, 0xcd, 0x91, 0xd8, 0x23, 0xe8, 0xa3,
-	0xa4, 0x3c, 0xfe, 0xd3, 0x57, 0xd6, 0x26, 0x5e, 0xd7, 0xdd, 0x6f, 0x06, 0x98, 0xef, 0x44, 0xf9,
-	0x4e, 0xb3, 0x1c, 0xc3, 0xf8, 0x4b, 0x15, 0xa1, 0xda, 0xb1, 0x13, 0xe8, 0xf9, 0xb9, 0x90, 0xcb,
-	0x55, 0x95, 0x61, 0xd0, 0x1e, 0x55, 0x3e, 0xa9, 0xe9, 0x16, 0xaf, 0x1c, 0xcc, 0x6b, 0xe7, 0x76,
-	0x7f, 0x85, 0x53, 0x87, 0x9b, 0x6e, 0x35, 0xc3, 0x27, 0x7b, 0x60, 0x07, 0x58, 0x2c, 0x51, 0x06,
-	0x28, 0xa9, 0x70, 0x2f, 0x00, 0xa6, 0xa2, 0x58, 0x61, 0xf0, 0xfa, 0x67, 0x74, 0x46, 0x8b, 0x8e,
-	0x3d, 0x00, 0x8d, 0xed, 0x6f, 0x51, 0x2a, 0xa8, 0x2f, 0xa1, 0xaf, 0xce, 0x51, 0x24, 0x1e, 0x43,
-	0x4f, 0x35, 0x36, 0x20, 0x0e, 0xda, 0x96, 0x76, 0x14, 0xaf, 0x3c, 0x13, 0xf8, 0xd8, 0xfc, 0xe2,
-	0x7e, 0x4f, 0xbf, 0xb9, 0xa7, 0x3f, 0x02, 0x00, 0x00, 0xff, 0xff, 0xdc, 0x35, 0xaa, 0x16, 0x05,
-	0x04, 0x00, 0x00,
+	// 1238 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x94, 0x56, 0x5f, 0x73, 0xdb, 0x44,
+	0x10, 0x8f, 0x2c, 0x5b, 0xb6, 0x57, 0x4e, 0x6a, 0x8e, 0x12, 0x34, 0x61, 0xa0, 0x8e, 0x86, 0x19,
+	0x0c, 0x65, 0x1c, 0x1a, 0x0a, 0x3c, 0xf1, 0x40, 0x5c, 0x17, 0x9b, 0xba, 0x36, 0x73, 0x71, 0x81,
+	0x96, 0x87, 0x8c, 0x2c, 0x9d, 0x6d, 0x11, 0x5b, 0x12, 0xba, 0x73, 0x69, 0x78, 0x83, 0xcf, 0xc1,
+	0xb7, 0xe0, 0x95, 0x8f, 0xc5, 0x07, 0x60, 0x76, 0xef, 0x64, 0xbb, 0xff, 0xe8, 0xe4, 0x6d, 0x7f,
+	0x7b, 0xfb, 0xe7, 0xa7, 0xdd, 0xbd, 0x3d, 0xc1, 0xc1, 0x2a, 0x48, 0xe2, 0x99, 0x90, 0xaa, 0x93,
+	0xe5, 0xa9, 0x4a, 0x59, 0xad, 0xc0, 0x47, 0xb7, 0xe6, 0x69, 0x3a, 0x5f, 0x8a, 0x13, 0xd2, 0x4f,
+	0xd7, 0xb3, 0x13, 0x15, 0xaf, 0x84, 0x54, 0xc1, 0x2a, 0xd3, 0xa6, 0xfe, 0xdf, 0x25, 0xa8, 0xf0,
+	0x20, 0x99, 0x0b, 0x76, 0x08, 0x4e, 0x3a, 0x9b, 0x49, 0xa1, 0xbc, 0x52, 0xcb, 0x6a, 0xdb, 0xdc,
+	0x20, 0xd4, 0x2f, 0x45, 0x32, 0x57, 0x0b, 0xcf, 0xd6, 0x7a, 0x8d, 0xd8, 0xfb, 0x00, 0xd3, 0x65,
+	0x3a, 0xbd, 0x98, 0x5e, 0x29, 0x21, 0xbd, 0x72, 0xcb, 0x6a, 0x37, 0x78, 0x1d, 0x35, 0x67, 0xa8,
+	0x60, 0x5f, 0x83, 0x1b, 0xa6, 0xab, 0x2c, 0x17, 0x52, 0xc6, 0x69, 0xe2, 0x55, 0x5a, 0x56, 0xfb,
+	0xe0, 0xf4, 0xbd, 0xce, 0x86, 0x29, 0x25, 0xed, 0x74, 0xb7, 0x26, 0x7c, 0xd7, 0x9e, 0x9d, 0xc0,
+	0xdb, 0xeb, 0xa4, 0x50, 0x88, 0xe8, 0xc2, 0x50, 0x70, 0x88, 0x02, 0xdb, 0x3d, 0x1a, 0x6a, 0x3a,
+	0x0c, 0xca, 0x8b, 0x74, 0x29, 0xbc, 0x6a, 0xcb, 0x6a, 0xd7, 0x38, 0xc9, 0xec, 0x2e, 0x1c, 0x46,
+	0x22, 0xcb, 0x45, 0x18, 0x28, 0x11, 0x5d, 0x10, 0x5b, 0xa9, 0xf2, 0x38, 0x99, 0x7b, 0x56, 0xcb,
+	0x6a, 0xd7, 0xf9, 0xcd, 0xed, 0xe9, 0xd9, 0x32, 0x9d, 0x9e, 0xd3, 0x99, 0x7f, 0x0c, 0xee, 0x0e,
+	0x2d, 0x56, 0x83, 0xf2, 0x68, 0x3c, 0xea, 0x35, 0xf7, 0x50, 0x7a, 0x32, 0x1c, 0x9c, 0x35, 0x2d,
+	0xff, 0x0e, 0x38, 0xe7, 0x2a, 0x17, 0xc1, 0x8a, 0x7d, 0x04, 0x4e, 0x8e, 0x5f, 0x22, 0x3d, 0xab,
+	0x65, 0xb7, 0xdd, 0xd3, 0x1b, 0x2f, 0x7c, 0x21, 0x37, 0xc7, 0xfe, 0x3f, 0x15, 0xa8, 0x3d, 0x14,
+	0x2a, 0x88, 0x02, 0x15, 0xb0, 0xdb, 0x50, 0x56, 0x57, 0x99, 0x20, 0x1a, 0x07, 0xa7, 0xef, 0x6e,
+	0x7d, 0x0a, 0x8b, 0xce, 0xe4, 0x2a, 0x13, 0x9c, 0x8c, 0xd8, 0x97, 0x50, 0x0b, 0x73, 0x11, 0x28,
+	0x2c, 0x23, 0xb6, 0xc6, 0x3d, 0x3d, 0xea, 0xe8, 0xb6, 0x76, 0x8a, 0xb6, 0x76, 0x26, 0x45, 0x5b,
+	0xf9, 0xc6, 0x16, 0xfd, 0x56, 0x69, 0x14, 0xcf, 0x62, 0x11, 0x79, 0xf6, 0x9b, 0xfd, 0x0a, 0x5b,
+	0xac, 0xe4, 0x2a, 0x8d, 0x04, 0xb5, 0x74, 0x9f, 0x93, 0xcc, 0x6e, 0x81, 0xbb, 0x8c, 0x93, 0xcb,
+	0x0b, 0x15, 0xe4, 0x73, 0xa1, 0xa8, 0x9b, 0x0d, 0x0e, 0xa8, 0x9a, 0x90, 0x06, 0x9d, 0x64, 0xfc,
+	0xbb, 0x30, 0x0d, 0x22, 0x99, 0xdd, 0x84, 0x4a, 0x9c, 0xa4, 0x91, 0xee, 0x49, 0x99, 0x6b, 0xc0,
+	0xee, 0x42, 0x35, 0x5c, 0x60, 0x4d, 0x22, 0xaf, 0xf6, 0x46, 0x56, 0x85, 0x29, 0xeb, 0x40, 0x25,
+	0xfd, 0x2d, 0x11, 0xb9, 0x57, 0x27, 0x1f, 0xef, 0x15, 0x25, 0x1b, 0xe3, 0x39, 0xd7, 0x66, 0xec,
+	0x33, 0x70, 0x9e, 0x05, 0x4a, 0xe5, 0xd2, 0x83, 0x96, 0xfd, 0x1a, 0x87, 0x9f, 0xd0, 0x80, 0x1b,
+	0x3b, 0x9c, 0x67, 0xfa, 0xc4, 0x79, 0x9e, 0xae, 0x33, 0xcf, 0xa5, 0x01, 0xa9, 0xa3, 0xe6, 0x5b,
+	0x54, 0xe0, 0x35, 0x88, 0xc4, 0xd3, 0x38, 0x14, 0x5e, 0x83, 0xbe, 0xc6, 0xa0, 0xa3, 0x47, 0x50,
+	0xa1, 0xc4, 0xac, 0x09, 0xf6, 0x3a, 0x8e, 0xa8, 0xa5, 0xfb, 0x1c, 0x45, 0xd4, 0xcc, 0xe3, 0x88,
+	0x7a, 0xb6, 0xcf, 0x51, 0xc4, 0x2a, 0xad, 0xa5, 0xc8, 0xa9, 0x1d, 0x75, 0x4e, 0x32, 0x56, 0x49,
+	0xa7, 0x2c, 0x93, 0x52, 0x83, 0xa3, 0x3b, 0x50, 0x21, 0x7a, 0xe8, 0x92, 0x04, 0x2b, 0x61, 0x26,
+	0x96, 0x64, 0x74, 0x79, 0x1a, 0x2c, 0xd7, 0x82, 0x42, 0x37, 0xb8, 0x06, 0xfe, 0xcf, 0x50, 0xc6,
+	0xa9, 0x61, 0x2e, 0x54, 0x1f, 0x8d, 0x1e, 0x8c, 0xc6, 0x3f, 0x8e, 0xf4, 0xcc, 0xde, 0x1f, 0x0c,
+	0x7b, 0x4d, 0x0b, 0xd5, 0xe7, 0x8f, 0x1f, 0x0e, 0x07, 0xa3, 0x07, 0xcd, 0x12, 0xdb, 0x87, 0xfa,
+	0xbd, 0x01, 0xef, 0x75, 0x27, 0x63, 0xfe, 0xb8, 0x69, 0x6b, 0xab, 0xfb, 0xe3, 0x66, 0x99, 0x01,
+	0x38, 0xf7, 0x7a, 0x3f, 0x0c, 0xba, 0xbd, 0x66, 0x05, 0xe5, 0xf3, 0x71, 0xf7, 0x41, 0x6f, 0xd2,
+	0x74, 0xfc, 0xc7, 0x50, 0xed, 0xa6, 0x89, 0x12, 0x89, 0x62, 0x1d, 0xa8, 0xad, 0x4c, 0x09, 0x89,
+	0x95, 0x7b, 0xca, 0x5e, 0x2e, 0x2e, 0xdf, 0xd8, 0xd0, 0xcd, 0x0c, 0xa4, 0x5e, 0x1f, 0x0d, 0x4e,
+	0xf2, 0x77, 0xe5, 0x5a, 0xa9, 0x69, 0xf3, 0x32, 0x9e, 0xfb, 0x7d, 0xa8, 0xf4, 0x12, 0x95, 0x5f,
+	0xa1, 0x61, 0x16, 0xa8, 0x05, 0x05, 0x6d, 0x70, 0x92, 0xd9, 0x6d, 0xa8, 0x86, 0x3a, 0xaf, 0x99,
+	0xfd, 0xb7, 0xb6, 0xb9, 0x0c, 0x21, 0x5e, 0x58, 0xf8, 0x5f, 0x40, 0x8d, 0x22, 0x9d, 0x0b, 0xc5,
+	0x3e, 0x86, 0xaa, 0x48, 0x54, 0x1e, 0xbf, 0xea, 0x66, 0x92, 0x11, 0x2f, 0xce, 0xfd, 0x7f, 0x2d,
+	0x28, 0x7f, 0x1f, 0xe8, 0x15, 0x98, 0xe5, 0x62, 0x16, 0x3f, 0x33, 0x14, 0x0c, 0x62, 0x9f, 0x80,
+	0x33, 0xcd, 0x83, 0x24, 0x5c, 0x18, 0x0e, 0xcd, 0x6d, 0x28, 0xbd, 0x06, 0xfa, 0x7b, 0xdc, 0x58,
+	0xb0, 0xce, 0x36, 0xaf, 0xfd, 0x62, 0x71, 0x0a, 0x72, 0xfd, 0xbd, 0x4d, 0x72, 0x76, 0x0c, 0xae,
+	0xf6, 0xbc, 0xa0, 0x22, 0xd1, 0x1e, 0xed, 0xef, 0x71, 0xd0, 0xca, 0x7e, 0x20, 0x17, 0xd8, 0xee,
+	0x30, 0x5d, 0x27, 0xfa, 0xda, 0xd9, 0x5c, 0x03, 0x9c, 0xf0, 0x85, 0x08, 0x22, 0x91, 0xd3, 0x9d,
+	0x7b, 0x6e, 0xc2, 0xcf, 0x93, 0x20, 0x93, 0x8b, 0x54, 0xf5, 0xe9, 0x9c, 0x1b, 0xbb, 0xb3, 0x7d,
+	0x70, 0x23, 0x21, 0x43, 0x91, 0x44, 0x22, 0x51, 0xd2, 0xbf, 0x0f, 0x80, 0xe1, 0x45, 0x74, 0x6f,
+	0xb7, 0x4b, 0xd6, 0xb6, 0x4b, 0xec, 0x43, 0xa0, 0x0e, 0xbd, 0xee, 0xab, 0x4d, 0xff, 0xbe, 0x82,
+	0x2a, 0xc6, 0xc1, 0xa2, 0x7f, 0x0a, 0x0e, 0x3a, 0x6e, 0x6a, 0x7e, 0x73, 0xeb, 0xb2, 0x4d, 0xc5,
+	0x8d, 0x8d, 0x3f, 0x06, 0xb7, 0xbb, 0x58, 0x27, 0x97, 0xff, 0xc3, 0xe0, 0x10, 0x9c, 0x10, 0x4d,
+	0xa4, 0x57, 0x6a, 0xd9, 0xd8, 0x11, 0x8d, 0xb0, 0x24, 0xb8, 0xe1, 0xb1, 0xc6, 0x36, 0x96, 0x84,
+	0x80, 0xff, 0x0b, 0xd4, 0x71, 0x8f, 0x0f, 0x92, 0x48, 0x3c, 0xbb, 0x1e, 0x17, 0x76, 0x82, 0x5b,
+	0x89, 0xb8, 0x50, 0x26, 0xf7, 0xf4, 0x9d, 0x9d, 0x39, 0xdb, 0x92, 0xe4, 0x85, 0x95, 0x3f, 0x81,
+	0x06, 0x86, 0xe1, 0xeb, 0xe4, 0x6c, 0x99, 0x86, 0x97, 0xc8, 0x68, 0x16, 0xe7, 0x52, 0x19, 0xfa,
+	0x1a, 0x5c, 0xf7, 0x51, 0xf5, 0xff, 0x28, 0x6d, 0xc2, 0xea, 0xaf, 0xd8, 0xf4, 0xde, 0xda, 0xed,
+	0x7d, 0x07, 0x9c, 0x29, 0x66, 0x95, 0x86, 0xec, 0xe1, 0xf3, 0xdf, 0x56, 0x90, 0xe2, 0xc6, 0x0a,
+	0xa3, 0x4c, 0x97, 0x69, 0xba, 0x32, 0x77, 0x50, 0x03, 0x76, 0x0c, 0x0d, 0x12, 0x2e, 0x4c, 0x9d,
+	0xf4, 0xc2, 0x77, 0x49, 0xd7, 0x2f, 0xca, 0xa2, 0x1f, 0xaa, 0x97, 0x9e, 0xef, 0x5d, 0x92, 0xbb,
+	0x8f, 0xd5, 0x07, 0x00, 0x72, 0x9d, 0x89, 0x5c, 0x8a, 0x48, 0x48, 0xcf, 0x69, 0xd9, 0xed, 0x3a,
+	0xdf, 0xd1, 0xf8, 0xc7, 0x66, 0x49, 0xdd, 0x00, 0x77, 0x30, 0xea, 0xf2, 0xde, 0xc3, 0xde, 0x68,
+	0xf2, 0xcd, 0xd0, 0x2c, 0xaa, 0x47, 0xc3, 0x61, 0xd3, 0xf2, 0xff, 0x2a, 0xc1, 0xc1, 0xf3, 0x13,
+	0xcc, 0x8e, 0xa0, 0xb6, 0x48, 0xa5, 0xda, 0x59, 0x84, 0x1b, 0xbc, 0xd9, 0xa9, 0xa5, 0x9d, 0x9d,
+	0x7a, 0x08, 0x8e, 0x4c, 0xd7, 0x79, 0x28, 0xcc, 0xa6, 0x35, 0x68, 0xe7, 0x82, 0xeb, 0x65, 0x6b,
+	0x10, 0xc6, 0x50, 0xc1, 0x5c, 0x7a, 0x15, 0xe2, 0x4b, 0x32, 0x6b, 0xe9, 0xdb, 0x92, 0xc7, 0x19,
+	0xbd, 0xbc, 0x0e, 0x39, 0xec, 0xaa, 0x98, 0x07, 0xd5, 0xa7, 0x22, 0xa7, 0xdf, 0x9b, 0x2a, 0x9d,
+	0x16, 0x10, 0xeb, 0x8d, 0xdb, 0x4b, 0xd2, 0x0b, 0x67, 0x73, 0x0d, 0xf4, 0x88, 0xe0, 0xd0, 0xd6,
+	0xb5, 0x96, 0x00, 0xf5, 0x86, 0x7e, 0xa1, 0x40, 0x6b, 0x09, 0x60, 0xec, 0x2c, 0xc8, 0xf1, 0x9e,
+	0x7a, 0x2e, 0x8d, 0x78, 0x01, 0xfd, 0x3f, 0x2d, 0xa8, 0x0d, 0xd3, 0xf0, 0x72, 0x90, 0xcc, 0xd2,
+	0x6b, 0x17, 0xa6, 0x09, 0x76, 0x16, 0x47, 0x66, 0xe8, 0x50, 0xc4, 0x44, 0x61, 0xba, 0x5a, 0x05,
+	0x49, 0x64, 0x6a, 0x52, 0x40, 0x8c, 0x1d, 0x84, 0xbf, 0xae, 0xe3, 0x5c, 0x44, 0x66, 0xf3, 0x6c,
+	0xf0, 0x19, 0x3c, 0xd9, 0xfc, 0x63, 0x4e, 0x1d, 0x7a, 0xb7, 0x3f, 0xff, 0x6f, 0x00, 0xde, 0x9e,
+	0x15, 0xc0, 0x86, 0x0a, 0x00, 0x00,
 }
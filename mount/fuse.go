@@ -78,6 +78,8 @@ type fuseNode struct {
 var _ fs.NodeStringLookuper = (*fuseNode)(nil)
 var _ fs.NodeOpener = (*fuseNode)(nil)
 var _ fs.NodeReadlinker = (*fuseNode)(nil)
+var _ fs.NodeGetxattrer = (*fuseNode)(nil)
+var _ fs.NodeListxattrer = (*fuseNode)(nil)
 
 func fullpath(parent, name string) string {
 	if parent == "" {
@@ -100,7 +102,15 @@ func (n *fuseNode) Lookup(ctx context.Context, name string) (fs.Node, error) {
 		if !exists {
 			return nil, fuse.ENOENT
 		}
-		meta, data = nil, nil
+		// the directory's own metadata, if it was stored.
+		meta, _, err = n.snap.Open(ctx, fullpath(child, ""))
+		if err != nil {
+			if !errors.Is(err, session.ErrNotFound) {
+				return nil, logE(err)
+			}
+			meta = nil
+		}
+		data = nil
 	} else if data != nil {
 		err = data.Close()
 		if err != nil {
@@ -123,6 +133,10 @@ var (
 func (n *fuseNode) Attr(ctx context.Context, out *fuse.Attr) error {
 	out.Uid = uid
 	out.Gid = gid
+	if owner := n.meta.GetOwner(); owner != nil {
+		out.Uid = owner.Uid
+		out.Gid = owner.Gid
+	}
 	if n.meta == nil {
 		out.Mode = os.ModeDir | 0500
 		return nil
@@ -140,8 +154,14 @@ func (n *fuseNode) Attr(ctx context.Context, out *fuse.Attr) error {
 	out.Crtime = crTime
 	if n.data != nil {
 		out.Size = uint64(n.data.Length())
-		out.Blocks = out.Size / 512
-		if out.Size%512 != 0 {
+		// holes take no blocks, so that tools like cp can tell the file is
+		// sparse and keep it that way.
+		allocated := out.Size
+		for _, hole := range n.data.Holes() {
+			allocated -= uint64(hole.Length)
+		}
+		out.Blocks = allocated / 512
+		if allocated%512 != 0 {
 			out.Blocks++
 		}
 	}
@@ -149,6 +169,15 @@ func (n *fuseNode) Attr(ctx context.Context, out *fuse.Attr) error {
 	case manifest.Metadata_FILE:
 	case manifest.Metadata_SYMLINK:
 		out.Mode = os.ModeSymlink
+	case manifest.Metadata_DIRECTORY:
+		out.Mode = os.ModeDir
+	case manifest.Metadata_FIFO:
+		out.Mode = os.ModeNamedPipe
+	case manifest.Metadata_DEVICE:
+		out.Mode = os.FileMode(n.meta.Mode) & (os.ModeDevice | os.ModeCharDevice)
+		out.Rdev = uint32(n.meta.Device)
+	case manifest.Metadata_SOCKET:
+		out.Mode = os.ModeSocket
 	default:
 		return logE(fmt.Errorf("unknown object type: %v", n.meta.Type))
 	}
@@ -156,6 +185,23 @@ func (n *fuseNode) Attr(ctx context.Context, out *fuse.Attr) error {
 	return nil
 }
 
+func (n *fuseNode) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	for _, xattr := range n.meta.GetXattrs() {
+		if xattr.Name == req.Name {
+			resp.Xattr = xattr.Value
+			return nil
+		}
+	}
+	return fuse.ErrNoXattr
+}
+
+func (n *fuseNode) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	for _, xattr := range n.meta.GetXattrs() {
+		resp.Append(xattr.Name)
+	}
+	return nil
+}
+
 type fuseDir struct {
 	n *fuseNode
 }
@@ -166,6 +212,10 @@ func (d *fuseDir) ReadDirAll(ctx context.Context) (entries []fuse.Dirent, err er
 	prefix := fullpath(d.n.path, "")
 	err = d.n.snap.List(ctx, prefix, false,
 		func(ctx context.Context, entry *session.ListEntry) error {
+			if entry.Path == prefix {
+				// the directory's own metadata
+				return nil
+			}
 			mode := fuse.DT_Dir
 			if !entry.Prefix {
 				switch entry.Meta.Type {
@@ -173,6 +223,15 @@ func (d *fuseDir) ReadDirAll(ctx context.Context) (entries []fuse.Dirent, err er
 					mode = fuse.DT_File
 				case manifest.Metadata_SYMLINK:
 					mode = fuse.DT_Link
+				case manifest.Metadata_FIFO:
+					mode = fuse.DT_FIFO
+				case manifest.Metadata_DEVICE:
+					mode = fuse.DT_Block
+					if os.FileMode(entry.Meta.Mode)&os.ModeCharDevice != 0 {
+						mode = fuse.DT_Char
+					}
+				case manifest.Metadata_SOCKET:
+					mode = fuse.DT_Socket
 				default:
 					return fmt.Errorf("unknown object type: %v", entry.Meta.Type)
 				}
@@ -8,15 +8,18 @@ import (
 	"io"
 	"reflect"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/zeebo/errs"
 
 	"github.com/jtolio/jam/backends"
 	"github.com/jtolio/jam/blobs"
+	"github.com/jtolio/jam/hashdb"
 	"github.com/jtolio/jam/manifest"
 	"github.com/jtolio/jam/pathdb/b"
-	"github.com/jtolio/jam/streams"
 	"github.com/jtolio/jam/utils"
 )
 
@@ -25,27 +28,68 @@ const versionHeader = "jam-v0\n"
 type DB struct {
 	backend backends.Backend
 	blobs   *blobs.Store
+	hashes  hashdb.DB
 	changed bool
-	// TODO: don't expect the whole manifest to fit into RAM
+
+	mtx  sync.Mutex
 	tree *b.Tree
+	// unread has the branches that haven't been read yet, by prefix. tree
+	// has none of the paths that start with one of them.
+	unread map[string]*branch
+	read   []*branch
+
+	header *manifest.SnapshotHeader
+	// stats is kept up to date as paths change, but starts out unknown for
+	// manifests without a header.
+	stats      Stats
+	statsKnown bool
 }
 
-func Open(ctx context.Context, backend backends.Backend, blobStore *blobs.Store, stream io.Reader) (*DB, error) {
-	db := New(backend, blobStore)
-	return db, db.load(ctx, stream)
+func Open(ctx context.Context, backend backends.Backend, blobStore *blobs.Store, hashes hashdb.DB,
+	stream io.Reader) (*DB, error) {
+	db := New(backend, blobStore, hashes)
+	err := db.load(ctx, stream)
+	db.statsKnown = db.header != nil
+	return db, err
 }
 
-func New(backend backends.Backend, blobStore *blobs.Store) *DB {
+func New(backend backends.Backend, blobStore *blobs.Store, hashes hashdb.DB) *DB {
 	return &DB{
-		backend: backend,
-		blobs:   blobStore,
-		tree:    b.TreeNew(strings.Compare),
+		backend:    backend,
+		blobs:      blobStore,
+		hashes:     hashes,
+		tree:       b.TreeNew(strings.Compare),
+		unread:     map[string]*branch{},
+		statsKnown: true,
 	}
 }
 
 func (db *DB) load(ctx context.Context, stream io.Reader) error {
+	return readPages(stream, func(page *manifest.Page) error {
+		if header := page.GetHeader(); header != nil {
+			db.header = header
+			db.stats = Stats{Paths: header.Paths, Files: header.Files, Bytes: header.Bytes}
+		}
+		if branch := pageBranch(page); branch != nil {
+			db.unread[string(page.Prefix)] = branch
+		}
+		if entries := page.GetEntries(); entries != nil {
+			for _, entry := range entries.Entries {
+				err := fixHash(entry)
+				if err != nil {
+					return err
+				}
+				db.tree.Set(string(entry.Path), entry.Content)
+			}
+		}
+		return nil
+	})
+}
+
+// readPages calls cb with every page of the manifest in stream.
+func readPages(stream io.Reader, cb func(page *manifest.Page) error) (err error) {
 	v := make([]byte, len([]byte(versionHeader)))
-	_, err := io.ReadFull(stream, v)
+	_, err = io.ReadFull(stream, v)
 	if err != nil {
 		if err == io.EOF {
 			err = errs.Wrap(io.ErrUnexpectedEOF)
@@ -69,39 +113,36 @@ func (db *DB) load(ctx context.Context, stream io.Reader) error {
 		err := utils.UnmarshalSized(r, &page)
 		if err != nil {
 			if err == io.EOF {
-				break
+				return nil
 			}
 			return err
 		}
-		if branch := page.GetBranch(); branch != nil {
-			substream, err := streams.Open(ctx, db.backend, branch)
-			if err != nil {
-				return err
-			}
-			err = db.load(ctx, substream)
-			if err != nil {
-				return err
-			}
-		}
-		if entries := page.GetEntries(); entries != nil {
-			for _, entry := range entries.Entries {
-				contentHash := entry.Content.Hash
-				if len(contentHash) > 0 && len(contentHash) != sha256.Size {
-					if len(contentHash) != sha256.Size*2 {
-						return errs.New("unknown hash length")
-					}
-					// TODO: sadlol, remove after everything is migrated
-					entry.Content.Hash = contentHash[len(contentHash)-sha256.Size:]
-				}
-				db.tree.Set(string(entry.Path), entry.Content)
-			}
+		err = cb(&page)
+		if err != nil {
+			return err
 		}
 	}
+}
 
+func fixHash(entry *manifest.Entry) error {
+	contentHash := entry.Content.Hash
+	if len(contentHash) > 0 && len(contentHash) != sha256.Size {
+		if len(contentHash) != sha256.Size*2 {
+			return errs.New("unknown hash length")
+		}
+		// TODO: sadlol, remove after everything is migrated
+		entry.Content.Hash = contentHash[len(contentHash)-sha256.Size:]
+	}
 	return nil
 }
 
 func (db *DB) Get(ctx context.Context, path string) (*manifest.Content, error) {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	err := db.readPath(ctx, path)
+	if err != nil {
+		return nil, err
+	}
 	v, ok := db.tree.Get(path)
 	if !ok {
 		return nil, nil
@@ -110,6 +151,21 @@ func (db *DB) Get(ctx context.Context, path string) (*manifest.Content, error) {
 }
 
 func (db *DB) HasPrefix(ctx context.Context, prefix string) (exists bool, err error) {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if prefix != "" {
+		// a branch with prefix itself doesn't need to be read, since branches
+		// are never empty.
+		err = db.readPath(ctx, prefix[:len(prefix)-1])
+		if err != nil {
+			return false, err
+		}
+	}
+	for branch := range db.unread {
+		if strings.HasPrefix(branch, prefix) {
+			return true, nil
+		}
+	}
 	it, _ := db.tree.Seek(prefix)
 	path, _, err := it.Next()
 	if err != nil {
@@ -123,28 +179,58 @@ func (db *DB) HasPrefix(ctx context.Context, prefix string) (exists bool, err er
 
 func (db *DB) List(ctx context.Context, prefix string, recursive bool,
 	cb func(ctx context.Context, path string, content *manifest.Content) error) error {
-	it, _ := db.tree.Seek(prefix)
+	// a non-recursive listing doesn't need to read branches that are all
+	// within one subdirectory, since the subdirectory is all it lists of them.
+	var dirs []string
+	var dirSet map[string]bool
+	if !recursive {
+		dirSet = map[string]bool{}
+	}
+	it, err := db.seek(ctx, prefix, dirSet)
+	if err != nil {
+		return err
+	}
+	for dir := range dirSet {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	var lastDir string
+	var emitted bool
+	emitDir := func(dir string) error {
+		if emitted && dir == lastDir {
+			return nil
+		}
+		lastDir, emitted = dir, true
+		return cb(ctx, dir, nil)
+	}
 
 	for {
-		path, content, err := it.Next()
+		path, content, ok, err := db.nextWithPrefix(it, prefix)
 		if err != nil {
-			if err == io.EOF {
-				break
-			}
 			return err
 		}
-		if !strings.HasPrefix(path, prefix) {
-			break
+		for len(dirs) > 0 && (!ok || dirs[0]+"/" <= path) {
+			err = emitDir(dirs[0])
+			if err != nil {
+				return err
+			}
+			dirs = dirs[1:]
+		}
+		if !ok {
+			return nil
 		}
 
 		if !recursive {
 			if idx := strings.Index(path[len(prefix):], "/"); idx >= 0 {
 				path = path[:len(prefix)+idx]
-				err = cb(ctx, path, nil)
+				err = emitDir(path)
 				if err != nil {
 					return err
 				}
+				db.mtx.Lock()
 				it, _ = db.tree.Seek(path + "0") // "0" is the next byte after "/"
+				db.mtx.Unlock()
 				continue
 			}
 		}
@@ -154,7 +240,39 @@ func (db *DB) List(ctx context.Context, prefix string, recursive bool,
 			return err
 		}
 	}
-	return nil
+}
+
+// seek reads the branches that paths starting with prefix could be in (see
+// readPrefix about dirs) and returns an enumerator from prefix on.
+func (db *DB) seek(ctx context.Context, prefix string, dirs map[string]bool) (*b.Enumerator, error) {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	err := db.readPrefix(ctx, prefix, dirs)
+	if err != nil {
+		return nil, err
+	}
+	it, _ := db.tree.Seek(prefix)
+	return it, nil
+}
+
+// nextWithPrefix returns the next path from it, if it starts with prefix.
+// Enumerators can be used while branches are being read, since they notice
+// when the tree changes.
+func (db *DB) nextWithPrefix(it *b.Enumerator, prefix string) (
+	path string, content *manifest.Content, ok bool, err error) {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	path, content, err = it.Next()
+	if err != nil {
+		if err == io.EOF {
+			return "", nil, false, nil
+		}
+		return "", nil, false, err
+	}
+	if !strings.HasPrefix(path, prefix) {
+		return "", nil, false, nil
+	}
+	return path, content, true, nil
 }
 
 type PutState int
@@ -166,38 +284,65 @@ const (
 )
 
 func (db *DB) Put(ctx context.Context, path string, content *manifest.Content) (state PutState, err error) {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	err = db.readPath(ctx, path)
+	if err != nil {
+		return PutStateUnchanged, err
+	}
 	state = PutStateNew
 	if v, ok := db.tree.Get(path); ok {
 		if reflect.DeepEqual(v, content) {
 			return PutStateUnchanged, nil
 		}
 		state = PutStateChanged
+		db.stats.add(v, -1)
 	}
 
 	db.tree.Set(path, content)
+	db.stats.add(content, 1)
 	db.changed = true
 	return state, nil
 }
 
 func (db *DB) Delete(ctx context.Context, path string) (removed bool, err error) {
-	if _, ok := db.tree.Get(path); !ok {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	err = db.readPath(ctx, path)
+	if err != nil {
+		return false, err
+	}
+	v, ok := db.tree.Get(path)
+	if !ok {
 		return false, nil
 	}
 
 	utils.L(ctx).Normalf("deleted path %q", path)
 	db.tree.Delete(path)
+	db.stats.add(v, -1)
 	db.changed = true
 	return true, nil
 }
 
 // Rename renames paths using regexp.ReplaceAllString (replacement can have
-// regexp expansions). See the docs for regexp.ReplaceAllString
-func (db *DB) Rename(ctx context.Context, re *regexp.Regexp, replacement string) (renamed int, err error) {
+// regexp expansions). See the docs for regexp.ReplaceAllString. cb, if not
+// nil, is called with every rename before any are applied. Rename fails
+// without changing anything if two paths would be renamed to the same path or
+// a path would be renamed over an existing path that isn't also renamed.
+func (db *DB) Rename(ctx context.Context, re *regexp.Regexp, replacement string,
+	cb func(ctx context.Context, oldPath, newPath string) error) (renamed int, err error) {
 	type element struct {
 		path    string
+		newPath string
 		content *manifest.Content
 	}
 	var queue []element
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	err = db.readAll(ctx)
+	if err != nil {
+		return 0, err
+	}
 	it, err := db.tree.SeekFirst()
 	if err != nil {
 		if err == io.EOF {
@@ -216,7 +361,35 @@ func (db *DB) Rename(ctx context.Context, re *regexp.Regexp, replacement string)
 			return 0, err
 		}
 		if re.MatchString(path) {
-			queue = append(queue, element{path: path, content: content})
+			queue = append(queue, element{
+				path:    path,
+				newPath: re.ReplaceAllString(path, replacement),
+				content: content,
+			})
+		}
+	}
+
+	sources := map[string]bool{}
+	for _, el := range queue {
+		sources[el.path] = true
+	}
+	destinations := map[string]string{}
+	for _, el := range queue {
+		if other, exists := destinations[el.newPath]; exists {
+			return 0, errs.New("both %q and %q would be renamed to %q", other, el.path, el.newPath)
+		}
+		destinations[el.newPath] = el.path
+		if _, exists := db.tree.Get(el.newPath); exists && !sources[el.newPath] {
+			return 0, errs.New("%q would be renamed to %q, which already exists", el.path, el.newPath)
+		}
+	}
+
+	if cb != nil {
+		for _, el := range queue {
+			err = cb(ctx, el.path, el.newPath)
+			if err != nil {
+				return 0, err
+			}
 		}
 	}
 
@@ -225,7 +398,7 @@ func (db *DB) Rename(ctx context.Context, re *regexp.Regexp, replacement string)
 	}
 
 	for _, el := range queue {
-		db.tree.Set(re.ReplaceAllString(el.path, replacement), el.content)
+		db.tree.Set(el.newPath, el.content)
 	}
 
 	if len(queue) > 0 {
@@ -237,6 +410,12 @@ func (db *DB) Rename(ctx context.Context, re *regexp.Regexp, replacement string)
 
 func (db *DB) DeleteAll(ctx context.Context, matcher func(path string) (delete bool)) (removed int, err error) {
 	var queue []string
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	err = db.readAll(ctx)
+	if err != nil {
+		return 0, err
+	}
 	it, err := db.tree.SeekFirst()
 	if err != nil {
 		if err == io.EOF {
@@ -247,7 +426,7 @@ func (db *DB) DeleteAll(ctx context.Context, matcher func(path string) (delete b
 	defer it.Close()
 
 	for {
-		path, _, err := it.Next()
+		path, content, err := it.Next()
 		if err != nil {
 			if err == io.EOF {
 				break
@@ -256,6 +435,7 @@ func (db *DB) DeleteAll(ctx context.Context, matcher func(path string) (delete b
 		}
 		if matcher(path) {
 			queue = append(queue, path)
+			db.stats.add(content, -1)
 		}
 	}
 
@@ -273,11 +453,36 @@ func (db *DB) Changed() bool {
 	return db.changed
 }
 
-func (db *DB) SerializeTo(ctx context.Context, destinationPath string) error {
-	// TODO: don't just dump all of the entries into the root manifest page.
+// SerializeTo writes the manifest to destinationPath, splitting it into
+// pages if it is large. Branches that were never read are referred to as
+// they are, and pages that are already stored aren't stored again. header
+// is written first, with the manifest's stats filled in.
+func (db *DB) SerializeTo(ctx context.Context, destinationPath string,
+	header *manifest.SnapshotHeader) error {
+	stats, err := db.Stats(ctx)
+	if err != nil {
+		return err
+	}
+	if header == nil {
+		header = &manifest.SnapshotHeader{}
+	} else {
+		header = proto.Clone(header).(*manifest.SnapshotHeader)
+	}
+	header.Paths, header.Files, header.Bytes = stats.Paths, stats.Files, stats.Bytes
+
 	// TODO: even if the whole manifest is in RAM, don't double the RAM usage here
-	var entries manifest.EntrySet
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+
+	var unread []string
+	for prefix := range db.unread {
+		unread = append(unread, prefix)
+	}
+	sort.Strings(unread)
 
+	// every path of an unread branch sorts after the branch's prefix and
+	// before the next path that doesn't start with it.
+	var items []*item
 	it, err := db.tree.SeekFirst()
 	if err != nil {
 		if err != io.EOF {
@@ -293,39 +498,98 @@ func (db *DB) SerializeTo(ctx context.Context, destinationPath string) error {
 				}
 				return err
 			}
-			entries.Entries = append(entries.Entries, &manifest.Entry{
-				Path:    []byte(path),
-				Content: content,
-			})
+			for len(unread) > 0 && unread[0] < path {
+				items = append(items, &item{path: unread[0], branch: db.unread[unread[0]]})
+				unread = unread[1:]
+			}
+			items = append(items, &item{path: path, content: content})
 		}
 	}
-
-	var page manifest.Page
-	page.Descendents = &manifest.Page_Entries{
-		Entries: &entries,
+	for _, prefix := range unread {
+		items = append(items, &item{path: prefix, branch: db.unread[prefix]})
 	}
-	data, err := utils.MarshalSized(&page)
+
+	pages, err := db.writePages(ctx, items)
 	if err != nil {
 		return err
 	}
-
-	var out bytes.Buffer
-	compressor := zlib.NewWriter(&out)
-	_, err = compressor.Write(data)
+	// the pages have to be found before the manifest refers to them.
+	err = db.hashes.Flush(ctx)
 	if err != nil {
 		return err
 	}
-	err = compressor.Close()
+	data, err := encodePages(append([]*manifest.Page{{Header: header}}, pages...))
 	if err != nil {
 		return err
 	}
+	return db.backend.Put(ctx, destinationPath, bytes.NewReader(data))
+}
+
+// Walk calls cb with the content of every path, and page with the hash and
+// data of every branch page. The hash is empty for pages from before pages
+// were content-addressed. Walk doesn't keep what it reads. Pages whose hash
+// is in seen, which may be nil, are skipped along with every path in them
+// that hasn't been read already, and the hashes of the rest are added to
+// seen, so that manifests that share pages can be walked without reading the
+// shared pages more than once. Paths aren't walked in order.
+func (db *DB) Walk(ctx context.Context, seen map[string]bool,
+	page func(ctx context.Context, hash string, data *manifest.Stream) error,
+	cb func(ctx context.Context, path string, content *manifest.Content) error) error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+
+	// the paths of branches that were read are in the tree.
+	for _, branch := range db.read {
+		if seen != nil && branch.hash != "" {
+			if seen[branch.hash] {
+				continue
+			}
+			seen[branch.hash] = true
+		}
+		data, err := db.branchData(ctx, branch)
+		if err != nil {
+			return err
+		}
+		err = page(ctx, branch.hash, data)
+		if err != nil {
+			return err
+		}
+	}
 
-	return db.backend.Put(ctx, destinationPath, io.NopCloser(io.MultiReader(
-		bytes.NewReader([]byte(versionHeader)),
-		utils.NewFramingReader(&out))))
+	it, err := db.tree.SeekFirst()
+	if err != nil {
+		if err != io.EOF {
+			return err
+		}
+	} else {
+		defer it.Close()
+		for {
+			path, content, err := it.Next()
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				return err
+			}
+			err = cb(ctx, path, content)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, branch := range db.unread {
+		err = db.walkBranch(ctx, branch, seen, page, cb)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (db *DB) Close() error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
 	tree := db.tree
 	db.tree = nil
 	if tree != nil {
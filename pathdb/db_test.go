@@ -1,13 +1,24 @@
 package pathdb
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
 	"sort"
 	"testing"
 
+	"github.com/golang/protobuf/ptypes/timestamp"
 	"github.com/stretchr/testify/require"
 
+	"github.com/jtolio/jam/backends"
+	"github.com/jtolio/jam/backends/fs"
+	"github.com/jtolio/jam/hashdb"
 	"github.com/jtolio/jam/manifest"
+	"github.com/jtolio/jam/streams"
 )
 
 var (
@@ -34,7 +45,7 @@ func collectPaths(list listFn, prefix string, recursive bool) (rv []string) {
 }
 
 func TestPathDB(t *testing.T) {
-	db := New(nil, nil)
+	db := New(nil, nil, nil)
 	paths := []string{
 		"", "a", "b", "/", "/a", "/b", "a/", "b/", "a/a", "a/b", "b/a", "b/b",
 		"a/a/a", "a/a/b", "a/b/a", "a/b/b", "b/a/a", "b/a/b", "b/b/a", "b/b/b",
@@ -55,3 +66,377 @@ func TestPathDB(t *testing.T) {
 	require.Equal(t, []string{"OBJ a/", "OBJ a/a", "PRE a/a", "OBJ a/b", "PRE a/b"},
 		collectPaths(db.List, "a/", false))
 }
+
+func TestDiff(t *testing.T) {
+	a, b := New(nil, nil, nil), New(nil, nil, nil)
+	for path, hash := range map[string]string{
+		"x/removed": "1", "x/same": "2", "x/changed": "3", "y/other": "4"} {
+		a.Put(ctx, path, &manifest.Content{Hash: []byte(hash)})
+	}
+	for path, hash := range map[string]string{
+		"x/added": "5", "x/same": "2", "x/changed": "6", "y/another": "7"} {
+		b.Put(ctx, path, &manifest.Content{Hash: []byte(hash)})
+	}
+
+	var diffs []string
+	require.NoError(t, Diff(ctx, a, b, "x/",
+		func(ctx context.Context, path string, oldContent, newContent *manifest.Content) error {
+			switch {
+			case oldContent == nil:
+				diffs = append(diffs, "A "+path)
+			case newContent == nil:
+				diffs = append(diffs, "D "+path)
+			default:
+				diffs = append(diffs, "M "+path)
+			}
+			return nil
+		}))
+	require.Equal(t, []string{"A x/added", "M x/changed", "D x/removed"}, diffs)
+}
+
+func mergeContent(hash string, modified int64) *manifest.Content {
+	return &manifest.Content{
+		Hash:     []byte(hash),
+		Metadata: &manifest.Metadata{Modified: &timestamp.Timestamp{Seconds: modified}},
+	}
+}
+
+func TestMerge(t *testing.T) {
+	tree := func(contents map[string]*manifest.Content) *DB {
+		db := New(nil, nil, nil)
+		for path, content := range contents {
+			db.Put(ctx, path, content)
+		}
+		return db
+	}
+	base := map[string]*manifest.Content{
+		"same": mergeContent("1", 1), "ours": mergeContent("2", 1), "theirs": mergeContent("3", 1),
+		"both": mergeContent("4", 1), "deleted": mergeContent("5", 1), "dir/": mergeContent("6", 1)}
+	ours := map[string]*manifest.Content{
+		"same": mergeContent("1", 1), "ours": mergeContent("2a", 2), "theirs": mergeContent("3", 1),
+		"both": mergeContent("4a", 3), "deleted": mergeContent("5a", 2), "dir/": mergeContent("6a", 3),
+		"added": mergeContent("7", 2)}
+	theirs := map[string]*manifest.Content{
+		"same": mergeContent("1", 1), "ours": mergeContent("2", 1), "theirs": mergeContent("3b", 2),
+		"both": mergeContent("4b", 2), "dir/": mergeContent("6b", 4), "added": mergeContent("7", 2),
+		"new": mergeContent("8", 2)}
+
+	merged := func(policy MergePolicy) (map[string]string, error) {
+		db := tree(ours)
+		_, err := Merge(ctx, db, tree(base), tree(theirs), policy, ".theirs")
+		hashes := map[string]string{}
+		require.NoError(t, db.List(ctx, "", true,
+			func(ctx context.Context, path string, content *manifest.Content) error {
+				hashes[path] = string(content.Hash)
+				return nil
+			}))
+		return hashes, err
+	}
+
+	hashes, err := merged(MergeFail)
+	require.True(t, ErrMergeConflict.Has(err))
+	require.Contains(t, err.Error(), `"both", "deleted", "dir/"`)
+	require.Equal(t, "2a", hashes["ours"])
+	require.Equal(t, "3", hashes["theirs"])
+
+	hashes, err = merged(MergeNewer)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"same": "1", "ours": "2a", "theirs": "3b", "both": "4a", "deleted": "5a",
+		"dir/": "6b", "added": "7", "new": "8"}, hashes)
+
+	hashes, err = merged(MergeKeepBoth)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"same": "1", "ours": "2a", "theirs": "3b", "both": "4a", "both.theirs": "4b",
+		"deleted": "5a", "dir/": "6b", "added": "7", "new": "8"}, hashes)
+}
+
+func TestRenameCollisions(t *testing.T) {
+	db := New(nil, nil, nil)
+	for _, path := range []string{"a/1", "a/2", "b/1", "c/1"} {
+		db.Put(ctx, path, &manifest.Content{Hash: []byte(path)})
+	}
+
+	_, err := db.Rename(ctx, regexp.MustCompile(`^[ab]/`), "d/", nil)
+	require.Error(t, err)
+	_, err = db.Rename(ctx, regexp.MustCompile(`^a/`), "c/", nil)
+	require.Error(t, err)
+	require.Equal(t, []string{"OBJ a/1", "OBJ a/2", "OBJ b/1", "OBJ c/1"},
+		collectPaths(db.List, "", true))
+
+	var renames []string
+	renamed, err := db.Rename(ctx, regexp.MustCompile(`^([ab])/1$`), "${1}/2",
+		func(ctx context.Context, oldPath, newPath string) error {
+			renames = append(renames, oldPath+" -> "+newPath)
+			return nil
+		})
+	require.Error(t, err)
+	require.Equal(t, 0, renamed)
+
+	renamed, err = db.Rename(ctx, regexp.MustCompile(`^a/(\d)$`), "b/${1}x",
+		func(ctx context.Context, oldPath, newPath string) error {
+			renames = append(renames, oldPath+" -> "+newPath)
+			return nil
+		})
+	require.NoError(t, err)
+	require.Equal(t, 2, renamed)
+	require.Equal(t, []string{"a/1 -> b/1x", "a/2 -> b/2x"}, renames)
+	require.Equal(t, []string{"OBJ b/1", "OBJ b/1x", "OBJ b/2x", "OBJ c/1"},
+		collectPaths(db.List, "", true))
+}
+
+func pathContent(path string) *manifest.Content {
+	hash := sha256.Sum256([]byte(path))
+	return &manifest.Content{Hash: hash[:]}
+}
+
+func reopen(t *testing.T, backend backends.Backend, hashes hashdb.DB, db *DB, path string) *DB {
+	require.NoError(t, db.SerializeTo(ctx, path, nil))
+	rc, err := backend.Get(ctx, path, 0, -1)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, rc.Close())
+	}()
+	db, err = Open(ctx, backend, nil, hashes, rc)
+	require.NoError(t, err)
+	return db
+}
+
+func countBlobs(t *testing.T, backend backends.Backend) (count int) {
+	require.NoError(t, backend.List(ctx, streams.BlobPrefix, func(ctx context.Context, path string) error {
+		count++
+		return nil
+	}))
+	return count
+}
+
+func TestPages(t *testing.T) {
+	td, err := os.MkdirTemp("", "pathdbtest")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(td))
+	}()
+
+	backend, err := fs.New(ctx, &url.URL{Path: td})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, backend.Close())
+	}()
+
+	hashes, err := hashdb.Open(ctx, backend)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, hashes.Close())
+	}()
+
+	// a flat directory too big for one page, directories big enough for
+	// pages of their own, and a few paths that stay in the root.
+	db := New(backend, nil, hashes)
+	var allPaths []string
+	put := func(path string) {
+		_, err := db.Put(ctx, path, pathContent(path))
+		require.NoError(t, err)
+		allPaths = append(allPaths, "OBJ "+path)
+	}
+	for i := 0; i < 3*maxPageEntries; i++ {
+		put(fmt.Sprintf("flat/%d", i))
+	}
+	for i := 0; i < 10; i++ {
+		for j := 0; j < minBranchEntries; j++ {
+			put(fmt.Sprintf("dirs/%d/%d", i, j))
+		}
+	}
+	put("a")
+	put("dirs/file")
+	put("z/file")
+	sort.Strings(allPaths)
+
+	opened := reopen(t, backend, hashes, db, "manifest/1")
+	defer func() {
+		require.NoError(t, opened.Close())
+	}()
+	require.Empty(t, opened.read)
+	require.NotEmpty(t, opened.unread)
+
+	content, err := opened.Get(ctx, "dirs/3/7")
+	require.NoError(t, err)
+	require.Equal(t, pathContent("dirs/3/7"), content)
+	// the pages of dirs/ and dirs/3/
+	require.Len(t, opened.read, 2)
+	content, err = opened.Get(ctx, "dirs/3/missing")
+	require.NoError(t, err)
+	require.Nil(t, content)
+
+	// listing dirs/ doesn't need the pages of its subdirectories.
+	var expected []string
+	for i := 0; i < 10; i++ {
+		expected = append(expected, fmt.Sprintf("PRE dirs/%d", i))
+	}
+	expected = append(expected, "OBJ dirs/file")
+	require.Equal(t, expected, collectPaths(opened.List, "dirs/", false))
+	require.Len(t, opened.read, 2)
+
+	exists, err := opened.HasPrefix(ctx, "dirs/9/")
+	require.NoError(t, err)
+	require.True(t, exists)
+	exists, err = opened.HasPrefix(ctx, "dirs/99")
+	require.NoError(t, err)
+	require.False(t, exists)
+	require.Len(t, opened.read, 2)
+
+	require.Equal(t, allPaths, collectPaths(opened.List, "", true))
+	require.Empty(t, opened.unread)
+	require.NoError(t, Diff(ctx, db, opened, "",
+		func(ctx context.Context, path string, oldContent, newContent *manifest.Content) error {
+			return fmt.Errorf("unexpected difference at %q", path)
+		}))
+
+	// every branch is in a blob of its own.
+	pages := map[string]bool{}
+	var paths int
+	require.NoError(t, opened.Walk(ctx, nil,
+		func(ctx context.Context, hash string, data *manifest.Stream) error {
+			require.NotEmpty(t, hash)
+			require.Len(t, data.Ranges, 1)
+			pages[streams.BlobPath(data.Ranges[0].Blob())] = true
+			return nil
+		},
+		func(ctx context.Context, path string, content *manifest.Content) error {
+			paths++
+			return nil
+		}))
+	require.Len(t, pages, len(opened.read))
+	require.Greater(t, len(pages), 10)
+	require.Equal(t, len(allPaths), paths)
+	require.Equal(t, len(pages), countBlobs(t, backend))
+
+	// writing the same manifest again stores no pages, and neither does
+	// writing it without reading it.
+	again := reopen(t, backend, hashes, opened, "manifest/2")
+	defer func() {
+		require.NoError(t, again.Close())
+	}()
+	require.Equal(t, len(pages), countBlobs(t, backend))
+
+	// a change only stores the pages it is in, and only the pages that lead
+	// to it are read.
+	_, err = again.Put(ctx, "dirs/0/new", pathContent("dirs/0/new"))
+	require.NoError(t, err)
+	removed, err := again.Delete(ctx, "dirs/0/0")
+	require.NoError(t, err)
+	require.True(t, removed)
+	require.Len(t, again.read, 2)
+
+	final := reopen(t, backend, hashes, again, "manifest/3")
+	defer func() {
+		require.NoError(t, final.Close())
+	}()
+	// only the pages of dirs/ and dirs/0/ are new.
+	require.Equal(t, len(pages)+2, countBlobs(t, backend))
+	var diffs []string
+	require.NoError(t, Diff(ctx, opened, final, "",
+		func(ctx context.Context, path string, oldContent, newContent *manifest.Content) error {
+			diffs = append(diffs, path)
+			return nil
+		}))
+	require.Equal(t, []string{"dirs/0/0", "dirs/0/new"}, diffs)
+
+	// walking both manifests only walks the pages they share once.
+	seen := map[string]bool{}
+	var walked int
+	for _, path := range []string{"manifest/1", "manifest/3"} {
+		rc, err := backend.Get(ctx, path, 0, -1)
+		require.NoError(t, err)
+		db, err := Open(ctx, backend, nil, hashes, rc)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+		require.NoError(t, db.Walk(ctx, seen,
+			func(ctx context.Context, hash string, data *manifest.Stream) error {
+				walked++
+				return nil
+			},
+			func(ctx context.Context, path string, content *manifest.Content) error { return nil }))
+		require.NoError(t, db.Close())
+	}
+	require.Equal(t, len(pages)+2, walked)
+}
+
+func TestHeader(t *testing.T) {
+	td, err := os.MkdirTemp("", "pathdbtest")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(td))
+	}()
+
+	backend, err := fs.New(ctx, &url.URL{Path: td})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, backend.Close())
+	}()
+
+	hashes, err := hashdb.Open(ctx, backend)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, hashes.Close())
+	}()
+
+	file := func(size int64) *manifest.Content {
+		return &manifest.Content{Metadata: &manifest.Metadata{Type: manifest.Metadata_FILE, Size: size}}
+	}
+	db := New(backend, nil, hashes)
+	for path, content := range map[string]*manifest.Content{
+		"a/":    {Metadata: &manifest.Metadata{Type: manifest.Metadata_DIRECTORY}},
+		"a/1":   file(10),
+		"a/2":   file(20),
+		"a/l":   {Metadata: &manifest.Metadata{Type: manifest.Metadata_SYMLINK}},
+		"b/big": file(1000),
+	} {
+		_, err := db.Put(ctx, path, content)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, db.SerializeTo(ctx, "manifest/1",
+		&manifest.SnapshotHeader{Hostname: "host", Tags: []string{"tag"}}))
+	rc, err := backend.Get(ctx, "manifest/1", 0, -1)
+	require.NoError(t, err)
+	opened, err := Open(ctx, backend, nil, hashes, rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	defer func() {
+		require.NoError(t, opened.Close())
+	}()
+	header := opened.Header()
+	require.Equal(t, "host", header.Hostname)
+	require.Equal(t, []string{"tag"}, header.Tags)
+	require.Equal(t, int64(5), header.Paths)
+	require.Equal(t, int64(4), header.Files)
+	require.Equal(t, int64(1030), header.Bytes)
+
+	// changes keep the stats up to date.
+	_, err = opened.Put(ctx, "a/2", file(25))
+	require.NoError(t, err)
+	_, err = opened.Delete(ctx, "a/1")
+	require.NoError(t, err)
+	_, err = opened.DeleteAll(ctx, func(path string) bool { return path == "b/big" })
+	require.NoError(t, err)
+	stats, err := opened.Stats(ctx)
+	require.NoError(t, err)
+	require.Equal(t, Stats{Paths: 3, Files: 2, Bytes: 25}, stats)
+
+	// manifests from before headers are counted.
+	data, err := encodePages(inlinePages([]*item{
+		{path: "x", content: file(3)},
+		{path: "y", content: file(4)},
+	}))
+	require.NoError(t, err)
+	old, err := Open(ctx, backend, nil, hashes, bytes.NewReader(data))
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, old.Close())
+	}()
+	require.Nil(t, old.Header())
+	stats, err = old.Stats(ctx)
+	require.NoError(t, err)
+	require.Equal(t, Stats{Paths: 2, Files: 2, Bytes: 7}, stats)
+}
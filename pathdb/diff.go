@@ -0,0 +1,68 @@
+package pathdb
+
+import (
+	"context"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/jtolio/jam/manifest"
+)
+
+// Diff walks both a and b in path order and calls cb for every path starting
+// with prefix whose content differs between them. oldContent is nil if the
+// path only exists in b and newContent is nil if it only exists in a.
+func Diff(ctx context.Context, a, b *DB, prefix string,
+	cb func(ctx context.Context, path string, oldContent, newContent *manifest.Content) error) error {
+	ait, err := a.seek(ctx, prefix, nil)
+	if err != nil {
+		return err
+	}
+	defer ait.Close()
+	bit, err := b.seek(ctx, prefix, nil)
+	if err != nil {
+		return err
+	}
+	defer bit.Close()
+
+	apath, acontent, aok, err := a.nextWithPrefix(ait, prefix)
+	if err != nil {
+		return err
+	}
+	bpath, bcontent, bok, err := b.nextWithPrefix(bit, prefix)
+	if err != nil {
+		return err
+	}
+
+	for aok || bok {
+		switch {
+		case aok && (!bok || apath < bpath):
+			err = cb(ctx, apath, acontent, nil)
+			if err != nil {
+				return err
+			}
+			apath, acontent, aok, err = a.nextWithPrefix(ait, prefix)
+		case bok && (!aok || bpath < apath):
+			err = cb(ctx, bpath, nil, bcontent)
+			if err != nil {
+				return err
+			}
+			bpath, bcontent, bok, err = b.nextWithPrefix(bit, prefix)
+		default:
+			if !proto.Equal(acontent, bcontent) {
+				err = cb(ctx, apath, acontent, bcontent)
+				if err != nil {
+					return err
+				}
+			}
+			apath, acontent, aok, err = a.nextWithPrefix(ait, prefix)
+			if err != nil {
+				return err
+			}
+			bpath, bcontent, bok, err = b.nextWithPrefix(bit, prefix)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
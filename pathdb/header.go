@@ -0,0 +1,60 @@
+package pathdb
+
+import (
+	"context"
+
+	"github.com/jtolio/jam/manifest"
+)
+
+// Stats are totals over every path in a manifest. Files counts every path
+// but directories, and Bytes adds up the sizes files had when stored.
+type Stats struct {
+	Paths int64
+	Files int64
+	Bytes int64
+}
+
+func (s *Stats) add(content *manifest.Content, sign int64) {
+	meta := content.GetMetadata()
+	s.Paths += sign
+	if meta.GetType() != manifest.Metadata_DIRECTORY {
+		s.Files += sign
+	}
+	if meta.GetType() == manifest.Metadata_FILE {
+		s.Bytes += sign * meta.GetSize()
+	}
+}
+
+// Header returns the header the manifest was serialized with, or nil if it
+// has none, which is the case for manifests from before headers existed.
+func (db *DB) Header() *manifest.SnapshotHeader {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	return db.header
+}
+
+// Stats returns the totals over every path. Manifests from before headers
+// existed have to be read completely to count them.
+func (db *DB) Stats(ctx context.Context) (Stats, error) {
+	db.mtx.Lock()
+	known, stats := db.statsKnown, db.stats
+	db.mtx.Unlock()
+	if known {
+		return stats, nil
+	}
+
+	err := db.Walk(ctx, nil,
+		func(ctx context.Context, hash string, data *manifest.Stream) error { return nil },
+		func(ctx context.Context, path string, content *manifest.Content) error {
+			stats.add(content, 1)
+			return nil
+		})
+	if err != nil {
+		return Stats{}, err
+	}
+
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	db.stats, db.statsKnown = stats, true
+	return stats, nil
+}
@@ -0,0 +1,167 @@
+package pathdb
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/zeebo/errs"
+
+	"github.com/jtolio/jam/manifest"
+	"github.com/jtolio/jam/utils"
+)
+
+// MergePolicy decides what happens to a path both sides of a merge changed
+// differently.
+type MergePolicy int
+
+const (
+	// MergeFail fails the merge.
+	MergeFail MergePolicy = iota
+	// MergeNewer keeps the side modified most recently.
+	MergeNewer
+	// MergeKeepBoth keeps both sides, the other side's under a new path.
+	MergeKeepBoth
+)
+
+// ParseMergePolicy parses "fail", "newer" or "both".
+func ParseMergePolicy(policy string) (MergePolicy, error) {
+	switch policy {
+	case "fail":
+		return MergeFail, nil
+	case "newer":
+		return MergeNewer, nil
+	case "both":
+		return MergeKeepBoth, nil
+	}
+	return MergeFail, errs.New("unknown merge policy %q, expected fail, newer or both", policy)
+}
+
+// ErrMergeConflict is returned when paths conflict under MergeFail.
+var ErrMergeConflict = errs.Class("merge conflict")
+
+type mergeChange struct {
+	path        string
+	baseContent *manifest.Content
+	newContent  *manifest.Content
+}
+
+// Merge applies every change other made since base to db. A path db also
+// changed differently is a conflict, which policy resolves. Under
+// MergeKeepBoth, the other side of a conflict is kept at its path plus
+// suffix, except that a side that deleted a path always loses, and
+// directories are resolved like under MergeNewer. Under MergeNewer ties go
+// to db. Under MergeFail db is left unchanged if there are any conflicts.
+func Merge(ctx context.Context, db, base, other *DB, policy MergePolicy, suffix string) (
+	conflicts int, err error) {
+	var changes []mergeChange
+	err = Diff(ctx, base, other, "",
+		func(ctx context.Context, path string, baseContent, newContent *manifest.Content) error {
+			changes = append(changes, mergeChange{path: path, baseContent: baseContent, newContent: newContent})
+			return nil
+		})
+	if err != nil {
+		return 0, err
+	}
+
+	type resolution struct {
+		path    string
+		content *manifest.Content
+	}
+	var resolutions []resolution
+	var conflicting []string
+	for _, change := range changes {
+		current, err := db.Get(ctx, change.path)
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case proto.Equal(current, change.newContent):
+			continue
+		case proto.Equal(current, change.baseContent):
+			resolutions = append(resolutions, resolution{path: change.path, content: change.newContent})
+			continue
+		}
+
+		conflicting = append(conflicting, change.path)
+		switch {
+		case policy == MergeFail:
+		case current == nil:
+			utils.L(ctx).Normalf("conflict: %q was deleted on one side, keeping the other", change.path)
+			resolutions = append(resolutions, resolution{path: change.path, content: change.newContent})
+		case change.newContent == nil:
+			utils.L(ctx).Normalf("conflict: %q was deleted on one side, keeping the other", change.path)
+		case policy == MergeNewer || strings.HasSuffix(change.path, "/"):
+			if modifiedAfter(change.newContent, current) {
+				utils.L(ctx).Normalf("conflict: keeping the newer other side of %q", change.path)
+				resolutions = append(resolutions, resolution{path: change.path, content: change.newContent})
+			} else {
+				utils.L(ctx).Normalf("conflict: keeping the newer side of %q", change.path)
+			}
+		default:
+			path, err := freePath(ctx, db, change.path+suffix)
+			if err != nil {
+				return 0, err
+			}
+			utils.L(ctx).Normalf("conflict: keeping both sides of %q, the other as %q", change.path, path)
+			resolutions = append(resolutions, resolution{path: path, content: change.newContent})
+		}
+	}
+
+	if policy == MergeFail && len(conflicting) > 0 {
+		return len(conflicting), ErrMergeConflict.New("%d paths were changed on both sides: %s",
+			len(conflicting), strings.Join(quoteAll(conflicting), ", "))
+	}
+
+	for _, r := range resolutions {
+		if r.content == nil {
+			_, err = db.Delete(ctx, r.path)
+		} else {
+			_, err = db.Put(ctx, r.path, r.content)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(conflicting), nil
+}
+
+// freePath returns path, or path with a number after it, whichever is the
+// first not in use.
+func freePath(ctx context.Context, db *DB, path string) (string, error) {
+	candidate := path
+	for i := 2; ; i++ {
+		existing, err := db.Get(ctx, candidate)
+		if err != nil {
+			return "", err
+		}
+		if existing == nil {
+			return candidate, nil
+		}
+		candidate = fmt.Sprintf("%s-%d", path, i)
+	}
+}
+
+func modifiedAfter(a, b *manifest.Content) bool {
+	am, bm := a.GetMetadata().GetModified(), b.GetMetadata().GetModified()
+	if am.GetSeconds() != bm.GetSeconds() {
+		return am.GetSeconds() > bm.GetSeconds()
+	}
+	return am.GetNanos() > bm.GetNanos()
+}
+
+func quoteAll(paths []string) []string {
+	const max = 10
+	sort.Strings(paths)
+	quoted := make([]string, 0, len(paths))
+	for i, path := range paths {
+		if i == max {
+			quoted = append(quoted, fmt.Sprintf("and %d more", len(paths)-max))
+			break
+		}
+		quoted = append(quoted, fmt.Sprintf("%q", path))
+	}
+	return quoted
+}
@@ -0,0 +1,429 @@
+package pathdb
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"io"
+	"strings"
+
+	"github.com/zeebo/errs"
+
+	"github.com/jtolio/jam/blobs"
+	"github.com/jtolio/jam/manifest"
+	"github.com/jtolio/jam/streams"
+	"github.com/jtolio/jam/utils"
+)
+
+// Large manifests are split into a tree of pages. A page either has entries
+// or is a branch, whose data is another manifest with every path that starts
+// with the branch's prefix. Branch data is stored in a blob of its own and is
+// found by its hash through the hash database, so a page that is the same in
+// many snapshots is only stored once. Only the root manifest is read when a
+// manifest is opened, and branches are read once a path that might be in them
+// is needed.
+//
+// Paths are split into branches by subdirectory where possible, so that
+// listing a directory doesn't have to read its subdirectories' pages, and by
+// the next byte of the path otherwise.
+const (
+	// manifests with more entries than this are split into pages
+	maxPageEntries = 2048
+	// smaller groups of paths stay in their parent's pages
+	minBranchEntries = 256
+)
+
+// branch refers to the data of a branch page by hash, or by stream for pages
+// from before pages were content-addressed.
+type branch struct {
+	hash   string
+	stream *manifest.Stream
+	count  int64
+}
+
+func pageBranch(page *manifest.Page) *branch {
+	if hash := page.GetBranchHash(); len(hash) > 0 {
+		return &branch{hash: string(hash), count: page.Count}
+	}
+	if stream := page.GetBranch(); stream != nil {
+		return &branch{stream: stream, count: page.Count}
+	}
+	return nil
+}
+
+func branchPage(prefix string, branch *branch) *manifest.Page {
+	page := &manifest.Page{Prefix: []byte(prefix), Count: branch.count}
+	if branch.hash != "" {
+		page.Descendents = &manifest.Page_BranchHash{BranchHash: []byte(branch.hash)}
+	} else {
+		page.Descendents = &manifest.Page_Branch{Branch: branch.stream}
+	}
+	return page
+}
+
+func (db *DB) branchData(ctx context.Context, branch *branch) (*manifest.Stream, error) {
+	if branch.hash == "" {
+		return branch.stream, nil
+	}
+	data, err := db.hashes.Lookup(ctx, branch.hash)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, errs.New("manifest page %x not found", branch.hash)
+	}
+	return data, nil
+}
+
+func (db *DB) openBranch(ctx context.Context, branch *branch) (*streams.Stream, error) {
+	data, err := db.branchData(ctx, branch)
+	if err != nil {
+		return nil, err
+	}
+	return streams.Open(ctx, db.backend, data)
+}
+
+// readBranch reads the unread branch with prefix, adding its entries and
+// its own branches.
+func (db *DB) readBranch(ctx context.Context, prefix string) (err error) {
+	branch := db.unread[prefix]
+	utils.L(ctx).Debugf("reading manifest page %q", prefix)
+	stream, err := db.openBranch(ctx, branch)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errs.Combine(err, stream.Close())
+	}()
+	delete(db.unread, prefix)
+	err = db.load(ctx, stream)
+	if err != nil {
+		db.unread[prefix] = branch
+		return err
+	}
+	db.read = append(db.read, branch)
+	return nil
+}
+
+// readPath reads every branch that path could be in.
+func (db *DB) readPath(ctx context.Context, path string) error {
+	// a branch's own branches have longer prefixes, so they are found later
+	// in the same loop.
+	for i := 0; i <= len(path) && len(db.unread) > 0; i++ {
+		if _, ok := db.unread[path[:i]]; ok {
+			err := db.readBranch(ctx, path[:i])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readPrefix reads every branch that paths starting with prefix could be in.
+// If dirs is not nil, branches whose paths are all in one subdirectory of
+// prefix are left unread, and the subdirectory is added to dirs instead.
+func (db *DB) readPrefix(ctx context.Context, prefix string, dirs map[string]bool) error {
+	err := db.readPath(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for {
+		var toRead []string
+		for branch := range db.unread {
+			if !strings.HasPrefix(branch, prefix) {
+				continue
+			}
+			if dirs != nil {
+				if idx := strings.Index(branch[len(prefix):], "/"); idx >= 0 {
+					dirs[branch[:len(prefix)+idx]] = true
+					continue
+				}
+			}
+			toRead = append(toRead, branch)
+		}
+		if len(toRead) == 0 {
+			return nil
+		}
+		for _, branch := range toRead {
+			err = db.readBranch(ctx, branch)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (db *DB) readAll(ctx context.Context) error {
+	return db.readPrefix(ctx, "", nil)
+}
+
+// walkBranch is Walk for a branch that hasn't been read.
+func (db *DB) walkBranch(ctx context.Context, b *branch, seen map[string]bool,
+	page func(ctx context.Context, hash string, data *manifest.Stream) error,
+	cb func(ctx context.Context, path string, content *manifest.Content) error) (err error) {
+	if b.hash != "" && seen != nil {
+		if seen[b.hash] {
+			return nil
+		}
+		seen[b.hash] = true
+	}
+	data, err := db.branchData(ctx, b)
+	if err != nil {
+		return err
+	}
+	err = page(ctx, b.hash, data)
+	if err != nil {
+		return err
+	}
+	stream, err := streams.Open(ctx, db.backend, data)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errs.Combine(err, stream.Close())
+	}()
+	return readPages(stream, func(p *manifest.Page) error {
+		if sub := pageBranch(p); sub != nil {
+			return db.walkBranch(ctx, sub, seen, page, cb)
+		}
+		for _, entry := range p.GetEntries().GetEntries() {
+			err := fixHash(entry)
+			if err != nil {
+				return err
+			}
+			err = cb(ctx, string(entry.Path), entry.Content)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// an item is a path and its content, or a branch that hasn't been read,
+// which has every path that starts with path.
+type item struct {
+	path    string
+	content *manifest.Content
+	branch  *branch
+}
+
+// paths returns how many paths the items have.
+func paths(items []*item) (count int64) {
+	for _, item := range items {
+		switch {
+		case item.branch == nil:
+			count++
+		case item.branch.count > 0:
+			count += item.branch.count
+		default:
+			// older branches don't say, but had at least this many.
+			count += minBranchEntries
+		}
+	}
+	return count
+}
+
+type pageGroup struct {
+	prefix string
+	branch bool
+	items  []*item
+}
+
+// writePages returns the pages of a manifest with items, which must be in
+// path order, storing the data of any new branches.
+func (db *DB) writePages(ctx context.Context, items []*item) (pages []*manifest.Page, err error) {
+	if paths(items) <= maxPageEntries {
+		return inlinePages(items), nil
+	}
+
+	prefix := commonPrefix(items[0].path, items[len(items)-1].path)
+	groups := groupItems(items, prefix, dirKey, minBranchEntries)
+	if inlinePaths(groups) > maxPageEntries {
+		groups = groupItems(items, prefix, byteKey, minBranchEntries)
+	}
+	if inlinePaths(groups) > maxPageEntries {
+		groups = groupItems(items, prefix, byteKey, 1)
+	}
+
+	for _, group := range groups {
+		switch {
+		case !group.branch:
+			pages = append(pages, inlinePages(group.items)...)
+		case len(group.items) == 1 && group.items[0].branch != nil:
+			pages = append(pages, branchPage(group.items[0].path, group.items[0].branch))
+		default:
+			branch, err := db.writeBranch(ctx, group.prefix, group.items)
+			if err != nil {
+				return nil, err
+			}
+			pages = append(pages, branchPage(group.prefix, branch))
+		}
+	}
+	return pages, nil
+}
+
+// writeBranch stores a manifest with items in a new blob, unless a page with
+// the same hash is already stored.
+func (db *DB) writeBranch(ctx context.Context, prefix string, items []*item) (*branch, error) {
+	pages, err := db.writePages(ctx, items)
+	if err != nil {
+		return nil, err
+	}
+	data, err := encodePages(pages)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	hash := string(sum[:])
+	exists, err := db.hashes.Has(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		utils.L(ctx).Debugf("manifest page %q is unchanged", prefix)
+		return &branch{hash: hash, count: paths(items)}, nil
+	}
+
+	id := utils.IdBytesGen()
+	stream := &manifest.Stream{
+		Ranges: []*manifest.Range{{BlobBytes: id, Length: int64(len(data))}},
+	}
+	// the blob's index has the page, so that the page can be found again if
+	// the hash database is rebuilt.
+	data, err = blobs.AppendIndex(data, &manifest.BlobIndex{
+		Hashes: []*manifest.HashedData{{Hash: sum[:], Data: stream}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = db.backend.Put(ctx, streams.BlobPath(utils.PathSafeIdEncode(id)), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	err = db.hashes.Put(ctx, hash, stream)
+	if err != nil {
+		return nil, err
+	}
+	count := paths(items)
+	utils.L(ctx).Debugf("wrote manifest page %q with %d paths", prefix, count)
+	return &branch{hash: hash, count: count}, nil
+}
+
+// inlinePages returns pages with the entries of items, and the branches of
+// items as they are.
+func inlinePages(items []*item) (pages []*manifest.Page) {
+	var entries []*manifest.Entry
+	flush := func() {
+		pages = append(pages, &manifest.Page{
+			Descendents: &manifest.Page_Entries{
+				Entries: &manifest.EntrySet{Entries: entries},
+			},
+		})
+		entries = nil
+	}
+	for _, item := range items {
+		if item.branch != nil {
+			if len(entries) > 0 {
+				flush()
+			}
+			pages = append(pages, branchPage(item.path, item.branch))
+			continue
+		}
+		entries = append(entries, &manifest.Entry{Path: []byte(item.path), Content: item.content})
+		if len(entries) >= maxPageEntries {
+			flush()
+		}
+	}
+	// an empty manifest still has a page.
+	if len(entries) > 0 || len(pages) == 0 {
+		flush()
+	}
+	return pages
+}
+
+// encodePages returns pages as a manifest.
+func encodePages(pages []*manifest.Page) ([]byte, error) {
+	var out bytes.Buffer
+	compressor := zlib.NewWriter(&out)
+	for _, page := range pages {
+		data, err := utils.MarshalSized(page)
+		if err != nil {
+			return nil, err
+		}
+		_, err = compressor.Write(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := compressor.Close()
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(io.MultiReader(
+		bytes.NewReader([]byte(versionHeader)),
+		utils.NewFramingReader(&out)))
+}
+
+// groupItems splits items, which all start with prefix, into runs of items
+// with the same key. Runs with at least min paths become branches with the
+// key as their prefix. An empty key never makes a branch.
+func groupItems(items []*item, prefix string,
+	key func(path, prefix string) string, min int64) (groups []*pageGroup) {
+	for len(items) > 0 {
+		k := key(items[0].path, prefix)
+		n := 1
+		if k != "" {
+			for n < len(items) && strings.HasPrefix(items[n].path, k) {
+				n++
+			}
+		}
+		if k != "" && paths(items[:n]) >= min {
+			groups = append(groups, &pageGroup{prefix: k, branch: true, items: items[:n]})
+		} else if len(groups) > 0 && !groups[len(groups)-1].branch {
+			// runs are contiguous, so this just extends the last group.
+			last := groups[len(groups)-1]
+			last.items = last.items[:len(last.items)+n]
+		} else {
+			groups = append(groups, &pageGroup{items: items[:n]})
+		}
+		items = items[n:]
+	}
+	return groups
+}
+
+func inlinePaths(groups []*pageGroup) (count int64) {
+	for _, group := range groups {
+		if !group.branch {
+			count += paths(group.items)
+		}
+	}
+	return count
+}
+
+// dirKey returns the subdirectory of prefix that path is in, with a trailing
+// slash, if any.
+func dirKey(path, prefix string) string {
+	if idx := strings.Index(path[len(prefix):], "/"); idx >= 0 {
+		return path[:len(prefix)+idx+1]
+	}
+	return ""
+}
+
+// byteKey returns prefix and the next byte of path, if any.
+func byteKey(path, prefix string) string {
+	if len(path) > len(prefix) {
+		return path[:len(prefix)+1]
+	}
+	return ""
+}
+
+func commonPrefix(a, b string) string {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return a[:i]
+}
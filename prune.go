@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+
+	"github.com/jtolio/jam/locks"
+	"github.com/jtolio/jam/utils"
+)
+
+var (
+	pruneFlags           = flag.NewFlagSet("", flag.ExitOnError)
+	pruneFlagKeepLast    = pruneFlags.Int("keep-last", 0, "keep the newest n snapshots")
+	pruneFlagKeepDaily   = pruneFlags.Int("keep-daily", 0, "keep the newest snapshot of each of the last n days with snapshots")
+	pruneFlagKeepWeekly  = pruneFlags.Int("keep-weekly", 0, "keep the newest snapshot of each of the last n weeks with snapshots")
+	pruneFlagKeepMonthly = pruneFlags.Int("keep-monthly", 0, "keep the newest snapshot of each of the last n months with snapshots")
+	pruneFlagKeepWithin  = pruneFlags.String("keep-within", "",
+		"keep all snapshots within this long of the latest snapshot,\n\tsuch as 30d, 2w, 6m, 1y or 1y6m (h, d, w, m and y are understood)")
+	pruneFlagDryRun = pruneFlags.Bool("dry-run", false, "if true, only report which snapshots would be removed")
+
+	cmdPrune = &ffcli.Command{
+		Name:       "prune",
+		ShortHelp:  "prune removes snapshots not kept by the given retention policy",
+		ShortUsage: fmt.Sprintf("%s [opts] prune [opts]", os.Args[0]),
+		FlagSet:    pruneFlags,
+		Exec:       Prune,
+	}
+)
+
+// retentionPolicy decides which snapshots prune keeps.
+type retentionPolicy struct {
+	last, daily, weekly, monthly int
+	// within keeps every snapshot made at most this long before the latest
+	// one. withinDesc is how it was given.
+	within     time.Duration
+	withinDesc string
+}
+
+type retentionBucket struct {
+	name  string
+	count int
+	key   func(ts time.Time) string
+}
+
+func (p *retentionPolicy) buckets() []retentionBucket {
+	return []retentionBucket{
+		{name: "last", count: p.last,
+			key: func(ts time.Time) string { return strconv.FormatInt(ts.UnixNano(), 10) }},
+		{name: "daily", count: p.daily,
+			key: func(ts time.Time) string { return ts.Local().Format("2006-01-02") }},
+		{name: "weekly", count: p.weekly,
+			key: func(ts time.Time) string {
+				year, week := ts.Local().ISOWeek()
+				return fmt.Sprintf("%d-%d", year, week)
+			}},
+		{name: "monthly", count: p.monthly,
+			key: func(ts time.Time) string { return ts.Local().Format("2006-01") }},
+	}
+}
+
+func (p *retentionPolicy) check() error {
+	policySet := p.within > 0
+	for _, bucket := range p.buckets() {
+		if bucket.count < 0 {
+			return fmt.Errorf("invalid -keep-%s value: %d", bucket.name, bucket.count)
+		}
+		policySet = policySet || bucket.count > 0
+	}
+	if !policySet {
+		return fmt.Errorf("no retention policy provided, refusing to remove every snapshot but the latest")
+	}
+	return nil
+}
+
+// keepReasons returns, for each of timestamps, which are newest first, why
+// the policy keeps it, or nothing if it doesn't. The latest snapshot is
+// always kept.
+func (p *retentionPolicy) keepReasons(timestamps []time.Time) [][]string {
+	reasons := make([][]string, len(timestamps))
+	if len(timestamps) == 0 {
+		return reasons
+	}
+	// Manager.DeleteSnapshot refuses to remove the latest snapshot anyway.
+	reasons[0] = append(reasons[0], "latest")
+	if p.within > 0 {
+		cutoff := timestamps[0].Add(-p.within)
+		for i, ts := range timestamps {
+			if !ts.Before(cutoff) {
+				reasons[i] = append(reasons[i], "within "+p.withinDesc)
+			}
+		}
+	}
+	for _, bucket := range p.buckets() {
+		remaining := bucket.count
+		lastKey := ""
+		for i, ts := range timestamps {
+			if remaining <= 0 {
+				break
+			}
+			// timestamps are newest first, so the first snapshot seen for a key
+			// is the one kept for it.
+			if key := bucket.key(ts); key != lastKey {
+				reasons[i] = append(reasons[i], bucket.name)
+				lastKey = key
+				remaining--
+			}
+		}
+	}
+	return reasons
+}
+
+func Prune(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return flag.ErrHelp
+	}
+
+	policy := &retentionPolicy{
+		last:       *pruneFlagKeepLast,
+		daily:      *pruneFlagKeepDaily,
+		weekly:     *pruneFlagKeepWeekly,
+		monthly:    *pruneFlagKeepMonthly,
+		withinDesc: *pruneFlagKeepWithin,
+	}
+	if *pruneFlagKeepWithin != "" {
+		var err error
+		policy.within, err = parseRetentionDuration(*pruneFlagKeepWithin)
+		if err != nil {
+			return err
+		}
+	}
+	err := policy.check()
+	if err != nil {
+		return err
+	}
+
+	mgr, _, _, mgrClose, err := getManager(ctx, locks.Exclusive)
+	if err != nil {
+		return err
+	}
+	defer mgrClose()
+
+	var timestamps []time.Time
+	err = mgr.ListSnapshots(ctx, func(ctx context.Context, timestamp time.Time) error {
+		timestamps = append(timestamps, timestamp)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(timestamps) == 0 {
+		return fmt.Errorf("no snapshots exist yet")
+	}
+
+	reasons := policy.keepReasons(timestamps)
+	var toRemove []time.Time
+	for i, ts := range timestamps {
+		desc := fmt.Sprintf("%v: %v", ts.UnixNano(), ts.Local().Format("2006-01-02 03:04:05 pm"))
+		if len(reasons[i]) > 0 {
+			fmt.Printf("keep   %s (%s)\n", desc, strings.Join(reasons[i], ", "))
+			continue
+		}
+		fmt.Printf("remove %s\n", desc)
+		toRemove = append(toRemove, ts)
+	}
+
+	if *pruneFlagDryRun {
+		fmt.Printf("would remove %d of %d snapshots\n", len(toRemove), len(timestamps))
+		return nil
+	}
+
+	for _, ts := range toRemove {
+		err = mgr.DeleteSnapshot(ctx, ts)
+		if err != nil {
+			return err
+		}
+	}
+
+	utils.L(ctx).Normalf("removed %d of %d snapshots", len(toRemove), len(timestamps))
+	return nil
+}
+
+// parseRetentionDuration parses durations like 30d or 1y6m, where a month is
+// 30 days and a year is 365 days.
+func parseRetentionDuration(val string) (time.Duration, error) {
+	units := map[byte]time.Duration{
+		'h': time.Hour,
+		'd': 24 * time.Hour,
+		'w': 7 * 24 * time.Hour,
+		'm': 30 * 24 * time.Hour,
+		'y': 365 * 24 * time.Hour,
+	}
+	var total time.Duration
+	rest := val
+	for len(rest) > 0 {
+		i := 0
+		for i < len(rest) && rest[i] >= '0' && rest[i] <= '9' {
+			i++
+		}
+		if i == 0 || i == len(rest) {
+			return 0, fmt.Errorf("invalid duration: %q", val)
+		}
+		n, err := strconv.ParseInt(rest[:i], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration: %q", val)
+		}
+		unit, ok := units[rest[i]]
+		if !ok {
+			return 0, fmt.Errorf("invalid duration unit in %q: %q", val, rest[i:i+1])
+		}
+		total += time.Duration(n) * unit
+		rest = rest[i+1:]
+	}
+	if total <= 0 {
+		return 0, fmt.Errorf("invalid duration: %q", val)
+	}
+	return total, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeepReasons(t *testing.T) {
+	at := func(val string) time.Time {
+		ts, err := time.ParseInLocation("2006-01-02 15:04", val, time.Local)
+		require.NoError(t, err)
+		return ts
+	}
+
+	for _, tc := range []struct {
+		name   string
+		policy retentionPolicy
+		// newest first, each mapped to the reasons it is kept for, if any
+		snapshots [][2]string
+	}{
+		{
+			name:   "daily buckets end at midnight",
+			policy: retentionPolicy{daily: 2},
+			snapshots: [][2]string{
+				{"2024-03-02 00:00", "latest, daily"},
+				{"2024-03-01 23:59", "daily"},
+				{"2024-03-01 12:00", ""},
+				{"2024-02-29 08:00", ""},
+			},
+		},
+		{
+			name:   "weekly buckets start on monday",
+			policy: retentionPolicy{weekly: 2},
+			snapshots: [][2]string{
+				{"2024-03-04 00:01", "latest, weekly"},
+				{"2024-03-03 23:59", "weekly"},
+				{"2024-03-01 10:00", ""},
+			},
+		},
+		{
+			name:   "weekly buckets span years",
+			policy: retentionPolicy{weekly: 2},
+			snapshots: [][2]string{
+				{"2025-01-05 10:00", "latest, weekly"},
+				{"2024-12-30 10:00", ""},
+				{"2024-12-29 10:00", "weekly"},
+			},
+		},
+		{
+			name:   "monthly buckets",
+			policy: retentionPolicy{monthly: 2},
+			snapshots: [][2]string{
+				{"2024-03-01 00:00", "latest, monthly"},
+				{"2024-02-29 23:59", "monthly"},
+				{"2024-02-01 00:00", ""},
+				{"2024-01-31 23:59", ""},
+			},
+		},
+		{
+			name:   "buckets count periods with snapshots",
+			policy: retentionPolicy{daily: 2},
+			snapshots: [][2]string{
+				{"2024-03-10 12:00", "latest, daily"},
+				{"2024-03-10 11:00", ""},
+				{"2024-03-01 12:00", "daily"},
+				{"2024-02-01 12:00", ""},
+			},
+		},
+		{
+			name:   "rules combine",
+			policy: retentionPolicy{last: 2, daily: 2, monthly: 3},
+			snapshots: [][2]string{
+				{"2024-03-10 12:00", "latest, last, daily, monthly"},
+				{"2024-03-10 11:00", "last"},
+				{"2024-03-09 12:00", "daily"},
+				{"2024-02-01 12:00", "monthly"},
+				{"2024-01-01 12:00", "monthly"},
+				{"2023-12-01 12:00", ""},
+			},
+		},
+		{
+			name:   "keep-within is relative to the latest snapshot",
+			policy: retentionPolicy{within: 48 * time.Hour, withinDesc: "2d"},
+			snapshots: [][2]string{
+				{"2020-01-10 00:00", "latest, within 2d"},
+				{"2020-01-08 00:00", "within 2d"},
+				{"2020-01-07 23:59", ""},
+			},
+		},
+		{
+			name:   "the latest snapshot is kept even when no rule keeps it",
+			policy: retentionPolicy{},
+			snapshots: [][2]string{
+				{"2024-03-10 12:00", "latest"},
+				{"2024-03-09 12:00", ""},
+			},
+		},
+	} {
+		var timestamps []time.Time
+		for _, snapshot := range tc.snapshots {
+			timestamps = append(timestamps, at(snapshot[0]))
+		}
+		reasons := tc.policy.keepReasons(timestamps)
+		for i, snapshot := range tc.snapshots {
+			require.Equal(t, snapshot[1], strings.Join(reasons[i], ", "), "%s: %s", tc.name, snapshot[0])
+		}
+	}
+
+	require.Empty(t, (&retentionPolicy{daily: 1}).keepReasons(nil))
+}
+
+func TestRetentionPolicyCheck(t *testing.T) {
+	for _, tc := range []struct {
+		policy retentionPolicy
+		ok     bool
+	}{
+		{policy: retentionPolicy{}, ok: false},
+		{policy: retentionPolicy{daily: -1, weekly: 1}, ok: false},
+		{policy: retentionPolicy{last: 1}, ok: true},
+		{policy: retentionPolicy{within: time.Hour}, ok: true},
+	} {
+		if tc.ok {
+			require.NoError(t, tc.policy.check(), "%+v", tc.policy)
+		} else {
+			require.Error(t, tc.policy.check(), "%+v", tc.policy)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -12,6 +13,8 @@ import (
 
 	"github.com/peterbourgon/ff/v3/ffcli"
 
+	"github.com/jtolio/jam/locks"
+	"github.com/jtolio/jam/manifest"
 	"github.com/jtolio/jam/mount"
 	"github.com/jtolio/jam/session"
 	"github.com/jtolio/jam/webdav"
@@ -26,6 +29,9 @@ var (
 	mountFlagSnapshot  = mountFlags.String("snap", "latest", "which snapshot to use")
 	mountFlagReadahead = mountFlags.Int("readahead", 128*1024, "FUSE max readahead")
 
+	catFlags        = flag.NewFlagSet("", flag.ExitOnError)
+	catFlagSnapshot = catFlags.String("snap", "latest", "which snapshot to use")
+
 	webdavFlags        = flag.NewFlagSet("", flag.ExitOnError)
 	webdavFlagSnapshot = webdavFlags.String("snap", "latest", "which snapshot to use")
 	webdavFlagAddr     = webdavFlags.String("addr", "localhost:8888", "address to listen on")
@@ -44,6 +50,13 @@ var (
 		FlagSet:    webdavFlags,
 		Exec:       Webdav,
 	}
+	cmdCat = &ffcli.Command{
+		Name:       "cat",
+		ShortHelp:  "cat writes a file in the given snapshot to stdout",
+		ShortUsage: fmt.Sprintf("%s [opts] cat [opts] <path>", os.Args[0]),
+		FlagSet:    catFlags,
+		Exec:       Cat,
+	}
 	cmdLs = &ffcli.Command{
 		Name:       "ls",
 		ShortHelp:  "ls lists files in the given snapshot",
@@ -77,7 +90,7 @@ func Mount(ctx context.Context, args []string) error {
 	}
 	defer sess.Close()
 
-	mgr, _, _, mgrClose, err := getManager(ctx)
+	mgr, _, _, mgrClose, err := getManager(ctx, locks.Shared)
 	if err != nil {
 		return err
 	}
@@ -115,7 +128,7 @@ func Webdav(ctx context.Context, args []string) error {
 		return flag.ErrHelp
 	}
 
-	mgr, _, _, mgrClose, err := getManager(ctx)
+	mgr, _, _, mgrClose, err := getManager(ctx, locks.Shared)
 	if err != nil {
 		return err
 	}
@@ -127,6 +140,20 @@ func Webdav(ctx context.Context, args []string) error {
 	}
 	defer snap.Close()
 
+	// stop serving on interrupt so the lock is released.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(c)
+	go func() {
+		select {
+		case <-c:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
 	fmt.Printf("serving snapshot %d at %q\n", ts.UnixNano(), *webdavFlagAddr)
 	return webdav.Serve(ctx, snap, *webdavFlagAddr)
 }
@@ -136,7 +163,7 @@ func List(ctx context.Context, args []string) error {
 		return flag.ErrHelp
 	}
 
-	mgr, _, _, mgrClose, err := getManager(ctx)
+	mgr, _, _, mgrClose, err := getManager(ctx, locks.Shared)
 	if err != nil {
 		return err
 	}
@@ -154,6 +181,11 @@ func List(ctx context.Context, args []string) error {
 	}
 
 	return snap.List(ctx, prefix, *listFlagRecursive, func(ctx context.Context, entry *session.ListEntry) error {
+		if !*listFlagRecursive && entry.Path == prefix && !entry.Prefix &&
+			entry.Meta.Type == manifest.Metadata_DIRECTORY {
+			// the directory being listed
+			return nil
+		}
 		if entry.Prefix {
 			fmt.Println(entry.Path + "/")
 		} else {
@@ -162,3 +194,33 @@ func List(ctx context.Context, args []string) error {
 		return nil
 	})
 }
+
+func Cat(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return flag.ErrHelp
+	}
+
+	mgr, _, _, mgrClose, err := getManager(ctx, locks.Shared)
+	if err != nil {
+		return err
+	}
+	defer mgrClose()
+
+	snap, _, err := getReadSnapshot(ctx, mgr, *catFlagSnapshot)
+	if err != nil {
+		return err
+	}
+	defer snap.Close()
+
+	_, stream, err := snap.Open(ctx, args[0])
+	if err != nil {
+		return fmt.Errorf("%q: %w", args[0], err)
+	}
+	if stream == nil {
+		return fmt.Errorf("%q is not a file", args[0])
+	}
+	defer stream.Close()
+
+	_, err = io.Copy(os.Stdout, stream)
+	return err
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+
+	"github.com/jtolio/jam/blobs"
+	"github.com/jtolio/jam/hashdb"
+	"github.com/jtolio/jam/locks"
+	"github.com/jtolio/jam/manifest"
+	"github.com/jtolio/jam/session"
+	"github.com/jtolio/jam/streams"
+	"github.com/jtolio/jam/utils"
+)
+
+var (
+	rebuildFlags       = flag.NewFlagSet("", flag.ExitOnError)
+	rebuildFlagReplace = rebuildFlags.Bool("replace", false, "if true, delete the existing hashsets once the rebuilt one is stored")
+
+	cmdRebuildIndex = &ffcli.Command{
+		Name:       "rebuild-index",
+		ShortHelp:  "rebuild the hash database from the index at the end of every blob",
+		ShortUsage: fmt.Sprintf("%s [opts] utils rebuild-index [opts]", os.Args[0]),
+		FlagSet:    rebuildFlags,
+		Exec:       RebuildIndex,
+	}
+)
+
+func RebuildIndex(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return flag.ErrHelp
+	}
+
+	compression, err := compressionPolicy()
+	if err != nil {
+		return err
+	}
+
+	// the existing hash database isn't loaded, since it may be what's
+	// corrupted.
+	backend, backendClose, err := getBackend(ctx, locks.Exclusive)
+	if err != nil {
+		return err
+	}
+	defer backendClose()
+
+	var hashsets []string
+	err = backend.List(ctx, hashdb.HashPrefix, func(ctx context.Context, path string) error {
+		hashsets = append(hashsets, path)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	r := &indexRebuilder{
+		exists:   map[string]bool{},
+		streams:  map[string][]*manifest.Stream{},
+		chunked:  map[string][]*manifest.ChunkedData{},
+		resolved: map[string]*manifest.Stream{},
+	}
+	var blobPaths []string
+	err = backend.List(ctx, streams.BlobPrefix, func(ctx context.Context, path string) error {
+		blobPaths = append(blobPaths, path)
+		r.exists[path] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(blobPaths)
+
+	var unindexed, unreadable int
+	for _, blobPath := range blobPaths {
+		utils.L(ctx).Debugf("reading index of %s", blobPath)
+		index, err := blobs.ReadIndex(ctx, backend, blobPath)
+		if err != nil {
+			if blobs.ErrNoIndex.Has(err) {
+				unindexed++
+				continue
+			}
+			utils.L(ctx).Urgentf("skipping %s, %v", blobPath, err)
+			unreadable++
+			continue
+		}
+		for _, hashed := range index.Hashes {
+			r.streams[string(hashed.Hash)] = append(r.streams[string(hashed.Hash)], hashed.Data)
+		}
+		for _, chunked := range index.Chunked {
+			r.chunked[string(chunked.Hash)] = append(r.chunked[string(chunked.Hash)], chunked)
+		}
+	}
+	if unindexed > 0 {
+		utils.L(ctx).Urgentf("%d blobs predate blob indexes, their data can't be recovered", unindexed)
+	}
+
+	var hashes []string
+	for hash := range r.streams {
+		hashes = append(hashes, hash)
+	}
+	for hash := range r.chunked {
+		if _, exists := r.streams[hash]; !exists {
+			hashes = append(hashes, hash)
+		}
+	}
+	// empty files have no data to be indexed with
+	emptyHash := sha256.Sum256(nil)
+	if _, exists := r.streams[string(emptyHash[:])]; !exists {
+		r.streams[string(emptyHash[:])] = []*manifest.Stream{{}}
+		hashes = append(hashes, string(emptyHash[:]))
+	}
+	sort.Strings(hashes)
+
+	rebuilt := hashdb.New(backend)
+	var recovered, unresolved int
+	for _, hash := range hashes {
+		stream := r.resolve(hash)
+		if stream == nil {
+			utils.L(ctx).Debugf("hash %x refers to missing blobs", hash)
+			unresolved++
+			continue
+		}
+		err = rebuilt.Put(ctx, hash, stream)
+		if err != nil {
+			return err
+		}
+		recovered++
+	}
+	err = rebuilt.Flush(ctx)
+	if err != nil {
+		return err
+	}
+
+	// snapshot manifests are read through the rebuilt database.
+	blobStore := getBlobStore(backend)
+	defer blobStore.Close()
+	mgr := session.NewManager(backend, blobStore, rebuilt, compression)
+	checked := true
+	missing := 0
+	live, _, err := liveHashes(ctx, mgr)
+	if err != nil {
+		utils.L(ctx).Urgentf("unable to check that snapshots are recoverable: %v", err)
+		checked = false
+	}
+	for hash := range live {
+		if r.resolve(hash) == nil {
+			missing++
+		}
+	}
+	if missing > 0 {
+		utils.L(ctx).Urgentf("%d hashes referenced by snapshots could not be recovered", missing)
+	}
+
+	if *rebuildFlagReplace {
+		if unreadable > 0 || missing > 0 || !checked {
+			return errors.New("not replacing existing hashsets, since not everything was recovered")
+		}
+		for _, path := range hashsets {
+			utils.L(ctx).Debugf("deleting hashset %s", path)
+			err = backend.Delete(ctx, path)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	utils.L(ctx).Normalf("recovered %d hashes from %d blobs, %d hashes refer to missing blobs",
+		recovered, len(blobPaths)-unindexed-unreadable, unresolved)
+	return nil
+}
+
+// indexRebuilder turns blob index entries back into hash database entries.
+type indexRebuilder struct {
+	exists   map[string]bool
+	streams  map[string][]*manifest.Stream
+	chunked  map[string][]*manifest.ChunkedData
+	resolved map[string]*manifest.Stream
+}
+
+// resolve returns the stream for hash, or nil if every stream found for it
+// refers to a blob that doesn't exist (anymore).
+func (r *indexRebuilder) resolve(hash string) *manifest.Stream {
+	if stream, ok := r.resolved[hash]; ok {
+		return stream
+	}
+	// guards against cycles, which shouldn't happen
+	r.resolved[hash] = nil
+
+	var rv *manifest.Stream
+	for _, stream := range r.streams[hash] {
+		if r.complete(stream) {
+			rv = stream
+			break
+		}
+	}
+	if rv == nil {
+	candidates:
+		for _, chunked := range r.chunked[hash] {
+			var stream manifest.Stream
+			for i, chunk := range chunked.Chunks {
+				stream.Ranges = appendHole(stream.Ranges, chunked.Holes, i)
+				chunkStream := r.resolve(string(chunk))
+				if chunkStream == nil {
+					continue candidates
+				}
+				stream.Ranges = append(stream.Ranges, chunkStream.Ranges...)
+			}
+			stream.Ranges = appendHole(stream.Ranges, chunked.Holes, len(chunked.Chunks))
+			rv = &stream
+			break
+		}
+	}
+	r.resolved[hash] = rv
+	return rv
+}
+
+// appendHole appends the i'th of a sparse file's holes, if there is one.
+func appendHole(ranges []*manifest.Range, holes []int64, i int) []*manifest.Range {
+	if i < len(holes) && holes[i] > 0 {
+		ranges = append(ranges, &manifest.Range{Hole: true, Length: holes[i]})
+	}
+	return ranges
+}
+
+func (r *indexRebuilder) complete(stream *manifest.Stream) bool {
+	for _, rr := range stream.Ranges {
+		if !rr.Hole && !r.exists[streams.BlobPath(rr.Blob())] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"github.com/zeebo/errs"
+
+	"github.com/jtolio/jam/backends"
+	"github.com/jtolio/jam/blobs"
+	"github.com/jtolio/jam/hashdb"
+	"github.com/jtolio/jam/locks"
+	"github.com/jtolio/jam/manifest"
+	"github.com/jtolio/jam/streams"
+	"github.com/jtolio/jam/utils"
+)
+
+var (
+	repackFlags         = flag.NewFlagSet("", flag.ExitOnError)
+	repackFlagThreshold = repackFlags.Float64("threshold", 0.5, "repack blobs with less than this fraction of live data")
+	repackFlagDryRun    = repackFlags.Bool("dry-run", false, "if true, only report which blobs would be repacked")
+
+	cmdRepack = &ffcli.Command{
+		Name:       "repack",
+		ShortHelp:  "copy live data out of mostly unreferenced blobs and delete them",
+		ShortUsage: fmt.Sprintf("%s [opts] utils repack [opts]", os.Args[0]),
+		FlagSet:    repackFlags,
+		Exec:       Repack,
+	}
+)
+
+type blobUsage struct {
+	live   int64
+	size   int64
+	ranges map[[2]int64]bool
+}
+
+func Repack(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return flag.ErrHelp
+	}
+
+	mgr, backend, hashes, mgrClose, err := getManager(ctx, locks.Exclusive)
+	if err != nil {
+		return err
+	}
+	defer mgrClose()
+
+	live, _, err := liveHashes(ctx, mgr)
+	if err != nil {
+		return err
+	}
+
+	utils.L(ctx).Debugf("measuring blob usage")
+
+	// the size of a blob is estimated from the furthest range any hash, live or
+	// not, refers to. gc leaves unreferenced hashes around for this reason.
+	usage := map[string]*blobUsage{}
+	err = hashes.Iterate(ctx, func(ctx context.Context, hash, hashset string, stream *manifest.Stream) error {
+		for _, r := range stream.Ranges {
+			if r.Hole {
+				continue
+			}
+			blobPath := streams.BlobPath(r.Blob())
+			u := usage[blobPath]
+			if u == nil {
+				u = &blobUsage{ranges: map[[2]int64]bool{}}
+				usage[blobPath] = u
+			}
+			if end := r.Offset + r.Length; end > u.size {
+				u.size = end
+			}
+			if live[hash] && !u.ranges[[2]int64{r.Offset, r.Length}] {
+				u.ranges[[2]int64{r.Offset, r.Length}] = true
+				u.live += r.Length
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	candidates := map[string]bool{}
+	var candidatePaths []string
+	var reclaimable int64
+	for blobPath, u := range usage {
+		// completely unreferenced blobs are gc's job
+		if u.live == 0 || u.size == 0 ||
+			float64(u.live)/float64(u.size) >= *repackFlagThreshold {
+			continue
+		}
+		candidates[blobPath] = true
+		candidatePaths = append(candidatePaths, blobPath)
+		reclaimable += u.size - u.live
+	}
+	sort.Strings(candidatePaths)
+
+	if *repackFlagDryRun || len(candidatePaths) == 0 {
+		for _, blobPath := range candidatePaths {
+			u := usage[blobPath]
+			fmt.Printf("would repack %s: %s of %s live\n",
+				blobPath, byteFmt(u.live), byteFmt(u.size))
+		}
+		fmt.Printf("would repack %d blobs, reclaiming about %s\n",
+			len(candidatePaths), byteFmt(reclaimable))
+		return nil
+	}
+
+	type repackable struct {
+		hash   string
+		stream *manifest.Stream
+	}
+	var affected []repackable
+	dead := map[string]bool{}
+	err = hashes.Iterate(ctx, func(ctx context.Context, hash, hashset string, stream *manifest.Stream) error {
+		for _, r := range stream.Ranges {
+			if r.Hole || !candidates[streams.BlobPath(r.Blob())] {
+				continue
+			}
+			// chunk hashes are not referenced by snapshots directly, but are kept
+			// if all of their data is part of live files.
+			if live[hash] || liveRanges(usage, stream) {
+				affected = append(affected, repackable{hash: hash, stream: stream})
+			} else {
+				dead[hash] = true
+			}
+			break
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	utils.L(ctx).Normalf("repacking %d blobs containing %d live hashes", len(candidatePaths), len(affected))
+
+	blobStore := blobs.NewStore(backend, *sysFlagBlobSize, *sysFlagMaxUnflushed, *sysFlagBlobUploads,
+		*sysFlagBlobStaging)
+	defer blobStore.Close()
+
+	copier := &rangeCopier{
+		backend: backend,
+		blobs:   blobStore,
+		hashes:  hashes,
+		copies:  map[rangeKey]*rangeCopy{},
+	}
+	for _, a := range affected {
+		copier.plan(candidates, a.hash, a.stream)
+	}
+	err = copier.copyAll(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = blobStore.Flush(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Prune writes every hashset anew, with the new ranges for live hashes and
+	// without the unreferenced hashes that refer to the old blobs, before
+	// deleting any old hashset. Only after that may the old blobs go.
+	_, err = hashes.Prune(ctx, func(hash string) bool { return !dead[hash] })
+	if err != nil {
+		return err
+	}
+
+	for _, blobPath := range candidatePaths {
+		utils.L(ctx).Debugf("deleting blob %s", blobPath)
+		err = backend.Delete(ctx, blobPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	utils.L(ctx).Normalf("repacked %d blobs, reclaiming about %s", len(candidatePaths), byteFmt(reclaimable))
+	return nil
+}
+
+func liveRanges(usage map[string]*blobUsage, stream *manifest.Stream) bool {
+	for _, r := range stream.Ranges {
+		if r.Hole {
+			continue
+		}
+		u := usage[streams.BlobPath(r.Blob())]
+		if u == nil || !u.ranges[[2]int64{r.Offset, r.Length}] {
+			return false
+		}
+	}
+	return len(stream.Ranges) > 0
+}
+
+type rangeKey struct {
+	blob   string
+	offset int64
+	length int64
+}
+
+// rangeCopy is a range to copy, along with every hash that refers to it.
+type rangeCopy struct {
+	r      *manifest.Range
+	ranges []*manifest.Range
+	users  []rangeUser
+}
+
+type rangeUser struct {
+	hash  *repackedHash
+	index int
+}
+
+// repackedHash is a hash whose stream is being rewritten to refer to copies
+// of its ranges.
+type repackedHash struct {
+	hash     string
+	ranges   [][]*manifest.Range
+	unplaced int
+	unstored int
+}
+
+func (h *repackedHash) stream() *manifest.Stream {
+	var stream manifest.Stream
+	for _, ranges := range h.ranges {
+		stream.Ranges = append(stream.Ranges, ranges...)
+	}
+	return &stream
+}
+
+// rangeCopier copies ranges into a blob store, copying each distinct range
+// only once no matter how many hashes (a file and its chunks, or files
+// sharing chunks) refer to it.
+type rangeCopier struct {
+	backend backends.Backend
+	blobs   *blobs.Store
+	hashes  hashdb.DB
+	copies  map[rangeKey]*rangeCopy
+	order   []*rangeCopy
+}
+
+// plan notes every range of stream that lives in a candidate blob as needing
+// a copy. Every hash has to be planned before anything is copied, so that
+// the blob a hash's last copy lands in can list the hash in its index.
+func (c *rangeCopier) plan(candidates map[string]bool, hash string, stream *manifest.Stream) {
+	h := &repackedHash{hash: hash, ranges: make([][]*manifest.Range, len(stream.Ranges))}
+	for i, r := range stream.Ranges {
+		if r.Hole || !candidates[streams.BlobPath(r.Blob())] {
+			h.ranges[i] = []*manifest.Range{r}
+			continue
+		}
+		key := rangeKey{blob: r.Blob(), offset: r.Offset, length: r.Length}
+		rc := c.copies[key]
+		if rc == nil {
+			rc = &rangeCopy{r: r}
+			c.copies[key] = rc
+			c.order = append(c.order, rc)
+		}
+		rc.users = append(rc.users, rangeUser{hash: h, index: i})
+		h.unplaced++
+		h.unstored++
+	}
+}
+
+// copyAll copies every planned range. Once all of a hash's copies are
+// stored, the hash is updated to refer to them.
+func (c *rangeCopier) copyAll(ctx context.Context) error {
+	for _, rc := range c.order {
+		err := c.copy(ctx, rc)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *rangeCopier) copy(ctx context.Context, rc *rangeCopy) error {
+	r := rc.r
+	return c.blobs.Put(ctx, &lazyRange{ctx: ctx, backend: c.backend, r: r}, r.Length,
+		&repackKey{blob: r.Blob(), offset: r.Offset},
+		func(copied *manifest.Stream, index *manifest.BlobIndex) {
+			// the copy is part of the same compressed frame, if any, as r was
+			for i, nr := range copied.Ranges {
+				nr.Compression = r.Compression
+				if i == 0 {
+					nr.UncompressedLength = r.UncompressedLength
+				}
+			}
+			rc.ranges = copied.Ranges
+			for _, user := range rc.users {
+				user.hash.ranges[user.index] = rc.ranges
+				user.hash.unplaced--
+				if user.hash.unplaced == 0 {
+					index.Hashes = append(index.Hashes, &manifest.HashedData{
+						Hash: []byte(user.hash.hash),
+						Data: user.hash.stream(),
+					})
+				}
+			}
+		},
+		func(ctx context.Context, copied *manifest.Stream, lastOfBlob bool) error {
+			var length int64
+			for _, nr := range copied.Ranges {
+				length += nr.Length
+			}
+			if length != r.Length {
+				return errs.New("repacked range has length %d, expected %d", length, r.Length)
+			}
+			for _, user := range rc.users {
+				user.hash.unstored--
+				if user.hash.unstored == 0 {
+					err := c.hashes.Put(ctx, user.hash.hash, user.hash.stream())
+					if err != nil {
+						return err
+					}
+				}
+			}
+			if lastOfBlob {
+				return c.hashes.Flush(ctx)
+			}
+			return nil
+		})
+}
+
+// lazyRange doesn't open the range until it is first read, so that queued up
+// ranges waiting for a blob flush don't hold open backend requests.
+type lazyRange struct {
+	ctx     context.Context
+	backend backends.Backend
+	r       *manifest.Range
+	rc      io.ReadCloser
+}
+
+func (l *lazyRange) Read(p []byte) (n int, err error) {
+	if l.rc == nil {
+		l.rc, err = streams.OpenRange(l.ctx, l.backend, l.r, 0)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return l.rc.Read(p)
+}
+
+func (l *lazyRange) Close() error {
+	if l.rc == nil {
+		return nil
+	}
+	return l.rc.Close()
+}
+
+type repackKey struct {
+	blob   string
+	offset int64
+}
+
+func (a *repackKey) Less(bi blobs.SortKey) bool {
+	b := bi.(*repackKey)
+	if a.blob < b.blob {
+		return true
+	}
+	if a.blob > b.blob {
+		return false
+	}
+	return a.offset < b.offset
+}
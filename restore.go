@@ -0,0 +1,511 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"github.com/zeebo/errs"
+
+	"github.com/jtolio/jam/locks"
+	"github.com/jtolio/jam/manifest"
+	"github.com/jtolio/jam/session"
+	"github.com/jtolio/jam/streams"
+	"github.com/jtolio/jam/utils"
+)
+
+var (
+	restoreFlags            = flag.NewFlagSet("", flag.ExitOnError)
+	restoreFlagSnapshot     = restoreFlags.String("snap", "latest", "which snapshot to use")
+	restoreFlagOverwrite    = restoreFlags.Bool("overwrite", false, "if true, replace anything already at a destination path")
+	restoreFlagSkipExisting = restoreFlags.Bool("skip-existing", false, "if true, leave anything already at a destination path alone")
+	restoreFlagVerify       = restoreFlags.Bool("verify", false, "if true, reread every restored file and confirm its hash")
+	restoreFlagParallelism  = restoreFlags.Int("parallelism", 4, "how many blobs to read from at once")
+	restoreFlagNumericOwner = restoreFlags.Bool("numeric-owner", false,
+		"if true, restore ownership by the stored user and group ids even if their names exist locally. "+
+			"ownership is only restored when running as root")
+
+	cmdRestore = &ffcli.Command{
+		Name:       "restore",
+		ShortHelp:  "restore writes the files under the given prefix to a local directory",
+		ShortUsage: fmt.Sprintf("%s [opts] restore [opts] <prefix> <dest-dir>", os.Args[0]),
+		FlagSet:    restoreFlags,
+		Exec:       Restore,
+	}
+)
+
+type restoreEntry struct {
+	dest   string
+	entry  *session.ListEntry
+	stream *streams.Stream
+	// linkTo is the first file of the entry's hard link group, if the entry
+	// isn't the first.
+	linkTo   *restoreEntry
+	restored bool
+}
+
+// linkKey identifies the files that were hard links to one another.
+type linkKey struct {
+	group string
+	hash  string
+}
+
+func Restore(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return flag.ErrHelp
+	}
+	if *restoreFlagOverwrite && *restoreFlagSkipExisting {
+		return fmt.Errorf("only one of -overwrite and -skip-existing may be provided")
+	}
+	if *restoreFlagParallelism < 1 {
+		return fmt.Errorf("invalid parallelism: %d", *restoreFlagParallelism)
+	}
+	prefix := args[0]
+	dest, err := filepath.Abs(args[1])
+	if err != nil {
+		return err
+	}
+
+	mgr, _, _, mgrClose, err := getManager(ctx, locks.Shared)
+	if err != nil {
+		return err
+	}
+	defer mgrClose()
+
+	snap, _, err := getReadSnapshot(ctx, mgr, *restoreFlagSnapshot)
+	if err != nil {
+		return err
+	}
+	defer snap.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var files, links, symlinks, specials, dirs []*restoreEntry
+	firstLinks := map[linkKey]*restoreEntry{}
+	err = snap.List(ctx, prefix, true, func(ctx context.Context, entry *session.ListEntry) error {
+		rel := strings.TrimPrefix(entry.Path, prefix)
+		if entry.Meta.Type == manifest.Metadata_DIRECTORY && strings.Trim(rel, "/") == "" {
+			// the destination directory itself
+			return nil
+		}
+		if rel == "" {
+			rel = filepath.Base(entry.Path)
+		}
+		target, ok := restoreTarget(dest, rel)
+		if !ok {
+			return errs.New("path %q would be restored outside of %q", entry.Path, dest)
+		}
+
+		switch entry.Meta.Type {
+		case manifest.Metadata_FILE:
+			var key linkKey
+			if entry.Meta.LinkGroup != "" {
+				key = linkKey{group: entry.Meta.LinkGroup, hash: string(entry.Hash)}
+				if first, exists := firstLinks[key]; exists {
+					links = append(links, &restoreEntry{dest: target, entry: entry, linkTo: first})
+					return nil
+				}
+			}
+			stream, err := entry.Stream(ctx)
+			if err != nil {
+				return err
+			}
+			file := &restoreEntry{dest: target, entry: entry, stream: stream}
+			files = append(files, file)
+			if entry.Meta.LinkGroup != "" {
+				firstLinks[key] = file
+			}
+		case manifest.Metadata_SYMLINK:
+			symlinks = append(symlinks, &restoreEntry{dest: target, entry: entry})
+		case manifest.Metadata_DIRECTORY:
+			dirs = append(dirs, &restoreEntry{dest: target, entry: entry})
+		case manifest.Metadata_FIFO, manifest.Metadata_DEVICE, manifest.Metadata_SOCKET:
+			specials = append(specials, &restoreEntry{dest: target, entry: entry})
+		default:
+			utils.L(ctx).Normalf("skipping %q, type %v not understood", entry.Path, entry.Meta.Type)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(files)+len(links)+len(symlinks)+len(specials)+len(dirs) == 0 {
+		return fmt.Errorf("no paths found with prefix %q", prefix)
+	}
+
+	var restored, skipped int64
+	count := func(wrote bool) {
+		if wrote {
+			restored++
+		} else {
+			skipped++
+		}
+	}
+
+	// directories are made first, and get their metadata last, so that
+	// restoring what's in them doesn't change their modification time and
+	// isn't stopped by their permissions.
+	for _, dir := range dirs {
+		wrote, err := restoreDirectory(ctx, dir)
+		if err != nil {
+			return err
+		}
+		count(wrote)
+	}
+
+	// files are grouped by the blob they start in and sorted by offset, so each
+	// group reads through its blob front to back.
+	sort.Slice(files, func(i, j int) bool {
+		bi, oi := restoreLocation(files[i])
+		bj, oj := restoreLocation(files[j])
+		if bi != bj {
+			return bi < bj
+		}
+		return oi < oj
+	})
+	var groups [][]*restoreEntry
+	lastBlob := ""
+	for i, file := range files {
+		blob, _ := restoreLocation(file)
+		if i == 0 || blob != lastBlob {
+			groups = append(groups, nil)
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], file)
+		lastBlob = blob
+	}
+
+	groupch := make(chan []*restoreEntry)
+	go func() {
+		defer close(groupch)
+		for _, group := range groups {
+			select {
+			case groupch <- group:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	workers := make([]func() error, 0, *restoreFlagParallelism)
+	for i := 0; i < *restoreFlagParallelism; i++ {
+		workers = append(workers, func() error {
+			for group := range groupch {
+				for _, file := range group {
+					if err := ctx.Err(); err != nil {
+						return err
+					}
+					wrote, err := restoreFile(ctx, file)
+					if err != nil {
+						cancel()
+						return err
+					}
+					file.restored = wrote
+					if wrote {
+						atomic.AddInt64(&restored, 1)
+					} else {
+						atomic.AddInt64(&skipped, 1)
+					}
+				}
+			}
+			return nil
+		})
+	}
+	err = utils.Parallel(workers...)
+	if err != nil {
+		return err
+	}
+
+	for _, link := range links {
+		wrote, err := restoreLink(ctx, link)
+		if err != nil {
+			return err
+		}
+		count(wrote)
+	}
+
+	for _, special := range specials {
+		wrote, err := restoreSpecial(ctx, special)
+		if err != nil {
+			return err
+		}
+		count(wrote)
+	}
+
+	// symlinks are made last so that nothing is ever written through one.
+	for _, link := range symlinks {
+		wrote, err := restoreSymlink(ctx, link)
+		if err != nil {
+			return err
+		}
+		count(wrote)
+	}
+
+	// children go before their parents, so that setting a child's metadata
+	// doesn't change its parent's modification time.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if !dirs[i].restored {
+			continue
+		}
+		err = applyMetadata(ctx, dirs[i].dest, dirs[i].entry.Meta)
+		if err != nil {
+			return err
+		}
+	}
+
+	utils.L(ctx).Normalf("restored %d paths, skipped %d existing paths", restored, skipped)
+	return nil
+}
+
+func restoreLocation(file *restoreEntry) (blob string, offset int64) {
+	for _, r := range file.stream.Ranges() {
+		if !r.Hole {
+			return r.Blob(), r.Offset
+		}
+	}
+	return "", 0
+}
+
+// prepareDest makes sure the parent directory of path exists and deals with
+// anything already at path. It returns false if path should be left alone.
+func prepareDest(ctx context.Context, path string) (bool, error) {
+	_, err := os.Lstat(path)
+	if err == nil {
+		switch {
+		case *restoreFlagSkipExisting:
+			utils.L(ctx).Debugf("skipping existing %q", path)
+			return false, nil
+		case *restoreFlagOverwrite:
+			return true, errs.Wrap(os.Remove(path))
+		default:
+			return false, errs.New("%q already exists (see -overwrite and -skip-existing)", path)
+		}
+	}
+	if !os.IsNotExist(err) {
+		return false, errs.Wrap(err)
+	}
+	return true, errs.Wrap(os.MkdirAll(filepath.Dir(path), 0755))
+}
+
+func restoreFile(ctx context.Context, file *restoreEntry) (wrote bool, err error) {
+	defer func() {
+		err = errs.Combine(err, file.stream.Close())
+	}()
+
+	proceed, err := prepareDest(ctx, file.dest)
+	if err != nil || !proceed {
+		return false, err
+	}
+
+	utils.L(ctx).Debugf("restoring %q", file.dest)
+
+	fh, err := os.OpenFile(file.dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return false, errs.Wrap(err)
+	}
+	hasher := sha256.New()
+	err = writeSparse(fh, hasher, file.stream)
+	if err != nil {
+		fh.Close()
+		return false, errs.Wrap(err)
+	}
+	err = fh.Close()
+	if err != nil {
+		return false, errs.Wrap(err)
+	}
+	if !bytes.Equal(hasher.Sum(nil), file.entry.Hash) {
+		return false, errs.New("restored data for %q does not match its hash", file.entry.Path)
+	}
+
+	if *restoreFlagVerify {
+		err = verifyRestored(file.dest, file.entry.Hash)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, applyMetadata(ctx, file.dest, file.entry.Meta)
+}
+
+// writeSparse writes stream to fh and hasher, but seeks past the stream's
+// holes in fh instead of writing them, so that fh is as sparse as the
+// original file was.
+func writeSparse(fh *os.File, hasher io.Writer, stream *streams.Stream) error {
+	w := io.MultiWriter(fh, hasher)
+	var pos int64
+	for _, hole := range stream.Holes() {
+		_, err := io.CopyN(w, stream, hole.Offset-pos)
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(hasher, stream, hole.Length)
+		if err != nil {
+			return err
+		}
+		_, err = fh.Seek(hole.Length, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		pos = hole.Offset + hole.Length
+	}
+	_, err := io.Copy(w, stream)
+	if err != nil {
+		return err
+	}
+	// a hole at the end has to be made by extending the file.
+	return fh.Truncate(stream.Length())
+}
+
+func verifyRestored(path string, expected []byte) error {
+	fh, err := os.Open(path)
+	if err != nil {
+		return errs.Wrap(err)
+	}
+	defer fh.Close()
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, fh)
+	if err != nil {
+		return errs.Wrap(err)
+	}
+	if !bytes.Equal(hasher.Sum(nil), expected) {
+		return errs.New("verification failed, %q does not match its hash", path)
+	}
+	return nil
+}
+
+func restoreSymlink(ctx context.Context, link *restoreEntry) (bool, error) {
+	proceed, err := prepareDest(ctx, link.dest)
+	if err != nil || !proceed {
+		return false, err
+	}
+	utils.L(ctx).Debugf("restoring symlink %q", link.dest)
+	err = os.Symlink(string(link.entry.Meta.LinkTarget), link.dest)
+	if err != nil {
+		return false, errs.Wrap(err)
+	}
+	// symlink permissions and timestamps are not restored, as os doesn't
+	// offer a way to change them without following the link.
+	return true, restoreOwner(link.dest, link.entry.Meta.Owner)
+}
+
+// restoreLink makes a hard link to the first file of link's group, or
+// restores link as a file of its own if that file wasn't restored.
+func restoreLink(ctx context.Context, link *restoreEntry) (bool, error) {
+	if !link.linkTo.restored {
+		stream, err := link.entry.Stream(ctx)
+		if err != nil {
+			return false, err
+		}
+		link.stream = stream
+		return restoreFile(ctx, link)
+	}
+	proceed, err := prepareDest(ctx, link.dest)
+	if err != nil || !proceed {
+		return false, err
+	}
+	utils.L(ctx).Debugf("restoring hard link %q to %q", link.dest, link.linkTo.dest)
+	return true, errs.Wrap(os.Link(link.linkTo.dest, link.dest))
+}
+
+// restoreDirectory makes a directory if there isn't one already, leaving its
+// metadata for later.
+func restoreDirectory(ctx context.Context, dir *restoreEntry) (bool, error) {
+	info, err := os.Lstat(dir.dest)
+	if err == nil && info.IsDir() {
+		if *restoreFlagSkipExisting {
+			utils.L(ctx).Debugf("skipping existing %q", dir.dest)
+			return false, nil
+		}
+		dir.restored = true
+		return true, nil
+	}
+	proceed, err := prepareDest(ctx, dir.dest)
+	if err != nil || !proceed {
+		return false, err
+	}
+	utils.L(ctx).Debugf("restoring directory %q", dir.dest)
+	err = os.Mkdir(dir.dest, 0700)
+	if err != nil {
+		return false, errs.Wrap(err)
+	}
+	dir.restored = true
+	return true, nil
+}
+
+func restoreSpecial(ctx context.Context, special *restoreEntry) (bool, error) {
+	proceed, err := prepareDest(ctx, special.dest)
+	if err != nil || !proceed {
+		return false, err
+	}
+	utils.L(ctx).Debugf("restoring %v %q", special.entry.Meta.Type, special.dest)
+	err = makeSpecial(special.dest, special.entry.Meta)
+	if err != nil {
+		return false, err
+	}
+	return true, applyMetadata(ctx, special.dest, special.entry.Meta)
+}
+
+// applyMetadata sets the extended attributes, owner, mode and modification
+// time of a restored path. Creation time can not be set on most platforms
+// and is left alone. Extended attributes that can't be set are only warned
+// about, since the destination filesystem may not support them.
+func applyMetadata(ctx context.Context, path string, meta *manifest.Metadata) error {
+	err := writeXattrs(path, meta.Xattrs)
+	if err != nil {
+		utils.L(ctx).Urgentf("unable to restore extended attributes of %q: %v", path, err)
+	}
+	// the owner goes first, since changing it can clear the setuid and setgid
+	// bits.
+	err = restoreOwner(path, meta.Owner)
+	if err != nil {
+		return err
+	}
+	mode := os.FileMode(meta.Mode) & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	err = os.Chmod(path, mode)
+	if err != nil {
+		return errs.Wrap(err)
+	}
+	modified := time.Now()
+	if meta.Modified != nil {
+		modified, err = ptypes.Timestamp(meta.Modified)
+		if err != nil {
+			return errs.Wrap(err)
+		}
+	}
+	return errs.Wrap(os.Chtimes(path, modified, modified))
+}
+
+// restoreOwner changes the owner of path, without following symlinks. The
+// stored user and group names are used if they exist locally, unless
+// -numeric-owner is set. Only root can give files away, so nothing is done
+// otherwise.
+func restoreOwner(path string, owner *manifest.Metadata_Owner) error {
+	if owner == nil || os.Geteuid() != 0 {
+		return nil
+	}
+	uid, gid := localOwner(owner, *restoreFlagNumericOwner)
+	return errs.Wrap(os.Lchown(path, uid, gid))
+}
+
+// restoreTarget returns where the snapshot path rel, relative to the restored
+// prefix, goes under dest, or false if that would be outside of dest.
+func restoreTarget(dest, rel string) (string, bool) {
+	target := filepath.Join(dest, filepath.FromSlash(rel))
+	relTarget, err := filepath.Rel(dest, target)
+	if err != nil || relTarget == "." || relTarget == ".." ||
+		strings.HasPrefix(relTarget, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return target, true
+}
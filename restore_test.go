@@ -0,0 +1,30 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestoreTarget(t *testing.T) {
+	for _, tc := range []struct {
+		dest, rel string
+		target    string
+		ok        bool
+	}{
+		{"/", "etc/passwd", "/etc/passwd", true},
+		{"/", "a/", "/a", true},
+		{"/", "../etc", "/etc", true},
+		{"/home/user/restore", "a/b/c", "/home/user/restore/a/b/c", true},
+		{"/home/user/restore", "..a", "/home/user/restore/..a", true},
+		{"/home/user/restore", "../escape", "", false},
+		{"/home/user/restore", "a/../../escape", "", false},
+		{"/home/user/restore", "..", "", false},
+		{"/home/user/restore", "a/..", "", false},
+	} {
+		target, ok := restoreTarget(filepath.FromSlash(tc.dest), tc.rel)
+		require.Equal(t, tc.ok, ok, "%q in %q", tc.rel, tc.dest)
+		require.Equal(t, filepath.FromSlash(tc.target), target, "%q in %q", tc.rel, tc.dest)
+	}
+}
@@ -0,0 +1,137 @@
+package session
+
+import (
+	"crypto/sha256"
+	"io"
+
+	"github.com/jtolio/jam/chunker"
+)
+
+type fileChunk struct {
+	offset int64
+	length int64
+	hash   []byte
+}
+
+// splitFile reads data to the end, returning the hash of all of it along with
+// the offset, length, and hash of each content-defined chunk. holes are not
+// read, but hashed as zeros: skip is called to move data past each one, and
+// no chunk spans a hole.
+func splitFile(data io.Reader, holes []fileHole, skip func(offset int64) error) (
+	hash []byte, size int64, chunks []fileChunk, err error) {
+	fileHasher := sha256.New()
+	split := func(data io.Reader) error {
+		c := chunker.NewDefault(io.TeeReader(data, fileHasher))
+		for {
+			chunk, err := c.Next()
+			if err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+			chunkHash := sha256.Sum256(chunk)
+			chunks = append(chunks, fileChunk{
+				offset: size,
+				length: int64(len(chunk)),
+				hash:   chunkHash[:],
+			})
+			size += int64(len(chunk))
+		}
+	}
+
+	for _, hole := range holes {
+		err = split(io.LimitReader(data, hole.offset-size))
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		if size != hole.offset {
+			return nil, 0, nil, io.ErrUnexpectedEOF
+		}
+		err = writeZeros(fileHasher, hole.length)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		size += hole.length
+		err = skip(size)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+	}
+	err = split(data)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return fileHasher.Sum(nil), size, chunks, nil
+}
+
+// chunkHoles returns the length of the hole before each chunk, and then the
+// length of the hole after the last one, for a manifest.ChunkedData.
+func chunkHoles(chunks []fileChunk, holes []fileHole) []int64 {
+	rv := make([]int64, len(chunks)+1)
+	h := 0
+	for i, chunk := range chunks {
+		for ; h < len(holes) && holes[h].offset < chunk.offset; h++ {
+			rv[i] += holes[h].length
+		}
+	}
+	for ; h < len(holes); h++ {
+		rv[len(chunks)] += holes[h].length
+	}
+	return rv
+}
+
+// sharedFile lets a number of chunkReaders take turns reading from one
+// underlying file, closing the file once every chunkReader is closed.
+type sharedFile struct {
+	data ReadSeekCloser
+	pos  int64
+	refs int
+}
+
+func (f *sharedFile) chunk(offset, length int64) *chunkReader {
+	f.refs++
+	return &chunkReader{f: f, offset: offset, remaining: length}
+}
+
+type chunkReader struct {
+	f         *sharedFile
+	offset    int64
+	remaining int64
+	closed    bool
+}
+
+func (r *chunkReader) Read(p []byte) (n int, err error) {
+	if r.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if r.f.pos != r.offset {
+		r.f.pos, err = r.f.data.Seek(r.offset, io.SeekStart)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err = r.f.data.Read(p)
+	r.f.pos += int64(n)
+	r.offset += int64(n)
+	r.remaining -= int64(n)
+	if err == io.EOF && r.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *chunkReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	r.f.refs--
+	if r.f.refs == 0 {
+		return r.f.data.Close()
+	}
+	return nil
+}
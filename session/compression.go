@@ -0,0 +1,36 @@
+package session
+
+import (
+	"path"
+	"strings"
+
+	"github.com/jtolio/jam/manifest"
+)
+
+// CompressionPolicy decides how the data stored for a path is compressed.
+type CompressionPolicy func(path string) manifest.Range_Compression
+
+// DefaultIncompressible lists the extensions of file formats that are
+// typically compressed already.
+var DefaultIncompressible = []string{
+	"7z", "aac", "apk", "avi", "br", "bz2", "deb", "docx", "epub", "flac",
+	"gif", "gz", "heic", "jar", "jpeg", "jpg", "lz", "lz4", "lzma", "m4a",
+	"m4v", "mkv", "mov", "mp3", "mp4", "odp", "ods", "odt", "ogg", "opus",
+	"png", "pptx", "rar", "rpm", "tgz", "txz", "webm", "webp", "whl", "xlsx",
+	"xz", "zip", "zst",
+}
+
+// ExtensionPolicy compresses data with compression unless the path has one
+// of the skip extensions (without the leading '.', compared ignoring case).
+func ExtensionPolicy(compression manifest.Range_Compression, skip []string) CompressionPolicy {
+	skipSet := make(map[string]bool, len(skip))
+	for _, ext := range skip {
+		skipSet[strings.ToLower(strings.TrimPrefix(ext, "."))] = true
+	}
+	return func(p string) manifest.Range_Compression {
+		if skipSet[strings.ToLower(strings.TrimPrefix(path.Ext(p), "."))] {
+			return manifest.Range_NONE
+		}
+		return compression
+	}
+}
@@ -0,0 +1,76 @@
+package session
+
+import (
+	"io"
+	"os"
+
+	"github.com/jtolio/jam/chunker"
+)
+
+// holes smaller than this are read as zeros like any other data, so that a
+// file with many small holes isn't split into many small chunks.
+const minHoleSize = chunker.DefaultMinSize
+
+// the end of a sparse file is always read as data, so that every file has
+// at least one chunk to store its blob index entry with.
+const sparseTail = 4096
+
+type fileHole struct {
+	offset int64
+	length int64
+}
+
+// readHoles returns the holes in data if it is a local file whose
+// filesystem can find them, and seeks data back to the start. data must be
+// at the start already.
+func readHoles(data io.Reader) ([]fileHole, error) {
+	fh, ok := data.(*os.File)
+	if !ok {
+		return nil, nil
+	}
+	size, err := fh.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	holes, err := findHoles(fh, size)
+	if err != nil {
+		return nil, err
+	}
+	_, err = fh.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(holes) > 0 {
+		last := &holes[len(holes)-1]
+		if last.offset+last.length > size-sparseTail {
+			last.length = size - sparseTail - last.offset
+		}
+	}
+	rv := holes[:0]
+	for _, hole := range holes {
+		if hole.length >= minHoleSize {
+			rv = append(rv, hole)
+		}
+	}
+	return rv, nil
+}
+
+// zeros is written for holes wherever their contents are needed, such as
+// for hashing.
+var zeros = make([]byte, 32*1024)
+
+func writeZeros(w io.Writer, n int64) error {
+	for n > 0 {
+		p := zeros
+		if int64(len(p)) > n {
+			p = p[:n]
+		}
+		_, err := w.Write(p)
+		if err != nil {
+			return err
+		}
+		n -= int64(len(p))
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package session
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+var seekData, seekHole = 3, 4
+
+func init() {
+	if runtime.GOOS == "darwin" {
+		seekData, seekHole = 4, 3
+	}
+}
+
+// findHoles finds the holes in the first size bytes of fh with SEEK_HOLE and
+// SEEK_DATA, leaving fh at some unspecified offset. Filesystems that don't
+// support them have no holes.
+func findHoles(fh *os.File, size int64) (holes []fileHole, err error) {
+	for pos := int64(0); pos < size; {
+		start, err := fh.Seek(pos, seekHole)
+		if err != nil {
+			if errors.Is(err, syscall.EINVAL) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		if start >= size {
+			break
+		}
+		end, err := fh.Seek(start, seekData)
+		if err != nil {
+			if !errors.Is(err, syscall.ENXIO) {
+				return nil, err
+			}
+			end = size
+		}
+		if end > size {
+			end = size
+		}
+		holes = append(holes, fileHole{offset: start, length: end - start})
+		pos = end
+	}
+	return holes, nil
+}
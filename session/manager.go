@@ -37,28 +37,106 @@ func pathToTimestamp(path string) (time.Time, error) {
 	return ts, errs.Wrap(err)
 }
 
+var ErrNoSnapshots = fmt.Errorf("no snapshots exist yet")
+
+// ErrConcurrentCommit is returned when committing a session would lose the
+// changes of a snapshot committed after the session started.
+var ErrConcurrentCommit = errs.Class("concurrent commit")
+
+const (
+	// a clock this far behind the latest snapshot is assumed to have been set
+	// back, rather than to be a little off from the clock of another system.
+	maxClockSkew = time.Minute
+	// how many unused timestamps to try before giving up
+	maxTimestampAttempts = 10
+	// how many times to merge in concurrently committed snapshots before
+	// giving up
+	maxMergeAttempts = 10
+)
+
+// commitTimestamp returns a timestamp for a new snapshot made at now. The
+// encryption keys of a snapshot are derived from its path, so the timestamp
+// is always after that of every existing snapshot, and is never one that is
+// already in use. base is the latest snapshot when the new one was started,
+// or the zero time if there was none. If another snapshot has been committed
+// since, ErrConcurrentCommit is returned.
+func commitTimestamp(ctx context.Context, backend backends.Backend, base, now time.Time) (time.Time, error) {
+	timestamps, err := listTimestamps(ctx, backend)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(timestamps) > 0 && !timestamps[0].Equal(base) {
+		started := "before there were any snapshots"
+		if !base.IsZero() {
+			started = fmt.Sprintf("from snapshot %d", base.UnixNano())
+		}
+		return time.Time{}, ErrConcurrentCommit.New(
+			"snapshot %d was committed after this one started %s. "+
+				"committing would lose its changes, so try again",
+			timestamps[0].UnixNano(), started)
+	}
+	ts := now.Round(0)
+	if len(timestamps) > 0 && !ts.After(timestamps[0]) {
+		latest := timestamps[0]
+		if latest.Sub(ts) > maxClockSkew {
+			return time.Time{}, errs.New(
+				"the clock says %v, which is %v before the latest snapshot at %v. was the clock set back?",
+				ts, latest.Sub(ts), latest)
+		}
+		utils.L(ctx).Debugf("clock is %v behind the latest snapshot, using a later timestamp", latest.Sub(ts))
+		ts = latest.Add(time.Nanosecond)
+	}
+
+	for i := 0; i < maxTimestampAttempts; i++ {
+		exists, err := objectExists(ctx, backend, timestampToPath(ts))
+		if err != nil {
+			return time.Time{}, err
+		}
+		if !exists {
+			return ts, nil
+		}
+		ts = ts.Add(time.Nanosecond)
+	}
+	return time.Time{}, errs.New("found no unused snapshot timestamp after %d attempts", maxTimestampAttempts)
+}
+
+func objectExists(ctx context.Context, backend backends.Backend, path string) (bool, error) {
+	rc, err := backend.Get(ctx, path, 0, 1)
+	if err != nil {
+		if errors.Is(err, backends.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, rc.Close()
+}
+
 type Manager struct {
-	backend backends.Backend
-	blobs   *blobs.Store
-	hashes  hashdb.DB
+	backend     backends.Backend
+	blobs       *blobs.Store
+	hashes      hashdb.DB
+	compression CompressionPolicy
 }
 
-func NewManager(backend backends.Backend, blobStore *blobs.Store, hashes hashdb.DB) *Manager {
+// NewManager returns a Manager. compression decides how new file data is
+// compressed, and may be nil to store everything uncompressed.
+func NewManager(backend backends.Backend, blobStore *blobs.Store, hashes hashdb.DB,
+	compression CompressionPolicy) *Manager {
 	return &Manager{
-		backend: backend,
-		blobs:   blobStore,
-		hashes:  hashes,
+		backend:     backend,
+		blobs:       blobStore,
+		hashes:      hashes,
+		compression: compression,
 	}
 }
 
-// ListSnapshots returns snapshots newest to oldest
-func (s *Manager) ListSnapshots(ctx context.Context,
-	cb func(ctx context.Context, timestamp time.Time) error) error {
+// listTimestamps returns the timestamps of every snapshot, newest to oldest.
+func listTimestamps(ctx context.Context, backend backends.Backend) ([]time.Time, error) {
 	// TODO: backend.List is not ordered. we could use the fact that manifests are stored
 	//		using timeFormat format and list by years and months in decreasing order to get
 	// 		an order
 	var timestamps []time.Time
-	err := s.backend.List(ctx, ManifestPrefix,
+	err := backend.List(ctx, ManifestPrefix,
 		func(ctx context.Context, path string) error {
 			timestamp, err := pathToTimestamp(path)
 			if err != nil {
@@ -69,11 +147,21 @@ func (s *Manager) ListSnapshots(ctx context.Context,
 			return nil
 		})
 	if err != nil {
-		return errs.Wrap(err)
+		return nil, errs.Wrap(err)
 	}
 	sort.Slice(timestamps, func(i, j int) bool {
 		return timestamps[i].After(timestamps[j])
 	})
+	return timestamps, nil
+}
+
+// ListSnapshots returns snapshots newest to oldest
+func (s *Manager) ListSnapshots(ctx context.Context,
+	cb func(ctx context.Context, timestamp time.Time) error) error {
+	timestamps, err := listTimestamps(ctx, s.backend)
+	if err != nil {
+		return err
+	}
 	for _, timestamp := range timestamps {
 		err = cb(ctx, timestamp)
 		if err != nil {
@@ -108,7 +196,7 @@ func (s *Manager) LatestSnapshot(ctx context.Context) (*Snapshot, time.Time, err
 		return nil, time.Time{}, err
 	}
 	if latest.IsZero() {
-		return nil, time.Time{}, fmt.Errorf("no snapshots exist yet")
+		return nil, time.Time{}, ErrNoSnapshots
 	}
 	snap, err := s.OpenSnapshot(ctx, latest)
 	return snap, latest, err
@@ -123,7 +211,7 @@ func (s *Manager) openPathDB(ctx context.Context, timestamp time.Time) (*pathdb.
 		err = errs.Combine(err, rc.Close())
 	}()
 
-	return pathdb.Open(ctx, s.backend, s.blobs, rc)
+	return pathdb.Open(ctx, s.backend, s.blobs, s.hashes, rc)
 }
 
 func (s *Manager) OpenSnapshot(ctx context.Context, timestamp time.Time) (*Snapshot, error) {
@@ -134,6 +222,18 @@ func (s *Manager) OpenSnapshot(ctx context.Context, timestamp time.Time) (*Snaps
 	return newSnapshot(s.backend, db, s.blobs, s.hashes), nil
 }
 
+// NewDryRunSession is like NewSession, but the returned Session never stores
+// any data and can't be committed. It is useful for seeing what a change
+// would do.
+func (s *Manager) NewDryRunSession(ctx context.Context) (*Session, error) {
+	sess, err := s.NewSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sess.dryRun = true
+	return sess, nil
+}
+
 func (s *Manager) NewSession(ctx context.Context) (*Session, error) {
 	latest, err := s.latestTimestamp(ctx)
 	if err != nil {
@@ -141,22 +241,50 @@ func (s *Manager) NewSession(ctx context.Context) (*Session, error) {
 	}
 	var db *pathdb.DB
 	if latest.IsZero() {
-		db = pathdb.New(s.backend, s.blobs)
+		db = pathdb.New(s.backend, s.blobs, s.hashes)
 	} else {
 		db, err = s.openPathDB(ctx, latest)
 		if err != nil {
 			return nil, err
 		}
 	}
-	return newSession(s.backend, db, s.blobs, s.hashes), nil
+	return s.session(db, latest), nil
+}
+
+// session returns a session changing db, started when base was the latest
+// snapshot.
+func (s *Manager) session(db *pathdb.DB, base time.Time) *Session {
+	sess := newSession(s.backend, db, s.blobs, s.hashes, s.compression)
+	sess.mgr = s
+	sess.base = base
+	if !base.IsZero() {
+		sess.parents = []time.Time{base}
+	}
+	return sess
+}
+
+// NewDryRunSessionAt is like NewDryRunSession, but the session starts from
+// the snapshot at timestamp instead of the latest one.
+func (s *Manager) NewDryRunSessionAt(ctx context.Context, timestamp time.Time) (*Session, error) {
+	db, err := s.openPathDB(ctx, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	sess := s.session(db, timestamp)
+	sess.dryRun = true
+	return sess, nil
 }
 
 func (s *Manager) RevertTo(ctx context.Context, timestamp time.Time) (*Session, error) {
+	latest, err := s.latestTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
 	db, err := s.openPathDB(ctx, timestamp)
 	if err != nil {
 		return nil, err
 	}
-	sess := newSession(s.backend, db, s.blobs, s.hashes)
+	sess := s.session(db, latest)
 	sess.reverting = true
 	return sess, nil
 }
@@ -167,7 +295,7 @@ func (s *Manager) DeleteSnapshot(ctx context.Context, timestamp time.Time) error
 		return err
 	}
 	if latest.IsZero() {
-		return fmt.Errorf("no snapshots exist yet")
+		return ErrNoSnapshots
 	}
 	if !latest.After(timestamp) {
 		return fmt.Errorf("can't remove latest snapshot")
@@ -0,0 +1,98 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/jtolio/jam/backends"
+)
+
+// hiddenManifests lists only the manifests in listed, like a backend whose
+// listings lag behind.
+type hiddenManifests struct {
+	backends.Backend
+	listed map[string]bool
+}
+
+func (h *hiddenManifests) List(ctx context.Context, prefix string,
+	cb func(ctx context.Context, path string) error) error {
+	return h.Backend.List(ctx, prefix, func(ctx context.Context, path string) error {
+		if strings.HasPrefix(path, ManifestPrefix) && !h.listed[path] {
+			return nil
+		}
+		return cb(ctx, path)
+	})
+}
+
+func TestCommitTimestamp(t *testing.T) {
+	_, backend := newTestManager(t)
+	now := time.Unix(1700000000, 0)
+
+	// without snapshots, any time is fine.
+	ts, err := commitTimestamp(ctx, backend, time.Time{}, now)
+	require.NoError(t, err)
+	require.True(t, ts.Equal(now))
+
+	latest := now.Add(time.Second)
+	require.NoError(t, backend.Put(ctx, timestampToPath(latest), bytes.NewReader(nil)))
+
+	// a clock a little behind the latest snapshot gets a timestamp just after
+	// it.
+	ts, err = commitTimestamp(ctx, backend, latest, now)
+	require.NoError(t, err)
+	require.True(t, ts.Equal(latest.Add(time.Nanosecond)))
+	ts, err = commitTimestamp(ctx, backend, latest, latest)
+	require.NoError(t, err)
+	require.True(t, ts.Equal(latest.Add(time.Nanosecond)))
+
+	// a clock after it is used as is.
+	ts, err = commitTimestamp(ctx, backend, latest, latest.Add(time.Hour))
+	require.NoError(t, err)
+	require.True(t, ts.Equal(latest.Add(time.Hour)))
+
+	// a clock far behind it was probably set back.
+	_, err = commitTimestamp(ctx, backend, latest, latest.Add(-maxClockSkew-time.Second))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "was the clock set back?")
+
+	// the monotonic clock reading doesn't end up in the timestamp.
+	ts, err = commitTimestamp(ctx, backend, latest, time.Now())
+	require.NoError(t, err)
+	require.Equal(t, ts.Round(0), ts)
+
+	// snapshots committed since base are a concurrent commit.
+	_, err = commitTimestamp(ctx, backend, now, latest.Add(time.Hour))
+	require.True(t, ErrConcurrentCommit.Has(err))
+	_, err = commitTimestamp(ctx, backend, time.Time{}, latest.Add(time.Hour))
+	require.True(t, ErrConcurrentCommit.Has(err))
+}
+
+func TestCommitTimestampTaken(t *testing.T) {
+	_, backend := newTestManager(t)
+	latest := time.Unix(1700000000, 0)
+	require.NoError(t, backend.Put(ctx, timestampToPath(latest), bytes.NewReader(nil)))
+
+	// timestamps that are in use, but not listed yet, such as those of
+	// snapshots being written, are skipped.
+	now := latest.Add(time.Second)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, backend.Put(ctx, timestampToPath(now.Add(time.Duration(i))), bytes.NewReader(nil)))
+	}
+	hidden := &hiddenManifests{Backend: backend.Backend, listed: map[string]bool{timestampToPath(latest): true}}
+	ts, err := commitTimestamp(ctx, hidden, latest, now)
+	require.NoError(t, err)
+	require.True(t, ts.Equal(now.Add(3*time.Nanosecond)))
+
+	// but not forever.
+	for i := 3; i < maxTimestampAttempts; i++ {
+		require.NoError(t, backend.Put(ctx, timestampToPath(now.Add(time.Duration(i))), bytes.NewReader(nil)))
+	}
+	_, err = commitTimestamp(ctx, hidden, latest, now)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "found no unused snapshot timestamp")
+}
@@ -0,0 +1,202 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/jtolio/jam/pathdb"
+	"github.com/jtolio/jam/utils"
+)
+
+// parentsOf returns the parents of the snapshot at ts that still exist.
+// timestamps has every snapshot, newest first. Snapshots that don't record
+// parents, or whose parents have all been removed, are assumed to be made
+// from the snapshot before them.
+func (s *Manager) parentsOf(ctx context.Context, ts time.Time, timestamps []time.Time,
+	existing map[int64]bool) (parents []time.Time, err error) {
+	db, err := s.openPathDB(ctx, ts)
+	if err != nil {
+		return nil, err
+	}
+	header := db.Header()
+	err = db.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, parent := range header.GetParents() {
+		// parents are always older, which commonAncestor relies on.
+		if existing[parent] && parent < ts.UnixNano() {
+			parents = append(parents, time.Unix(0, parent))
+		}
+	}
+	if len(parents) > 0 {
+		return parents, nil
+	}
+	for _, timestamp := range timestamps {
+		if timestamp.Before(ts) {
+			return []time.Time{timestamp}, nil
+		}
+	}
+	return nil, nil
+}
+
+// concurrentSnapshots returns the snapshots, oldest first, that were
+// committed after base but that the snapshot at ts, just committed from
+// base, wasn't made from and that weren't made from it.
+func (s *Manager) concurrentSnapshots(ctx context.Context, base, ts time.Time) ([]time.Time, error) {
+	timestamps, err := listTimestamps(ctx, s.backend)
+	if err != nil {
+		return nil, err
+	}
+	existing := map[int64]bool{}
+	for _, timestamp := range timestamps {
+		existing[timestamp.UnixNano()] = true
+	}
+	var concurrent []time.Time
+	for i := len(timestamps) - 1; i >= 0; i-- {
+		timestamp := timestamps[i]
+		if !timestamp.After(base) || timestamp.Equal(ts) {
+			continue
+		}
+		if timestamp.After(ts) {
+			parents, err := s.parentsOf(ctx, timestamp, timestamps, existing)
+			if err != nil {
+				return nil, err
+			}
+			if containsTimestamp(parents, ts) {
+				continue
+			}
+		}
+		concurrent = append(concurrent, timestamp)
+	}
+	return concurrent, nil
+}
+
+func containsTimestamp(timestamps []time.Time, ts time.Time) bool {
+	for _, timestamp := range timestamps {
+		if timestamp.Equal(ts) {
+			return true
+		}
+	}
+	return false
+}
+
+func joinTimestamps(timestamps []time.Time) string {
+	var nanos []string
+	for _, timestamp := range timestamps {
+		nanos = append(nanos, fmt.Sprint(timestamp.UnixNano()))
+	}
+	return strings.Join(nanos, ", ")
+}
+
+// commonAncestor returns the newest snapshot both the snapshots at a and b
+// were made from, which may be either of them, or the zero time if there is
+// none.
+func (s *Manager) commonAncestor(ctx context.Context, a, b time.Time) (time.Time, error) {
+	timestamps, err := listTimestamps(ctx, s.backend)
+	if err != nil {
+		return time.Time{}, err
+	}
+	existing := map[int64]bool{}
+	for _, timestamp := range timestamps {
+		existing[timestamp.UnixNano()] = true
+	}
+
+	const fromA, fromB = 1, 2
+	marks := map[int64]int{}
+	marks[a.UnixNano()] |= fromA
+	marks[b.UnixNano()] |= fromB
+	// parents are older than the snapshots made from them, so when the
+	// marked snapshots are visited newest first, every snapshot has been
+	// reached from both sides if it ever will be.
+	for len(marks) > 0 {
+		newest := int64(math.MinInt64)
+		for timestamp := range marks {
+			if timestamp > newest {
+				newest = timestamp
+			}
+		}
+		mark := marks[newest]
+		delete(marks, newest)
+		if mark == fromA|fromB {
+			return time.Unix(0, newest), nil
+		}
+		parents, err := s.parentsOf(ctx, time.Unix(0, newest), timestamps, existing)
+		if err != nil {
+			return time.Time{}, err
+		}
+		for _, parent := range parents {
+			marks[parent.UnixNano()] |= mark
+		}
+	}
+	return time.Time{}, nil
+}
+
+// mergeInto merges the changes made in the snapshot at other since the
+// snapshot at base into db. base is the zero time if they have no common
+// ancestor.
+func (s *Manager) mergeInto(ctx context.Context, db *pathdb.DB, base, other time.Time,
+	policy pathdb.MergePolicy) error {
+	otherDB, err := s.openPathDB(ctx, other)
+	if err != nil {
+		return err
+	}
+	defer otherDB.Close()
+
+	baseDB := pathdb.New(nil, nil, nil)
+	if !base.IsZero() {
+		baseDB, err = s.openPathDB(ctx, base)
+		if err != nil {
+			return err
+		}
+	}
+	defer baseDB.Close()
+
+	if base.IsZero() {
+		utils.L(ctx).Normalf("merging snapshot %d, which has no common ancestor", other.UnixNano())
+	} else {
+		utils.L(ctx).Normalf("merging changes made in snapshot %d since %d", other.UnixNano(), base.UnixNano())
+	}
+	conflicts, err := pathdb.Merge(ctx, db, baseDB, otherDB, policy,
+		fmt.Sprintf(".conflict-%d", other.UnixNano()))
+	if err != nil {
+		return err
+	}
+	if conflicts > 0 {
+		utils.L(ctx).Normalf("resolved %d conflicting paths", conflicts)
+	}
+	return nil
+}
+
+// Merge returns a session that makes a snapshot combining the snapshots at a
+// and b: the one at a, plus every change made in the one at b since their
+// common ancestor. policy resolves paths both changed differently. The
+// session commits even if the result is the same as the snapshot at a.
+func (s *Manager) Merge(ctx context.Context, a, b time.Time, policy pathdb.MergePolicy) (*Session, error) {
+	latest, err := s.latestTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ancestor, err := s.commonAncestor(ctx, a, b)
+	if err != nil {
+		return nil, err
+	}
+	db, err := s.openPathDB(ctx, a)
+	if err != nil {
+		return nil, err
+	}
+	err = s.mergeInto(ctx, db, ancestor, b, policy)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	sess := s.session(db, latest)
+	sess.parents = []time.Time{a, b}
+	sess.merging = true
+	sess.mergePolicy = policy
+	return sess, nil
+}
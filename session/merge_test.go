@@ -0,0 +1,214 @@
+package session
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/jtolio/jam/manifest"
+	"github.com/jtolio/jam/pathdb"
+)
+
+// writeSnapshot writes a snapshot at ts with the given files, mapped to hash
+// names, recording parents if there are any.
+func writeSnapshot(t *testing.T, mgr *Manager, ts time.Time, parents []time.Time,
+	files map[string]string) time.Time {
+	sess := mgr.session(pathdb.New(mgr.backend, mgr.blobs, mgr.hashes), time.Time{})
+	defer sess.Close()
+	for path, hash := range files {
+		put(t, sess, path, hash, 1)
+	}
+	header := &manifest.SnapshotHeader{Parents: nanos(parents...)}
+	require.NoError(t, sess.paths.SerializeTo(ctx, timestampToPath(ts), header))
+	return ts
+}
+
+func TestCommonAncestor(t *testing.T) {
+	mgr, _ := newTestManager(t)
+	start := time.Unix(1700000000, 0)
+	at := func(i int) time.Time { return start.Add(time.Duration(i) * time.Second) }
+
+	// 0 <- 1 <- 2 <- 4
+	//        \- 3 <- 5 (merge of 3 and 4)
+	s0 := writeSnapshot(t, mgr, at(0), nil, nil)
+	s1 := writeSnapshot(t, mgr, at(1), []time.Time{s0}, nil)
+	s2 := writeSnapshot(t, mgr, at(2), []time.Time{s1}, nil)
+	s3 := writeSnapshot(t, mgr, at(3), []time.Time{s1}, nil)
+	s4 := writeSnapshot(t, mgr, at(4), []time.Time{s2}, nil)
+	s5 := writeSnapshot(t, mgr, at(5), []time.Time{s3, s4}, nil)
+
+	for _, tc := range []struct {
+		a, b, ancestor time.Time
+	}{
+		{s2, s3, s1},
+		{s3, s2, s1},
+		{s4, s3, s1},
+		{s4, s2, s2},
+		{s5, s4, s4},
+		{s5, s3, s3},
+		{s2, s2, s2},
+		{s0, s5, s0},
+	} {
+		ancestor, err := mgr.commonAncestor(ctx, tc.a, tc.b)
+		require.NoError(t, err)
+		require.Equal(t, tc.ancestor.UnixNano(), ancestor.UnixNano(),
+			"ancestor of %d and %d", tc.a.Unix()-start.Unix(), tc.b.Unix()-start.Unix())
+	}
+}
+
+func TestCommonAncestorWithoutParents(t *testing.T) {
+	mgr, _ := newTestManager(t)
+	start := time.Unix(1700000000, 0)
+	at := func(i int) time.Time { return start.Add(time.Duration(i) * time.Second) }
+
+	// snapshots from before parents were recorded are assumed to be made
+	// from the one before them.
+	s0 := writeSnapshot(t, mgr, at(0), nil, nil)
+	s1 := writeSnapshot(t, mgr, at(1), nil, nil)
+	s2 := writeSnapshot(t, mgr, at(2), nil, nil)
+	s3 := writeSnapshot(t, mgr, at(3), []time.Time{s1}, nil)
+
+	timestamps := timestamps(t, mgr)
+	existing := map[int64]bool{}
+	for _, timestamp := range timestamps {
+		existing[timestamp.UnixNano()] = true
+	}
+	parents, err := mgr.parentsOf(ctx, s2, timestamps, existing)
+	require.NoError(t, err)
+	require.Equal(t, nanos(s1), nanos(parents...))
+	parents, err = mgr.parentsOf(ctx, s0, timestamps, existing)
+	require.NoError(t, err)
+	require.Empty(t, parents)
+
+	ancestor, err := mgr.commonAncestor(ctx, s2, s3)
+	require.NoError(t, err)
+	require.Equal(t, s1.UnixNano(), ancestor.UnixNano())
+	ancestor, err = mgr.commonAncestor(ctx, s2, s0)
+	require.NoError(t, err)
+	require.Equal(t, s0.UnixNano(), ancestor.UnixNano())
+}
+
+func TestCommonAncestorRemoved(t *testing.T) {
+	mgr, _ := newTestManager(t)
+	start := time.Unix(1700000000, 0)
+	at := func(i int) time.Time { return start.Add(time.Duration(i) * time.Second) }
+
+	// 0 <- 1 <- 2
+	//        \- 3, with 1 removed
+	s0 := writeSnapshot(t, mgr, at(0), nil, nil)
+	s1 := writeSnapshot(t, mgr, at(1), []time.Time{s0}, nil)
+	s2 := writeSnapshot(t, mgr, at(2), []time.Time{s1}, nil)
+	s3 := writeSnapshot(t, mgr, at(3), []time.Time{s1}, nil)
+	require.NoError(t, mgr.DeleteSnapshot(ctx, s1))
+
+	// parents that are gone are replaced by the snapshot before, so 2 is
+	// assumed to be made from 0, and 3 from 2.
+	ancestor, err := mgr.commonAncestor(ctx, s2, s3)
+	require.NoError(t, err)
+	require.Equal(t, s2.UnixNano(), ancestor.UnixNano())
+
+	// with every older snapshot gone, the newer of the two is assumed to be
+	// made from the older.
+	mgr2, _ := newTestManager(t)
+	s0 = writeSnapshot(t, mgr2, at(0), nil, nil)
+	s2 = writeSnapshot(t, mgr2, at(2), []time.Time{s0}, nil)
+	s3 = writeSnapshot(t, mgr2, at(3), []time.Time{s0}, nil)
+	writeSnapshot(t, mgr2, at(4), []time.Time{s3}, nil)
+	ancestor, err = mgr2.commonAncestor(ctx, s2, s3)
+	require.NoError(t, err)
+	require.Equal(t, s0.UnixNano(), ancestor.UnixNano())
+	require.NoError(t, mgr2.DeleteSnapshot(ctx, s0))
+	ancestor, err = mgr2.commonAncestor(ctx, s2, s3)
+	require.NoError(t, err)
+	require.Equal(t, s2.UnixNano(), ancestor.UnixNano())
+}
+
+func TestManagerMerge(t *testing.T) {
+	mgr, _ := newTestManager(t)
+	start := time.Unix(1700000000, 0)
+	at := func(i int) time.Time { return start.Add(time.Duration(i) * time.Second) }
+
+	base := writeSnapshot(t, mgr, at(0), nil, map[string]string{"same": "1", "a-changes": "2", "b-removes": "3"})
+	a := writeSnapshot(t, mgr, at(1), []time.Time{base},
+		map[string]string{"same": "1", "a-changes": "4", "b-removes": "3", "a-adds": "5"})
+	b := writeSnapshot(t, mgr, at(2), []time.Time{base},
+		map[string]string{"same": "1", "a-changes": "2", "b-adds": "6"})
+
+	sess, err := mgr.Merge(ctx, a, b, pathdb.MergeFail)
+	require.NoError(t, err)
+	defer sess.Close()
+	require.NoError(t, sess.Commit(ctx))
+	all := timestamps(t, mgr)
+	require.Len(t, all, 4)
+	require.Equal(t, map[string]string{"same": "1", "a-changes": "4", "a-adds": "5", "b-adds": "6"},
+		contents(t, mgr, all[0]))
+	require.Equal(t, nanos(a, b), parents(t, mgr, all[0]))
+}
+
+func TestAutoMerge(t *testing.T) {
+	mgr, _ := newTestManager(t)
+	commit(t, mgr, map[string]string{"shared": "1"})
+
+	// a starts, then b commits before a does.
+	a, err := mgr.NewSession(ctx)
+	require.NoError(t, err)
+	defer a.Close()
+	put(t, a, "from-a", "2", 1)
+	bTimestamp := commit(t, mgr, map[string]string{"from-b": "3"})
+
+	require.NoError(t, a.Commit(ctx))
+	all := timestamps(t, mgr)
+	require.Len(t, all, 3)
+	require.Equal(t, map[string]string{"shared": "1", "from-a": "2", "from-b": "3"},
+		contents(t, mgr, all[0]))
+	require.Equal(t, nanos(bTimestamp), parents(t, mgr, all[0]))
+}
+
+func TestAutoMergeConflict(t *testing.T) {
+	for _, tc := range []struct {
+		policy   pathdb.MergePolicy
+		conflict bool
+		result   map[string]string
+	}{
+		{pathdb.MergeFail, true, nil},
+		{pathdb.MergeNewer, false, map[string]string{"path": "3"}},
+		{pathdb.MergeKeepBoth, false, nil},
+	} {
+		mgr, _ := newTestManager(t)
+		commit(t, mgr, map[string]string{"path": "1"})
+
+		a, err := mgr.NewSession(ctx)
+		require.NoError(t, err)
+		a.SetMergePolicy(tc.policy)
+		put(t, a, "path", "2", 2)
+
+		b, err := mgr.NewSession(ctx)
+		require.NoError(t, err)
+		put(t, b, "path", "3", 3)
+		require.NoError(t, b.Commit(ctx))
+		require.NoError(t, b.Close())
+		bTimestamp := timestamps(t, mgr)[0]
+
+		err = a.Commit(ctx)
+		require.NoError(t, a.Close())
+		if tc.conflict {
+			require.True(t, pathdb.ErrMergeConflict.Has(err))
+			require.Len(t, timestamps(t, mgr), 2)
+			continue
+		}
+		require.NoError(t, err)
+		all := timestamps(t, mgr)
+		require.Len(t, all, 3)
+		result := tc.result
+		if result == nil {
+			// a keeps its side, and b's is kept next to it.
+			result = map[string]string{
+				"path": "2",
+				fmt.Sprintf("path.conflict-%d", bTimestamp.UnixNano()): "3",
+			}
+		}
+		require.Equal(t, result, contents(t, mgr, all[0]))
+	}
+}
@@ -5,11 +5,13 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"io"
+	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
 	"time"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
 	"github.com/golang/protobuf/ptypes/timestamp"
 	"github.com/zeebo/errs"
@@ -19,6 +21,7 @@ import (
 	"github.com/jtolio/jam/hashdb"
 	"github.com/jtolio/jam/manifest"
 	"github.com/jtolio/jam/pathdb"
+	"github.com/jtolio/jam/streams"
 	"github.com/jtolio/jam/utils"
 )
 
@@ -33,17 +36,33 @@ type Session struct {
 	paths     *pathdb.DB
 	blobs     *blobs.Store
 	hashes    hashdb.DB
-	pending   map[string]bool
+	pending   map[string][]func(ctx context.Context, stream *manifest.Stream) error
 	reverting bool
+	merging   bool
+	dryRun    bool
+	header    *manifest.SnapshotHeader
+	mgr       *Manager
+	// base is the latest snapshot when the session started, and parents are
+	// the snapshots the session's changes are made to.
+	base        time.Time
+	parents     []time.Time
+	mergePolicy pathdb.MergePolicy
+
+	compression CompressionPolicy
 }
 
-func newSession(backend backends.Backend, paths *pathdb.DB, blobStore *blobs.Store, hashes hashdb.DB) *Session {
+func newSession(backend backends.Backend, paths *pathdb.DB, blobStore *blobs.Store, hashes hashdb.DB,
+	compression CompressionPolicy) *Session {
+	if compression == nil {
+		compression = func(string) manifest.Range_Compression { return manifest.Range_NONE }
+	}
 	return &Session{
-		backend: backend,
-		paths:   paths,
-		blobs:   blobStore,
-		hashes:  hashes,
-		pending: map[string]bool{},
+		backend:     backend,
+		paths:       paths,
+		blobs:       blobStore,
+		hashes:      hashes,
+		pending:     map[string][]func(ctx context.Context, stream *manifest.Stream) error{},
+		compression: compression,
 	}
 }
 
@@ -57,117 +76,508 @@ func (s *Session) DeleteAll(ctx context.Context, matcher func(string) bool) (rem
 
 // PutFile causes the Session to take ownership of the data io.ReadCloser and will close it when the Session
 // either uses the data or closes itself.
+//
+// Files are split into content-defined chunks, and only chunks the hash
+// database doesn't already know about are stored. The file's hash refers to
+// the concatenation of its chunks' ranges.
 func (s *Session) PutFile(ctx context.Context, path string, creation, modified time.Time, mode uint32,
-	data ReadSeekCloser) (state pathdb.PutState, err error) {
-	if strings.HasSuffix(path, "/") {
-		return pathdb.PutStateUnchanged, fmt.Errorf("file paths cannot end with a '/': %q", path)
-	}
-	creationPB, modifiedPB, err := convertTime(creation, modified)
+	stat *FileStat, data ReadSeekCloser) (state pathdb.PutState, err error) {
+	prepared, err := PrepareFile(path, creation, modified, mode, stat, data)
 	if err != nil {
-		return pathdb.PutStateUnchanged, errs.Combine(err, data.Close())
+		return pathdb.PutStateUnchanged, err
 	}
+	return s.PutPrepared(ctx, prepared)
+}
 
+// PreparedFile is a file that has been read through and hashed, ready to be
+// added to a Session with PutPrepared.
+type PreparedFile struct {
+	path        string
+	content     *manifest.Content
+	size        int64
+	startOffset int64
+	chunks      []fileChunk
+	holes       []fileHole
+	data        ReadSeekCloser
+}
+
+// PrepareFile does the reading and hashing part of PutFile. Unlike Session
+// methods, it is safe to call concurrently. PrepareFile takes ownership of
+// data, which is closed on error.
+func PrepareFile(path string, creation, modified time.Time, mode uint32,
+	stat *FileStat, data ReadSeekCloser) (*PreparedFile, error) {
+	if strings.HasSuffix(path, "/") {
+		return nil, errs.Combine(fmt.Errorf("file paths cannot end with a '/': %q", path), data.Close())
+	}
 	startOffset, err := data.Seek(0, io.SeekCurrent)
 	if err != nil {
-		return pathdb.PutStateUnchanged, errs.Combine(err, data.Close())
+		return nil, errs.Combine(err, data.Close())
 	}
 
-	hasher := sha256.New()
-	size, err := io.Copy(hasher, data)
-	if err != nil {
-		return pathdb.PutStateUnchanged, errs.Combine(err, data.Close())
+	var holes []fileHole
+	if startOffset == 0 {
+		holes, err = readHoles(data)
+		if err != nil {
+			return nil, errs.Combine(err, data.Close())
+		}
 	}
 
-	var hashAlloc [sha256.Size]byte
-	hash := hasher.Sum(hashAlloc[:0])
-
-	_, err = data.Seek(startOffset, io.SeekStart)
+	hash, size, chunks, err := splitFile(data, holes, func(offset int64) error {
+		_, err := data.Seek(offset, io.SeekStart)
+		return err
+	})
 	if err != nil {
-		return pathdb.PutStateUnchanged, errs.Combine(err, data.Close())
+		return nil, errs.Combine(err, data.Close())
 	}
-
-	content := &manifest.Content{
-		Metadata: &manifest.Metadata{
-			Type:     manifest.Metadata_FILE,
-			Creation: creationPB,
-			Modified: modifiedPB,
-			Mode:     mode,
-		},
-		Hash: hash,
+	content, err := fileContent(creation, modified, mode, stat, hash)
+	if err != nil {
+		return nil, errs.Combine(err, data.Close())
 	}
 
-	hashStr := string(hash)
+	return &PreparedFile{
+		path:        path,
+		content:     content,
+		size:        size,
+		startOffset: startOffset,
+		chunks:      chunks,
+		holes:       holes,
+		data:        data,
+	}, nil
+}
+
+// Close closes the file's data. It only needs to be called if the
+// PreparedFile is not given to PutPrepared.
+func (p *PreparedFile) Close() error {
+	return p.data.Close()
+}
+
+// PutPrepared finishes what PutFile does for a file prepared by PrepareFile,
+// taking ownership of it.
+func (s *Session) PutPrepared(ctx context.Context, p *PreparedFile) (state pathdb.PutState, err error) {
+	hashStr := string(p.content.Hash)
+
+	if s.dryRun {
+		err = p.data.Close()
+		if err != nil {
+			return pathdb.PutStateUnchanged, err
+		}
+		return s.paths.Put(ctx, p.path, p.content)
+	}
 
 	exists, err := s.hashes.Has(ctx, hashStr)
 	if err != nil {
-		return pathdb.PutStateUnchanged, errs.Combine(err, data.Close())
+		return pathdb.PutStateUnchanged, errs.Combine(err, p.data.Close())
 	}
+	_, pending := s.pending[hashStr]
 
-	if exists || s.pending[hashStr] {
-		utils.L(ctx).Debugf("data for %q is duplicate", path)
-		err = data.Close()
+	if exists || pending {
+		utils.L(ctx).Debugf("data for %q is duplicate", p.path)
+		err = p.data.Close()
 		if err != nil {
 			return pathdb.PutStateUnchanged, err
 		}
 
 	} else {
-		s.pending[hashStr] = true
+		s.pending[hashStr] = nil
+
+		err = s.putChunks(ctx, p.path, p.size, p.startOffset, p.data, hashStr, p.chunks, p.holes)
+		if err != nil {
+			return pathdb.PutStateUnchanged, err
+		}
+	}
+
+	return s.paths.Put(ctx, p.path, p.content)
+}
 
-		utils.L(ctx).Normalf("storing data for %q", path)
+// PutUnchanged records path as having the content hash without reading the
+// file, for when the file looks unchanged from a previous snapshot (see
+// StatUnchanged). ok is false if the data for hash isn't stored or being
+// stored anymore, in which case the file has to be put with PutFile instead.
+func (s *Session) PutUnchanged(ctx context.Context, path string, creation, modified time.Time, mode uint32,
+	stat *FileStat, hash []byte) (state pathdb.PutState, ok bool, err error) {
+	if strings.HasSuffix(path, "/") {
+		return pathdb.PutStateUnchanged, false, fmt.Errorf("file paths cannot end with a '/': %q", path)
+	}
+	exists, err := s.hashes.Has(ctx, string(hash))
+	if err != nil {
+		return pathdb.PutStateUnchanged, false, err
+	}
+	if _, pending := s.pending[string(hash)]; !exists && !pending {
+		return pathdb.PutStateUnchanged, false, nil
+	}
+	content, err := fileContent(creation, modified, mode, stat, hash)
+	if err != nil {
+		return pathdb.PutStateUnchanged, false, err
+	}
+	utils.L(ctx).Debugf("data for %q is unchanged", path)
+	state, err = s.paths.Put(ctx, path, content)
+	return state, err == nil, err
+}
 
-		// Put closes data so we don't have to call Close
-		err = s.blobs.Put(ctx,
-			newHashConfirmReader(data, sha256.New(), hash, fmt.Sprintf("file changed while reading: %q", path)),
-			size, &sortKey{col1: filepath.Dir(path), col2: size},
+// putChunks stores every chunk that isn't already known and records hash as
+// the concatenation of all of the chunks, with holes between them, once they
+// all have been stored. putChunks takes ownership of data.
+func (s *Session) putChunks(ctx context.Context, path string, size, startOffset int64,
+	data ReadSeekCloser, hash string, chunks []fileChunk, holes []fileHole) (err error) {
+	file := &sharedFile{data: data, pos: -1}
+	// the extra reference keeps data open until every chunk is queued.
+	file.refs++
+	defer func() {
+		file.refs--
+		if file.refs == 0 {
+			err = errs.Combine(err, data.Close())
+		}
+	}()
+
+	chunkStreams := make([]*manifest.Stream, len(chunks))
+	remaining := len(chunks)
+	var stored, duplicate int
+	done := func(ctx context.Context) error {
+		var stream manifest.Stream
+		h := 0
+		for i, chunkStream := range chunkStreams {
+			for ; h < len(holes) && holes[h].offset < chunks[i].offset; h++ {
+				stream.Ranges = append(stream.Ranges, &manifest.Range{Hole: true, Length: holes[h].length})
+			}
+			stream.Ranges = append(stream.Ranges, chunkStream.Ranges...)
+		}
+		for ; h < len(holes); h++ {
+			stream.Ranges = append(stream.Ranges, &manifest.Range{Hole: true, Length: holes[h].length})
+		}
+		if stored > 0 {
+			utils.L(ctx).Normalf("stored data for %q", path)
+		}
+		return s.stored(ctx, hash, &stream)
+	}
+	if remaining == 0 {
+		return done(ctx)
+	}
+
+	sparse := len(holes) > 0
+	isNew, lastNew, err := s.newChunks(ctx, hash, chunks, sparse)
+	if err != nil {
+		return err
+	}
+	chunked := &manifest.ChunkedData{Hash: []byte(hash)}
+	for _, chunk := range chunks {
+		chunked.Chunks = append(chunked.Chunks, chunk.hash)
+	}
+	if sparse {
+		chunked.Holes = chunkHoles(chunks, holes)
+	}
+
+	compression := s.compression(path)
+	for i, chunk := range chunks {
+		i, chunk := i, chunk // range variable/closure fix
+		filled := func(ctx context.Context, stream *manifest.Stream) error {
+			chunkStreams[i] = stream
+			remaining--
+			if remaining == 0 {
+				return done(ctx)
+			}
+			return nil
+		}
+
+		chunkHash := string(chunk.hash)
+		if !isNew[i] {
+			duplicate++
+			existing, err := s.hashes.Lookup(ctx, chunkHash)
+			if err != nil {
+				return err
+			}
+			if existing != nil {
+				err = filled(ctx, existing)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			waiters, pending := s.pending[chunkHash]
+			if !pending {
+				return errs.New("chunk of %q is neither stored nor pending", path)
+			}
+			s.pending[chunkHash] = append(waiters, filled)
+			continue
+		}
+		if _, pending := s.pending[chunkHash]; !pending {
+			s.pending[chunkHash] = nil
+		}
+		stored++
+
+		chunkData, err := streams.Compress(
+			newHashConfirmReader(file.chunk(startOffset+chunk.offset, chunk.length),
+				sha256.New(), chunk.hash, fmt.Sprintf("file changed while reading: %q", path)),
+			compression)
+		if err != nil {
+			return err
+		}
+
+		// Put closes the chunk data so we don't have to call Close
+		err = s.blobs.Put(ctx, chunkData, chunk.length,
+			&sortKey{col1: filepath.Dir(path), col2: size, col3: path, col4: chunk.offset},
+			func(stream *manifest.Stream, index *manifest.BlobIndex) {
+				if compression != manifest.Range_NONE {
+					// every chunk is compressed as its own frame
+					for i, r := range stream.Ranges {
+						r.Compression = compression
+						if i == 0 {
+							r.UncompressedLength = chunk.length
+						}
+					}
+				}
+				index.Hashes = append(index.Hashes, &manifest.HashedData{Hash: chunk.hash, Data: stream})
+				if i == lastNew && (len(chunks) > 1 || sparse) {
+					index.Chunked = append(index.Chunked, chunked)
+				}
+			},
 			func(ctx context.Context, stream *manifest.Stream, lastOfBlob bool) error {
-				utils.L(ctx).Normalf("stored data for %q", path)
-				err := s.hashes.Put(ctx, string(hash), stream)
+				err := s.stored(ctx, chunkHash, stream)
+				if err != nil {
+					return err
+				}
+				err = filled(ctx, stream)
 				if err != nil {
 					return err
 				}
-				delete(s.pending, hashStr)
 				if lastOfBlob {
 					return s.hashes.Flush(ctx)
 				}
 				return nil
 			})
 		if err != nil {
-			return pathdb.PutStateUnchanged, err
+			return err
+		}
+	}
+
+	if stored == 0 {
+		utils.L(ctx).Debugf("data for %q is made of duplicate chunks", path)
+	} else {
+		utils.L(ctx).Normalf("storing data for %q (%d new chunks, %d duplicate chunks)",
+			path, stored, duplicate)
+	}
+	return nil
+}
+
+// newChunks decides which of a file's chunks need to be stored, returning
+// the index of the last one.
+//
+// A file made of more than one chunk, or with holes, is listed in the blob
+// index along with its last new chunk, so that the hash database can be
+// rebuilt from blobs. If every chunk is already stored, the smallest one is
+// stored again to give the file's index entry a blob that the file's data
+// refers to.
+func (s *Session) newChunks(ctx context.Context, hash string, chunks []fileChunk, sparse bool) (
+	isNew []bool, lastNew int, err error) {
+	isNew = make([]bool, len(chunks))
+	lastNew = -1
+	seen := map[string]bool{}
+	for i, chunk := range chunks {
+		chunkHash := string(chunk.hash)
+		if seen[chunkHash] {
+			continue
+		}
+		seen[chunkHash] = true
+		exists, err := s.hashes.Has(ctx, chunkHash)
+		if err != nil {
+			return nil, 0, err
+		}
+		if exists {
+			continue
+		}
+		// a file that is a single chunk has the same hash as that chunk, and is
+		// already marked pending by PutFile.
+		if _, pending := s.pending[chunkHash]; pending && chunkHash != hash {
+			continue
+		}
+		isNew[i], lastNew = true, i
+	}
+	if lastNew < 0 && (len(chunks) > 1 || sparse) {
+		smallest := 0
+		for i, chunk := range chunks {
+			if chunk.length < chunks[smallest].length {
+				smallest = i
+			}
+		}
+		isNew[smallest], lastNew = true, smallest
+	}
+	return isNew, lastNew, nil
+}
+
+// stored records the stream for hash and hands it to anything in the session
+// waiting on it.
+func (s *Session) stored(ctx context.Context, hash string, stream *manifest.Stream) error {
+	err := s.hashes.Put(ctx, hash, stream)
+	if err != nil {
+		return err
+	}
+	waiters := s.pending[hash]
+	delete(s.pending, hash)
+	for _, waiter := range waiters {
+		err = waiter(ctx, stream)
+		if err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+func (s *Session) PutSymlink(ctx context.Context, path string, creation, modified time.Time, mode uint32,
+	stat *FileStat, target string) (state pathdb.PutState, err error) {
+	if strings.HasSuffix(path, "/") {
+		return pathdb.PutStateUnchanged, fmt.Errorf("file paths cannot end with a '/': %q", path)
+	}
+	content, err := SymlinkContent(creation, modified, mode, stat, target)
+	if err != nil {
+		return pathdb.PutStateUnchanged, err
+	}
 
+	utils.L(ctx).Debugf("stored symlink %q", path)
+
+	return s.paths.Put(ctx, path, content)
+}
+
+// PutDirectory records a directory, so that its metadata is kept and so
+// that it exists even if it is empty. Unlike other paths, directory paths
+// end with a '/'.
+func (s *Session) PutDirectory(ctx context.Context, path string, creation, modified time.Time, mode uint32,
+	stat *FileStat) (state pathdb.PutState, err error) {
+	if !strings.HasSuffix(path, "/") {
+		return pathdb.PutStateUnchanged, fmt.Errorf("directory paths must end with a '/': %q", path)
+	}
+	content, err := DirectoryContent(creation, modified, mode, stat)
+	if err != nil {
+		return pathdb.PutStateUnchanged, err
+	}
 	return s.paths.Put(ctx, path, content)
 }
 
-func (s *Session) PutSymlink(ctx context.Context, path string, creation, modified time.Time, mode uint32, target string) (
-	state pathdb.PutState, err error) {
+// PutSpecial records a FIFO, device or socket, depending on mode, which is an
+// os.FileMode.
+func (s *Session) PutSpecial(ctx context.Context, path string, creation, modified time.Time, mode uint32,
+	stat *FileStat) (state pathdb.PutState, err error) {
 	if strings.HasSuffix(path, "/") {
 		return pathdb.PutStateUnchanged, fmt.Errorf("file paths cannot end with a '/': %q", path)
 	}
-	creationPB, modifiedPB, err := convertTime(creation, modified)
+	content, err := SpecialContent(creation, modified, mode, stat)
 	if err != nil {
 		return pathdb.PutStateUnchanged, err
 	}
 
+	utils.L(ctx).Debugf("stored special file %q", path)
+
+	return s.paths.Put(ctx, path, content)
+}
+
+// FileContent reads data to the end and returns the Content that PutFile
+// would record for it, along with the amount of data read.
+func FileContent(creation, modified time.Time, mode uint32, stat *FileStat, data io.Reader) (
+	content *manifest.Content, size int64, err error) {
+	hasher := sha256.New()
+	size, err = io.Copy(hasher, data)
+	if err != nil {
+		return nil, 0, err
+	}
+	content, err = fileContent(creation, modified, mode, stat, hasher.Sum(nil))
+	return content, size, err
+}
+
+func fileContent(creation, modified time.Time, mode uint32, stat *FileStat, hash []byte) (*manifest.Content, error) {
+	creationPB, modifiedPB, err := convertTime(creation, modified)
+	if err != nil {
+		return nil, err
+	}
 	content := &manifest.Content{
 		Metadata: &manifest.Metadata{
-			Type:       manifest.Metadata_SYMLINK,
-			Creation:   creationPB,
-			Modified:   modifiedPB,
-			Mode:       mode,
-			LinkTarget: []byte(target),
+			Type:     manifest.Metadata_FILE,
+			Creation: creationPB,
+			Modified: modifiedPB,
+			Mode:     mode,
 		},
+		Hash: hash,
+	}
+	if stat != nil {
+		changedPB, err := ptypes.TimestampProto(stat.Changed)
+		if err != nil {
+			return nil, err
+		}
+		content.Metadata.Size = stat.Size
+		content.Metadata.Inode = stat.Inode
+		content.Metadata.Changed = changedPB
+		applyStat(content.Metadata, stat)
 	}
+	return content, nil
+}
 
-	utils.L(ctx).Debugf("stored symlink %q", path)
+// SymlinkContent returns the Content that PutSymlink would record.
+func SymlinkContent(creation, modified time.Time, mode uint32, stat *FileStat, target string) (
+	*manifest.Content, error) {
+	content, err := otherContent(manifest.Metadata_SYMLINK, creation, modified, mode, stat)
+	if err != nil {
+		return nil, err
+	}
+	content.Metadata.LinkTarget = []byte(target)
+	return content, nil
+}
 
-	return s.paths.Put(ctx, path, content)
+// DirectoryContent returns the Content that PutDirectory would record.
+func DirectoryContent(creation, modified time.Time, mode uint32, stat *FileStat) (*manifest.Content, error) {
+	return otherContent(manifest.Metadata_DIRECTORY, creation, modified, mode, stat)
+}
+
+// SpecialContent returns the Content that PutSpecial would record.
+func SpecialContent(creation, modified time.Time, mode uint32, stat *FileStat) (*manifest.Content, error) {
+	var typ manifest.Metadata_Type
+	switch fileMode := os.FileMode(mode); {
+	case fileMode&os.ModeNamedPipe != 0:
+		typ = manifest.Metadata_FIFO
+	case fileMode&os.ModeDevice != 0:
+		typ = manifest.Metadata_DEVICE
+	case fileMode&os.ModeSocket != 0:
+		typ = manifest.Metadata_SOCKET
+	default:
+		return nil, fmt.Errorf("not a special file mode: %v", fileMode)
+	}
+	return otherContent(typ, creation, modified, mode, stat)
+}
+
+// otherContent returns the Content for anything besides a file, which has no
+// data.
+func otherContent(typ manifest.Metadata_Type, creation, modified time.Time, mode uint32, stat *FileStat) (
+	*manifest.Content, error) {
+	creationPB, modifiedPB, err := convertTime(creation, modified)
+	if err != nil {
+		return nil, err
+	}
+	content := &manifest.Content{
+		Metadata: &manifest.Metadata{
+			Type:     typ,
+			Creation: creationPB,
+			Modified: modifiedPB,
+			Mode:     mode,
+		},
+	}
+	applyStat(content.Metadata, stat)
+	return content, nil
 }
 
 // Rename renames paths using regexp.ReplaceAllString (replacement can have
-// regexp expansions). See the docs for regexp.ReplaceAllString
-func (s *Session) Rename(ctx context.Context, re *regexp.Regexp, replacement string) (renamed int, err error) {
-	return s.paths.Rename(ctx, re, replacement)
+// regexp expansions). See the docs for regexp.ReplaceAllString and
+// pathdb.DB.Rename.
+func (s *Session) Rename(ctx context.Context, re *regexp.Regexp, replacement string,
+	cb func(ctx context.Context, oldPath, newPath string) error) (renamed int, err error) {
+	return s.paths.Rename(ctx, re, replacement, cb)
+}
+
+// Diff calls cb for every path whose content differs between base and the
+// session's current state. base is nil if there is no prior snapshot.
+func (s *Session) Diff(ctx context.Context, base *Snapshot,
+	cb func(ctx context.Context, path string, oldContent, newContent *manifest.Content) error) error {
+	if base == nil {
+		empty := pathdb.New(nil, nil, nil)
+		defer empty.Close()
+		return pathdb.Diff(ctx, empty, s.paths, "", cb)
+	}
+	return pathdb.Diff(ctx, base.paths, s.paths, "", cb)
 }
 
 func convertTime(a, b time.Time) (*timestamp.Timestamp, *timestamp.Timestamp, error) {
@@ -190,26 +600,134 @@ func (s *Session) Flush(ctx context.Context) error {
 	return s.hashes.Flush(ctx)
 }
 
+// SetHeader sets what the snapshot Commit makes is described with. The
+// totals are filled in by Commit.
+func (s *Session) SetHeader(header *manifest.SnapshotHeader) {
+	s.header = header
+}
+
+// SetMergePolicy sets how Commit resolves paths that were changed both by
+// the session and by snapshots committed since it started. The default is
+// pathdb.MergeFail.
+func (s *Session) SetMergePolicy(policy pathdb.MergePolicy) {
+	s.mergePolicy = policy
+}
+
+// mergeLatest merges the changes made in the latest snapshot since the
+// session started into the session.
+func (s *Session) mergeLatest(ctx context.Context) error {
+	latest, err := s.mgr.latestTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	err = s.mgr.mergeInto(ctx, s.paths, s.base, latest, s.mergePolicy)
+	if err != nil {
+		return err
+	}
+	parents := []time.Time{}
+	for _, parent := range s.parents {
+		if !parent.Equal(s.base) {
+			parents = append(parents, parent)
+		}
+	}
+	s.parents = append(parents, latest)
+	s.base = latest
+	return nil
+}
+
+// mergeConcurrent merges the snapshots committed at the same time as the
+// session's snapshot at ts into the session, so that committing it again
+// makes a snapshot with the changes of both.
+func (s *Session) mergeConcurrent(ctx context.Context, ts time.Time, concurrent []time.Time) error {
+	for _, other := range concurrent {
+		ancestor, err := s.mgr.commonAncestor(ctx, ts, other)
+		if err != nil {
+			return err
+		}
+		err = s.mgr.mergeInto(ctx, s.paths, ancestor, other, s.mergePolicy)
+		if err != nil {
+			return err
+		}
+	}
+	s.parents = append([]time.Time{ts}, concurrent...)
+	s.base = ts
+	if latest := concurrent[len(concurrent)-1]; latest.After(ts) {
+		s.base = latest
+	}
+	s.merging = true
+	return nil
+}
+
 func (s *Session) Commit(ctx context.Context) (err error) {
+	if s.dryRun {
+		return errs.New("dry run sessions can't be committed")
+	}
 	err = s.Flush(ctx)
 	if err != nil {
 		return err
 	}
-	if !s.paths.Changed() && !s.reverting {
+	if !s.paths.Changed() && !s.reverting && !s.merging {
 		utils.L(ctx).Normalf("no changes detected, skipping new manifest")
 		return nil
 	}
-	// TODO: make sure this timestamp is strictly newer than all previous
-	// timestamps, and make sure you can't delete the newest timestamp,
-	// to avoid key reuse with different snapshots with the same timestamp
-	ts := time.Now()
-	err = s.paths.SerializeTo(ctx, timestampToPath(ts))
+	for attempts := 0; ; attempts++ {
+		ts, err := s.commit(ctx)
+		if err != nil {
+			return err
+		}
+		// committing lists the snapshots and then writes one, so another
+		// process can do the same in between. of two snapshots made from the
+		// same one, whichever process sees both merges the other in.
+		concurrent, err := s.mgr.concurrentSnapshots(ctx, s.base, ts)
+		if err != nil {
+			return err
+		}
+		if len(concurrent) == 0 {
+			utils.L(ctx).Normalf("wrote manifest for %v", ts)
+			return nil
+		}
+		utils.L(ctx).Normalf("wrote manifest for %v, but %d other snapshots were committed at the same time",
+			ts, len(concurrent))
+		if attempts >= maxMergeAttempts {
+			return ErrConcurrentCommit.New("snapshot %d lacks the changes of snapshots committed at the "+
+				"same time as it: %s. see jam merge", ts.UnixNano(), joinTimestamps(concurrent))
+		}
+		err = s.mergeConcurrent(ctx, ts, concurrent)
+		if err != nil {
+			return ErrConcurrentCommit.New("snapshot %d lacks the changes of snapshots committed at the "+
+				"same time as it: %s, and merging them failed: %v. see jam merge",
+				ts.UnixNano(), joinTimestamps(concurrent), err)
+		}
+	}
+}
+
+// commit writes the session's manifest and returns its timestamp.
+func (s *Session) commit(ctx context.Context) (ts time.Time, err error) {
+	for attempts := 0; ; attempts++ {
+		ts, err = commitTimestamp(ctx, s.backend, s.base, time.Now())
+		if !ErrConcurrentCommit.Has(err) || attempts >= maxMergeAttempts {
+			break
+		}
+		// rather than lose the changes of the snapshots committed since the
+		// session started, merge them in.
+		utils.L(ctx).Normalf("%v", err)
+		err = s.mergeLatest(ctx)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
 	if err != nil {
-		return err
+		return time.Time{}, err
 	}
 
-	utils.L(ctx).Normalf("wrote manifest for %v", ts)
-	return nil
+	header := &manifest.SnapshotHeader{}
+	if s.header != nil {
+		header = proto.Clone(s.header).(*manifest.SnapshotHeader)
+	}
+	for _, parent := range s.parents {
+		header.Parents = append(header.Parents, parent.UnixNano())
+	}
+	return ts, s.paths.SerializeTo(ctx, timestampToPath(ts), header)
 }
 
 func (s *Session) Close() error {
@@ -219,6 +737,8 @@ func (s *Session) Close() error {
 type sortKey struct {
 	col1 string
 	col2 int64
+	col3 string
+	col4 int64
 }
 
 func (a *sortKey) Less(bi blobs.SortKey) bool {
@@ -229,7 +749,35 @@ func (a *sortKey) Less(bi blobs.SortKey) bool {
 	if a.col1 > b.col1 {
 		return false
 	}
-	return a.col2 < b.col2
+	if a.col2 < b.col2 {
+		return true
+	}
+	if a.col2 > b.col2 {
+		return false
+	}
+	if a.col3 < b.col3 {
+		return true
+	}
+	if a.col3 > b.col3 {
+		return false
+	}
+	return a.col4 < b.col4
+}
+
+// Open is like Snapshot.Open, but for the session's current state. Anything
+// stored so far is flushed first, so that it can be read back.
+func (s *Session) Open(ctx context.Context, path string) (*manifest.Metadata, *streams.Stream, error) {
+	err := s.Flush(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return newSnapshot(s.backend, s.paths, s.blobs, s.hashes).Open(ctx, path)
+}
+
+// Changed returns true if the session has changes that haven't been
+// committed.
+func (s *Session) Changed() bool {
+	return s.paths.Changed()
 }
 
 func (s *Session) List(ctx context.Context, prefix string, recursive bool,
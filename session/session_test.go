@@ -0,0 +1,182 @@
+package session
+
+import (
+	"context"
+	"crypto/sha256"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jtolio/jam/backends"
+	"github.com/jtolio/jam/backends/fs"
+	"github.com/jtolio/jam/blobs"
+	"github.com/jtolio/jam/hashdb"
+	"github.com/jtolio/jam/manifest"
+)
+
+var ctx = context.Background()
+
+// hookedBackend calls beforePut, if set, before putting a manifest.
+type hookedBackend struct {
+	backends.Backend
+	beforePut func(path string)
+}
+
+func (h *hookedBackend) Put(ctx context.Context, path string, data io.Reader) error {
+	if hook := h.beforePut; hook != nil && strings.HasPrefix(path, ManifestPrefix) {
+		h.beforePut = nil
+		hook(path)
+	}
+	return h.Backend.Put(ctx, path, data)
+}
+
+func newTestManager(t *testing.T) (*Manager, *hookedBackend) {
+	td, err := os.MkdirTemp("", "sessiontest")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, os.RemoveAll(td))
+	})
+	fsBackend, err := fs.New(ctx, &url.URL{Path: td})
+	require.NoError(t, err)
+	backend := &hookedBackend{Backend: fsBackend}
+	blobStore := blobs.NewStore(backend, 1<<20, 10, 1, "")
+	hashes := hashdb.New(backend)
+	t.Cleanup(func() {
+		require.NoError(t, blobStore.Close())
+		require.NoError(t, backend.Close())
+	})
+	return NewManager(backend, blobStore, hashes, nil), backend
+}
+
+// testHash extends a short name for a hash to the length of one.
+func testHash(name string) []byte {
+	return []byte(strings.Repeat("\x00", sha256.Size-len(name)) + name)
+}
+
+// put sets path to a file with the hash named hash, modified at the given
+// unix time.
+func put(t *testing.T, sess *Session, path, hash string, modified int64) {
+	mtime, err := ptypes.TimestampProto(time.Unix(modified, 0))
+	require.NoError(t, err)
+	_, err = sess.paths.Put(ctx, path, &manifest.Content{
+		Hash:     testHash(hash),
+		Metadata: &manifest.Metadata{Type: manifest.Metadata_FILE, Modified: mtime},
+	})
+	require.NoError(t, err)
+}
+
+// commit makes a snapshot with the given files, mapped to hash names, from
+// a new session, and returns its timestamp.
+func commit(t *testing.T, mgr *Manager, files map[string]string) time.Time {
+	sess, err := mgr.NewSession(ctx)
+	require.NoError(t, err)
+	defer sess.Close()
+	for path, hash := range files {
+		put(t, sess, path, hash, 1)
+	}
+	require.NoError(t, sess.Commit(ctx))
+	_, latest, err := mgr.LatestSnapshot(ctx)
+	require.NoError(t, err)
+	return latest
+}
+
+// contents returns the paths of the snapshot at ts, mapped to the names of
+// their hashes.
+func contents(t *testing.T, mgr *Manager, ts time.Time) map[string]string {
+	snap, err := mgr.OpenSnapshot(ctx, ts)
+	require.NoError(t, err)
+	defer snap.Close()
+	rv := map[string]string{}
+	require.NoError(t, snap.Contents(ctx, "",
+		func(ctx context.Context, path string, content *manifest.Content) error {
+			rv[path] = strings.TrimLeft(string(content.Hash), "\x00")
+			return nil
+		}))
+	return rv
+}
+
+func parents(t *testing.T, mgr *Manager, ts time.Time) []int64 {
+	db, err := mgr.openPathDB(ctx, ts)
+	require.NoError(t, err)
+	defer db.Close()
+	return db.Header().GetParents()
+}
+
+func nanos(timestamps ...time.Time) (rv []int64) {
+	for _, timestamp := range timestamps {
+		rv = append(rv, timestamp.UnixNano())
+	}
+	return rv
+}
+
+func timestamps(t *testing.T, mgr *Manager) []time.Time {
+	rv, err := listTimestamps(ctx, mgr.backend)
+	require.NoError(t, err)
+	return rv
+}
+
+func TestCommitRace(t *testing.T) {
+	mgr, backend := newTestManager(t)
+	base := commit(t, mgr, map[string]string{"a": "1"})
+
+	// b commits between a listing the snapshots and writing its own, with
+	// a later timestamp than a's.
+	a, err := mgr.NewSession(ctx)
+	require.NoError(t, err)
+	defer a.Close()
+	put(t, a, "from-a", "2", 1)
+	b, err := mgr.NewSession(ctx)
+	require.NoError(t, err)
+	defer b.Close()
+	put(t, b, "from-b", "3", 1)
+	var aTimestamp time.Time
+	backend.beforePut = func(path string) {
+		aTimestamp, err = pathToTimestamp(path)
+		require.NoError(t, err)
+		time.Sleep(time.Millisecond)
+		require.NoError(t, b.Commit(ctx))
+	}
+	require.NoError(t, a.Commit(ctx))
+
+	// b didn't see a's snapshot, but a saw b's and merged it in.
+	all := timestamps(t, mgr)
+	require.Len(t, all, 4)
+	bTimestamp := all[1]
+	require.True(t, bTimestamp.After(aTimestamp))
+	require.Equal(t, map[string]string{"a": "1", "from-a": "2"}, contents(t, mgr, aTimestamp))
+	require.Equal(t, map[string]string{"a": "1", "from-b": "3"}, contents(t, mgr, bTimestamp))
+	require.Equal(t, map[string]string{"a": "1", "from-a": "2", "from-b": "3"}, contents(t, mgr, all[0]))
+	require.Equal(t, nanos(aTimestamp, bTimestamp), parents(t, mgr, all[0]))
+	require.Equal(t, nanos(base), parents(t, mgr, aTimestamp))
+}
+
+func TestCommitRaceConflict(t *testing.T) {
+	mgr, backend := newTestManager(t)
+	commit(t, mgr, map[string]string{"a": "1"})
+
+	a, err := mgr.NewSession(ctx)
+	require.NoError(t, err)
+	defer a.Close()
+	put(t, a, "a", "2", 2)
+	b, err := mgr.NewSession(ctx)
+	require.NoError(t, err)
+	defer b.Close()
+	put(t, b, "a", "3", 3)
+	backend.beforePut = func(path string) {
+		time.Sleep(time.Millisecond)
+		require.NoError(t, b.Commit(ctx))
+	}
+
+	// a can't merge b's conflicting change, and says so rather than
+	// reporting success.
+	err = a.Commit(ctx)
+	require.True(t, ErrConcurrentCommit.Has(err))
+	require.Contains(t, err.Error(), "merge conflict")
+	require.Len(t, timestamps(t, mgr), 3)
+}
@@ -34,6 +34,8 @@ type ListEntry struct {
 	Path   string
 	Prefix bool
 	Meta   *manifest.Metadata
+	// Hash is the content hash, set for files only
+	Hash []byte
 
 	backend backends.Backend
 	data    *manifest.Stream
@@ -59,7 +61,21 @@ func (s *Snapshot) List(ctx context.Context, prefix string, recursive bool,
 				return err
 			}
 
-			return cb(ctx, &ListEntry{Path: path, Meta: content.Metadata, backend: s.backend, data: data})
+			return cb(ctx, &ListEntry{Path: path, Meta: content.Metadata, Hash: content.Hash,
+				backend: s.backend, data: data})
+		})
+}
+
+// Contents calls cb with the content of every path starting with prefix. It
+// is like a recursive List, but doesn't look up where file data is stored.
+func (s *Snapshot) Contents(ctx context.Context, prefix string,
+	cb func(ctx context.Context, path string, content *manifest.Content) error) error {
+	return s.paths.List(ctx, prefix, true,
+		func(ctx context.Context, path string, content *manifest.Content) error {
+			if content == nil {
+				return nil
+			}
+			return cb(ctx, path, content)
 		})
 }
 
@@ -104,6 +120,60 @@ func (s *Snapshot) Open(ctx context.Context, path string) (*manifest.Metadata, *
 	return content.Metadata, nil, nil
 }
 
+// Lookup returns the content stored for path, or nil if there is none.
+func (s *Snapshot) Lookup(ctx context.Context, path string) (*manifest.Content, error) {
+	return s.paths.Get(ctx, path)
+}
+
+// References calls hash with every hash the snapshot refers to, which are
+// the content hash of every file and the hash of every page of its manifest,
+// and page with the data of every page besides the root. Pages whose hash is
+// in seen, which may be nil, are skipped along with everything in them, and
+// the hashes of the rest are added to seen, so that snapshots that share
+// pages can be walked without reading the shared pages more than once. The
+// same hash may be provided more than once.
+func (s *Snapshot) References(ctx context.Context, seen map[string]bool,
+	hash func(ctx context.Context, hash string) error,
+	page func(ctx context.Context, data *manifest.Stream) error) error {
+	return s.paths.Walk(ctx, seen,
+		func(ctx context.Context, pageHash string, data *manifest.Stream) error {
+			if pageHash != "" {
+				err := hash(ctx, pageHash)
+				if err != nil {
+					return err
+				}
+			}
+			return page(ctx, data)
+		},
+		func(ctx context.Context, path string, content *manifest.Content) error {
+			if content.Metadata.Type != manifest.Metadata_FILE || len(content.Hash) == 0 {
+				return nil
+			}
+			return hash(ctx, string(content.Hash))
+		})
+}
+
+// Diff calls cb for every path starting with prefix whose content differs
+// between s and other. oldContent is nil if the path was added in other and
+// newContent is nil if the path was removed in other.
+func (s *Snapshot) Diff(ctx context.Context, other *Snapshot, prefix string,
+	cb func(ctx context.Context, path string, oldContent, newContent *manifest.Content) error) error {
+	return s.DiffTree(ctx, other.paths, prefix, cb)
+}
+
+// DiffTree is like Diff, but compares against a path database that isn't a
+// stored snapshot, such as one built from a local directory.
+func (s *Snapshot) DiffTree(ctx context.Context, other *pathdb.DB, prefix string,
+	cb func(ctx context.Context, path string, oldContent, newContent *manifest.Content) error) error {
+	return pathdb.Diff(ctx, s.paths, other, prefix, cb)
+}
+
+// Header returns what the snapshot was described with when it was made,
+// including its totals, or nil for snapshots from before headers existed.
+func (s *Snapshot) Header() *manifest.SnapshotHeader {
+	return s.paths.Header()
+}
+
 func (s *Snapshot) HasPrefix(ctx context.Context, prefix string) (exists bool, err error) {
 	return s.paths.HasPrefix(ctx, prefix)
 }
@@ -0,0 +1,72 @@
+package session
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/zeebo/errs"
+)
+
+// StageFile is like PrepareFile, but copies data into a file in the local
+// directory dir while reading and hashing it, and closes data right away.
+// The prepared file then reads from the copy, so the data stored always
+// matches the hash even if the original changes afterwards. The copy is
+// removed when the prepared file is closed. Holes in data are left as holes
+// in the copy.
+func StageFile(dir, path string, creation, modified time.Time, mode uint32,
+	stat *FileStat, data io.ReadCloser) (*PreparedFile, error) {
+	if strings.HasSuffix(path, "/") {
+		return nil, errs.Combine(fmt.Errorf("file paths cannot end with a '/': %q", path), data.Close())
+	}
+	fh, err := os.CreateTemp(dir, "file-*")
+	if err != nil {
+		return nil, errs.Combine(err, data.Close())
+	}
+	staged := stagedFile{File: fh}
+
+	holes, err := readHoles(data)
+	if err != nil {
+		return nil, errs.Combine(err, data.Close(), staged.Close())
+	}
+
+	hash, size, chunks, err := splitFile(io.TeeReader(data, fh), holes, func(offset int64) error {
+		_, err := data.(io.Seeker).Seek(offset, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		_, err = fh.Seek(offset, io.SeekStart)
+		return err
+	})
+	if err == nil {
+		err = fh.Truncate(size)
+	}
+	err = errs.Combine(err, data.Close())
+	if err != nil {
+		return nil, errs.Combine(err, staged.Close())
+	}
+	content, err := fileContent(creation, modified, mode, stat, hash)
+	if err != nil {
+		return nil, errs.Combine(err, staged.Close())
+	}
+
+	return &PreparedFile{
+		path:    path,
+		content: content,
+		size:    size,
+		chunks:  chunks,
+		holes:   holes,
+		data:    staged,
+	}, nil
+}
+
+// stagedFile is a temporary copy of a file that is removed when closed.
+type stagedFile struct {
+	*os.File
+}
+
+func (f stagedFile) Close() error {
+	return errs.Combine(f.File.Close(), os.Remove(f.File.Name()))
+}
@@ -0,0 +1,74 @@
+package session
+
+import (
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+
+	"github.com/jtolio/jam/manifest"
+)
+
+// FileStat is what is known about a path from the filesystem beyond its
+// times and mode. The size, inode and change time are recorded for files so
+// that a later store can tell if the file has likely changed without reading
+// it. The rest is recorded for every type of path.
+type FileStat struct {
+	Size  int64
+	Inode uint64
+	// Changed is the inode change time (ctime), which unlike the modification
+	// time can't be set by the user.
+	Changed time.Time
+
+	// Owner is nil if ownership isn't known.
+	Owner  *manifest.Metadata_Owner
+	Xattrs map[string][]byte
+	// LinkGroup is the same for files that are hard links to the same file.
+	// It is empty for files with only one link.
+	LinkGroup string
+	// Device is the device number of a device.
+	Device uint64
+}
+
+// applyStat records the parts of stat that aren't just for noticing
+// unchanged files.
+func applyStat(meta *manifest.Metadata, stat *FileStat) {
+	if stat == nil {
+		return
+	}
+	meta.Owner = stat.Owner
+	meta.LinkGroup = stat.LinkGroup
+	meta.Device = stat.Device
+	names := make([]string, 0, len(stat.Xattrs))
+	for name := range stat.Xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		meta.Xattrs = append(meta.Xattrs, &manifest.Metadata_Xattr{Name: name, Value: stat.Xattrs[name]})
+	}
+}
+
+// StatUnchanged returns true if content was recorded for a file with the same
+// modification time and stat as the given ones, which means the file's data
+// most likely hasn't changed since. Content stored without a stat never
+// matches.
+func StatUnchanged(content *manifest.Content, modified time.Time, stat *FileStat) bool {
+	if content == nil || stat == nil || len(content.Hash) == 0 {
+		return false
+	}
+	meta := content.Metadata
+	if meta == nil || meta.Type != manifest.Metadata_FILE || meta.Changed == nil ||
+		meta.Modified == nil || meta.Size != stat.Size || meta.Inode != stat.Inode {
+		return false
+	}
+	recordedModified, err := ptypes.Timestamp(meta.Modified)
+	if err != nil || !recordedModified.Equal(modified) {
+		return false
+	}
+	recordedChanged, err := ptypes.Timestamp(meta.Changed)
+	if err != nil || !recordedChanged.Equal(stat.Changed) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,148 @@
+package session
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jtolio/jam/manifest"
+)
+
+func TestStatUnchanged(t *testing.T) {
+	modified := time.Unix(1700000000, 1)
+	changed := time.Unix(1700000100, 2)
+	stat := &FileStat{Size: 10, Inode: 5, Changed: changed}
+	modifiedProto, err := ptypes.TimestampProto(modified)
+	require.NoError(t, err)
+	changedProto, err := ptypes.TimestampProto(changed)
+	require.NoError(t, err)
+	recorded := &manifest.Content{
+		Hash: testHash("1"),
+		Metadata: &manifest.Metadata{
+			Type:     manifest.Metadata_FILE,
+			Modified: modifiedProto,
+			Changed:  changedProto,
+			Size:     10,
+			Inode:    5,
+		},
+	}
+	require.True(t, StatUnchanged(recorded, modified, stat))
+
+	for _, tc := range []struct {
+		name     string
+		content  func(*manifest.Content)
+		modified time.Time
+		stat     func(*FileStat)
+	}{
+		{name: "size", stat: func(s *FileStat) { s.Size = 11 }},
+		{name: "recorded size", content: func(c *manifest.Content) { c.Metadata.Size = 0 }},
+		{name: "mtime", modified: modified.Add(time.Nanosecond)},
+		{name: "inode", stat: func(s *FileStat) { s.Inode = 6 }},
+		{name: "ctime", stat: func(s *FileStat) { s.Changed = changed.Add(time.Second) }},
+		{name: "nil Changed", content: func(c *manifest.Content) { c.Metadata.Changed = nil }},
+		{name: "nil Modified", content: func(c *manifest.Content) { c.Metadata.Modified = nil }},
+		{name: "symlink", content: func(c *manifest.Content) { c.Metadata.Type = manifest.Metadata_SYMLINK }},
+		{name: "directory", content: func(c *manifest.Content) { c.Metadata.Type = manifest.Metadata_DIRECTORY }},
+		{name: "empty hash", content: func(c *manifest.Content) { c.Hash = nil }},
+		{name: "nil metadata", content: func(c *manifest.Content) { c.Metadata = nil }},
+	} {
+		content := proto.Clone(recorded).(*manifest.Content)
+		if tc.content != nil {
+			tc.content(content)
+		}
+		fileStat := *stat
+		if tc.stat != nil {
+			tc.stat(&fileStat)
+		}
+		mtime := modified
+		if !tc.modified.IsZero() {
+			mtime = tc.modified
+		}
+		require.False(t, StatUnchanged(content, mtime, &fileStat), tc.name)
+	}
+
+	require.False(t, StatUnchanged(nil, modified, stat))
+	require.False(t, StatUnchanged(recorded, modified, nil))
+}
+
+type readSeekNopCloser struct {
+	*bytes.Reader
+}
+
+func (readSeekNopCloser) Close() error { return nil }
+
+func TestStatRoundTrip(t *testing.T) {
+	mgr, _ := newTestManager(t)
+	sess, err := mgr.NewSession(ctx)
+	require.NoError(t, err)
+	defer sess.Close()
+
+	created, modified := time.Unix(1700000000, 0), time.Unix(1700000001, 0)
+	owner := &manifest.Metadata_Owner{Uid: 1000, Gid: 100, User: "user", Group: "users"}
+	xattrs := map[string][]byte{"user.b": []byte("2"), "user.a": []byte("1")}
+	stat := func(linkGroup string) *FileStat {
+		return &FileStat{Size: 4, Inode: 7, Changed: modified, Owner: owner, Xattrs: xattrs, LinkGroup: linkGroup}
+	}
+
+	dirMode := uint32(os.ModeDir | 0750)
+	_, err = sess.PutDirectory(ctx, "dir/", created, modified, dirMode, stat(""))
+	require.NoError(t, err)
+	fifoMode := uint32(os.ModeNamedPipe | 0640)
+	_, err = sess.PutSpecial(ctx, "dir/fifo", created, modified, fifoMode, stat(""))
+	require.NoError(t, err)
+	for _, path := range []string{"dir/link1", "dir/link2"} {
+		_, err = sess.PutFile(ctx, path, created, modified, 0600, stat("1:7"),
+			readSeekNopCloser{bytes.NewReader([]byte("data"))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, sess.Commit(ctx))
+
+	snap, _, err := mgr.LatestSnapshot(ctx)
+	require.NoError(t, err)
+	defer snap.Close()
+	lookup := func(path string) *manifest.Metadata {
+		content, err := snap.Lookup(ctx, path)
+		require.NoError(t, err)
+		require.NotNil(t, content, path)
+		meta := content.Metadata
+		require.True(t, proto.Equal(owner, meta.Owner), path)
+		require.Equal(t, []*manifest.Metadata_Xattr{
+			{Name: "user.a", Value: []byte("1")},
+			{Name: "user.b", Value: []byte("2")},
+		}, meta.Xattrs, path)
+		modifiedAt, err := ptypes.Timestamp(meta.Modified)
+		require.NoError(t, err)
+		require.True(t, modifiedAt.Equal(modified), path)
+		return meta
+	}
+
+	dir := lookup("dir/")
+	require.Equal(t, manifest.Metadata_DIRECTORY, dir.Type)
+	require.Equal(t, dirMode, dir.Mode)
+	require.Empty(t, dir.LinkGroup)
+
+	fifo := lookup("dir/fifo")
+	require.Equal(t, manifest.Metadata_FIFO, fifo.Type)
+	require.Equal(t, fifoMode, fifo.Mode)
+	require.Empty(t, fifo.LinkGroup)
+
+	link1, link2 := lookup("dir/link1"), lookup("dir/link2")
+	for _, link := range []*manifest.Metadata{link1, link2} {
+		require.Equal(t, manifest.Metadata_FILE, link.Type)
+		require.Equal(t, uint32(0600), link.Mode)
+		require.Equal(t, "1:7", link.LinkGroup)
+		require.Equal(t, int64(4), link.Size)
+		require.Equal(t, uint64(7), link.Inode)
+	}
+	content1, err := snap.Lookup(ctx, "dir/link1")
+	require.NoError(t, err)
+	content2, err := snap.Lookup(ctx, "dir/link2")
+	require.NoError(t, err)
+	require.Equal(t, content1.Hash, content2.Hash)
+	require.True(t, StatUnchanged(content1, modified, stat("1:7")))
+}
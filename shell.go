@@ -0,0 +1,511 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"github.com/zeebo/errs"
+
+	"github.com/jtolio/jam/locks"
+	"github.com/jtolio/jam/session"
+	"github.com/jtolio/jam/utils"
+)
+
+var (
+	batchFlags      = flag.NewFlagSet("", flag.ExitOnError)
+	batchFlagDryRun = batchFlags.Bool("dry-run", false,
+		"if true, list what the script would change without storing anything")
+	batchFlagTags = batchFlags.String("tag", "",
+		"if set, a comma-separated list of tags to record with the snapshot")
+	batchFlagMessage = batchFlags.String("message", "",
+		"if set, a description to record with the snapshot")
+
+	cmdShell = &ffcli.Command{
+		Name:       "shell",
+		ShortHelp:  "shell runs commands against one session, which commit makes a snapshot of",
+		ShortUsage: fmt.Sprintf("%s [opts] shell", os.Args[0]),
+		Exec:       Shell,
+	}
+	cmdBatch = &ffcli.Command{
+		Name:       "batch",
+		ShortHelp:  "batch runs a script of shell commands and commits them as one snapshot",
+		ShortUsage: fmt.Sprintf("%s [opts] batch [opts] <script-file, or - for stdin>", os.Args[0]),
+		FlagSet:    batchFlags,
+		Exec:       Batch,
+	}
+)
+
+// shellCommand is a command that shell and batch understand.
+type shellCommand struct {
+	usage string
+	help  string
+	run   func(sh *shell, ctx context.Context, args []string) error
+}
+
+var shellCommands = map[string]*shellCommand{
+	"cat": {usage: "cat <path>...", help: "print files",
+		run: (*shell).cat},
+	"cd": {usage: "cd [<prefix>]", help: "change the prefix other paths are relative to",
+		run: (*shell).cd},
+	"commit": {usage: "commit [-message <msg>] [-tag <tags>]", help: "make a snapshot of the changes so far",
+		run: (*shell).commit},
+	"diff": {usage: "diff", help: "list the changes made since the latest snapshot",
+		run: (*shell).diff},
+	"ls": {usage: "ls [-r] [<prefix>]", help: "list paths",
+		run: (*shell).ls},
+	"rename": {usage: "rename <regexp> <replacement>", help: "rename every full path matching regexp",
+		run: (*shell).rename},
+	"rm": {usage: "rm [-r] [-f] <path>", help: "remove a path and everything under it, or full paths matching the regexp with -r",
+		run: (*shell).rm},
+	"store": {usage: "store [opts] <source-dir> [<target-prefix>]", help: "add a local directory, like jam store",
+		run: (*shell).store},
+}
+
+// shell keeps one session open for many commands.
+type shell struct {
+	mgr    *session.Manager
+	sess   *session.Session
+	dryRun bool
+	// batch is true if the commands come from a script, which is committed
+	// as one snapshot.
+	batch bool
+	// cwd is the prefix relative paths start with. it is empty or ends with
+	// a '/'.
+	cwd string
+}
+
+func newShell(ctx context.Context, mgr *session.Manager, dryRun, batch bool) (*shell, error) {
+	sess, err := newSession(ctx, mgr, dryRun)
+	if err != nil {
+		return nil, err
+	}
+	return &shell{mgr: mgr, sess: sess, dryRun: dryRun, batch: batch}, nil
+}
+
+func (sh *shell) Close() error {
+	return sh.sess.Close()
+}
+
+func (sh *shell) run(ctx context.Context, words []string) error {
+	if len(words) == 0 {
+		return nil
+	}
+	if words[0] == "help" {
+		sh.help()
+		return nil
+	}
+	cmd, ok := shellCommands[words[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %q, see help", words[0])
+	}
+	if sh.batch && words[0] == "commit" {
+		return fmt.Errorf("batch scripts are committed as one snapshot when they end")
+	}
+	err := cmd.run(sh, ctx, words[1:])
+	if errors.Is(err, errUsage) {
+		return fmt.Errorf("usage: %s", cmd.usage)
+	}
+	return err
+}
+
+func (sh *shell) help() {
+	usages := map[string]string{"help": "list commands"}
+	if !sh.batch {
+		usages["exit [-f]"] = "leave, discarding uncommitted changes with -f"
+	}
+	for name, cmd := range shellCommands {
+		if sh.batch && name == "commit" {
+			continue
+		}
+		usages[cmd.usage] = cmd.help
+	}
+	var lines []string
+	for usage := range usages {
+		lines = append(lines, usage)
+	}
+	sort.Strings(lines)
+	for _, usage := range lines {
+		fmt.Printf("  %-45s %s\n", usage, usages[usage])
+	}
+}
+
+// resolve returns the full path of p, which is relative to the current
+// prefix unless it starts with a '/'. "." and ".." work like they do for
+// local paths, and a trailing '/' is kept.
+func (sh *shell) resolve(p string) string {
+	full := p
+	if !strings.HasPrefix(p, "/") {
+		full = sh.cwd + p
+	}
+	dir := strings.HasSuffix(full, "/") || p == "." || p == ".." ||
+		strings.HasSuffix(p, "/.") || strings.HasSuffix(p, "/..")
+	resolved := strings.TrimPrefix(path.Clean("/"+full), "/")
+	if dir && resolved != "" {
+		resolved += "/"
+	}
+	return resolved
+}
+
+func shellFlags(name string) *flag.FlagSet {
+	return flag.NewFlagSet(name, flag.ContinueOnError)
+}
+
+var (
+	// errUsage is returned by shell commands given the wrong arguments.
+	errUsage = errors.New("usage")
+	errFound = errors.New("found")
+)
+
+func (sh *shell) cd(ctx context.Context, args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+	target := ""
+	if len(args) == 1 {
+		target = sh.resolve(args[0])
+		if target != "" && !strings.HasSuffix(target, "/") {
+			target += "/"
+		}
+	}
+	if target != "" {
+		err := sh.sess.List(ctx, target, false, func(ctx context.Context, path string, prefix bool) error {
+			return errFound
+		})
+		if err == nil {
+			return fmt.Errorf("no paths start with %q", target)
+		}
+		if !errors.Is(err, errFound) {
+			return err
+		}
+	}
+	sh.cwd = target
+	return nil
+}
+
+func (sh *shell) ls(ctx context.Context, args []string) error {
+	flags := shellFlags("ls")
+	recursive := flags.Bool("r", false, "if true, list recursively")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() > 1 {
+		return errUsage
+	}
+	prefix := sh.cwd
+	if flags.NArg() == 1 {
+		prefix = sh.resolve(flags.Arg(0))
+	}
+	return sh.sess.List(ctx, prefix, *recursive, func(ctx context.Context, path string, isPrefix bool) error {
+		if !*recursive && path == prefix && !isPrefix && strings.HasSuffix(path, "/") {
+			// the directory being listed
+			return nil
+		}
+		if isPrefix {
+			path += "/"
+		}
+		fmt.Println(strings.TrimPrefix(path, sh.cwd))
+		return nil
+	})
+}
+
+func (sh *shell) cat(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	for _, arg := range args {
+		path := sh.resolve(arg)
+		_, stream, err := sh.sess.Open(ctx, path)
+		if err != nil {
+			return fmt.Errorf("%q: %w", path, err)
+		}
+		if stream == nil {
+			return fmt.Errorf("%q is not a file", path)
+		}
+		_, err = io.Copy(os.Stdout, stream)
+		err = errs.Combine(err, stream.Close())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sh *shell) store(ctx context.Context, args []string) error {
+	flags := shellFlags("store")
+	opts := bindStoreOptions(flags)
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		return errUsage
+	}
+	targetPrefix := sh.cwd
+	if flags.NArg() == 2 {
+		targetPrefix = sh.resolve(flags.Arg(1))
+	}
+	result, err := storeInto(ctx, sh.mgr, sh.sess, flags.Arg(0), targetPrefix, opts)
+	if err != nil {
+		return err
+	}
+	result.log(ctx)
+	return nil
+}
+
+func (sh *shell) rm(ctx context.Context, args []string) error {
+	flags := shellFlags("rm")
+	isRegexp := flags.Bool("r", false, "if true, remove full paths matching a regexp instead of a path")
+	force := flags.Bool("f", false, "if true, allow removing every path")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errUsage
+	}
+	var matcher func(string) bool
+	if *isRegexp {
+		matcher, err = removeMatcher(flags.Arg(0), true)
+		if err != nil {
+			return err
+		}
+	} else {
+		matcher = sh.removePath(flags.Arg(0))
+		if matcher == nil {
+			if !*force {
+				return fmt.Errorf("%q is the root. remove every path with rm -f", flags.Arg(0))
+			}
+			matcher = func(string) bool { return true }
+		}
+	}
+	removed, err := sh.sess.DeleteAll(ctx, matcher)
+	if err != nil {
+		return err
+	}
+	utils.L(ctx).Normalf("removed %d paths", removed)
+	return nil
+}
+
+// removePath returns a matcher for p and, if it is a directory, everything
+// under it, but not for paths that only share a prefix with it. It returns
+// nil if p resolves to the root.
+func (sh *shell) removePath(p string) func(string) bool {
+	resolved := strings.TrimSuffix(sh.resolve(p), "/")
+	if resolved == "" {
+		return nil
+	}
+	return func(path string) bool {
+		return path == resolved || strings.HasPrefix(path, resolved+"/")
+	}
+}
+
+func (sh *shell) rename(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	re, err := regexp.Compile(args[0])
+	if err != nil {
+		return err
+	}
+	renamed, err := sh.sess.Rename(ctx, re, args[1],
+		func(ctx context.Context, oldPath, newPath string) error {
+			utils.L(ctx).Debugf("renaming %q to %q", oldPath, newPath)
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+	utils.L(ctx).Normalf("renamed %d paths", renamed)
+	return nil
+}
+
+func (sh *shell) diff(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	return printDryRun(ctx, sh.mgr, sh.sess)
+}
+
+func (sh *shell) commit(ctx context.Context, args []string) error {
+	flags := shellFlags("commit")
+	message := flags.String("message", "", "if set, a description to record with the snapshot")
+	tags := flags.String("tag", "", "if set, a comma-separated list of tags to record with the snapshot")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return errUsage
+	}
+
+	header := snapshotHeader()
+	header.Description = *message
+	header.Tags = splitList(*tags)
+	sh.sess.SetHeader(header)
+	err = sh.sess.Commit(ctx)
+	if err != nil {
+		return err
+	}
+
+	// later commands start from the new snapshot.
+	sess, err := newSession(ctx, sh.mgr, sh.dryRun)
+	if err != nil {
+		return err
+	}
+	err = sh.sess.Close()
+	sh.sess = sess
+	return err
+}
+
+// splitWords splits a line into words separated by spaces, which can be
+// quoted with ' or ", or escaped with \. Anything after an unquoted # is a
+// comment.
+func splitWords(line string) (words []string, err error) {
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inWord = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case r == '#' && !inWord:
+			return words, nil
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote or escape")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+func Shell(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return flag.ErrHelp
+	}
+
+	mgr, _, _, mgrClose, err := getManager(ctx, locks.Shared)
+	if err != nil {
+		return err
+	}
+	defer mgrClose()
+
+	sh, err := newShell(ctx, mgr, false, false)
+	if err != nil {
+		return err
+	}
+	defer sh.Close()
+
+	fmt.Println(`type "help" for a list of commands`)
+	input := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Printf("jam:/%s> ", sh.cwd)
+		if !input.Scan() {
+			break
+		}
+		words, err := splitWords(input.Text())
+		if err == nil && len(words) > 0 && (words[0] == "exit" || words[0] == "quit") {
+			if !sh.sess.Changed() || (len(words) == 2 && words[1] == "-f") {
+				return nil
+			}
+			err = fmt.Errorf("there are uncommitted changes. commit them, or discard them with exit -f")
+		} else if err == nil {
+			err = sh.run(ctx, words)
+		}
+		if err != nil && !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		}
+	}
+	fmt.Println()
+	if sh.sess.Changed() {
+		utils.L(ctx).Urgentf("discarding uncommitted changes")
+	}
+	return input.Err()
+}
+
+func Batch(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return flag.ErrHelp
+	}
+
+	var script io.Reader = os.Stdin
+	if args[0] != "-" {
+		fh, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		script = fh
+	}
+
+	mgr, _, _, mgrClose, err := getManager(ctx, locks.Shared)
+	if err != nil {
+		return err
+	}
+	defer mgrClose()
+
+	sh, err := newShell(ctx, mgr, *batchFlagDryRun, true)
+	if err != nil {
+		return err
+	}
+	defer sh.Close()
+
+	header := snapshotHeader()
+	header.Tags = splitList(*batchFlagTags)
+	header.Description = *batchFlagMessage
+	sh.sess.SetHeader(header)
+
+	input := bufio.NewScanner(script)
+	for line := 1; input.Scan(); line++ {
+		words, err := splitWords(input.Text())
+		if err == nil {
+			err = sh.run(ctx, words)
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	err = input.Err()
+	if err != nil {
+		return err
+	}
+
+	if *batchFlagDryRun {
+		return printDryRun(ctx, mgr, sh.sess)
+	}
+	return sh.sess.Commit(ctx)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitWords(t *testing.T) {
+	for _, tc := range []struct {
+		line  string
+		words []string
+		ok    bool
+	}{
+		{"", nil, true},
+		{"  \t ", nil, true},
+		{"ls -r docs", []string{"ls", "-r", "docs"}, true},
+		{"  cd   docs  ", []string{"cd", "docs"}, true},
+		{"# a comment", nil, true},
+		{"ls docs # a comment", []string{"ls", "docs"}, true},
+		{"rm a#b", []string{"rm", "a#b"}, true},
+		{"rm '#a'", []string{"rm", "#a"}, true},
+		{`rm \ `, []string{"rm", " "}, true},
+		{`rm a\ b`, []string{"rm", "a b"}, true},
+		{`rm \#a`, []string{"rm", "#a"}, true},
+		{`rm 'a b' "c d"`, []string{"rm", "a b", "c d"}, true},
+		{`rm 'a\b'`, []string{"rm", `a\b`}, true},
+		{`rm "a\"b"`, []string{"rm", `a"b`}, true},
+		{`rm a"b c"d`, []string{"rm", "ab cd"}, true},
+		{`rm ''`, []string{"rm", ""}, true},
+		{"rm 'a b", nil, false},
+		{`rm "a b`, nil, false},
+		{`rm 'a b"`, nil, false},
+		{`rm a\`, nil, false},
+	} {
+		words, err := splitWords(tc.line)
+		if !tc.ok {
+			require.Error(t, err, tc.line)
+			continue
+		}
+		require.NoError(t, err, tc.line)
+		require.Equal(t, tc.words, words, tc.line)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	for _, tc := range []struct {
+		cwd, p, resolved string
+	}{
+		{"", "a", "a"},
+		{"", "a/", "a/"},
+		{"", "/a/b", "a/b"},
+		{"", ".", ""},
+		{"", "/", ""},
+		{"", "..", ""},
+		{"", "../x", "x"},
+		{"", "../../x/", "x/"},
+		{"", "a/./b/../c", "a/c"},
+		{"", "a//b", "a/b"},
+		{"docs/", "a", "docs/a"},
+		{"docs/", "/a", "a"},
+		{"docs/", ".", "docs/"},
+		{"docs/", "..", ""},
+		{"docs/", "../x", "x"},
+		{"docs/", "../../x", "x"},
+		{"docs/sub/", "..", "docs/"},
+		{"docs/sub/", "../a", "docs/a"},
+		{"docs/sub/", "b/..", "docs/sub/"},
+	} {
+		sh := &shell{cwd: tc.cwd}
+		require.Equal(t, tc.resolved, sh.resolve(tc.p), "%q in %q", tc.p, tc.cwd)
+	}
+}
+
+func newTestShell(t *testing.T, paths ...string) *shell {
+	ctx := context.Background()
+	mgr := newTestManager(t)
+	sess, err := mgr.NewSession(ctx)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, sess.Close())
+	})
+	for _, path := range paths {
+		_, err := sess.PutSymlink(ctx, path, time.Unix(1, 0), time.Unix(1, 0), 0777, nil, "target")
+		require.NoError(t, err)
+	}
+	return &shell{mgr: mgr, sess: sess}
+}
+
+func shellPaths(t *testing.T, sh *shell) (rv []string) {
+	require.NoError(t, sh.sess.List(context.Background(), "", true,
+		func(ctx context.Context, path string, prefix bool) error {
+			rv = append(rv, path)
+			return nil
+		}))
+	return rv
+}
+
+func TestShellCd(t *testing.T) {
+	ctx := context.Background()
+	sh := newTestShell(t, "docs/sub/a", "docs2/b")
+
+	require.NoError(t, sh.cd(ctx, []string{"docs"}))
+	require.Equal(t, "docs/", sh.cwd)
+	require.Equal(t, "docs/sub/a", sh.resolve("sub/a"))
+	require.Equal(t, "docs2/b", sh.resolve("../docs2/b"))
+
+	require.NoError(t, sh.cd(ctx, []string{"sub/"}))
+	require.Equal(t, "docs/sub/", sh.cwd)
+	require.Equal(t, "docs/sub/a", sh.resolve("a"))
+	require.NoError(t, sh.cd(ctx, []string{".."}))
+	require.Equal(t, "docs/", sh.cwd)
+
+	// paths that only share a prefix with a directory aren't in it.
+	require.Error(t, sh.cd(ctx, []string{"/doc"}))
+	require.Error(t, sh.cd(ctx, []string{"missing"}))
+	require.Equal(t, "docs/", sh.cwd)
+
+	require.NoError(t, sh.cd(ctx, []string{"../.."}))
+	require.Equal(t, "", sh.cwd)
+	require.NoError(t, sh.cd(ctx, []string{"docs2"}))
+	require.NoError(t, sh.cd(ctx, nil))
+	require.Equal(t, "", sh.cwd)
+}
+
+func TestShellRm(t *testing.T) {
+	ctx := context.Background()
+	sh := newTestShell(t, "docs/a", "docs/sub/b", "docs2/c", "docs.txt", "top")
+
+	require.NoError(t, sh.rm(ctx, []string{"docs"}))
+	require.Equal(t, []string{"docs.txt", "docs2/c", "top"}, shellPaths(t, sh))
+
+	require.NoError(t, sh.cd(ctx, []string{"docs2"}))
+	for _, root := range []string{"/", ".."} {
+		require.Error(t, sh.rm(ctx, []string{root}), root)
+	}
+	require.NoError(t, sh.cd(ctx, nil))
+	for _, root := range []string{"", ".", "/", "..", "../.."} {
+		require.Error(t, sh.rm(ctx, []string{root}), root)
+	}
+	require.Equal(t, []string{"docs.txt", "docs2/c", "top"}, shellPaths(t, sh))
+
+	require.NoError(t, sh.rm(ctx, []string{"-r", `\.txt$`}))
+	require.Equal(t, []string{"docs2/c", "top"}, shellPaths(t, sh))
+
+	require.NoError(t, sh.rm(ctx, []string{"-f", "."}))
+	require.Empty(t, shellPaths(t, sh))
+}
@@ -6,17 +6,22 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
 
+	"github.com/jtolio/jam/locks"
 	"github.com/jtolio/jam/manifest"
+	"github.com/jtolio/jam/pathdb"
 	"github.com/jtolio/jam/session"
 )
 
 var (
 	snapsFlags      = flag.NewFlagSet("", flag.ExitOnError)
 	snapsFlagsBrief = snapsFlags.Bool("b", false, "if set, just list snap timestamps only (brief)")
+	snapsFlagTag    = snapsFlags.String("tag", "", "if set, only list snaps with this tag")
+	snapsFlagHost   = snapsFlags.String("host", "", "if set, only list snaps made on this host")
 
 	cmdSnaps = &ffcli.Command{
 		Name:       "snaps",
@@ -31,6 +36,17 @@ var (
 		ShortUsage: fmt.Sprintf("%s [opts] unsnap <snapid>", os.Args[0]),
 		Exec:       Unsnap,
 	}
+	mergeFlags         = flag.NewFlagSet("", flag.ExitOnError)
+	mergeFlagConflicts = mergeFlags.String("conflicts", "fail",
+		"how to resolve paths both snapshots changed. fail,\n\tnewer (keep the most recently modified) or both\n\t(keep the second snapshot's under a new name)")
+	cmdMerge = &ffcli.Command{
+		Name: "merge",
+		ShortHelp: ("merge makes a new snapshot with the changes of two\n\t" +
+			"snapshots since their common ancestor"),
+		ShortUsage: fmt.Sprintf("%s [opts] merge [opts] <snapid> <snapid>", os.Args[0]),
+		FlagSet:    mergeFlags,
+		Exec:       Merge,
+	}
 	cmdRevertTo = &ffcli.Command{
 		Name:       "revert-to",
 		ShortHelp:  "revert-to makes a new snapshot that matches an older one",
@@ -44,14 +60,15 @@ func Snaps(ctx context.Context, args []string) error {
 		return flag.ErrHelp
 	}
 
-	mgr, _, _, mgrClose, err := getManager(ctx)
+	mgr, _, _, mgrClose, err := getManager(ctx, locks.Shared)
 	if err != nil {
 		return err
 	}
 	defer mgrClose()
 
+	filtered := *snapsFlagTag != "" || *snapsFlagHost != ""
 	return mgr.ListSnapshots(ctx, func(ctx context.Context, timestamp time.Time) error {
-		if *snapsFlagsBrief {
+		if *snapsFlagsBrief && !filtered {
 			fmt.Printf("%v: %v\n", timestamp.UnixNano(), timestamp.Local().Format("2006-01-02 03:04:05 pm"))
 			return nil
 		}
@@ -61,9 +78,27 @@ func Snaps(ctx context.Context, args []string) error {
 			return err
 		}
 		defer snapshot.Close()
+		header := snapshot.Header()
+		if filtered && !headerMatches(header, *snapsFlagTag, *snapsFlagHost) {
+			return nil
+		}
+		if *snapsFlagsBrief {
+			fmt.Printf("%v: %v\n", timestamp.UnixNano(), timestamp.Local().Format("2006-01-02 03:04:05 pm"))
+			return nil
+		}
+		if header != nil {
+			fmt.Printf("%v: %v (%d files, %s)\n", timestamp.UnixNano(), timestamp.Local().Format("2006-01-02 03:04:05 pm"), header.Files, byteFmt(header.Bytes))
+			printHeader(header)
+			return nil
+		}
+
+		// snapshots from before headers have to be counted.
 		var fileCount int64
 		var byteCount int64
 		err = snapshot.List(ctx, "", true, func(ctx context.Context, entry *session.ListEntry) error {
+			if !entry.Prefix && entry.Meta.Type == manifest.Metadata_DIRECTORY {
+				return nil
+			}
 			fileCount++
 			if entry.Prefix || entry.Meta.Type != manifest.Metadata_FILE {
 				return nil
@@ -84,12 +119,53 @@ func Snaps(ctx context.Context, args []string) error {
 	})
 }
 
+// headerMatches returns true if header has tag and was made on host, where
+// either may be empty to match anything. Snapshots without a header match
+// nothing.
+func headerMatches(header *manifest.SnapshotHeader, tag, host string) bool {
+	if header == nil {
+		return false
+	}
+	if host != "" && header.Hostname != host {
+		return false
+	}
+	if tag == "" {
+		return true
+	}
+	for _, t := range header.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func printHeader(header *manifest.SnapshotHeader) {
+	fmt.Printf("  by %s@%s with jam %s\n", header.User, header.Hostname, header.Version)
+	if header.Source != "" {
+		fmt.Printf("  stored %q into %q\n", header.Source, header.Prefix)
+	}
+	if len(header.Tags) > 0 {
+		fmt.Printf("  tags: %s\n", strings.Join(header.Tags, ", "))
+	}
+	if header.Description != "" {
+		fmt.Printf("  %s\n", header.Description)
+	}
+	if len(header.Parents) > 1 {
+		var parents []string
+		for _, parent := range header.Parents {
+			parents = append(parents, strconv.FormatInt(parent, 10))
+		}
+		fmt.Printf("  made from %s\n", strings.Join(parents, ", "))
+	}
+}
+
 func Unsnap(ctx context.Context, args []string) error {
 	if len(args) != 1 {
 		return flag.ErrHelp
 	}
 
-	mgr, _, _, mgrClose, err := getManager(ctx)
+	mgr, _, _, mgrClose, err := getManager(ctx, locks.Exclusive)
 	if err != nil {
 		return err
 	}
@@ -107,7 +183,7 @@ func RevertTo(ctx context.Context, args []string) error {
 		return flag.ErrHelp
 	}
 
-	mgr, _, _, mgrClose, err := getManager(ctx)
+	mgr, _, _, mgrClose, err := getManager(ctx, locks.Shared)
 	if err != nil {
 		return err
 	}
@@ -117,11 +193,60 @@ func RevertTo(ctx context.Context, args []string) error {
 	if err != nil {
 		return fmt.Errorf("invalid snapshot value: %q", args[0])
 	}
+	policy, err := mergePolicy()
+	if err != nil {
+		return err
+	}
 
 	sess, err := mgr.RevertTo(ctx, time.Unix(0, nano))
 	if err != nil {
 		return err
 	}
 	defer sess.Close()
+	header := snapshotHeader()
+	header.Description = fmt.Sprintf("reverted to %d", nano)
+	sess.SetHeader(header)
+	sess.SetMergePolicy(policy)
+	return sess.Commit(ctx)
+}
+
+func Merge(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return flag.ErrHelp
+	}
+
+	policy, err := pathdb.ParseMergePolicy(*mergeFlagConflicts)
+	if err != nil {
+		return err
+	}
+
+	mgr, _, _, mgrClose, err := getManager(ctx, locks.Shared)
+	if err != nil {
+		return err
+	}
+	defer mgrClose()
+
+	var timestamps []time.Time
+	for _, arg := range args {
+		snap, ts, err := getReadSnapshot(ctx, mgr, arg)
+		if err != nil {
+			return err
+		}
+		err = snap.Close()
+		if err != nil {
+			return err
+		}
+		timestamps = append(timestamps, ts)
+	}
+
+	sess, err := mgr.Merge(ctx, timestamps[0], timestamps[1], policy)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+	header := snapshotHeader()
+	header.Description = fmt.Sprintf("merged %d and %d",
+		timestamps[0].UnixNano(), timestamps[1].UnixNano())
+	sess.SetHeader(header)
 	return sess.Commit(ctx)
 }
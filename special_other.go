@@ -0,0 +1,16 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import (
+	"github.com/zeebo/errs"
+
+	"github.com/jtolio/jam/manifest"
+)
+
+// makeSpecial makes the FIFO, device or socket that meta describes at path,
+// which isn't supported on this platform.
+func makeSpecial(path string, meta *manifest.Metadata) error {
+	return errs.New("unable to restore %q, %v is not supported on this platform", path, meta.Type)
+}
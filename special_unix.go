@@ -0,0 +1,33 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/zeebo/errs"
+
+	"github.com/jtolio/jam/manifest"
+)
+
+// makeSpecial makes the FIFO, device or socket that meta describes at path.
+// Its mode and other metadata are applied separately.
+func makeSpecial(path string, meta *manifest.Metadata) error {
+	var typ uint32
+	switch meta.Type {
+	case manifest.Metadata_FIFO:
+		typ = syscall.S_IFIFO
+	case manifest.Metadata_DEVICE:
+		typ = syscall.S_IFBLK
+		if os.FileMode(meta.Mode)&os.ModeCharDevice != 0 {
+			typ = syscall.S_IFCHR
+		}
+	case manifest.Metadata_SOCKET:
+		typ = syscall.S_IFSOCK
+	default:
+		return errs.New("%q is not a special file", path)
+	}
+	return errs.Wrap(syscall.Mknod(path, typ|0600, int(meta.Device)))
+}
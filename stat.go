@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+
+	"github.com/jtolio/jam/manifest"
+	"github.com/jtolio/jam/session"
+	"github.com/jtolio/jam/utils"
+)
+
+// pathStat is fileStat along with the path's extended attributes, which
+// aren't read for symlinks, since reading them would follow the link.
+func pathStat(ctx context.Context, path string, info os.FileInfo) *session.FileStat {
+	stat := fileStat(info)
+	if stat == nil || info.Mode()&os.ModeSymlink != 0 {
+		return stat
+	}
+	xattrs, err := readXattrs(path)
+	if err != nil {
+		utils.L(ctx).Normalf("skipping extended attributes of %q, %v", path, err)
+		return stat
+	}
+	stat.Xattrs = xattrs
+	return stat
+}
+
+// linkGroup identifies the file that hard links share. It is only unique
+// among paths stored at the same time, so restore also compares hashes.
+func linkGroup(device, inode uint64) string {
+	return fmt.Sprintf("%d:%d", device, inode)
+}
+
+var ownerNames = struct {
+	mtx    sync.Mutex
+	users  map[uint32]string
+	groups map[uint32]string
+}{
+	users:  map[uint32]string{},
+	groups: map[uint32]string{},
+}
+
+// fileOwner returns the owner to record for uid and gid, along with their
+// names if they have any.
+func fileOwner(uid, gid uint32) *manifest.Metadata_Owner {
+	ownerNames.mtx.Lock()
+	defer ownerNames.mtx.Unlock()
+	name, ok := ownerNames.users[uid]
+	if !ok {
+		if u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10)); err == nil {
+			name = u.Username
+		}
+		ownerNames.users[uid] = name
+	}
+	group, ok := ownerNames.groups[gid]
+	if !ok {
+		if g, err := user.LookupGroupId(strconv.FormatUint(uint64(gid), 10)); err == nil {
+			group = g.Name
+		}
+		ownerNames.groups[gid] = group
+	}
+	return &manifest.Metadata_Owner{Uid: uid, Gid: gid, User: name, Group: group}
+}
+
+var localIDs = struct {
+	mtx    sync.Mutex
+	users  map[string]int
+	groups map[string]int
+}{
+	users:  map[string]int{},
+	groups: map[string]int{},
+}
+
+// localOwner returns the ids to give a restored path owned by owner, which
+// are the local ids of its user and group names if they exist and numeric is
+// false, and the stored ids otherwise.
+func localOwner(owner *manifest.Metadata_Owner, numeric bool) (uid, gid int) {
+	uid, gid = int(owner.Uid), int(owner.Gid)
+	if numeric {
+		return uid, gid
+	}
+	localIDs.mtx.Lock()
+	defer localIDs.mtx.Unlock()
+	if owner.User != "" {
+		id, ok := localIDs.users[owner.User]
+		if !ok {
+			id = -1
+			if u, err := user.Lookup(owner.User); err == nil {
+				if parsed, err := strconv.Atoi(u.Uid); err == nil {
+					id = parsed
+				}
+			}
+			localIDs.users[owner.User] = id
+		}
+		if id >= 0 {
+			uid = id
+		}
+	}
+	if owner.Group != "" {
+		id, ok := localIDs.groups[owner.Group]
+		if !ok {
+			id = -1
+			if g, err := user.LookupGroup(owner.Group); err == nil {
+				if parsed, err := strconv.Atoi(g.Gid); err == nil {
+					id = parsed
+				}
+			}
+			localIDs.groups[owner.Group] = id
+		}
+		if id >= 0 {
+			gid = id
+		}
+	}
+	return uid, gid
+}
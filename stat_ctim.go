@@ -0,0 +1,33 @@
+//go:build linux || openbsd || dragonfly || solaris
+// +build linux openbsd dragonfly solaris
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/jtolio/jam/session"
+)
+
+// fileStat returns the stat to record for a path, if known.
+func fileStat(info os.FileInfo) *session.FileStat {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	stat := &session.FileStat{
+		Size:    info.Size(),
+		Inode:   uint64(st.Ino),
+		Changed: time.Unix(st.Ctim.Unix()),
+		Owner:   fileOwner(st.Uid, st.Gid),
+	}
+	if info.Mode().IsRegular() && st.Nlink > 1 {
+		stat.LinkGroup = linkGroup(uint64(st.Dev), uint64(st.Ino))
+	}
+	if info.Mode()&os.ModeDevice != 0 {
+		stat.Device = uint64(st.Rdev)
+	}
+	return stat
+}
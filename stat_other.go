@@ -0,0 +1,15 @@
+//go:build !linux && !openbsd && !dragonfly && !solaris && !darwin && !freebsd && !netbsd
+// +build !linux,!openbsd,!dragonfly,!solaris,!darwin,!freebsd,!netbsd
+
+package main
+
+import (
+	"os"
+
+	"github.com/jtolio/jam/session"
+)
+
+// fileStat returns the stat to record for a path, if known.
+func fileStat(info os.FileInfo) *session.FileStat {
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/jtolio/jam/manifest"
+)
+
+// localIDsOf returns the local ids of the user and group named name, or skips
+// the test if there aren't any.
+func localIDsOf(t *testing.T, name string) (uid, gid int) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		t.Skipf("no local user %q: %v", name, err)
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		t.Skipf("no local group %q: %v", name, err)
+	}
+	uid, err = strconv.Atoi(u.Uid)
+	require.NoError(t, err)
+	gid, err = strconv.Atoi(g.Gid)
+	require.NoError(t, err)
+	return uid, gid
+}
+
+func TestLocalOwner(t *testing.T) {
+	rootUID, rootGID := localIDsOf(t, "root")
+	const missing = "jam-test-no-such-name"
+
+	for _, tc := range []struct {
+		owner    *manifest.Metadata_Owner
+		numeric  bool
+		uid, gid int
+	}{
+		// names that exist locally win over the stored ids.
+		{&manifest.Metadata_Owner{Uid: 1234, Gid: 5678, User: "root", Group: "root"}, false, rootUID, rootGID},
+		{&manifest.Metadata_Owner{Uid: 1234, Gid: 5678, User: "root", Group: missing}, false, rootUID, 5678},
+		{&manifest.Metadata_Owner{Uid: 1234, Gid: 5678, User: missing, Group: "root"}, false, 1234, rootGID},
+		// the stored ids are used for names that don't exist or weren't known.
+		{&manifest.Metadata_Owner{Uid: 1234, Gid: 5678, User: missing, Group: missing}, false, 1234, 5678},
+		{&manifest.Metadata_Owner{Uid: 1234, Gid: 5678}, false, 1234, 5678},
+		// and always with -numeric-owner.
+		{&manifest.Metadata_Owner{Uid: 1234, Gid: 5678, User: "root", Group: "root"}, true, 1234, 5678},
+		{&manifest.Metadata_Owner{Uid: 1234, Gid: 5678, User: missing, Group: missing}, true, 1234, 5678},
+	} {
+		// twice, so that the cached lookups are checked too.
+		for i := 0; i < 2; i++ {
+			uid, gid := localOwner(tc.owner, tc.numeric)
+			require.Equal(t, tc.uid, uid, "%+v numeric=%v", tc.owner, tc.numeric)
+			require.Equal(t, tc.gid, gid, "%+v numeric=%v", tc.owner, tc.numeric)
+		}
+	}
+}
+
+func TestRestoreOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("only root can change owners")
+	}
+	rootUID, rootGID := localIDsOf(t, "root")
+	td, err := os.MkdirTemp("", "jamtest")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(td))
+	}()
+	path := filepath.Join(td, "f")
+	require.NoError(t, os.WriteFile(path, nil, 0644))
+
+	owned := func() (uid, gid uint32) {
+		info, err := os.Lstat(path)
+		require.NoError(t, err)
+		stat := fileStat(info)
+		if stat == nil || stat.Owner == nil {
+			t.Skip("owners aren't known on this platform")
+		}
+		return stat.Owner.Uid, stat.Owner.Gid
+	}
+
+	defer func(numeric bool) { *restoreFlagNumericOwner = numeric }(*restoreFlagNumericOwner)
+	owner := &manifest.Metadata_Owner{Uid: 1234, Gid: 5678, User: "root", Group: "root"}
+
+	*restoreFlagNumericOwner = true
+	require.NoError(t, restoreOwner(path, owner))
+	uid, gid := owned()
+	require.Equal(t, uint32(1234), uid)
+	require.Equal(t, uint32(5678), gid)
+
+	*restoreFlagNumericOwner = false
+	require.NoError(t, restoreOwner(path, owner))
+	uid, gid = owned()
+	require.Equal(t, uint32(rootUID), uid)
+	require.Equal(t, uint32(rootGID), gid)
+}
+
+func TestLinkGroup(t *testing.T) {
+	require.Equal(t, linkGroup(1, 2), linkGroup(1, 2))
+	require.NotEqual(t, linkGroup(1, 2), linkGroup(2, 1))
+	require.NotEqual(t, linkGroup(1, 23), linkGroup(12, 3))
+}
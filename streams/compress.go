@@ -0,0 +1,158 @@
+package streams
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/zeebo/errs"
+
+	"github.com/jtolio/jam/backends"
+	"github.com/jtolio/jam/manifest"
+)
+
+// Compress returns a reader of data compressed as a single frame. Compress
+// takes ownership of data and closes it when the returned reader is closed.
+func Compress(data io.ReadCloser, compression manifest.Range_Compression) (io.ReadCloser, error) {
+	switch compression {
+	case manifest.Range_NONE:
+		return data, nil
+	case manifest.Range_ZLIB:
+		c := &compressReader{source: data, scratch: make([]byte, 32*1024)}
+		w, err := zlib.NewWriterLevel(&c.buf, zlib.BestSpeed)
+		if err != nil {
+			return nil, errs.Combine(err, data.Close())
+		}
+		c.w = w
+		return c, nil
+	default:
+		return nil, errs.Combine(
+			fmt.Errorf("unknown compression: %v", compression), data.Close())
+	}
+}
+
+type compressReader struct {
+	source  io.ReadCloser
+	scratch []byte
+	buf     bytes.Buffer
+	w       io.WriteCloser
+	done    bool
+}
+
+func (c *compressReader) Read(p []byte) (n int, err error) {
+	for c.buf.Len() == 0 && !c.done {
+		n, err := c.source.Read(c.scratch)
+		if n > 0 {
+			_, writeErr := c.w.Write(c.scratch[:n])
+			if writeErr != nil {
+				return 0, writeErr
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				return 0, err
+			}
+			err = c.w.Close()
+			if err != nil {
+				return 0, err
+			}
+			c.done = true
+		}
+	}
+	if c.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.buf.Read(p)
+}
+
+func (c *compressReader) Close() error {
+	return c.source.Close()
+}
+
+// frame is a piece of a stream that must be read as a unit: either a single
+// uncompressed range, or all of the ranges of a compressed frame.
+type frame struct {
+	ranges      []*manifest.Range
+	compression manifest.Range_Compression
+	length      int64
+}
+
+func frames(stream *manifest.Stream) ([]frame, error) {
+	var rv []frame
+	for _, r := range stream.Ranges {
+		if r.Compression == manifest.Range_NONE {
+			rv = append(rv, frame{ranges: []*manifest.Range{r}, length: r.Length})
+			continue
+		}
+		if r.UncompressedLength > 0 {
+			rv = append(rv, frame{
+				ranges:      []*manifest.Range{r},
+				compression: r.Compression,
+				length:      r.UncompressedLength,
+			})
+			continue
+		}
+		if len(rv) == 0 || rv[len(rv)-1].compression != r.Compression {
+			return nil, errs.New("compressed range continues no frame")
+		}
+		rv[len(rv)-1].ranges = append(rv[len(rv)-1].ranges, r)
+	}
+	return rv, nil
+}
+
+// open returns a reader of the frame's uncompressed data, starting at offset.
+func (f *frame) open(ctx context.Context, backend backends.Backend, offset int64) (io.ReadCloser, error) {
+	if f.compression == manifest.Range_NONE {
+		return OpenRange(ctx, backend, f.ranges[0], offset)
+	}
+
+	// the whole frame has to be read and decompressed up to the offset.
+	var readers []io.Reader
+	var closers closeAll
+	for _, r := range f.ranges {
+		rc, err := OpenRange(ctx, backend, r, 0)
+		if err != nil {
+			return nil, errs.Combine(err, closers.Close())
+		}
+		readers = append(readers, rc)
+		closers = append(closers, rc)
+	}
+
+	var decompressed io.ReadCloser
+	switch f.compression {
+	case manifest.Range_ZLIB:
+		zr, err := zlib.NewReader(io.MultiReader(readers...))
+		if err != nil {
+			return nil, errs.Combine(errs.Wrap(err), closers.Close())
+		}
+		decompressed = zr
+	default:
+		return nil, errs.Combine(
+			fmt.Errorf("unknown compression: %v", f.compression), closers.Close())
+	}
+	closers = append(closers, decompressed)
+
+	_, err := io.CopyN(io.Discard, decompressed, offset)
+	if err != nil {
+		return nil, errs.Combine(errs.Wrap(err), closers.Close())
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: io.LimitReader(decompressed, f.length-offset),
+		Closer: closers,
+	}, nil
+}
+
+type closeAll []io.Closer
+
+func (c closeAll) Close() error {
+	var group errs.Group
+	for _, closer := range c {
+		group.Add(closer.Close())
+	}
+	return group.Err()
+}
@@ -0,0 +1,81 @@
+package streams
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/jtolio/jam/backends/fs"
+	"github.com/jtolio/jam/manifest"
+)
+
+var ctx = context.Background()
+
+func TestCompressedStream(t *testing.T) {
+	td, err := os.MkdirTemp("", "streamstest")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(td))
+	}()
+
+	b, err := fs.New(ctx, &url.URL{Path: td})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, b.Close())
+	}()
+
+	raw := make([]byte, 1000)
+	_, err = rand.New(rand.NewSource(0)).Read(raw)
+	require.NoError(t, err)
+	compressible := bytes.Repeat([]byte("abcdefgh"), 10000)
+
+	rc, err := Compress(io.NopCloser(bytes.NewReader(compressible)), manifest.Range_ZLIB)
+	require.NoError(t, err)
+	compressed, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.True(t, len(compressed) < len(compressible))
+
+	// blob 1 has the raw data followed by the first half of the frame, and
+	// blob 2 has the rest of the frame.
+	split := len(compressed) / 2
+	require.NoError(t, b.Put(ctx, BlobPath("blob1"),
+		bytes.NewReader(append(append([]byte(nil), raw...), compressed[:split]...))))
+	require.NoError(t, b.Put(ctx, BlobPath("blob2"), bytes.NewReader(compressed[split:])))
+
+	stream := &manifest.Stream{Ranges: []*manifest.Range{
+		{DeprecatedBlobString: "blob1", Offset: 0, Length: int64(len(raw))},
+		{DeprecatedBlobString: "blob1", Offset: int64(len(raw)), Length: int64(split),
+			Compression: manifest.Range_ZLIB, UncompressedLength: int64(len(compressible))},
+		{DeprecatedBlobString: "blob2", Offset: 0, Length: int64(len(compressed) - split),
+			Compression: manifest.Range_ZLIB},
+		{DeprecatedBlobString: "blob1", Offset: 10, Length: 20},
+	}}
+	expected := append(append(append([]byte(nil), raw...), compressible...), raw[10:30]...)
+
+	s, err := Open(ctx, b, stream)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(expected)), s.Length())
+	actual, err := io.ReadAll(s)
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+
+	for _, offset := range []int64{0, 999, 1000, 1001, 50000, int64(len(expected)) - 21, int64(len(expected)) - 1} {
+		_, err = s.Seek(offset, io.SeekStart)
+		require.NoError(t, err)
+		actual, err := io.ReadAll(s)
+		require.NoError(t, err)
+		require.Equal(t, expected[offset:], actual)
+	}
+
+	_, err = Open(ctx, b, &manifest.Stream{Ranges: []*manifest.Range{
+		{DeprecatedBlobString: "blob2", Offset: 0, Length: 1, Compression: manifest.Range_ZLIB},
+	}})
+	require.Error(t, err)
+}
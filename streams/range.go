@@ -20,6 +20,8 @@ func BlobPath(id string) string {
 	return BlobPrefix + IdPathComponent(id)
 }
 
+// OpenRange returns a reader of r's data, starting at offset. Holes read as
+// zeros without reading anything from the backend.
 func OpenRange(ctx context.Context, backend backends.Backend, r *manifest.Range,
 	offset int64) (io.ReadCloser, error) {
 	if offset > r.Length {
@@ -28,6 +30,9 @@ func OpenRange(ctx context.Context, backend backends.Backend, r *manifest.Range,
 	if offset == r.Length {
 		return io.NopCloser(bytes.NewReader(nil)), nil
 	}
+	if r.Hole {
+		return io.NopCloser(io.LimitReader(zeroReader{}, r.Length-offset)), nil
+	}
 	rc, err := backend.Get(ctx, BlobPath(r.Blob()), r.Offset+offset, r.Length-offset)
 	if err != nil {
 		return nil, err
@@ -40,3 +45,13 @@ func OpenRange(ctx context.Context, backend backends.Backend, r *manifest.Range,
 		Closer: rc,
 	}, nil
 }
+
+// zeroReader reads the zeros of a hole.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (n int, err error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
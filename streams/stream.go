@@ -12,6 +12,7 @@ import (
 type Stream struct {
 	backend       backends.Backend
 	stream        *manifest.Stream
+	frames        []frame
 	currentRange  io.ReadCloser
 	currentOffset int64
 	length        int64
@@ -23,13 +24,18 @@ var _ io.Seeker = (*Stream)(nil)
 
 // Open returns a Stream ready for reading.
 func Open(ctx context.Context, backend backends.Backend, stream *manifest.Stream) (*Stream, error) {
+	frames, err := frames(stream)
+	if err != nil {
+		return nil, err
+	}
 	var length int64
-	for _, r := range stream.Ranges {
-		length += r.Length
+	for _, f := range frames {
+		length += f.length
 	}
 	return &Stream{
 		backend: backend,
 		stream:  stream,
+		frames:  frames,
 		length:  length,
 		ctx:     ctx,
 	}, nil
@@ -41,6 +47,7 @@ func (f *Stream) Fork(ctx context.Context) *Stream {
 	return &Stream{
 		backend:       f.backend,
 		stream:        f.stream,
+		frames:        f.frames,
 		currentOffset: f.currentOffset,
 		length:        f.length,
 		ctx:           ctx,
@@ -64,16 +71,16 @@ func (f *Stream) Read(p []byte) (n int, err error) {
 
 func (f *Stream) open() error {
 	offset := f.currentOffset
-	for _, r := range f.stream.Ranges {
-		if offset-r.Length < 0 {
-			currentRange, err := OpenRange(f.ctx, f.backend, r, offset)
+	for i := range f.frames {
+		if offset-f.frames[i].length < 0 {
+			currentRange, err := f.frames[i].open(f.ctx, f.backend, offset)
 			if err != nil {
 				return err
 			}
 			f.currentRange = currentRange
 			return nil
 		}
-		offset -= r.Length
+		offset -= f.frames[i].length
 	}
 	return io.EOF
 }
@@ -109,3 +116,24 @@ func (f *Stream) Seek(offset int64, whence int) (int64, error) {
 }
 
 func (f *Stream) Length() int64 { return f.length }
+
+// Ranges returns the blob ranges that make up the stream, in order.
+func (f *Stream) Ranges() []*manifest.Range { return f.stream.Ranges }
+
+// A Hole is a run of zeros in a stream that isn't stored anywhere.
+type Hole struct {
+	Offset int64
+	Length int64
+}
+
+// Holes returns the holes in the stream, in order.
+func (f *Stream) Holes() (holes []Hole) {
+	var offset int64
+	for _, fr := range f.frames {
+		if fr.compression == manifest.Range_NONE && fr.ranges[0].Hole {
+			holes = append(holes, Hole{Offset: offset, Length: fr.length})
+		}
+		offset += fr.length
+	}
+	return holes
+}
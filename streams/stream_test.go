@@ -0,0 +1,61 @@
+package streams
+
+import (
+	"bytes"
+	"io"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/jtolio/jam/backends/fs"
+	"github.com/jtolio/jam/manifest"
+)
+
+func TestHoles(t *testing.T) {
+	td, err := os.MkdirTemp("", "streamstest")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(td))
+	}()
+
+	b, err := fs.New(ctx, &url.URL{Path: td})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, b.Close())
+	}()
+
+	data := []byte("0123456789")
+	require.NoError(t, b.Put(ctx, BlobPath("blob1"), bytes.NewReader(data)))
+
+	stream := &manifest.Stream{Ranges: []*manifest.Range{
+		{Hole: true, Length: 5000},
+		{DeprecatedBlobString: "blob1", Offset: 0, Length: 10},
+		{Hole: true, Length: 100000},
+		{DeprecatedBlobString: "blob1", Offset: 5, Length: 5},
+		{Hole: true, Length: 1},
+	}}
+	var expected []byte
+	expected = append(expected, make([]byte, 5000)...)
+	expected = append(expected, data...)
+	expected = append(expected, make([]byte, 100000)...)
+	expected = append(expected, data[5:]...)
+	expected = append(expected, 0)
+
+	s, err := Open(ctx, b, stream)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(expected)), s.Length())
+	require.Equal(t, []Hole{{0, 5000}, {5010, 100000}, {105015, 1}}, s.Holes())
+	actual, err := io.ReadAll(s)
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+
+	for _, offset := range []int64{0, 4999, 5000, 5005, 60000, 105010, 105015} {
+		_, err = s.Seek(offset, io.SeekStart)
+		require.NoError(t, err)
+		actual, err := io.ReadAll(s)
+		require.NoError(t, err)
+		require.Equal(t, expected[offset:], actual)
+	}
+}
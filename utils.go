@@ -7,10 +7,12 @@ import (
 	"io"
 	"net/url"
 	"os"
+	"strings"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
 
 	"github.com/jtolio/jam/backends"
+	"github.com/jtolio/jam/locks"
 )
 
 var (
@@ -28,20 +30,39 @@ var (
 		Exec:       BackendSync,
 	}
 
+	cmdHashCleanup = &ffcli.Command{
+		Name:       "hash-cleanup",
+		ShortHelp:  "delete hash files that newer ones supersede",
+		ShortUsage: fmt.Sprintf("%s [opts] utils hash-cleanup", os.Args[0]),
+		Exec:       HashCleanup,
+	}
+
 	cmdHashCoalesce = &ffcli.Command{
 		Name:       "hash-coalesce",
-		ShortHelp:  "combine hash files",
+		ShortHelp:  "combine hash files into a full set, leaving the old ones for hash-cleanup",
 		ShortUsage: fmt.Sprintf("%s [opts] utils hash-coalesce", os.Args[0]),
 		Exec:       HashCoalesce,
 	}
 
 	cmdHashSplit = &ffcli.Command{
 		Name:       "hash-split",
-		ShortHelp:  "split hash files to one per blob (default behavior on upload)",
+		ShortHelp:  "rewrite hash files as runs of bounded size",
 		ShortUsage: fmt.Sprintf("%s [opts] utils hash-split", os.Args[0]),
 		Exec:       HashSplit,
 	}
 
+	unlockFlags   = flag.NewFlagSet("", flag.ExitOnError)
+	unlockFlagAll = unlockFlags.Bool("all", false,
+		"if true, delete every lock, not just stale ones. only\n\tuse when no other jam process is running")
+
+	cmdUnlock = &ffcli.Command{
+		Name:       "unlock",
+		ShortHelp:  "list locks and delete stale ones",
+		ShortUsage: fmt.Sprintf("%s [opts] utils unlock [opts]", os.Args[0]),
+		FlagSet:    unlockFlags,
+		Exec:       Unlock,
+	}
+
 	cmdUtils = &ffcli.Command{
 		Name:       "utils",
 		ShortHelp:  "miscellaneous utilities",
@@ -49,8 +70,12 @@ var (
 		Subcommands: []*ffcli.Command{
 			cmdBackendCat,
 			cmdBackendSync,
+			cmdHashCleanup,
 			cmdHashCoalesce,
 			cmdHashSplit,
+			cmdRebuildIndex,
+			cmdRepack,
+			cmdUnlock,
 		},
 		Exec: help,
 	}
@@ -93,6 +118,10 @@ func BackendSync(ctx context.Context, args []string) error {
 
 	var missingPaths []string
 	err = sourceStore.List(ctx, "", func(ctx context.Context, path string) error {
+		// locks belong to the processes using the source.
+		if strings.HasPrefix(path, locks.Prefix) {
+			return nil
+		}
 		if !destContains[path] {
 			missingPaths = append(missingPaths, path)
 		}
@@ -124,7 +153,7 @@ func BackendCat(ctx context.Context, args []string) error {
 		return flag.ErrHelp
 	}
 
-	_, backend, _, mgrClose, err := getManager(ctx)
+	_, backend, _, mgrClose, err := getManager(ctx, locks.Shared)
 	if err != nil {
 		return err
 	}
@@ -139,12 +168,27 @@ func BackendCat(ctx context.Context, args []string) error {
 	return err
 }
 
+func HashCleanup(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return flag.ErrHelp
+	}
+
+	_, _, hashes, mgrClose, err := getManager(ctx, locks.Exclusive)
+	if err != nil {
+		return err
+	}
+	defer mgrClose()
+
+	_, err = hashes.Cleanup(ctx)
+	return err
+}
+
 func HashCoalesce(ctx context.Context, args []string) error {
 	if len(args) != 0 {
 		return flag.ErrHelp
 	}
 
-	_, _, hashes, mgrClose, err := getManager(ctx)
+	_, _, hashes, mgrClose, err := getManager(ctx, locks.Exclusive)
 	if err != nil {
 		return err
 	}
@@ -158,7 +202,7 @@ func HashSplit(ctx context.Context, args []string) error {
 		return flag.ErrHelp
 	}
 
-	_, _, hashes, mgrClose, err := getManager(ctx)
+	_, _, hashes, mgrClose, err := getManager(ctx, locks.Exclusive)
 	if err != nil {
 		return err
 	}
@@ -167,6 +211,45 @@ func HashSplit(ctx context.Context, args []string) error {
 	return hashes.Split(ctx)
 }
 
+func Unlock(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return flag.ErrHelp
+	}
+
+	_, backend, _, mgrClose, err := getManager(ctx, noLock)
+	if err != nil {
+		return err
+	}
+	defer mgrClose()
+
+	held, err := locks.List(ctx, backend)
+	if err != nil {
+		return err
+	}
+	for _, lock := range held {
+		holder := "unknown holder"
+		if info, err := locks.Info(ctx, backend, lock); err == nil {
+			holder = fmt.Sprintf("%q (pid %d on %s, as %s)",
+				info.Command, info.Pid, info.Hostname, info.User)
+		}
+		status := "held"
+		if lock.Stale {
+			status = "stale"
+		}
+		fmt.Printf("%s lock %s held by %s, refreshed %v: %s\n", lock.Kind, lock.ID, holder,
+			lock.Refreshed.Local().Format("2006-01-02 15:04:05"), status)
+		if !lock.Stale && !*unlockFlagAll {
+			continue
+		}
+		err = backend.Delete(ctx, lock.Path)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("deleted %s lock %s\n", lock.Kind, lock.ID)
+	}
+	return nil
+}
+
 func byteFmt(bytes int64) string {
 	val := float64(bytes)
 	suffixes := []string{"B", "KB", "MB", "GB", "TB", "PB", "EB", "ZB", "YB"}
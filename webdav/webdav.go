@@ -106,6 +106,14 @@ func calcMode(meta *manifest.Metadata) (os.FileMode, error) {
 		mode = 0
 	case manifest.Metadata_SYMLINK:
 		mode = os.ModeSymlink
+	case manifest.Metadata_DIRECTORY:
+		mode = os.ModeDir
+	case manifest.Metadata_FIFO:
+		mode = os.ModeNamedPipe
+	case manifest.Metadata_DEVICE:
+		mode = os.FileMode(meta.Mode) & (os.ModeDevice | os.ModeCharDevice)
+	case manifest.Metadata_SOCKET:
+		mode = os.ModeSocket
 	default:
 		return 0, fmt.Errorf("unknown object type: %v", meta.Type)
 	}
@@ -160,26 +168,44 @@ func (f *webdavFile) Write(p []byte) (n int, err error) { return 0, ErrReadOnly
 func (fs *webdavFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
 	name = strings.TrimPrefix(name, "/")
 	meta, data, err := fs.snap.Open(ctx, name)
-	if err == nil {
+	if err == nil && meta.Type != manifest.Metadata_DIRECTORY {
 		return &webdavFile{snap: fs.snap, path: name, meta: meta, data: data}, nil
 	}
-	if !errors.Is(err, session.ErrNotFound) {
+	if err != nil && !errors.Is(err, session.ErrNotFound) {
 		return nil, err
 	}
 	pre := name
 	if len(pre) > 0 && pre[len(pre)-1:] != "/" {
 		pre += "/"
 	}
+	self := &fileInfo{
+		name: filepath.Base(name),
+		mode: os.ModeDir,
+	}
+	found := false
 	var entries []os.FileInfo
 	err = fs.snap.List(ctx, pre, false,
 		func(ctx context.Context, entry *session.ListEntry) error {
+			found = true
 			mode := os.ModeDir | 0555
 			size := int64(0)
 			var modTime time.Time
 			if !entry.Prefix {
-				switch entry.Meta.Type {
-				case manifest.Metadata_FILE:
-					mode = 0
+				var err error
+				mode, err = calcMode(entry.Meta)
+				if err != nil {
+					return err
+				}
+				modTime, err = ptypes.Timestamp(entry.Meta.Modified)
+				if err != nil {
+					return err
+				}
+				if entry.Path == pre {
+					// the directory's own metadata
+					self.mode, self.modTime = mode, modTime
+					return nil
+				}
+				if entry.Meta.Type == manifest.Metadata_FILE {
 					str, err := entry.Stream(ctx)
 					if err != nil {
 						return err
@@ -189,16 +215,6 @@ func (fs *webdavFS) OpenFile(ctx context.Context, name string, flag int, perm os
 					if err != nil {
 						return err
 					}
-				case manifest.Metadata_SYMLINK:
-					mode = os.ModeSymlink
-				default:
-					return fmt.Errorf("unknown object type: %v", entry.Meta.Type)
-				}
-				mode |= os.FileMode(entry.Meta.Mode & 0777)
-				var err error
-				modTime, err = ptypes.Timestamp(entry.Meta.Modified)
-				if err != nil {
-					return err
 				}
 			}
 			entries = append(entries, &fileInfo{
@@ -209,22 +225,34 @@ func (fs *webdavFS) OpenFile(ctx context.Context, name string, flag int, perm os
 			})
 			return nil
 		})
-	if len(entries) == 0 {
+	if err != nil {
+		return nil, err
+	}
+	if !found {
 		return nil, os.ErrNotExist
 	}
 	return &webdavDir{
-		self: &fileInfo{
-			name: filepath.Base(name),
-			mode: os.ModeDir,
-		},
+		self:    self,
 		entries: entries,
 	}, nil
 }
 
+// Serve serves snap at addr until ctx is canceled.
 func Serve(ctx context.Context, snap *session.Snapshot, addr string) error {
-	handler := &webdav.Handler{
-		FileSystem: WebdavFS(snap),
-		LockSystem: webdav.NewMemLS(),
+	server := &http.Server{
+		Addr: addr,
+		Handler: &webdav.Handler{
+			FileSystem: WebdavFS(snap),
+			LockSystem: webdav.NewMemLS(),
+		},
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	err := server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
 	}
-	return http.ListenAndServe(addr, handler)
+	return err
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
@@ -9,24 +10,37 @@ import (
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
+	"github.com/zeebo/errs"
 
+	"github.com/jtolio/jam/locks"
 	"github.com/jtolio/jam/pathdb"
+	"github.com/jtolio/jam/session"
 	"github.com/jtolio/jam/utils"
 )
 
 var (
-	storeFlags       = flag.NewFlagSet("", flag.ExitOnError)
-	storeFlagReplace = storeFlags.Bool("r", false,
-		"if set, remove and replace anything with the given prefix")
-	storeFlagsExclude = storeFlags.String("exclude", "",
-		"if set, a comma-separated list of full path prefixes to ignore locally")
+	storeFlags      = flag.NewFlagSet("", flag.ExitOnError)
+	storeFlagOpts   = bindStoreOptions(storeFlags)
+	storeFlagDryRun = storeFlags.Bool("dry-run", false,
+		"if true, list what would change without storing anything")
+	storeFlagTags = storeFlags.String("tag", "",
+		"if set, a comma-separated list of tags to record with the snapshot")
+	storeFlagMessage = storeFlags.String("message", "",
+		"if set, a description to record with the snapshot")
 
 	rmFlags      = flag.NewFlagSet("", flag.ExitOnError)
 	rmFlagRegexp = rmFlags.Bool("r", false,
 		"if true, removes using regex matching instead of prefix matching. "+
 			"https://golang.org/pkg/regexp/#Regexp.Match for semantics.")
+	rmFlagDryRun = rmFlags.Bool("dry-run", false,
+		"if true, list what would be removed without removing anything")
+
+	renameFlags      = flag.NewFlagSet("", flag.ExitOnError)
+	renameFlagDryRun = renameFlags.Bool("dry-run", false,
+		"if true, list what would be renamed without renaming anything")
 
 	cmdStore = &ffcli.Command{
 		Name:       "store",
@@ -40,7 +54,8 @@ var (
 		ShortHelp: ("rename allows a regexp-based search and replace against all paths\n\tin the system, " +
 			"forked from the latest snapshot. See\n\thttps://golang.org/pkg/regexp/#Regexp.ReplaceAll " +
 			"for semantics."),
-		ShortUsage: fmt.Sprintf("%s [opts] rename <regexp> <replacement>", os.Args[0]),
+		ShortUsage: fmt.Sprintf("%s [opts] rename [opts] <regexp> <replacement>", os.Args[0]),
+		FlagSet:    renameFlags,
 		Exec:       Rename,
 	}
 	cmdRm = &ffcli.Command{
@@ -52,6 +67,41 @@ var (
 	}
 )
 
+// storeOptions are the options of storing a directory, which can be bound to
+// the flags of any command that stores.
+type storeOptions struct {
+	replace       *bool
+	exclude       *string
+	excludeFile   *string
+	include       *string
+	excludeCaches *bool
+	oneFileSystem *bool
+	parallelism   *int
+	forceRehash   *bool
+}
+
+func bindStoreOptions(flags *flag.FlagSet) *storeOptions {
+	return &storeOptions{
+		replace: flags.Bool("r", false,
+			"if set, remove and replace anything with the given prefix"),
+		exclude: flags.String("exclude", "",
+			"if set, a comma-separated list of full path prefixes to ignore locally"),
+		excludeFile: flags.String("exclude-file", "",
+			"if set, a file of gitignore-style patterns (relative to the source) to ignore locally. "+
+				ignoreFileName+" files are always honored"),
+		include: flags.String("include", "",
+			"if set, a comma-separated list of gitignore-style patterns to store even if otherwise ignored"),
+		excludeCaches: flags.Bool("exclude-caches", false,
+			"if true, skip directories containing a valid "+cacheDirTagName+" file"),
+		oneFileSystem: flags.Bool("one-file-system", false,
+			"if true, skip directories on a different filesystem than the source"),
+		parallelism: flags.Int("parallelism", 4,
+			"how many files to read and hash at once"),
+		forceRehash: flags.Bool("force-rehash", false,
+			"if true, read and hash files even if they look unchanged since the latest snapshot"),
+	}
+}
+
 func Store(ctx context.Context, args []string) error {
 	if len(args) <= 0 || len(args) > 2 {
 		return flag.ErrHelp
@@ -62,98 +112,129 @@ func Store(ctx context.Context, args []string) error {
 		targetPrefix = args[1]
 	}
 
-	mgr, _, _, close, err := getManager(ctx)
+	mgr, _, _, mgrClose, err := getManager(ctx, locks.Shared)
 	if err != nil {
 		return err
 	}
-	defer close()
+	defer mgrClose()
 
-	sess, err := mgr.NewSession(ctx)
+	sess, err := newSession(ctx, mgr, *storeFlagDryRun)
 	if err != nil {
 		return err
 	}
 	defer sess.Close()
 
+	header := snapshotHeader()
+	header.Source, err = filepath.Abs(source)
+	if err != nil {
+		return err
+	}
+	header.Prefix = targetPrefix
+	header.Tags = splitList(*storeFlagTags)
+	header.Description = *storeFlagMessage
+	sess.SetHeader(header)
+
+	result, err := storeInto(ctx, mgr, sess, source, targetPrefix, storeFlagOpts)
+	if err != nil {
+		return err
+	}
+
+	if *storeFlagDryRun {
+		return printDryRun(ctx, mgr, sess)
+	}
+
+	result.log(ctx)
+	return sess.Commit(ctx)
+}
+
+// storeInto adds the source directory to sess under targetPrefix.
+func storeInto(ctx context.Context, mgr *session.Manager, sess *session.Session,
+	source, targetPrefix string, opts *storeOptions) (*storeResult, error) {
 	pathsToRemove := map[string]struct{}{}
-	if *storeFlagReplace {
+	if *opts.replace {
 		err := sess.List(ctx, targetPrefix, true,
 			func(ctx context.Context, path string, _ bool) error {
 				pathsToRemove[path] = struct{}{}
 				return nil
 			})
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	var pathsToExclude []string
-	if len(*storeFlagsExclude) > 0 {
-		for _, path := range strings.Split(*storeFlagsExclude, ",") {
-			if len(path) > 0 {
-				pathsToExclude = append(pathsToExclude, path)
-			}
-		}
+	filter, err := newStoreFilter(source, splitList(*opts.exclude), *opts.excludeFile,
+		splitList(*opts.include), *opts.excludeCaches, *opts.oneFileSystem)
+	if err != nil {
+		return nil, err
 	}
 
-	var addedPaths, changedPaths, unchangedPaths int64
-
-	err = filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
-		for _, excludedPath := range pathsToExclude {
-			if strings.HasPrefix(path, excludedPath) {
-				return nil
-			}
-		}
-
-		if err != nil {
-			utils.L(ctx).Normalf("skipping %q, %v", path, err)
-			return nil
-		}
-		if info.IsDir() {
-			return nil
-		}
+	parallelism := *opts.parallelism
+	if parallelism < 1 {
+		return nil, fmt.Errorf("invalid parallelism: %d", parallelism)
+	}
 
-		base, err := filepath.Rel(source, path)
+	// files that look the same as in the latest snapshot keep their hash
+	// without being read. the walk gets its own copy of the snapshot, since
+	// the session's isn't safe for concurrent use.
+	var latest *session.Snapshot
+	if !*opts.forceRehash {
+		latest, _, err = mgr.LatestSnapshot(ctx)
 		if err != nil {
-			return err
+			if !errors.Is(err, session.ErrNoSnapshots) {
+				return nil, err
+			}
+			latest = nil
+		} else {
+			defer latest.Close()
 		}
+	}
 
-		if info.Mode()&os.ModeSymlink != 0 {
-			target, err := os.Readlink(path)
-			if err != nil {
-				return err
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// the walk feeds files to hashing workers, while this goroutine adds the
+	// results to the session (which isn't safe for concurrent use) in walk
+	// order.
+	items := make(chan *storeItem, 4*parallelism)
+	work := make(chan *storeItem)
+	var walkErr error
+	go func() {
+		defer close(items)
+		defer close(work)
+		walkErr = walkStore(ctx, source, targetPrefix, filter, latest, items, work)
+	}()
+
+	var workers sync.WaitGroup
+	for i := 0; i < parallelism; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for item := range work {
+				item.prepare(ctx)
 			}
-			state, err := sess.PutSymlink(ctx, targetPrefix+base, info.ModTime(), info.ModTime(), uint32(info.Mode()), target)
-			if err != nil {
-				return err
-			}
-			switch state {
-			case pathdb.PutStateNew:
-				addedPaths++
-			case pathdb.PutStateChanged:
-				changedPaths++
-			case pathdb.PutStateUnchanged:
-				unchangedPaths++
-			default:
-				return fmt.Errorf("unknown put state")
-			}
-			delete(pathsToRemove, targetPrefix+base)
-			return nil
-		}
+		}()
+	}
 
-		if !info.Mode().IsRegular() {
-			utils.L(ctx).Normalf("skipping %q, mode type not understood", targetPrefix+base)
-			return nil
+	var addedPaths, changedPaths, unchangedPaths, skippedPaths int64
+	var storeErr error
+	for item := range items {
+		<-item.ready
+		if storeErr != nil {
+			item.close()
+			continue
 		}
-
-		fh, err := os.Open(path)
-		if err != nil {
-			return err
+		state, err := item.put(ctx, sess)
+		if errors.Is(err, errFileChanged) {
+			// whatever the latest snapshot has for the path is kept.
+			utils.L(ctx).Urgentf("skipping %q, %v", item.path, err)
+			skippedPaths++
+			delete(pathsToRemove, item.path)
+			continue
 		}
-
-		// PutFile closes the fh
-		state, err := sess.PutFile(ctx, targetPrefix+base, info.ModTime(), info.ModTime(), uint32(info.Mode()), fh)
 		if err != nil {
-			return err
+			storeErr = err
+			cancel()
+			continue
 		}
 		switch state {
 		case pathdb.PutStateNew:
@@ -163,26 +244,42 @@ func Store(ctx context.Context, args []string) error {
 		case pathdb.PutStateUnchanged:
 			unchangedPaths++
 		default:
-			return fmt.Errorf("unknown put state")
+			storeErr = fmt.Errorf("unknown put state")
+			cancel()
+			continue
 		}
-		delete(pathsToRemove, targetPrefix+base)
-		return nil
-	})
-	if err != nil {
-		return err
+		delete(pathsToRemove, item.path)
+	}
+	workers.Wait()
+	if storeErr != nil {
+		return nil, storeErr
+	}
+	if walkErr != nil {
+		return nil, walkErr
 	}
 
 	for _, path := range sortedKeys(pathsToRemove) {
 		_, err := sess.Delete(ctx, path)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	utils.L(ctx).Normalf("added %d new paths, changed %d paths, removed %d paths, and left %d paths alone",
-		addedPaths, changedPaths, len(pathsToRemove), unchangedPaths)
+	return &storeResult{added: addedPaths, changed: changedPaths, removed: int64(len(pathsToRemove)),
+		unchanged: unchangedPaths, skipped: skippedPaths}, nil
+}
 
-	return sess.Commit(ctx)
+// storeResult counts what storing a directory did to each path.
+type storeResult struct {
+	added, changed, removed, unchanged, skipped int64
+}
+
+func (r *storeResult) log(ctx context.Context) {
+	utils.L(ctx).Normalf("added %d new paths, changed %d paths, removed %d paths, and left %d paths alone",
+		r.added, r.changed, r.removed, r.unchanged)
+	if r.skipped > 0 {
+		utils.L(ctx).Urgentf("skipped %d paths that kept changing while being read", r.skipped)
+	}
 }
 
 func Rename(ctx context.Context, args []string) error {
@@ -194,23 +291,36 @@ func Rename(ctx context.Context, args []string) error {
 		return err
 	}
 
-	mgr, _, _, close, err := getManager(ctx)
+	mgr, _, _, close, err := getManager(ctx, locks.Shared)
 	if err != nil {
 		return err
 	}
 	defer close()
 
-	sess, err := mgr.NewSession(ctx)
+	sess, err := newSession(ctx, mgr, *renameFlagDryRun)
 	if err != nil {
 		return err
 	}
 	defer sess.Close()
 
-	renamed, err := sess.Rename(ctx, re, args[1])
+	renamed, err := sess.Rename(ctx, re, args[1],
+		func(ctx context.Context, oldPath, newPath string) error {
+			if *renameFlagDryRun {
+				fmt.Printf("R %s -> %s\n", oldPath, newPath)
+			} else {
+				utils.L(ctx).Debugf("renaming %q to %q", oldPath, newPath)
+			}
+			return nil
+		})
 	if err != nil {
 		return err
 	}
 
+	if *renameFlagDryRun {
+		utils.L(ctx).Normalf("would rename %d paths", renamed)
+		return nil
+	}
+
 	utils.L(ctx).Normalf("renamed %d paths", renamed)
 
 	return sess.Commit(ctx)
@@ -220,27 +330,18 @@ func Remove(ctx context.Context, args []string) error {
 	if len(args) != 1 {
 		return flag.ErrHelp
 	}
-	var matcher func(string) bool
-
-	if *rmFlagRegexp {
-		re, err := regexp.Compile(args[0])
-		if err != nil {
-			return err
-		}
-		matcher = re.MatchString
-	} else {
-		matcher = func(path string) bool {
-			return strings.HasPrefix(path, args[0])
-		}
+	matcher, err := removeMatcher(args[0], *rmFlagRegexp)
+	if err != nil {
+		return err
 	}
 
-	mgr, _, _, close, err := getManager(ctx)
+	mgr, _, _, close, err := getManager(ctx, locks.Shared)
 	if err != nil {
 		return err
 	}
 	defer close()
 
-	sess, err := mgr.NewSession(ctx)
+	sess, err := newSession(ctx, mgr, *rmFlagDryRun)
 	if err != nil {
 		return err
 	}
@@ -251,11 +352,274 @@ func Remove(ctx context.Context, args []string) error {
 		return err
 	}
 
+	if *rmFlagDryRun {
+		return printDryRun(ctx, mgr, sess)
+	}
+
 	utils.L(ctx).Normalf("removed %d paths", removed)
 
 	return sess.Commit(ctx)
 }
 
+// removeMatcher matches paths that start with pattern, or that match it if
+// it's a regexp.
+func removeMatcher(pattern string, isRegexp bool) (func(string) bool, error) {
+	if !isRegexp {
+		return func(path string) bool { return strings.HasPrefix(path, pattern) }, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return re.MatchString, nil
+}
+
+// storeItem is a path found by the store walk, which is ready to be added to
+// the session once ready is closed. Only regular files need any preparing.
+type storeItem struct {
+	path       string
+	localPath  string
+	info       os.FileInfo
+	stat       *session.FileStat
+	linkTarget string
+	// knownHash is set instead of prepared if the file looks unchanged.
+	knownHash []byte
+	prepared  *session.PreparedFile
+	err       error
+	ready     chan struct{}
+}
+
+func walkStore(ctx context.Context, source, targetPrefix string, filter *storeFilter,
+	latest *session.Snapshot, items, work chan<- *storeItem) error {
+	return filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			utils.L(ctx).Normalf("skipping %q, %v", path, err)
+			return nil
+		}
+		skip, err := filter.skip(ctx, path, info)
+		if err != nil {
+			return err
+		}
+		if skip {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		base, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+		itemPath := targetPrefix + base
+		if base == "." {
+			// the source directory itself is only recorded if the target
+			// prefix is a directory.
+			if !strings.HasSuffix(targetPrefix, "/") {
+				return nil
+			}
+			itemPath = strings.TrimSuffix(targetPrefix, "/")
+		}
+
+		item := &storeItem{path: itemPath, info: info, stat: pathStat(ctx, path, info),
+			ready: make(chan struct{})}
+		switch {
+		case info.IsDir():
+			item.path += "/"
+			close(item.ready)
+		case info.Mode()&os.ModeSymlink != 0:
+			item.linkTarget, item.err = os.Readlink(path)
+			close(item.ready)
+		case info.Mode()&(os.ModeNamedPipe|os.ModeDevice|os.ModeSocket) != 0:
+			close(item.ready)
+		case info.Mode().IsRegular():
+			item.localPath = path
+			if latest != nil {
+				content, err := latest.Lookup(ctx, item.path)
+				if err != nil {
+					return err
+				}
+				if session.StatUnchanged(content, info.ModTime(), item.stat) {
+					item.knownHash = content.Hash
+					close(item.ready)
+				}
+			}
+		default:
+			utils.L(ctx).Normalf("skipping %q, mode type not understood", item.path)
+			return nil
+		}
+
+		select {
+		case items <- item:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if item.localPath != "" && item.knownHash == nil {
+			select {
+			case work <- item:
+			case <-ctx.Done():
+				item.err = ctx.Err()
+				close(item.ready)
+				return ctx.Err()
+			}
+		}
+		return nil
+	})
+}
+
+// prepare reads and hashes a regular file. It is safe to call concurrently
+// for different items.
+func (item *storeItem) prepare(ctx context.Context) {
+	defer close(item.ready)
+	item.prepared, item.err = item.read(ctx)
+}
+
+// stagingRetries is how many more times a file that changes while being
+// staged is read before it is skipped.
+const stagingRetries = 2
+
+var errFileChanged = errors.New("file changed while reading")
+
+func (item *storeItem) read(ctx context.Context) (*session.PreparedFile, error) {
+	if *sysFlagBlobStaging == "" {
+		fh, err := os.Open(item.localPath)
+		if err != nil {
+			return nil, err
+		}
+		// PrepareFile closes the fh on error
+		return session.PrepareFile(item.path,
+			item.info.ModTime(), item.info.ModTime(), uint32(item.info.Mode()), item.stat, fh)
+	}
+
+	// a staged copy can't change anymore, but the original might have
+	// changed while it was copied.
+	for attempt := 0; ; attempt++ {
+		fh, err := os.Open(item.localPath)
+		if err != nil {
+			return nil, err
+		}
+		prepared, err := session.StageFile(*sysFlagBlobStaging, item.path,
+			item.info.ModTime(), item.info.ModTime(), uint32(item.info.Mode()), item.stat, fh)
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Lstat(item.localPath)
+		if err != nil {
+			return nil, errs.Combine(err, prepared.Close())
+		}
+		if !fileChanged(item.info, info) {
+			return prepared, nil
+		}
+		err = prepared.Close()
+		if err != nil {
+			return nil, err
+		}
+		if attempt >= stagingRetries || !info.Mode().IsRegular() {
+			return nil, errFileChanged
+		}
+		item.info, item.stat = info, pathStat(ctx, item.localPath, info)
+	}
+}
+
+// fileChanged returns true if the file described by before looks different
+// in after.
+func fileChanged(before, after os.FileInfo) bool {
+	if before.Size() != after.Size() || !before.ModTime().Equal(after.ModTime()) ||
+		before.Mode() != after.Mode() {
+		return true
+	}
+	a, b := fileStat(before), fileStat(after)
+	if a == nil || b == nil {
+		return a != b
+	}
+	return a.Inode != b.Inode || !a.Changed.Equal(b.Changed)
+}
+
+func (item *storeItem) put(ctx context.Context, sess *session.Session) (pathdb.PutState, error) {
+	if item.err != nil {
+		return pathdb.PutStateUnchanged, item.err
+	}
+	mode, modified := item.info.Mode(), item.info.ModTime()
+	switch {
+	case mode.IsDir():
+		return sess.PutDirectory(ctx, item.path, modified, modified, uint32(mode), item.stat)
+	case mode&os.ModeSymlink != 0:
+		return sess.PutSymlink(ctx, item.path, modified, modified, uint32(mode), item.stat, item.linkTarget)
+	case !mode.IsRegular():
+		return sess.PutSpecial(ctx, item.path, modified, modified, uint32(mode), item.stat)
+	}
+	if item.knownHash != nil {
+		state, ok, err := sess.PutUnchanged(ctx, item.path, modified, modified, uint32(mode),
+			item.stat, item.knownHash)
+		if err != nil || ok {
+			return state, err
+		}
+		// the hash database no longer has the data, so the file has to be
+		// read after all.
+		item.prepared, err = item.read(ctx)
+		if err != nil {
+			return pathdb.PutStateUnchanged, err
+		}
+	}
+	// PutPrepared closes the prepared file
+	return sess.PutPrepared(ctx, item.prepared)
+}
+
+func (item *storeItem) close() {
+	if item.prepared != nil {
+		item.prepared.Close()
+	}
+}
+
+func splitList(val string) (rv []string) {
+	for _, item := range strings.Split(val, ",") {
+		if len(item) > 0 {
+			rv = append(rv, item)
+		}
+	}
+	return rv
+}
+
+func newSession(ctx context.Context, mgr *session.Manager, dryRun bool) (sess *session.Session, err error) {
+	policy, err := mergePolicy()
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		sess, err = mgr.NewDryRunSession(ctx)
+	} else {
+		sess, err = mgr.NewSession(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sess.SetHeader(snapshotHeader())
+	sess.SetMergePolicy(policy)
+	return sess, nil
+}
+
+// printDryRun lists every path that differs between the latest snapshot and
+// sess.
+func printDryRun(ctx context.Context, mgr *session.Manager, sess *session.Session) error {
+	base, _, err := mgr.LatestSnapshot(ctx)
+	if err != nil {
+		if !errors.Is(err, session.ErrNoSnapshots) {
+			return err
+		}
+		base = nil
+	} else {
+		defer base.Close()
+	}
+
+	var changes diffCollector
+	err = sess.Diff(ctx, base, changes.add)
+	if err != nil {
+		return err
+	}
+	changes.print(ctx, true)
+	return nil
+}
+
 func sortedKeys(m map[string]struct{}) (rv []string) {
 	rv = make([]string, 0, len(m))
 	for key := range m {
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/jtolio/jam/backends/fs"
+	"github.com/jtolio/jam/blobs"
+	"github.com/jtolio/jam/hashdb"
+	"github.com/jtolio/jam/session"
+)
+
+func newTestManager(t *testing.T) *session.Manager {
+	ctx := context.Background()
+	td, err := os.MkdirTemp("", "jamtest")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, os.RemoveAll(td))
+	})
+	backend, err := fs.New(ctx, &url.URL{Path: td})
+	require.NoError(t, err)
+	blobStore := blobs.NewStore(backend, 1<<20, 10, 1, "")
+	t.Cleanup(func() {
+		require.NoError(t, blobStore.Close())
+		require.NoError(t, backend.Close())
+	})
+	return session.NewManager(backend, blobStore, hashdb.New(backend), nil)
+}
+
+func TestStoreForceRehash(t *testing.T) {
+	ctx := context.Background()
+	mgr := newTestManager(t)
+	source, err := os.MkdirTemp("", "jamtest")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(source))
+	}()
+	require.NoError(t, os.WriteFile(filepath.Join(source, "f"), []byte("one"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(source, "g"), []byte("two"), 0644))
+
+	store := func(args ...string) string {
+		flags := flag.NewFlagSet("store", flag.ContinueOnError)
+		opts := bindStoreOptions(flags)
+		require.NoError(t, flags.Parse(args))
+		sess, err := mgr.NewSession(ctx)
+		require.NoError(t, err)
+		defer sess.Close()
+		_, err = storeInto(ctx, mgr, sess, source, "", opts)
+		require.NoError(t, err)
+		require.NoError(t, sess.Commit(ctx))
+		return readLatest(t, mgr, "f")
+	}
+	require.Equal(t, "one", store())
+
+	// record g's data for f, with f's stat, as if f had held it when the
+	// latest snapshot was made and hasn't changed since.
+	snap, _, err := mgr.LatestSnapshot(ctx)
+	require.NoError(t, err)
+	g, err := snap.Lookup(ctx, "g")
+	require.NoError(t, err)
+	require.NoError(t, snap.Close())
+	info, err := os.Lstat(filepath.Join(source, "f"))
+	require.NoError(t, err)
+	sess, err := mgr.NewSession(ctx)
+	require.NoError(t, err)
+	_, ok, err := sess.PutUnchanged(ctx, "f", info.ModTime(), info.ModTime(), uint32(info.Mode()),
+		pathStat(ctx, filepath.Join(source, "f"), info), g.Hash)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.NoError(t, sess.Commit(ctx))
+	require.NoError(t, sess.Close())
+
+	// f looks unchanged, so it isn't read again, unless asked to.
+	require.Equal(t, "two", store())
+	require.Equal(t, "one", store("-force-rehash"))
+	require.Equal(t, "one", store())
+}
+
+func readLatest(t *testing.T, mgr *session.Manager, path string) string {
+	ctx := context.Background()
+	snap, _, err := mgr.LatestSnapshot(ctx)
+	require.NoError(t, err)
+	defer snap.Close()
+	_, stream, err := snap.Open(ctx, path)
+	require.NoError(t, err)
+	defer stream.Close()
+	data, err := io.ReadAll(stream)
+	require.NoError(t, err)
+	return string(data)
+}
@@ -0,0 +1,66 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"syscall"
+
+	"github.com/zeebo/errs"
+
+	"github.com/jtolio/jam/manifest"
+)
+
+// readXattrs returns the extended attributes of path, following symlinks.
+func readXattrs(path string) (map[string][]byte, error) {
+	size, err := syscall.Listxattr(path, nil)
+	if err != nil {
+		if err == syscall.ENOTSUP {
+			return nil, nil
+		}
+		return nil, errs.Wrap(err)
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	names := make([]byte, size)
+	size, err = syscall.Listxattr(path, names)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+
+	xattrs := map[string][]byte{}
+	for _, name := range bytes.Split(names[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		size, err := syscall.Getxattr(path, string(name), nil)
+		if err != nil {
+			if err == syscall.ENODATA {
+				// removed since it was listed
+				continue
+			}
+			return nil, errs.Wrap(err)
+		}
+		value := make([]byte, size)
+		size, err = syscall.Getxattr(path, string(name), value)
+		if err != nil {
+			return nil, errs.Wrap(err)
+		}
+		xattrs[string(name)] = value[:size]
+	}
+	return xattrs, nil
+}
+
+// writeXattrs sets the extended attributes of path, following symlinks.
+func writeXattrs(path string, xattrs []*manifest.Metadata_Xattr) error {
+	var group errs.Group
+	for _, xattr := range xattrs {
+		err := syscall.Setxattr(path, xattr.Name, xattr.Value, 0)
+		if err != nil {
+			group.Add(errs.New("%s: %v", xattr.Name, err))
+		}
+	}
+	return group.Err()
+}
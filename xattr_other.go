@@ -0,0 +1,25 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"github.com/zeebo/errs"
+
+	"github.com/jtolio/jam/manifest"
+)
+
+// readXattrs returns the extended attributes of path, which aren't supported
+// on this platform.
+func readXattrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+// writeXattrs fails if there are any extended attributes to set, since they
+// aren't supported on this platform.
+func writeXattrs(path string, xattrs []*manifest.Metadata_Xattr) error {
+	if len(xattrs) > 0 {
+		return errs.New("extended attributes are not supported on this platform")
+	}
+	return nil
+}